@@ -16,9 +16,14 @@ package api
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
 )
@@ -31,9 +36,19 @@ type Identity struct {
 	TenantToken string `json:"tenant_token,omitempty"`
 }
 
+// Fingerprint returns a digest of the identity, identifying the device
+// the tokens are issued to.
+func (id *Identity) Fingerprint() string {
+	b, _ := json.Marshal(id)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
 type Authz struct {
-	Token     string
-	ServerURL string
+	Token     string `json:"token"`
+	ServerURL string `json:"server_url"`
+	// ReceivedAt is the local time when the token was issued to the client.
+	ReceivedAt time.Time `json:"received_at"`
 }
 
 func (state *Authz) IsZero() bool {
@@ -47,8 +62,20 @@ func (state Authz) Equal(other Authz) bool {
 	return state.ServerURL == other.ServerURL && state.Token == other.ServerURL
 }
 
+// ErrQueueFull is returned by Sender.Send if the message cannot be queued
+// for sending within the configured time.
+var ErrQueueFull = errors.New("api: outbound queue full")
+
+// ErrPatchNotSupported is returned by Client.PatchInventory if the client
+// only supports complete inventory updates.
+var ErrPatchNotSupported = errors.New("api: inventory patch not supported")
+
 type Sender interface {
+	// Send writes the message to the socket. It blocks while the outbound
+	// queue is full and may fail with ErrQueueFull.
 	Send(ws.ProtoMsg) error
+	// SendContext is like Send, but gives up when the context is done.
+	SendContext(context.Context, ws.ProtoMsg) error
 }
 
 type Socket interface {
@@ -72,6 +99,10 @@ type Client interface {
 	Authenticate(ctx context.Context) (*Authz, error)
 	// SendInventory sends the inventory attributes to the server
 	SendInventory(ctx context.Context, authz *Authz, inv Inventory) error
+	// PatchInventory updates the inventory attributes on the server,
+	// leaving the other attributes unchanged. It fails with
+	// ErrPatchNotSupported if only complete updates are supported.
+	PatchInventory(ctx context.Context, authz *Authz, inv Inventory) error
 }
 
 func IsUnauthorized(err error) bool {
@@ -87,6 +118,7 @@ func IsRetryable(err error) bool {
 	var e *Error
 	if errors.As(err, &e) {
 		if e.Code == http.StatusUnauthorized ||
+			e.Code == http.StatusTooManyRequests ||
 			e.Code >= http.StatusInternalServerError {
 			return true
 		}
@@ -94,8 +126,47 @@ func IsRetryable(err error) bool {
 	return false
 }
 
+// RetryAfter returns the delay requested by the server before retrying
+// the request.
+func RetryAfter(err error) (time.Duration, bool) {
+	var e *Error
+	if errors.As(err, &e) && e.RetryAfter > 0 {
+		return e.RetryAfter, true
+	}
+	return 0, false
+}
+
 type Error struct {
 	Code int
+	// Header contains the response headers.
+	Header http.Header
+	// RetryAfter is the delay requested by the server using the
+	// Retry-After header.
+	RetryAfter time.Duration
+}
+
+// NewError returns an Error from an unsuccessful response.
+func NewError(rsp *http.Response) *Error {
+	return &Error{
+		Code:       rsp.StatusCode,
+		Header:     rsp.Header,
+		RetryAfter: parseRetryAfter(rsp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// parseRetryAfter parses the Retry-After header value which is either a
+// number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if sec, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
 }
 
 func (e *Error) Error() string {
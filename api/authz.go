@@ -0,0 +1,235 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/northerntechhq/nt-connect/utils"
+)
+
+// maxRefreshMargin is the maximum duration before the token expires that
+// the token is considered due for refresh.
+const maxRefreshMargin = time.Minute * 10
+
+type claims struct {
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+}
+
+func (state *Authz) claims() (*claims, error) {
+	parts := strings.Split(state.Token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("api: token is not a JWT")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, err
+	}
+	var c claims
+	if err = json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// ExpiresAt returns the time the token expires ("exp" claim) or the zero
+// time if the token does not expire.
+func (state *Authz) ExpiresAt() time.Time {
+	if state == nil {
+		return time.Time{}
+	}
+	c, err := state.claims()
+	if err != nil || c.ExpiresAt <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// Subject returns the subject of the token ("sub" claim), identifying the
+// device, or an empty string if unknown.
+func (state *Authz) Subject() string {
+	if state == nil {
+		return ""
+	}
+	c, err := state.claims()
+	if err != nil {
+		return ""
+	}
+	return c.Subject
+}
+
+// RefreshAt returns the local time when the token should be renewed. The
+// token lifetime is computed from the issued at claim if present, so that
+// clock skew between the server and the device does not matter. The zero
+// time is returned if the lifetime is unknown.
+func (state *Authz) RefreshAt() time.Time {
+	if state == nil || state.ReceivedAt.IsZero() {
+		return time.Time{}
+	}
+	c, err := state.claims()
+	if err != nil || c.ExpiresAt <= 0 {
+		return time.Time{}
+	}
+	var lifetime time.Duration
+	if c.IssuedAt > 0 {
+		lifetime = time.Duration(c.ExpiresAt-c.IssuedAt) * time.Second
+	} else {
+		lifetime = time.Unix(c.ExpiresAt, 0).Sub(state.ReceivedAt)
+	}
+	if lifetime <= 0 {
+		return time.Time{}
+	}
+	margin := lifetime / 10
+	if margin > maxRefreshMargin {
+		margin = maxRefreshMargin
+	}
+	return state.ReceivedAt.Add(lifetime - margin)
+}
+
+// authzCache persists the token and reuses it until it is due for refresh
+// or rejected by the server.
+type authzCache struct {
+	Client
+	path      string
+	serverURL string
+	identity  string
+
+	mu    sync.Mutex
+	authz *Authz
+}
+
+// cachedAuthz is the persisted token with the fingerprint of the identity
+// it was issued to.
+type cachedAuthz struct {
+	Authz
+	Identity string `json:"identity"`
+}
+
+// CachedAuthz wraps the client to persist the token at path. A cached token
+// is only reused for the given server URL and device identity, so that a
+// new identity or key is not presented with the token of the previous one.
+func CachedAuthz(client Client, path, serverURL string, identity *Identity) Client {
+	cache := &authzCache{
+		Client:    client,
+		path:      path,
+		serverURL: serverURL,
+		identity:  identity.Fingerprint(),
+	}
+	cache.authz = cache.load()
+	return cache
+}
+
+func (c *authzCache) load() *Authz {
+	b, err := os.ReadFile(c.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("failed to read cached token: %s", err.Error())
+		}
+		return nil
+	}
+	var cached cachedAuthz
+	if err = json.Unmarshal(b, &cached); err != nil {
+		log.Warnf("failed to parse cached token: %s", err.Error())
+		return nil
+	} else if cached.IsZero() || cached.ServerURL != c.serverURL {
+		return nil
+	} else if cached.Identity != c.identity {
+		log.Info("ignoring cached token issued to a different identity")
+		return nil
+	}
+	return &cached.Authz
+}
+
+func (c *authzCache) store(authz *Authz) {
+	c.authz = authz
+	b, _ := json.Marshal(cachedAuthz{Authz: *authz, Identity: c.identity})
+	if err := utils.WriteFileAtomic(c.path, b, 0600); err != nil {
+		log.Warnf("failed to cache token: %s", err.Error())
+	}
+}
+
+func (c *authzCache) invalidate(authz *Authz) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.authz == nil || authz == nil || c.authz.Token != authz.Token {
+		return
+	}
+	c.authz = nil
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		log.Warnf("failed to remove cached token: %s", err.Error())
+	}
+}
+
+func (c *authzCache) Authenticate(ctx context.Context) (*Authz, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.authz != nil && time.Now().Before(c.authz.RefreshAt()) {
+		log.Debug("using cached authorization token")
+		authz := *c.authz
+		return &authz, nil
+	}
+	authz, err := c.Client.Authenticate(ctx)
+	if err == nil {
+		c.store(authz)
+	}
+	return authz, err
+}
+
+// Refresh requests a new token from the server, replacing the cached
+// token.
+func (c *authzCache) Refresh(ctx context.Context) (*Authz, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	authz, err := c.Client.Authenticate(ctx)
+	if err == nil {
+		c.store(authz)
+	}
+	return authz, err
+}
+
+func (c *authzCache) OpenSocket(ctx context.Context, authz *Authz) (Socket, error) {
+	sock, err := c.Client.OpenSocket(ctx, authz)
+	if IsUnauthorized(err) {
+		c.invalidate(authz)
+	}
+	return sock, err
+}
+
+func (c *authzCache) SendInventory(ctx context.Context, authz *Authz, inv Inventory) error {
+	err := c.Client.SendInventory(ctx, authz, inv)
+	if IsUnauthorized(err) {
+		c.invalidate(authz)
+	}
+	return err
+}
+
+func (c *authzCache) PatchInventory(ctx context.Context, authz *Authz, inv Inventory) error {
+	err := c.Client.PatchInventory(ctx, authz, inv)
+	if IsUnauthorized(err) {
+		c.invalidate(authz)
+	}
+	return err
+}
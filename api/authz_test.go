@@ -0,0 +1,211 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeToken(claims string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." +
+		enc.EncodeToString([]byte(claims)) + "." +
+		enc.EncodeToString([]byte("signature"))
+}
+
+func TestAuthzRefreshAt(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1700000000, 0)
+	testCases := map[string]struct {
+		Authz Authz
+
+		ExpiresAt time.Time
+		RefreshAt time.Time
+	}{
+		"ok/issued at": {
+			Authz: Authz{
+				// Server clock is one day ahead of the device
+				Token:      makeToken(`{"exp":1700090000,"iat":1700086400}`),
+				ReceivedAt: now,
+			},
+			ExpiresAt: time.Unix(1700090000, 0),
+			RefreshAt: now.Add(time.Hour - time.Minute*6),
+		},
+		"ok/long lived": {
+			Authz: Authz{
+				Token:      makeToken(`{"exp":1700604800,"iat":1700000000}`),
+				ReceivedAt: now,
+			},
+			ExpiresAt: time.Unix(1700604800, 0),
+			RefreshAt: now.Add(time.Hour*24*7 - maxRefreshMargin),
+		},
+		"ok/no issued at": {
+			Authz: Authz{
+				Token:      makeToken(`{"exp":1700001000}`),
+				ReceivedAt: now,
+			},
+			ExpiresAt: time.Unix(1700001000, 0),
+			RefreshAt: now.Add(time.Second * 900),
+		},
+		"expired": {
+			Authz: Authz{
+				Token:      makeToken(`{"exp":1234567890}`),
+				ReceivedAt: now,
+			},
+			ExpiresAt: time.Unix(1234567890, 0),
+		},
+		"not received": {
+			Authz: Authz{
+				Token: makeToken(`{"exp":1700001000}`),
+			},
+			ExpiresAt: time.Unix(1700001000, 0),
+		},
+		"no expiry": {
+			Authz: Authz{
+				Token:      makeToken(`{"sub":"device"}`),
+				ReceivedAt: now,
+			},
+		},
+		"opaque token": {
+			Authz: Authz{
+				Token:      "token",
+				ReceivedAt: now,
+			},
+		},
+	}
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.ExpiresAt, tc.Authz.ExpiresAt())
+			assert.Equal(t, tc.RefreshAt, tc.Authz.RefreshAt())
+		})
+	}
+}
+
+func TestAuthzSubject(t *testing.T) {
+	t.Parallel()
+	authz := &Authz{Token: makeToken(`{"sub":"device","exp":1700001000}`)}
+	assert.Equal(t, "device", authz.Subject())
+	assert.Empty(t, (&Authz{Token: "token"}).Subject())
+	assert.Empty(t, (*Authz)(nil).Subject())
+}
+
+type fakeClient struct {
+	Client
+	authenticate func() (*Authz, error)
+	calls        int
+	err          error
+}
+
+func (c *fakeClient) Authenticate(context.Context) (*Authz, error) {
+	c.calls++
+	return c.authenticate()
+}
+
+func (c *fakeClient) SendInventory(context.Context, *Authz, Inventory) error {
+	return c.err
+}
+
+func (c *fakeClient) OpenSocket(context.Context, *Authz) (Socket, error) {
+	return nil, c.err
+}
+
+func TestCachedAuthz(t *testing.T) {
+	t.Parallel()
+	const serverURL = "https://localhost"
+	i := 0
+	newAuthz := func() (*Authz, error) {
+		i++
+		return &Authz{
+			Token:      makeToken(fmt.Sprintf(`{"exp":%d,"jti":"%d"}`, time.Now().Unix()+3600, i)),
+			ServerURL:  serverURL,
+			ReceivedAt: time.Now(),
+		}, nil
+	}
+	ctx := context.Background()
+	cachePath := filepath.Join(t.TempDir(), "authz.json")
+	identity := &Identity{Data: `{"mac":"00:11:22:33:44:55"}`, PublicKey: "key"}
+
+	fake := &fakeClient{authenticate: newAuthz}
+	client := CachedAuthz(fake, cachePath, serverURL, identity)
+	authz, err := client.Authenticate(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fake.calls)
+	cached, err := client.Authenticate(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fake.calls)
+	assert.Equal(t, authz.Token, cached.Token)
+
+	fi, err := os.Stat(cachePath)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	}
+
+	// Restarting reuses the persisted token
+	fake = &fakeClient{authenticate: newAuthz}
+	client = CachedAuthz(fake, cachePath, serverURL, identity)
+	cached, err = client.Authenticate(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, fake.calls)
+	assert.Equal(t, authz.Token, cached.Token)
+
+	// ...but not for a different server
+	other := CachedAuthz(fake, cachePath, "https://example.com", identity)
+	_, err = other.Authenticate(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fake.calls)
+
+	// ...nor for a different identity
+	fake = &fakeClient{authenticate: newAuthz}
+	rotated := &Identity{Data: identity.Data, PublicKey: "rotated"}
+	other = CachedAuthz(fake, cachePath, serverURL, rotated)
+	renewed, err := other.Authenticate(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fake.calls)
+	assert.NotEqual(t, authz.Token, renewed.Token)
+	fake = &fakeClient{authenticate: newAuthz}
+	client = CachedAuthz(fake, cachePath, serverURL, identity)
+	authz, err = client.Authenticate(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fake.calls)
+
+	// Rejected tokens are dropped from the cache
+	fake = &fakeClient{
+		authenticate: newAuthz,
+		err:          &Error{Code: http.StatusUnauthorized},
+	}
+	client = CachedAuthz(fake, cachePath, serverURL, identity)
+	authz, err = client.Authenticate(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, fake.calls)
+	err = client.SendInventory(ctx, authz, Inventory{})
+	assert.True(t, IsUnauthorized(err))
+	_, err = os.Stat(cachePath)
+	assert.True(t, os.IsNotExist(err))
+	renewed, err = client.Authenticate(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fake.calls)
+	assert.NotEqual(t, authz.Token, renewed.Token)
+}
@@ -16,119 +16,338 @@ package api
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"math/rand"
 	"sync"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
-type expBackoff struct {
-	Client
-	timer           *time.Timer
+// Operation identifies the API operations with independent backoff state.
+type Operation string
+
+const (
+	OperationAuthenticate  Operation = "authenticate"
+	OperationOpenSocket    Operation = "open_socket"
+	OperationSendInventory Operation = "send_inventory"
+)
+
+// Operations lists all API operations.
+var Operations = []Operation{
+	OperationAuthenticate,
+	OperationOpenSocket,
+	OperationSendInventory,
+}
+
+// CircuitState is the state of the circuit breaker of an operation.
+type CircuitState int
+
+const (
+	// CircuitClosed lets requests through subject to the backoff.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects requests until the cooldown expires.
+	CircuitOpen
+	// CircuitHalfOpen lets a single trial request through.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+// ErrCircuitOpen is returned without attempting the request while the
+// circuit breaker of the operation is open.
+var ErrCircuitOpen = errors.New("api: circuit breaker open")
+
+// BackoffState is a snapshot of the backoff state of an operation.
+type BackoffState struct {
+	// NextAttempt is the earliest time of the next attempt.
+	NextAttempt time.Time
+	// Attempt is the number of the next attempt.
+	Attempt int
+	// Failures is the number of consecutive failed attempts.
+	Failures int
+	// Circuit is the state of the circuit breaker.
+	Circuit CircuitState
+}
+
+// Clock provides the time for the backoff; replaced in tests.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+type backoffState struct {
 	nextAttempt     time.Time
 	backoffDuration time.Duration
 	retries         int
-	mu              sync.Mutex
+	failures        int
+	circuit         CircuitState
+}
+
+type expBackoff struct {
+	Client
+	config BackoffConfig
+	clock  Clock
+	mu     sync.Mutex
+	ops    map[Operation]*backoffState
+	last   Operation
 }
 
 const (
 	backOffMin = time.Second
 	backoffMax = time.Hour * 8
+
+	defaultCircuitCooldown = time.Minute * 10
 )
 
+// BackoffConfig configures the interval between failed attempts.
+type BackoffConfig struct {
+	// MinInterval is the interval after the first failed attempt
+	// (default 1s). The interval doubles on every failed attempt.
+	MinInterval time.Duration
+	// MaxInterval is the upper bound for the interval (default 8h).
+	MaxInterval time.Duration
+	// Jitter is the upper bound of the random duration added to each
+	// interval (default MinInterval). A negative value disables jitter.
+	Jitter time.Duration
+	// CircuitThreshold is the number of consecutive failures opening the
+	// circuit breaker. The circuit breaker is disabled if not positive
+	// (default).
+	CircuitThreshold int
+	// CircuitCooldown is the minimum time the circuit breaker stays open
+	// before a trial request is let through (default 10m).
+	CircuitCooldown time.Duration
+}
+
+func (cfg BackoffConfig) withDefaults() BackoffConfig {
+	if cfg.MinInterval <= 0 {
+		cfg.MinInterval = backOffMin
+	}
+	if cfg.MaxInterval <= 0 {
+		cfg.MaxInterval = backoffMax
+	}
+	if cfg.MaxInterval < cfg.MinInterval {
+		cfg.MaxInterval = cfg.MinInterval
+	}
+	if cfg.Jitter == 0 {
+		cfg.Jitter = cfg.MinInterval
+	}
+	if cfg.CircuitCooldown <= 0 {
+		cfg.CircuitCooldown = defaultCircuitCooldown
+	}
+	return cfg
+}
+
 func ExpBackoff(client Client) BackoffClient {
+	return NewExpBackoff(client, BackoffConfig{})
+}
+
+// NewExpBackoff wraps the client with exponential backoff between failed
+// attempts and, if configured, a circuit breaker for each operation. A Retry-After delay
+// requested by the server takes precedence over the exponential schedule
+// if it is longer.
+func NewExpBackoff(client Client, config BackoffConfig) BackoffClient {
+	return newExpBackoff(client, config, realClock{})
+}
+
+func newExpBackoff(client Client, config BackoffConfig, clock Clock) *expBackoff {
+	ops := make(map[Operation]*backoffState, len(Operations))
+	for _, op := range Operations {
+		ops[op] = &backoffState{}
+	}
 	return &expBackoff{
 		Client: client,
-		timer:  time.NewTimer(0),
+		config: config.withDefaults(),
+		clock:  clock,
+		ops:    ops,
+		last:   OperationAuthenticate,
 	}
 }
 
 type BackoffClient interface {
 	Client
+	// NextAttempt returns the time and number of the next attempt of the
+	// most recently attempted operation.
 	NextAttempt() (time.Time, int)
+	// State returns the backoff state of the operation.
+	State(op Operation) BackoffState
 }
 
 var _ Client = &expBackoff{}
 
-func (a *expBackoff) incBackoff() {
-	a.mu.Lock()
-	defer a.mu.Unlock()
+func (a *expBackoff) jitter() time.Duration {
+	if a.config.Jitter <= 0 {
+		return 0
+	}
 	//nolint:gosec // math/rand is good enough for jitter
-	jitter := time.Duration((1 - rand.Float64()/2) * float64(backOffMin))
-	if a.backoffDuration > backoffMax {
-		a.backoffDuration = backoffMax
+	return time.Duration(rand.Int63n(int64(a.config.Jitter)))
+}
+
+// incBackoff schedules the next attempt; the caller must hold a.mu.
+func (a *expBackoff) incBackoff(st *backoffState) {
+	if st.backoffDuration <= 0 {
+		st.backoffDuration = a.config.MinInterval
 	} else {
-		a.backoffDuration *= 2
+		st.backoffDuration *= 2
 	}
-	a.backoffDuration += jitter
-	if a.nextAttempt.IsZero() {
-		a.nextAttempt = time.Now()
+	if st.backoffDuration > a.config.MaxInterval {
+		st.backoffDuration = a.config.MaxInterval
 	}
-	a.nextAttempt = a.nextAttempt.Add(a.backoffDuration)
-	a.timer.Reset(a.backoffDuration)
+	st.nextAttempt = a.clock.Now().Add(st.backoffDuration + a.jitter())
 }
 
-func (a *expBackoff) resetBackoff() {
+func (a *expBackoff) limit(ctx context.Context, op Operation) error {
 	a.mu.Lock()
-	a.nextAttempt = time.Time{}
-	a.timer.Reset(0)
-	a.backoffDuration = backOffMin
-	a.retries = 0
+	st := a.ops[op]
+	a.last = op
+	now := a.clock.Now()
+	switch st.circuit {
+	case CircuitOpen:
+		if now.Before(st.nextAttempt) {
+			a.mu.Unlock()
+			return fmt.Errorf("%s: %w", op, ErrCircuitOpen)
+		}
+		log.Infof("circuit breaker %s: half-open", op)
+		st.circuit = CircuitHalfOpen
+	case CircuitHalfOpen:
+		// A trial request is already in progress
+		a.mu.Unlock()
+		return fmt.Errorf("%s: %w", op, ErrCircuitOpen)
+	}
+	st.retries++
+	wait := st.nextAttempt.Sub(now)
 	a.mu.Unlock()
-}
 
-func (a *expBackoff) incAttempt() error {
+	if wait > 0 {
+		select {
+		case <-ctx.Done():
+			a.mu.Lock()
+			if st.circuit == CircuitHalfOpen {
+				st.circuit = CircuitOpen
+			}
+			a.mu.Unlock()
+			return ctx.Err()
+		case <-a.clock.After(wait):
+		}
+	}
 	a.mu.Lock()
-	defer a.mu.Unlock()
-	a.retries += 1
+	a.incBackoff(st)
+	a.mu.Unlock()
 	return nil
 }
 
-func (a *expBackoff) limit(ctx context.Context) error {
-	if err := a.incAttempt(); err != nil {
-		return err
+// result updates the backoff state of the operation with the result of
+// the request.
+func (a *expBackoff) result(ctx context.Context, op Operation, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st := a.ops[op]
+	if err == nil {
+		if st.circuit != CircuitClosed {
+			log.Infof("circuit breaker %s: closed", op)
+		}
+		*st = backoffState{}
+		return
+	} else if ctx.Err() != nil {
+		if st.circuit == CircuitHalfOpen {
+			st.circuit = CircuitOpen
+		}
+		return
 	}
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-a.timer.C:
-		a.incBackoff()
+	st.failures++
+	if delay, ok := RetryAfter(err); ok {
+		if delay > a.config.MaxInterval {
+			delay = a.config.MaxInterval
+		}
+		if next := a.clock.Now().Add(delay); next.After(st.nextAttempt) {
+			st.nextAttempt = next
+		}
+	}
+	if st.circuit == CircuitHalfOpen ||
+		(a.config.CircuitThreshold > 0 && st.failures >= a.config.CircuitThreshold) {
+		if st.circuit != CircuitOpen {
+			log.Warnf("circuit breaker %s: open after %d consecutive failures",
+				op, st.failures)
+		}
+		st.circuit = CircuitOpen
+		if next := a.clock.Now().Add(a.config.CircuitCooldown); next.After(st.nextAttempt) {
+			st.nextAttempt = next
+		}
 	}
-	return nil
 }
 
 func (a *expBackoff) NextAttempt() (time.Time, int) {
-	return a.nextAttempt, a.retries + 1
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st := a.ops[a.last]
+	return st.nextAttempt, st.retries + 1
+}
+
+func (a *expBackoff) State(op Operation) BackoffState {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st, ok := a.ops[op]
+	if !ok {
+		return BackoffState{}
+	}
+	return BackoffState{
+		NextAttempt: st.nextAttempt,
+		Attempt:     st.retries + 1,
+		Failures:    st.failures,
+		Circuit:     st.circuit,
+	}
 }
 
 func (a *expBackoff) Authenticate(ctx context.Context) (*Authz, error) {
-	if err := a.limit(ctx); err != nil {
+	if err := a.limit(ctx, OperationAuthenticate); err != nil {
 		return nil, err
 	}
 	authz, err := a.Client.Authenticate(ctx)
-	if err == nil {
-		a.resetBackoff()
-	}
+	a.result(ctx, OperationAuthenticate, err)
 	return authz, err
 }
 
 func (a *expBackoff) OpenSocket(ctx context.Context, authz *Authz) (Socket, error) {
-	if err := a.limit(ctx); err != nil {
+	if err := a.limit(ctx, OperationOpenSocket); err != nil {
 		return nil, err
 	}
 	sock, err := a.Client.OpenSocket(ctx, authz)
-	if err == nil {
-		a.resetBackoff()
-	}
+	a.result(ctx, OperationOpenSocket, err)
 	return sock, err
 }
 
 func (a *expBackoff) SendInventory(ctx context.Context, authz *Authz, inv Inventory) error {
-	if err := a.limit(ctx); err != nil {
+	if err := a.limit(ctx, OperationSendInventory); err != nil {
 		return err
 	}
 	err := a.Client.SendInventory(ctx, authz, inv)
-	if err == nil {
-		a.resetBackoff()
+	a.result(ctx, OperationSendInventory, err)
+	return err
+}
+
+func (a *expBackoff) PatchInventory(ctx context.Context, authz *Authz, inv Inventory) error {
+	if err := a.limit(ctx, OperationSendInventory); err != nil {
+		return err
+	}
+	err := a.Client.PatchInventory(ctx, authz, inv)
+	if !errors.Is(err, ErrPatchNotSupported) {
+		a.result(ctx, OperationSendInventory, err)
 	}
 	return err
 }
@@ -0,0 +1,249 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2023, 10, 21, 7, 28, 0, 0, time.UTC)
+	testCases := map[string]struct {
+		Value    string
+		Expected time.Duration
+	}{
+		"seconds": {
+			Value:    "120",
+			Expected: time.Minute * 2,
+		},
+		"http date": {
+			Value:    "Sat, 21 Oct 2023 07:30:00 GMT",
+			Expected: time.Minute * 2,
+		},
+		"date in the past": {
+			Value: "Sat, 21 Oct 2023 07:00:00 GMT",
+		},
+		"empty": {},
+		"invalid": {
+			Value: "-1",
+		},
+	}
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.Expected, parseRetryAfter(tc.Value, now))
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	t.Parallel()
+	for code, retryable := range map[int]bool{
+		http.StatusBadRequest:          false,
+		http.StatusUnauthorized:        true,
+		http.StatusNotFound:            false,
+		http.StatusTooManyRequests:     true,
+		http.StatusInternalServerError: true,
+		http.StatusServiceUnavailable:  true,
+	} {
+		assert.Equal(t, retryable, IsRetryable(&Error{Code: code}), code)
+	}
+}
+
+// fakeClock is a Clock where waiting advances the time immediately.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestExpBackoffSchedule(t *testing.T) {
+	t.Parallel()
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	fake := &fakeClient{
+		authenticate: func() (*Authz, error) { return &Authz{}, nil },
+		err:          &Error{Code: http.StatusInternalServerError},
+	}
+	client := newExpBackoff(fake, BackoffConfig{
+		MinInterval:      time.Second,
+		MaxInterval:      time.Second * 4,
+		Jitter:           -1,
+		CircuitThreshold: -1,
+	}, clock)
+	ctx := context.Background()
+	var wait time.Duration
+	for i, expected := range []time.Duration{1, 2, 4, 4, 4} {
+		start := clock.Now()
+		_ = client.SendInventory(ctx, nil, nil)
+		assert.Equal(t, wait, clock.Now().Sub(start),
+			"unexpected wait before attempt %d", i+1)
+		wait = expected * time.Second
+		state := client.State(OperationSendInventory)
+		assert.Equal(t, expected*time.Second, state.NextAttempt.Sub(clock.Now()))
+		assert.Equal(t, i+1, state.Failures)
+		assert.Equal(t, i+2, state.Attempt)
+	}
+	nextAttempt, attempt := client.NextAttempt()
+	assert.Equal(t, clock.Now().Add(time.Second*4), nextAttempt)
+	assert.Equal(t, 6, attempt)
+
+	// Other operations are not affected by the failing operation
+	start := clock.Now()
+	_, err := client.Authenticate(ctx)
+	assert.NoError(t, err)
+	_, err = client.Authenticate(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, start, clock.Now())
+	assert.Equal(t, BackoffState{Attempt: 1}, client.State(OperationAuthenticate))
+
+	fake.err = nil
+	assert.NoError(t, client.SendInventory(ctx, nil, nil))
+	assert.Equal(t, BackoffState{Attempt: 1}, client.State(OperationSendInventory))
+}
+
+func TestExpBackoffRetryAfter(t *testing.T) {
+	t.Parallel()
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	ctx := context.Background()
+	fake := &fakeClient{
+		err: &Error{
+			Code:       http.StatusServiceUnavailable,
+			RetryAfter: time.Minute,
+		},
+	}
+	client := newExpBackoff(fake, BackoffConfig{
+		MinInterval: time.Second,
+		MaxInterval: time.Minute * 10,
+		Jitter:      -1,
+	}, clock)
+	err := client.SendInventory(ctx, nil, nil)
+	assert.True(t, IsRetryable(err))
+	nextAttempt, attempt := client.NextAttempt()
+	assert.Equal(t, 2, attempt)
+	assert.Equal(t, clock.Now().Add(time.Minute), nextAttempt)
+
+	start := clock.Now()
+	fake.err = nil
+	err = client.SendInventory(ctx, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, clock.Now().Sub(start))
+
+	// Server hints are bounded by MaxInterval
+	fake.err = &Error{
+		Code:       http.StatusTooManyRequests,
+		RetryAfter: time.Hour,
+	}
+	_ = client.SendInventory(ctx, nil, nil)
+	nextAttempt, _ = client.NextAttempt()
+	assert.Equal(t, clock.Now().Add(time.Minute*10), nextAttempt)
+}
+
+func TestExpBackoffCircuitBreakerDisabled(t *testing.T) {
+	t.Parallel()
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	ctx := context.Background()
+	fake := &fakeClient{
+		authenticate: func() (*Authz, error) {
+			return nil, &Error{Code: http.StatusBadGateway}
+		},
+	}
+	client := newExpBackoff(fake, BackoffConfig{Jitter: -1}, clock)
+	for i := 0; i < 20; i++ {
+		_, err := client.Authenticate(ctx)
+		assert.NotErrorIs(t, err, ErrCircuitOpen)
+	}
+	assert.Equal(t, 20, fake.calls)
+	assert.Equal(t, CircuitClosed, client.State(OperationAuthenticate).Circuit)
+}
+
+func TestExpBackoffCircuitBreaker(t *testing.T) {
+	t.Parallel()
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	ctx := context.Background()
+	var authErr error = &Error{Code: http.StatusBadGateway}
+	fake := &fakeClient{
+		authenticate: func() (*Authz, error) {
+			if authErr != nil {
+				return nil, authErr
+			}
+			return &Authz{}, nil
+		},
+	}
+	client := newExpBackoff(fake, BackoffConfig{
+		MinInterval:      time.Second,
+		MaxInterval:      time.Second,
+		Jitter:           -1,
+		CircuitThreshold: 3,
+		CircuitCooldown:  time.Minute,
+	}, clock)
+	for i := 0; i < 3; i++ {
+		_, err := client.Authenticate(ctx)
+		assert.ErrorIs(t, err, authErr)
+	}
+	assert.Equal(t, 3, fake.calls)
+	state := client.State(OperationAuthenticate)
+	assert.Equal(t, CircuitOpen, state.Circuit)
+	assert.Equal(t, clock.Now().Add(time.Minute), state.NextAttempt)
+
+	// Requests are rejected without reaching the server
+	_, err := client.Authenticate(ctx)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, 3, fake.calls)
+
+	// A failing trial request reopens the circuit
+	clock.Advance(time.Minute)
+	_, err = client.Authenticate(ctx)
+	assert.ErrorIs(t, err, authErr)
+	assert.Equal(t, 4, fake.calls)
+	state = client.State(OperationAuthenticate)
+	assert.Equal(t, CircuitOpen, state.Circuit)
+	assert.Equal(t, clock.Now().Add(time.Minute), state.NextAttempt)
+
+	// A successful trial request closes the circuit
+	clock.Advance(time.Minute)
+	authErr = nil
+	_, err = client.Authenticate(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, BackoffState{Attempt: 1}, client.State(OperationAuthenticate))
+	assert.Equal(t, "closed", client.State(OperationAuthenticate).Circuit.String())
+}
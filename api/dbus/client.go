@@ -16,9 +16,12 @@ package dbus
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"net/http"
 
 	"github.com/northerntechhq/nt-connect/api"
+	apihttp "github.com/northerntechhq/nt-connect/api/http"
 	"github.com/northerntechhq/nt-connect/api/ws"
 	"github.com/northerntechhq/nt-connect/client/dbus"
 )
@@ -40,6 +43,8 @@ type ClientDBus struct {
 	dbusAPI          dbus.DBusAPI
 	authManagerProxy dbus.Handle
 	wsClient         api.SocketClient
+	httpClient       *http.Client
+	sendInventory    bool
 }
 
 var _ api.Client = &ClientDBus{}
@@ -72,7 +77,8 @@ func NewClient(
 	return &ClientDBus{
 		dbusAPI:          dbusAPI,
 		authManagerProxy: authManagerProxy,
-		wsClient:         ws.NewClient(nil),
+		wsClient:         ws.NewClient(nil, ws.Config{}),
+		httpClient:       http.DefaultClient,
 	}, nil
 }
 
@@ -95,6 +101,23 @@ func (a *ClientDBus) Authenticate(ctx context.Context) (*api.Authz, error) {
 	}, nil
 }
 
+// ConfigureSocket sets the TLS and websocket configuration used for
+// opening the socket.
+func (a *ClientDBus) ConfigureSocket(tlsConfig *tls.Config, wsConfig ws.Config) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig.Clone()
+	a.httpClient = &http.Client{
+		Transport: transport,
+	}
+	a.wsClient = ws.NewClient(a.httpClient, wsConfig)
+}
+
+// ConfigureInventory enables submitting the inventory to the server using
+// the token from the Authentication Manager, which has no inventory method.
+func (a *ClientDBus) ConfigureInventory(enabled bool) {
+	a.sendInventory = enabled
+}
+
 func (a *ClientDBus) OpenSocket(ctx context.Context, authz *api.Authz) (api.Socket, error) {
 	return a.wsClient.OpenSocket(ctx, authz)
 }
@@ -145,8 +168,30 @@ func (a *ClientDBus) waitForAuthStateChange(ctx context.Context) (authz *api.Aut
 	return authz, err
 }
 
-func (a *ClientDBus) SendInventory(_ context.Context, _ *api.Authz, _ api.Inventory) error {
-	// Inventory is assumed managed by the mender client.
-	// This function exists simply for interface completion.
-	return nil
+// SendInventory submits the inventory if enabled by ConfigureInventory.
+func (a *ClientDBus) SendInventory(ctx context.Context, authz *api.Authz, inv api.Inventory) error {
+	if !a.sendInventory {
+		// Inventory is assumed managed by the mender client.
+		return nil
+	}
+	if authz.IsZero() {
+		return &api.Error{Code: http.StatusUnauthorized}
+	}
+	return apihttp.PutInventory(ctx, a.httpClient, authz.ServerURL, authz, inv)
+}
+
+// PatchInventory submits the changed attributes if enabled by
+// ConfigureInventory.
+func (a *ClientDBus) PatchInventory(
+	ctx context.Context,
+	authz *api.Authz,
+	inv api.Inventory,
+) error {
+	if !a.sendInventory {
+		return nil
+	}
+	if authz.IsZero() {
+		return &api.Error{Code: http.StatusUnauthorized}
+	}
+	return apihttp.PatchInventory(ctx, a.httpClient, authz.ServerURL, authz, inv)
 }
@@ -18,6 +18,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -297,3 +299,103 @@ func TestAuthClientWaitForJwtTokenStateChange(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthClientSendInventory(t *testing.T) {
+	inv := api.Inventory{"os": api.NewInventoryValue("linux")}
+	testCases := map[string]struct {
+		enabled bool
+		authz   *api.Authz
+		patch   bool
+
+		httpStatus int
+
+		err error
+	}{
+		"disabled": {},
+		"disabled, patch": {
+			patch: true,
+		},
+		"enabled": {
+			enabled:    true,
+			authz:      &api.Authz{Token: "token"},
+			httpStatus: http.StatusOK,
+		},
+		"enabled, patch": {
+			enabled:    true,
+			authz:      &api.Authz{Token: "token"},
+			patch:      true,
+			httpStatus: http.StatusOK,
+		},
+		"enabled, unauthorized": {
+			enabled:    true,
+			authz:      &api.Authz{Token: "token"},
+			httpStatus: http.StatusUnauthorized,
+			err:        &api.Error{Code: http.StatusUnauthorized},
+		},
+		"enabled, no token": {
+			enabled: true,
+			authz:   &api.Authz{},
+			err:     &api.Error{Code: http.StatusUnauthorized},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dbusAPI := &dbus_mocks.DBusAPI{}
+			defer dbusAPI.AssertExpectations(t)
+
+			dbusAPI.On("BusGet",
+				uint(dbus.GBusTypeSystem),
+			).Return(dbus.Handle(nil), nil)
+			dbusAPI.On("BusProxyNew",
+				dbus.Handle(nil),
+				DBusObjectName,
+				DBusObjectPath,
+				DBusInterfaceName,
+			).Return(dbus.Handle(nil), nil)
+
+			var requests int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if tc.patch {
+					assert.Equal(t, http.MethodPatch, r.Method)
+				} else {
+					assert.Equal(t, http.MethodPut, r.Method)
+				}
+				assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+				w.WriteHeader(tc.httpStatus)
+			}))
+			defer srv.Close()
+			if tc.authz != nil {
+				tc.authz.ServerURL = srv.URL
+			}
+
+			client, err := NewClient(
+				dbusAPI,
+				DBusObjectName,
+				DBusObjectPath,
+				DBusInterfaceName,
+			)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			client.ConfigureInventory(tc.enabled)
+
+			if tc.patch {
+				err = client.PatchInventory(context.Background(), tc.authz, inv)
+			} else {
+				err = client.SendInventory(context.Background(), tc.authz, inv)
+			}
+			if tc.err != nil {
+				assert.EqualError(t, err, tc.err.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+			if tc.httpStatus != 0 {
+				assert.Equal(t, 1, requests)
+			} else {
+				assert.Zero(t, requests)
+			}
+		})
+	}
+}
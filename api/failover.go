@@ -0,0 +1,168 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultFailoverAttempts = 3
+
+var ErrNoEndpoints = errors.New("api: no endpoints configured")
+
+// Endpoint is a client for a single server.
+type Endpoint struct {
+	Client
+	ServerURL string
+}
+
+// FailoverClient distributes the requests to the first healthy endpoint
+// in order of preference. The client fails over to the next endpoint after
+// a number of consecutive failures authenticating or opening the socket.
+type FailoverClient struct {
+	endpoints   []Endpoint
+	maxAttempts int
+
+	mu       sync.Mutex
+	active   int
+	failures int
+}
+
+var _ Client = &FailoverClient{}
+
+// NewFailoverClient creates a client for the endpoints, where the first
+// endpoint is the primary. A non-positive maxAttempts selects the default
+// number of attempts before failing over.
+func NewFailoverClient(endpoints []Endpoint, maxAttempts int) (*FailoverClient, error) {
+	if len(endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = defaultFailoverAttempts
+	}
+	return &FailoverClient{
+		endpoints:   endpoints,
+		maxAttempts: maxAttempts,
+	}, nil
+}
+
+// Active returns the index and the server URL of the active endpoint.
+func (f *FailoverClient) Active() (int, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active, f.endpoints[f.active].ServerURL
+}
+
+func (f *FailoverClient) activeEndpoint() (int, Endpoint) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active, f.endpoints[f.active]
+}
+
+// report updates the health of the endpoint with the result of a request.
+func (f *FailoverClient) report(ctx context.Context, i int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if i != f.active || ctx.Err() != nil {
+		return
+	} else if err == nil {
+		f.failures = 0
+		return
+	}
+	f.failures++
+	if f.failures >= f.maxAttempts && len(f.endpoints) > 1 {
+		next := (f.active + 1) % len(f.endpoints)
+		log.Warnf("server %q failed %d consecutive attempts: failing over to %q",
+			f.endpoints[f.active].ServerURL, f.failures,
+			f.endpoints[next].ServerURL)
+		f.active = next
+		f.failures = 0
+	}
+}
+
+func (f *FailoverClient) Authenticate(ctx context.Context) (*Authz, error) {
+	i, ep := f.activeEndpoint()
+	authz, err := ep.Authenticate(ctx)
+	f.report(ctx, i, err)
+	return authz, err
+}
+
+func (f *FailoverClient) OpenSocket(ctx context.Context, authz *Authz) (Socket, error) {
+	i, ep := f.activeEndpoint()
+	if authz != nil && authz.ServerURL != ep.ServerURL {
+		// The token was issued by another endpoint
+		return nil, &Error{Code: http.StatusUnauthorized}
+	}
+	sock, err := ep.OpenSocket(ctx, authz)
+	f.report(ctx, i, err)
+	return sock, err
+}
+
+func (f *FailoverClient) SendInventory(ctx context.Context, authz *Authz, inv Inventory) error {
+	_, ep := f.activeEndpoint()
+	if authz != nil && authz.ServerURL != ep.ServerURL {
+		return &Error{Code: http.StatusUnauthorized}
+	}
+	return ep.SendInventory(ctx, authz, inv)
+}
+
+func (f *FailoverClient) PatchInventory(ctx context.Context, authz *Authz, inv Inventory) error {
+	_, ep := f.activeEndpoint()
+	if authz != nil && authz.ServerURL != ep.ServerURL {
+		return &Error{Code: http.StatusUnauthorized}
+	}
+	return ep.PatchInventory(ctx, authz, inv)
+}
+
+// refresher is implemented by the clients caching the token (see
+// CachedAuthz) to request a new token from the server.
+type refresher interface {
+	Refresh(ctx context.Context) (*Authz, error)
+}
+
+// ProbePrimary attempts to authenticate with the primary endpoint while
+// failed over. On success, the primary becomes the active endpoint and the
+// new token is returned. It returns nil if the primary is already active.
+// The token is always requested from the server, since a cached token does
+// not prove that the primary is reachable.
+func (f *FailoverClient) ProbePrimary(ctx context.Context) (*Authz, error) {
+	if i, _ := f.activeEndpoint(); i == 0 {
+		return nil, nil
+	}
+	primary := f.endpoints[0]
+	var (
+		authz *Authz
+		err   error
+	)
+	if r, ok := primary.Client.(refresher); ok {
+		authz, err = r.Refresh(ctx)
+	} else {
+		authz, err = primary.Authenticate(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.active = 0
+	f.failures = 0
+	f.mu.Unlock()
+	log.Infof("primary server %q is available", primary.ServerURL)
+	return authz, nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailoverClient(t *testing.T) {
+	t.Parallel()
+	const (
+		primaryURL   = "https://primary.example.com"
+		secondaryURL = "https://secondary.example.com"
+	)
+	ctx := context.Background()
+	errUnavailable := errors.New("connection refused")
+	primaryErr := errUnavailable
+	primary := &fakeClient{authenticate: func() (*Authz, error) {
+		if primaryErr != nil {
+			return nil, primaryErr
+		}
+		return &Authz{Token: "primary", ServerURL: primaryURL}, nil
+	}}
+	secondary := &fakeClient{authenticate: func() (*Authz, error) {
+		return &Authz{Token: "secondary", ServerURL: secondaryURL}, nil
+	}}
+
+	_, err := NewFailoverClient(nil, 0)
+	assert.ErrorIs(t, err, ErrNoEndpoints)
+
+	client, err := NewFailoverClient([]Endpoint{
+		{Client: primary, ServerURL: primaryURL},
+		{Client: secondary, ServerURL: secondaryURL},
+	}, 2)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	authz, err := client.ProbePrimary(ctx)
+	assert.NoError(t, err)
+	assert.Nil(t, authz, "primary is already active")
+
+	for i := 0; i < 2; i++ {
+		_, err = client.Authenticate(ctx)
+		assert.ErrorIs(t, err, errUnavailable)
+	}
+	i, serverURL := client.Active()
+	assert.Equal(t, 1, i)
+	assert.Equal(t, secondaryURL, serverURL)
+
+	authz, err = client.Authenticate(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, secondaryURL, authz.ServerURL)
+
+	// Tokens from other endpoints are rejected
+	_, err = client.OpenSocket(ctx, &Authz{Token: "primary", ServerURL: primaryURL})
+	assert.True(t, IsUnauthorized(err))
+	err = client.SendInventory(ctx, &Authz{Token: "primary", ServerURL: primaryURL}, nil)
+	assert.True(t, IsUnauthorized(err))
+
+	_, err = client.ProbePrimary(ctx)
+	assert.ErrorIs(t, err, errUnavailable)
+	i, _ = client.Active()
+	assert.Equal(t, 1, i)
+
+	primaryErr = nil
+	authz, err = client.ProbePrimary(ctx)
+	assert.NoError(t, err)
+	if assert.NotNil(t, authz) {
+		assert.Equal(t, primaryURL, authz.ServerURL)
+	}
+	i, serverURL = client.Active()
+	assert.Equal(t, 0, i)
+	assert.Equal(t, primaryURL, serverURL)
+
+	// Cancelled requests do not count as failures
+	primaryErr = context.Canceled
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	for i := 0; i < 3; i++ {
+		_, _ = client.Authenticate(cancelled)
+	}
+	i, _ = client.Active()
+	assert.Equal(t, 0, i)
+}
+
+func TestFailoverClientProbeCachedPrimary(t *testing.T) {
+	t.Parallel()
+	const (
+		primaryURL   = "https://primary.example.com"
+		secondaryURL = "https://secondary.example.com"
+	)
+	ctx := context.Background()
+	errUnavailable := errors.New("connection refused")
+	identity := &Identity{Data: `{"mac":"00:11:22:33:44:55"}`, PublicKey: "key"}
+	cachePath := filepath.Join(t.TempDir(), "authz.json")
+
+	// The primary issued a token that is still valid before going down
+	primaryErr := error(nil)
+	primary := &fakeClient{authenticate: func() (*Authz, error) {
+		if primaryErr != nil {
+			return nil, primaryErr
+		}
+		return &Authz{
+			Token:      makeToken(fmt.Sprintf(`{"exp":%d}`, time.Now().Unix()+3600)),
+			ServerURL:  primaryURL,
+			ReceivedAt: time.Now(),
+		}, nil
+	}}
+	cached := CachedAuthz(primary, cachePath, primaryURL, identity)
+	_, err := cached.Authenticate(ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	primaryErr = errUnavailable
+	secondary := &fakeClient{authenticate: func() (*Authz, error) {
+		return &Authz{Token: "secondary", ServerURL: secondaryURL}, nil
+	}}
+	client, err := NewFailoverClient([]Endpoint{
+		{Client: cached, ServerURL: primaryURL},
+		{Client: secondary, ServerURL: secondaryURL},
+	}, 1)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = client.OpenSocket(ctx, nil)
+	assert.NoError(t, err)
+	primary.err = errUnavailable
+	_, err = client.OpenSocket(ctx, nil)
+	assert.ErrorIs(t, err, errUnavailable)
+	i, _ := client.Active()
+	assert.Equal(t, 1, i)
+
+	calls := primary.calls
+	_, err = client.ProbePrimary(ctx)
+	assert.ErrorIs(t, err, errUnavailable)
+	assert.Equal(t, calls+1, primary.calls, "the probe must reach the server")
+	i, _ = client.Active()
+	assert.Equal(t, 1, i, "the cached token must not fail back")
+
+	primaryErr, primary.err = nil, nil
+	authz, err := client.ProbePrimary(ctx)
+	assert.NoError(t, err)
+	if assert.NotNil(t, authz) {
+		assert.Equal(t, primaryURL, authz.ServerURL)
+	}
+	i, _ = client.Active()
+	assert.Equal(t, 0, i)
+}
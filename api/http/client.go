@@ -27,6 +27,7 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/northerntechhq/nt-connect/api"
 	apiws "github.com/northerntechhq/nt-connect/api/ws"
@@ -71,6 +72,10 @@ func NewClient(
 	} else if cfg.GetIdentity() == nil {
 		return nil, fmt.Errorf("invalid client config: empty identity data")
 	}
+	wsConfig, err := apiws.NewConfig(cfg.Websocket)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client config: %w", err)
+	}
 	transport := http.DefaultTransport.(*http.Transport).Clone()
 	transport.TLSClientConfig = tlsConfig.Clone()
 	client := &http.Client{
@@ -82,7 +87,7 @@ func NewClient(
 		PrivateKey: cfg.GetPrivateKey(),
 		Identity:   cfg.GetIdentity(),
 		client:     client,
-		wsClient:   apiws.NewClient(client),
+		wsClient:   apiws.NewClient(client, wsConfig),
 	}
 	return &localAuth, nil
 }
@@ -111,17 +116,16 @@ func (a *HTTPClient) Authenticate(ctx context.Context) (*api.Authz, error) {
 	}
 	defer rsp.Body.Close()
 	if rsp.StatusCode >= 300 {
-		return nil, &api.Error{
-			Code: rsp.StatusCode,
-		}
+		return nil, api.NewError(rsp)
 	}
 	b, err := io.ReadAll(rsp.Body)
 	if err != nil {
 		return nil, err
 	}
 	return &api.Authz{
-		ServerURL: a.serverURL,
-		Token:     string(b),
+		ServerURL:  a.serverURL,
+		Token:      string(b),
+		ReceivedAt: time.Now(),
 	}, nil
 }
 
@@ -137,28 +141,64 @@ func (a *HTTPClient) OpenSocket(ctx context.Context, authz *api.Authz) (api.Sock
 }
 
 func (a *HTTPClient) SendInventory(ctx context.Context, authz *api.Authz, inv api.Inventory) error {
+	return PutInventory(ctx, a.client, a.serverURL, authz, inv)
+}
+
+func (a *HTTPClient) PatchInventory(ctx context.Context, authz *api.Authz, inv api.Inventory) error {
+	return PatchInventory(ctx, a.client, a.serverURL, authz, inv)
+}
+
+// PutInventory submits the inventory attributes to the server using the
+// device token, replacing all the attributes.
+func PutInventory(
+	ctx context.Context,
+	client *http.Client,
+	serverURL string,
+	authz *api.Authz,
+	inv api.Inventory,
+) error {
+	return submitInventory(ctx, client, http.MethodPut, serverURL, authz, inv)
+}
+
+// PatchInventory submits the inventory attributes to the server using the
+// device token, leaving the other attributes unchanged.
+func PatchInventory(
+	ctx context.Context,
+	client *http.Client,
+	serverURL string,
+	authz *api.Authz,
+	inv api.Inventory,
+) error {
+	return submitInventory(ctx, client, http.MethodPatch, serverURL, authz, inv)
+}
+
+func submitInventory(
+	ctx context.Context,
+	client *http.Client,
+	method, serverURL string,
+	authz *api.Authz,
+	inv api.Inventory,
+) error {
 	if authz.IsZero() {
 		return &api.Error{Code: http.StatusUnauthorized}
 	}
 
 	bodyBytes, _ := json.Marshal(inv)
 
-	url := a.serverURL + apiURLInventory
-	req, err := NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(bodyBytes))
+	url := serverURL + apiURLInventory
+	req, err := NewRequestWithContext(ctx, method, url, bytes.NewReader(bodyBytes))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Authorization", "Bearer "+authz.Token)
 	req.Header.Set("Content-Type", "application/json")
-	rsp, err := a.client.Do(req)
+	rsp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer rsp.Body.Close()
 	if rsp.StatusCode >= 300 {
-		return &api.Error{
-			Code: rsp.StatusCode,
-		}
+		return api.NewError(rsp)
 	}
 	return nil
 }
@@ -29,6 +29,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/northerntechhq/nt-connect/api"
 	"github.com/northerntechhq/nt-connect/config"
@@ -176,6 +177,7 @@ func TestAuthenticate(t *testing.T) {
 	type testCase struct {
 		CTX            context.Context
 		StatusCode     int
+		Header         http.Header
 		RoundTripError error
 
 		ServerURL string
@@ -225,6 +227,18 @@ func TestAuthenticate(t *testing.T) {
 				return assert.ErrorAs(t, err, &apiErr) && assert.Equal(t, http.StatusBadGateway, apiErr.Code)
 			},
 		},
+		"error/too many requests": {
+			CTX:        context.Background(),
+			StatusCode: http.StatusTooManyRequests,
+			Header:     http.Header{"Retry-After": []string{"120"}},
+
+			ErrorAssertionFunc: func(t assert.TestingT, err error, i ...interface{}) bool {
+				retryAfter, ok := api.RetryAfter(err)
+				return assert.True(t, api.IsRetryable(err)) &&
+					assert.True(t, ok) &&
+					assert.Equal(t, 2*time.Minute, retryAfter)
+			},
+		},
 		"error/server url": {
 			CTX:        context.Background(),
 			StatusCode: http.StatusBadGateway,
@@ -251,6 +265,9 @@ func TestAuthenticate(t *testing.T) {
 				assert.Contains(t, req.Header, "X-Men-Signature")
 				w := httptest.NewRecorder()
 				w.Header().Set("Content-Type", "application/jwt")
+				for key, value := range tc.Header {
+					w.Header()[key] = value
+				}
 				w.WriteHeader(tc.StatusCode)
 				w.Write([]byte(tc.Token))
 
@@ -289,6 +306,7 @@ func TestSendInventory(t *testing.T) {
 
 		Inventory api.Inventory
 		Authz     *api.Authz
+		Patch     bool
 
 		assert.ErrorAssertionFunc
 	}
@@ -302,6 +320,15 @@ func TestSendInventory(t *testing.T) {
 				Token:     "token",
 			},
 		},
+		"ok/patch": {
+			CTX:        context.Background(),
+			StatusCode: 204,
+			Authz: &api.Authz{
+				ServerURL: "http+testing://localhost:1234",
+				Token:     "token",
+			},
+			Patch: true,
+		},
 		"error/roundtrip": {
 			CTX:        context.Background(),
 			StatusCode: 500,
@@ -359,7 +386,11 @@ func TestSendInventory(t *testing.T) {
 				)
 				assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
 				assert.Equal(t, apiURLInventory, req.URL.Path)
-				assert.Equal(t, http.MethodPut, req.Method)
+				if tc.Patch {
+					assert.Equal(t, http.MethodPatch, req.Method)
+				} else {
+					assert.Equal(t, http.MethodPut, req.Method)
+				}
 				w := httptest.NewRecorder()
 				w.WriteHeader(tc.StatusCode)
 
@@ -369,7 +400,12 @@ func TestSendInventory(t *testing.T) {
 					h.serverURL = tc.Authz.ServerURL
 				}
 			})
-			err := c.SendInventory(tc.CTX, tc.Authz, tc.Inventory)
+			var err error
+			if tc.Patch {
+				err = c.PatchInventory(tc.CTX, tc.Authz, tc.Inventory)
+			} else {
+				err = c.SendInventory(tc.CTX, tc.Authz, tc.Inventory)
+			}
 			if tc.ErrorAssertionFunc != nil {
 				tc.ErrorAssertionFunc(t, err)
 			} else {
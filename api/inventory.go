@@ -11,12 +11,14 @@
 //	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //	See the License for the specific language governing permissions and
 //	limitations under the License.
-
 package api
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"io"
@@ -24,22 +26,128 @@ import (
 	"strings"
 )
 
-type InventoryValue []string
+var ErrInvalidInventory = errors.New("invalid inventory")
+
+// InventoryValue is the value of an inventory attribute: a list of
+// strings, numbers (float64) or booleans, with an optional scope and
+// description.
+type InventoryValue struct {
+	Values      []interface{}
+	Scope       string
+	Description string
+}
+
+// NewInventoryValue returns a value with the values. Integers are
+// converted to float64, and types other than strings, numbers and booleans
+// to strings.
+func NewInventoryValue(values ...interface{}) InventoryValue {
+	var v InventoryValue
+	for _, value := range values {
+		v.Values = append(v.Values, normalize(value))
+	}
+	return v
+}
+
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string, float64, bool:
+		return v
+	case float32:
+		return float64(v)
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint:
+		return float64(v)
+	case uint32:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
 
+// MarshalJSON encodes the values: an empty string if there are none, the
+// value if there is one, or an array. Mixed types are encoded as strings.
 func (v InventoryValue) MarshalJSON() ([]byte, error) {
-	switch len(v) {
+	switch len(v.Values) {
 	case 0:
 		return []byte{'"', '"'}, nil
 	case 1:
-		return json.Marshal(v[0])
-	default:
-		return json.Marshal([]string(v))
+		return json.Marshal(v.Values[0])
+	}
+	values := v.Values
+	for _, value := range values[1:] {
+		if fmt.Sprintf("%T", value) != fmt.Sprintf("%T", values[0]) {
+			values = make([]interface{}, len(v.Values))
+			for i, value := range v.Values {
+				values[i] = fmt.Sprint(value)
+			}
+			break
+		}
 	}
+	return json.Marshal(values)
 }
 
 type Inventory map[string]InventoryValue
 
+// Add appends the values to the attribute.
+func (inv Inventory) Add(key string, values ...interface{}) {
+	inv.Append(key, NewInventoryValue(values...))
+}
+
+// Append appends the values of value to the attribute, and sets its scope
+// and description if not empty.
+func (inv Inventory) Append(key string, value InventoryValue) {
+	attr := inv[key]
+	attr.Values = append(attr.Values, value.Values...)
+	if value.Scope != "" {
+		attr.Scope = value.Scope
+	}
+	if value.Description != "" {
+		attr.Description = value.Description
+	}
+	inv[key] = attr
+}
+
+// NewInventoryFromStream parses inventory attributes in one of the formats:
+//   - "key=value" lines (legacy), where the values are strings
+//   - JSON objects mapping the keys to the values
+//   - JSON lines, each an object with the "name", "value" and optional
+//     "scope" and "description" of an attribute
+//
+// In the JSON formats, a value is a string, a number, a boolean or an array
+// of those, or an object with the "value", "scope" and "description" of the
+// attribute. The attributes parsed before an error are returned with the
+// error.
 func NewInventoryFromStream(r io.Reader) (Inventory, error) {
+	br := bufio.NewReader(r)
+	var prefix []byte
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			return make(Inventory), nil
+		} else if err != nil {
+			return nil, err
+		}
+		prefix = append(prefix, c)
+		if c == '{' {
+			return newInventoryFromJSON(io.MultiReader(bytes.NewReader(prefix), br))
+		} else if !isSpace(c) {
+			return newInventoryFromLines(io.MultiReader(bytes.NewReader(prefix), br))
+		}
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func newInventoryFromLines(r io.Reader) (Inventory, error) {
 	s := bufio.NewScanner(r)
 	inv := make(Inventory)
 
@@ -50,11 +158,140 @@ func NewInventoryFromStream(r io.Reader) (Inventory, error) {
 		}
 		key := kv[0]
 		value := kv[1]
-		inv[key] = append(inv[key], value)
+		inv.Add(key, value)
 	}
 	return inv, s.Err()
 }
 
+// inventoryRecord is an attribute in the JSON lines format.
+type inventoryRecord struct {
+	Name        string          `json:"name"`
+	Value       json.RawMessage `json:"value"`
+	Scope       string          `json:"scope,omitempty"`
+	Description string          `json:"description,omitempty"`
+}
+
+// isRecord returns true if the object is an attribute in the JSON lines
+// format, rather than an object mapping keys to values.
+func isRecord(obj map[string]json.RawMessage) bool {
+	if _, ok := obj["value"]; !ok {
+		return false
+	}
+	var name string
+	if err := json.Unmarshal(obj["name"], &name); err != nil {
+		return false
+	}
+	for key := range obj {
+		switch key {
+		case "name", "value", "scope", "description":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newInventoryFromJSON(r io.Reader) (Inventory, error) {
+	dec := json.NewDecoder(r)
+	inv := make(Inventory)
+	for {
+		var raw json.RawMessage
+		var obj map[string]json.RawMessage
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			return inv, nil
+		} else if err == nil {
+			err = json.Unmarshal(raw, &obj)
+		}
+		if err != nil {
+			return inv, fmt.Errorf("%w: %s", ErrInvalidInventory, err.Error())
+		}
+		if isRecord(obj) {
+			var record inventoryRecord
+			if err = json.Unmarshal(raw, &record); err != nil {
+				return inv, fmt.Errorf("%w: %s", ErrInvalidInventory, err.Error())
+			}
+			value, err := parseValues(record.Value)
+			if err != nil {
+				return inv, fmt.Errorf("%w: attribute %q: %s",
+					ErrInvalidInventory, record.Name, err.Error())
+			}
+			value.Scope = record.Scope
+			value.Description = record.Description
+			inv.Append(record.Name, value)
+			continue
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value, err := parseAttribute(obj[key])
+			if err != nil {
+				return inv, fmt.Errorf("%w: attribute %q: %s",
+					ErrInvalidInventory, key, err.Error())
+			}
+			inv.Append(key, value)
+		}
+	}
+}
+
+// parseAttribute parses the values, or an object with the values, scope
+// and description of an attribute.
+func parseAttribute(raw json.RawMessage) (InventoryValue, error) {
+	if trimmed := bytes.TrimLeft(raw, " \t\r\n"); len(trimmed) == 0 || trimmed[0] != '{' {
+		return parseValues(raw)
+	}
+	var attr struct {
+		Value       json.RawMessage `json:"value"`
+		Scope       string          `json:"scope"`
+		Description string          `json:"description"`
+	}
+	if err := json.Unmarshal(raw, &attr); err != nil {
+		return InventoryValue{}, err
+	}
+	value, err := parseValues(attr.Value)
+	value.Scope = attr.Scope
+	value.Description = attr.Description
+	return value, err
+}
+
+func parseValues(raw json.RawMessage) (InventoryValue, error) {
+	var value interface{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return InventoryValue{}, err
+		}
+	}
+	switch v := value.(type) {
+	case nil:
+		return InventoryValue{}, nil
+	case string, float64, bool:
+		return NewInventoryValue(v), nil
+	case []interface{}:
+		for _, elem := range v {
+			switch elem.(type) {
+			case string, float64, bool:
+			default:
+				return InventoryValue{}, errors.New(
+					"array values must be strings, numbers or booleans",
+				)
+			}
+		}
+		return InventoryValue{Values: v}, nil
+	}
+	return InventoryValue{}, errors.New("unsupported value type")
+}
+
+// Merge copies the attributes of other into inv, replacing the values of
+// existing attributes.
+func (inv Inventory) Merge(other Inventory) {
+	for key, value := range other {
+		inv[key] = value
+	}
+}
+
 func (inv Inventory) Digest() []byte {
 	hash := fnv.New64()
 	keys := make([]string, 0, len(inv))
@@ -63,23 +300,72 @@ func (inv Inventory) Digest() []byte {
 	}
 	sort.Strings(keys)
 	for _, key := range keys {
-		for _, value := range inv[key] {
-			fmt.Fprintf(hash, "%s=%s\n", key, value)
-		}
+		inv[key].digest(hash, key)
 	}
 	return hash.Sum(nil)
 }
 
+func (v InventoryValue) digest(w io.Writer, key string) {
+	for _, value := range v.Values {
+		if s, ok := value.(string); ok {
+			fmt.Fprintf(w, "%s=%s\n", key, s)
+		} else {
+			// Distinguish the typed values from their string form
+			fmt.Fprintf(w, "%s:%T=%v\n", key, value, value)
+		}
+	}
+	if v.Scope != "" {
+		fmt.Fprintf(w, "%s@scope=%s\n", key, v.Scope)
+	}
+	if v.Description != "" {
+		fmt.Fprintf(w, "%s@description=%s\n", key, v.Description)
+	}
+}
+
+// Digests returns the hex encoded digests of the attributes.
+func (inv Inventory) Digests() map[string]string {
+	digests := make(map[string]string, len(inv))
+	for key, value := range inv {
+		hash := fnv.New64()
+		value.digest(hash, key)
+		digests[key] = hex.EncodeToString(hash.Sum(nil))
+	}
+	return digests
+}
+
+// Diff compares the attributes with the digests of a previous inventory
+// (see Digests). It returns the attributes added or changed since, and the
+// sorted names of the attributes removed.
+func (inv Inventory) Diff(digests map[string]string) (changed Inventory, removed []string) {
+	changed = make(Inventory)
+	for key, digest := range inv.Digests() {
+		if digests[key] != digest {
+			changed[key] = inv[key]
+		}
+	}
+	for key := range digests {
+		if _, ok := inv[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(removed)
+	return changed, removed
+}
+
 func (inv Inventory) MarshalJSON() ([]byte, error) {
 	type Schema struct {
-		Name  string         `json:"name"`
-		Value InventoryValue `json:"value"`
+		Name        string         `json:"name"`
+		Value       InventoryValue `json:"value"`
+		Scope       string         `json:"scope,omitempty"`
+		Description string         `json:"description,omitempty"`
 	}
 	schema := make([]Schema, 0, len(inv))
 	for key := range inv {
 		schema = append(schema, Schema{
-			Name:  key,
-			Value: inv[key],
+			Name:        key,
+			Value:       inv[key],
+			Scope:       inv[key].Scope,
+			Description: inv[key].Description,
 		})
 	}
 	sort.Slice(schema, func(i, j int) bool {
@@ -87,3 +373,23 @@ func (inv Inventory) MarshalJSON() ([]byte, error) {
 	})
 	return json.Marshal(schema)
 }
+
+// UnmarshalJSON parses the inventory encoded by MarshalJSON.
+func (inv *Inventory) UnmarshalJSON(b []byte) error {
+	var records []inventoryRecord
+	if err := json.Unmarshal(b, &records); err != nil {
+		return err
+	}
+	*inv = make(Inventory, len(records))
+	for _, record := range records {
+		value, err := parseValues(record.Value)
+		if err != nil {
+			return fmt.Errorf("%w: attribute %q: %s",
+				ErrInvalidInventory, record.Name, err.Error())
+		}
+		value.Scope = record.Scope
+		value.Description = record.Description
+		inv.Append(record.Name, value)
+	}
+	return nil
+}
@@ -16,6 +16,7 @@ package api
 
 import (
 	"bytes"
+	"encoding/json"
 	"io"
 	"testing"
 	"testing/iotest"
@@ -34,9 +35,9 @@ baz=
 		inv, err := NewInventoryFromStream(bytes.NewReader(input))
 		assert.NoError(t, err)
 		expected := Inventory{
-			"foo": InventoryValue{"bar"},
-			"bar": InventoryValue{"baz", "foo"},
-			"baz": InventoryValue{""},
+			"foo": NewInventoryValue("bar"),
+			"bar": NewInventoryValue("baz", "foo"),
+			"baz": NewInventoryValue(""),
 		}
 		assert.Equal(t, expected, inv)
 		assert.Equal(t, expected.Digest(), inv.Digest())
@@ -52,6 +53,126 @@ baz=
 		assert.Equal(t, Inventory{}, inv)
 		assert.Equal(t, Inventory{}.Digest(), inv.Digest())
 	})
+	t.Run("decode JSON object", func(t *testing.T) {
+		input := []byte(`
+{
+  "os": "Debian",
+  "mem_total_kB": 8000000,
+  "rootfs_rw": true,
+  "cpu_model": ["ARMv7", "ARMv8"],
+  "empty": null,
+  "location": {"value": "lab", "scope": "tags", "description": "Site"}
+}`)
+		inv, err := NewInventoryFromStream(bytes.NewReader(input))
+		assert.NoError(t, err)
+		assert.Equal(t, Inventory{
+			"os":           NewInventoryValue("Debian"),
+			"mem_total_kB": NewInventoryValue(8000000),
+			"rootfs_rw":    NewInventoryValue(true),
+			"cpu_model":    NewInventoryValue("ARMv7", "ARMv8"),
+			"empty":        NewInventoryValue(),
+			"location": InventoryValue{
+				Values:      []interface{}{"lab"},
+				Scope:       "tags",
+				Description: "Site",
+			},
+		}, inv)
+		js, _ := inv.MarshalJSON()
+		assert.JSONEq(t, `[
+{"name":"cpu_model","value":["ARMv7","ARMv8"]},
+{"name":"empty","value":""},
+{"name":"location","value":"lab","scope":"tags","description":"Site"},
+{"name":"mem_total_kB","value":8000000},
+{"name":"os","value":"Debian"},
+{"name":"rootfs_rw","value":true}]`, string(js))
+	})
+	t.Run("decode JSON lines", func(t *testing.T) {
+		input := []byte(`{"name": "cpu_count", "value": 4, "description": "CPUs"}
+{"name": "ipv4", "value": ["10.0.0.1/8"]}
+{"name": "ipv4", "value": "192.168.1.1/24"}
+{"uptime_s": 120}
+`)
+		inv, err := NewInventoryFromStream(bytes.NewReader(input))
+		assert.NoError(t, err)
+		assert.Equal(t, Inventory{
+			"cpu_count": InventoryValue{
+				Values:      []interface{}{float64(4)},
+				Description: "CPUs",
+			},
+			"ipv4":     NewInventoryValue("10.0.0.1/8", "192.168.1.1/24"),
+			"uptime_s": NewInventoryValue(120),
+		}, inv)
+	})
+	t.Run("error/invalid JSON", func(t *testing.T) {
+		input := []byte(`{"os": "Debian"}
+{"nested": [["a"]]}
+{"kernel": "Linux"}`)
+		inv, err := NewInventoryFromStream(bytes.NewReader(input))
+		assert.ErrorIs(t, err, ErrInvalidInventory)
+		assert.Equal(t, Inventory{"os": NewInventoryValue("Debian")}, inv)
+
+		_, err = NewInventoryFromStream(bytes.NewReader([]byte(`{"os": `)))
+		assert.ErrorIs(t, err, ErrInvalidInventory)
+	})
+	t.Run("marshal mixed types", func(t *testing.T) {
+		inv := Inventory{"mixed": NewInventoryValue("a", 1, false)}
+		js, _ := inv.MarshalJSON()
+		assert.JSONEq(t, `[{"name":"mixed","value":["a","1","false"]}]`, string(js))
+	})
+	t.Run("digest typed values", func(t *testing.T) {
+		str := Inventory{"count": NewInventoryValue("1")}
+		num := Inventory{"count": NewInventoryValue(1)}
+		assert.NotEqual(t, str.Digest(), num.Digest())
+
+		desc := Inventory{"count": NewInventoryValue(1)}
+		desc.Append("count", InventoryValue{Description: "Count"})
+		assert.NotEqual(t, num.Digest(), desc.Digest())
+		assert.Equal(t, num.Digest(), Inventory{"count": NewInventoryValue(1)}.Digest())
+	})
+	t.Run("diff", func(t *testing.T) {
+		previous := Inventory{
+			"os":      NewInventoryValue("Debian"),
+			"kernel":  NewInventoryValue("6.1"),
+			"removed": NewInventoryValue("x"),
+			"count":   NewInventoryValue(1),
+		}
+		inv := Inventory{
+			"os":     NewInventoryValue("Debian"),
+			"kernel": NewInventoryValue("6.2"),
+			"count":  NewInventoryValue(1),
+			"added":  NewInventoryValue(true),
+		}
+		changed, removed := inv.Diff(previous.Digests())
+		assert.Equal(t, Inventory{
+			"kernel": NewInventoryValue("6.2"),
+			"added":  NewInventoryValue(true),
+		}, changed)
+		assert.Equal(t, []string{"removed"}, removed)
+
+		changed, removed = inv.Diff(inv.Digests())
+		assert.Empty(t, changed)
+		assert.Empty(t, removed)
+	})
+	t.Run("unmarshal", func(t *testing.T) {
+		inv := Inventory{
+			"os":       NewInventoryValue("Debian"),
+			"ipv4":     NewInventoryValue("10.0.0.1/8", "192.168.1.1/24"),
+			"uptime_s": NewInventoryValue(120),
+			"location": InventoryValue{
+				Values:      []interface{}{"lab"},
+				Scope:       "tags",
+				Description: "Site",
+			},
+		}
+		js, _ := inv.MarshalJSON()
+		var decoded Inventory
+		if assert.NoError(t, json.Unmarshal(js, &decoded)) {
+			assert.Equal(t, inv, decoded)
+		}
+
+		err := json.Unmarshal([]byte(`[{"name":"nested","value":[["a"]]}]`), &decoded)
+		assert.ErrorIs(t, err, ErrInvalidInventory)
+	})
 	t.Run("error/unexpected EOF", func(t *testing.T) {
 		_, err := NewInventoryFromStream(iotest.ErrReader(io.ErrUnexpectedEOF))
 		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
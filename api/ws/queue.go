@@ -0,0 +1,245 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+package ws
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/mendersoftware/go-lib-micro/ws"
+
+	"github.com/northerntechhq/nt-connect/api"
+)
+
+// Priority is the priority class of outbound messages. Messages with a
+// lower value are written first.
+type Priority int
+
+const (
+	PriorityControl Priority = iota
+	PriorityShell
+	PriorityPortForward
+	PriorityFileTransfer
+
+	numPriorities = int(PriorityFileTransfer) + 1
+)
+
+const defaultQueueSize = 16
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityControl:
+		return "control"
+	case PriorityShell:
+		return "shell"
+	case PriorityPortForward:
+		return "portforward"
+	case PriorityFileTransfer:
+		return "filetransfer"
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// MessagePriority returns the priority class of messages of the protocol.
+func MessagePriority(proto ws.ProtoType) Priority {
+	switch proto {
+	case ws.ProtoTypeControl:
+		return PriorityControl
+	case ws.ProtoTypePortForward, ws.ProtoTypePortForwardV2:
+		return PriorityPortForward
+	case ws.ProtoTypeFileTransfer:
+		return PriorityFileTransfer
+	}
+	return PriorityShell
+}
+
+// QueueStats holds the outbound queue metrics of a priority class.
+type QueueStats struct {
+	Priority Priority
+	// Depth is the number of queued messages.
+	Depth int64
+	// MaxDepth is the highest number of queued messages observed.
+	MaxDepth int64
+	// Sent is the number of messages written.
+	Sent uint64
+	// Rejected is the number of messages rejected on a full queue.
+	Rejected uint64
+}
+
+type queueCounters struct {
+	depth    atomic.Int64
+	maxDepth atomic.Int64
+	sent     atomic.Uint64
+	rejected atomic.Uint64
+}
+
+var queueMetrics [numPriorities]queueCounters
+
+// GetQueueStats returns the outbound queue metrics of all sockets.
+func GetQueueStats() []QueueStats {
+	stats := make([]QueueStats, numPriorities)
+	for i := range queueMetrics {
+		c := &queueMetrics[i]
+		stats[i] = QueueStats{
+			Priority: Priority(i),
+			Depth:    c.depth.Load(),
+			MaxDepth: c.maxDepth.Load(),
+			Sent:     c.sent.Load(),
+			Rejected: c.rejected.Load(),
+		}
+	}
+	return stats
+}
+
+func (c *queueCounters) push() {
+	depth := c.depth.Add(1)
+	for {
+		max := c.maxDepth.Load()
+		if depth <= max || c.maxDepth.CompareAndSwap(max, depth) {
+			return
+		}
+	}
+}
+
+type outMsg struct {
+	ctx          context.Context
+	data         []byte
+	uncompressed bool
+	result       chan error
+}
+
+// enqueue adds the message to the queue of the priority class. If the
+// queue is full, it blocks until the configured QueueTimeout expires or
+// the context is done.
+func (sock *socket) enqueue(ctx context.Context, prio Priority, m *outMsg) error {
+	queue := sock.queues[prio]
+	counters := &queueMetrics[prio]
+	select {
+	case <-sock.done:
+		return ErrClosed
+	case queue <- m:
+		counters.push()
+		return nil
+	default:
+	}
+	var timeout <-chan time.Time
+	if sock.config.QueueTimeout < 0 {
+		counters.rejected.Add(1)
+		return api.ErrQueueFull
+	} else if sock.config.QueueTimeout > 0 {
+		timer := time.NewTimer(sock.config.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-sock.done:
+		return ErrClosed
+	case <-ctx.Done():
+		counters.rejected.Add(1)
+		return ctx.Err()
+	case queue <- m:
+		counters.push()
+		return nil
+	case <-timeout:
+		counters.rejected.Add(1)
+		return api.ErrQueueFull
+	}
+}
+
+// next returns the queued message with the highest priority. It blocks
+// until a message is queued or returns nil if the socket is closed.
+func (sock *socket) next() (*outMsg, Priority) {
+	for prio, queue := range sock.queues {
+		select {
+		case m := <-queue:
+			return m, Priority(prio)
+		default:
+		}
+	}
+	select {
+	case <-sock.done:
+		return nil, 0
+	case m := <-sock.queues[PriorityControl]:
+		return m, PriorityControl
+	case m := <-sock.queues[PriorityShell]:
+		return m, PriorityShell
+	case m := <-sock.queues[PriorityPortForward]:
+		return m, PriorityPortForward
+	case m := <-sock.queues[PriorityFileTransfer]:
+		return m, PriorityFileTransfer
+	}
+}
+
+// writer writes the queued messages in order of priority.
+func (sock *socket) writer() {
+	defer sock.drain()
+	for {
+		m, prio := sock.next()
+		if m == nil {
+			return
+		}
+		counters := &queueMetrics[prio]
+		counters.depth.Add(-1)
+		err := m.ctx.Err()
+		if err == nil {
+			err = sock.write(m)
+		}
+		if err == nil {
+			counters.sent.Add(1)
+		}
+		m.result <- err
+	}
+}
+
+// write writes the message within the write timeout. If the timeout
+// expires, the connection is considered stuck and the socket is closed.
+// The caller's context does not apply: cancelling a write in progress would
+// break the connection for everyone else, so a caller giving up only
+// abandons the wait for the result.
+func (sock *socket) write(m *outMsg) error {
+	timer := time.AfterFunc(sock.config.WriteTimeout, func() {
+		sock.term(ErrWriteDeadline)
+		_ = sock.conn.CloseNow()
+	})
+	var err error
+	if m.uncompressed {
+		err = sock.writeUncompressed(m.data)
+	} else {
+		err = sock.conn.Write(sock, websocket.MessageBinary, m.data)
+	}
+	if !timer.Stop() {
+		return ErrWriteDeadline
+	}
+	return err
+}
+
+// drain fails the messages left in the queues after closing the socket.
+func (sock *socket) drain() {
+	for prio, queue := range sock.queues {
+		for {
+			select {
+			case m := <-queue:
+				queueMetrics[prio].depth.Add(-1)
+				m.result <- ErrClosed
+				continue
+			default:
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+package ws
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/northerntechhq/nt-connect/api"
+)
+
+func newTestQueues(config Config) *socket {
+	sock := &socket{
+		done:   make(chan struct{}),
+		config: config.withDefaults(),
+	}
+	for i := range sock.queues {
+		sock.queues[i] = make(chan *outMsg, sock.config.QueueSize)
+	}
+	return sock
+}
+
+func TestMessagePriority(t *testing.T) {
+	t.Parallel()
+	testCases := map[ws.ProtoType]Priority{
+		ws.ProtoTypeControl:       PriorityControl,
+		ws.ProtoTypeShell:         PriorityShell,
+		ws.ProtoTypeMenderClient:  PriorityShell,
+		ws.ProtoTypePortForward:   PriorityPortForward,
+		ws.ProtoTypePortForwardV2: PriorityPortForward,
+		ws.ProtoTypeFileTransfer:  PriorityFileTransfer,
+	}
+	for proto, expected := range testCases {
+		assert.Equal(t, expected, MessagePriority(proto), "protocol %d", proto)
+	}
+}
+
+func TestQueuePriority(t *testing.T) {
+	t.Parallel()
+	sock := newTestQueues(Config{})
+	order := []Priority{
+		PriorityFileTransfer,
+		PriorityPortForward,
+		PriorityShell,
+		PriorityFileTransfer,
+		PriorityControl,
+	}
+	for i, prio := range order {
+		err := sock.enqueue(context.Background(), prio, &outMsg{data: []byte{byte(i)}})
+		assert.NoError(t, err)
+	}
+	var actual []byte
+	for range order {
+		m, _ := sock.next()
+		actual = append(actual, m.data[0])
+	}
+	assert.Equal(t, []byte{4, 2, 1, 0, 3}, actual,
+		"messages should be dequeued by priority and in FIFO order")
+
+	close(sock.done)
+	m, _ := sock.next()
+	assert.Nil(t, m)
+}
+
+func TestQueueFull(t *testing.T) {
+	t.Parallel()
+	testCases := map[string]struct {
+		Timeout time.Duration
+
+		MinWait time.Duration
+	}{
+		"fail fast": {
+			Timeout: -1,
+		},
+		"timeout": {
+			Timeout: time.Millisecond * 50,
+			MinWait: time.Millisecond * 50,
+		},
+	}
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			sock := newTestQueues(Config{
+				QueueSize:    1,
+				QueueTimeout: tc.Timeout,
+			})
+			rejected := queueMetrics[PriorityShell].rejected.Load()
+			err := sock.enqueue(context.Background(), PriorityShell, &outMsg{})
+			assert.NoError(t, err)
+
+			start := time.Now()
+			err = sock.enqueue(context.Background(), PriorityShell, &outMsg{})
+			assert.ErrorIs(t, err, api.ErrQueueFull)
+			assert.GreaterOrEqual(t, time.Since(start), tc.MinWait)
+			assert.Greater(t,
+				queueMetrics[PriorityShell].rejected.Load(), rejected)
+
+			// Other priority classes are not affected
+			err = sock.enqueue(context.Background(), PriorityControl, &outMsg{})
+			assert.NoError(t, err)
+
+			close(sock.done)
+			err = sock.enqueue(context.Background(), PriorityShell, &outMsg{})
+			assert.ErrorIs(t, err, ErrClosed)
+		})
+	}
+}
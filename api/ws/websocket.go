@@ -17,9 +17,11 @@ package ws
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coder/websocket"
@@ -27,6 +29,7 @@ import (
 	"github.com/vmihailenco/msgpack/v5"
 
 	"github.com/northerntechhq/nt-connect/api"
+	"github.com/northerntechhq/nt-connect/config"
 )
 
 type socket struct {
@@ -34,8 +37,13 @@ type socket struct {
 	err     error
 	done    chan struct{}
 	mu      sync.Mutex
-	writeMu sync.Mutex
 	conn    *websocket.Conn
+	config  Config
+	queues  [numPriorities]chan *outMsg
+
+	// lastRead is the time (unix nanoseconds) of the last message or pong
+	// received from the server.
+	lastRead atomic.Int64
 }
 
 func (sock *socket) ReceiveChan() <-chan ws.ProtoMsg {
@@ -45,25 +53,81 @@ func (sock *socket) ReceiveChan() <-chan ws.ProtoMsg {
 var (
 	ErrClosed       = errors.New("closed")
 	ErrPongDeadline = errors.New("deadline exceeded waiting for pong message")
+	ErrReadDeadline = errors.New("deadline exceeded waiting for messages")
+
+	ErrWriteDeadline = errors.New("deadline exceeded writing message")
 )
 
+const (
+	defaultPingInterval = time.Minute * 30
+	defaultPongTimeout  = time.Second * 10
+	dialTimeout         = time.Minute
+)
+
+// Send queues the message by priority and waits until it is written.
 func (sock *socket) Send(msg ws.ProtoMsg) error {
-	var (
-		err error
-		b   []byte
-	)
+	return sock.SendContext(context.Background(), msg)
+}
+
+// SendContext queues the message by priority and waits until it is
+// written or the context is done. A message whose context is done before
+// it is written is dropped. The write itself must complete within the
+// configured WriteTimeout; otherwise the connection is considered stuck
+// and closed.
+func (sock *socket) SendContext(ctx context.Context, msg ws.ProtoMsg) error {
 	select {
 	case <-sock.done:
 		return ErrClosed
-
 	default:
-		b, err = msgpack.Marshal(msg)
-		if err != nil {
-			return err
-		}
-		sock.writeMu.Lock()
-		defer sock.writeMu.Unlock()
-		err = sock.conn.Write(sock, websocket.MessageBinary, b)
+	}
+	b, err := msgpack.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	m := &outMsg{
+		ctx:          ctx,
+		data:         b,
+		uncompressed: sock.config.uncompressed(msg.Header.Proto),
+		result:       make(chan error, 1),
+	}
+	err = sock.enqueue(ctx, MessagePriority(msg.Header.Proto), m)
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-m.result:
+		return err
+	case <-sock.done:
+		return sock.closedErr()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closedErr returns ErrClosed wrapping the reason the socket was closed.
+func (sock *socket) closedErr() error {
+	if sock.err != nil {
+		return fmt.Errorf("%w: %w", ErrClosed, sock.err)
+	}
+	return ErrClosed
+}
+
+// writeUncompressed writes the message without compression. The websocket
+// library (github.com/coder/websocket v1.8) only compresses messages where
+// the first frame reaches the compression threshold, so the message is split
+// into an empty frame and a continuation frame. The library has no option
+// for this: TestSocketCompression checks the RSV1 bit of the frames on the
+// wire to catch a change of behavior when upgrading it.
+func (sock *socket) writeUncompressed(b []byte) error {
+	w, err := sock.conn.Writer(sock, websocket.MessageBinary)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(nil); err == nil {
+		_, err = w.Write(b)
+	}
+	if errClose := w.Close(); err == nil {
+		err = errClose
 	}
 	return err
 }
@@ -104,6 +168,7 @@ func (sock *socket) receiver() {
 			sock.term(err)
 			return
 		}
+		sock.lastRead.Store(time.Now().UnixNano())
 		select {
 		case <-sock.done:
 			return
@@ -113,32 +178,68 @@ func (sock *socket) receiver() {
 }
 
 func (sock *socket) pinger() {
-	ticker := time.NewTicker(time.Minute * 30)
+	ticker := time.NewTicker(sock.config.PingInterval)
+	defer ticker.Stop()
 	defer sock.Close()
 	for {
 		select {
 		case <-sock.done:
 			return
 		case <-ticker.C:
-			ctx, cancel := context.WithTimeout(sock, time.Second*10)
+			ctx, cancel := context.WithTimeout(sock, sock.config.PongTimeout)
 			err := sock.conn.Ping(ctx)
 			cancel()
 			if err != nil {
+				if errors.Is(err, context.DeadlineExceeded) {
+					err = ErrPongDeadline
+				}
 				sock.term(err)
 				return
 			}
+			sock.lastRead.Store(time.Now().UnixNano())
 		}
 	}
 }
 
-func newSocket(conn *websocket.Conn) (*socket, error) {
+// watchdog closes the socket if nothing is received from the server within
+// the read timeout.
+func (sock *socket) watchdog() {
+	timer := time.NewTimer(sock.config.ReadTimeout)
+	defer timer.Stop()
+	defer sock.Close()
+	for {
+		select {
+		case <-sock.done:
+			return
+		case <-timer.C:
+		}
+		idle := time.Since(time.Unix(0, sock.lastRead.Load()))
+		if idle >= sock.config.ReadTimeout {
+			sock.term(fmt.Errorf("%w: idle for %s",
+				ErrReadDeadline, idle.Round(time.Second)))
+			return
+		}
+		timer.Reset(sock.config.ReadTimeout - idle)
+	}
+}
+
+func newSocket(conn *websocket.Conn, config Config) (*socket, error) {
 	sock := &socket{
 		msgChan: make(chan ws.ProtoMsg),
 		done:    make(chan struct{}),
 		conn:    conn,
+		config:  config,
 	}
+	for i := range sock.queues {
+		sock.queues[i] = make(chan *outMsg, config.QueueSize)
+	}
+	sock.lastRead.Store(time.Now().UnixNano())
+	go sock.writer()
 	go sock.receiver()
 	go sock.pinger()
+	if config.ReadTimeout > 0 {
+		go sock.watchdog()
+	}
 	return sock, nil
 }
 
@@ -170,14 +271,132 @@ func (sock *socket) Value(key any) any {
 	return nil
 }
 
+// Config configures the websocket connection.
+type Config struct {
+	// CompressionMode is the permessage-deflate mode negotiated with the
+	// server.
+	CompressionMode websocket.CompressionMode
+	// CompressionThreshold is the minimum size in bytes of compressed
+	// messages.
+	CompressionThreshold int
+	// UncompressedProtocols are never compressed, such as file transfers
+	// which are usually compressed already.
+	UncompressedProtocols []ws.ProtoType
+
+	// PingInterval is the interval between pings (default 30m).
+	PingInterval time.Duration
+	// PongTimeout is the time to wait for a pong (default 10s).
+	PongTimeout time.Duration
+	// ReadTimeout closes the socket if nothing is received from the
+	// server, including pongs, within the timeout. Disabled if zero.
+	ReadTimeout time.Duration
+
+	// QueueSize is the capacity of the outbound queue of each priority
+	// class (default 16).
+	QueueSize int
+	// QueueTimeout is the maximum time to wait for a full outbound queue
+	// before failing with api.ErrQueueFull. Zero waits indefinitely and a
+	// negative value fails immediately.
+	QueueTimeout time.Duration
+	// WriteTimeout is the maximum time to write a message to the
+	// connection (default config.MessageWriteTimeout).
+	WriteTimeout time.Duration
+}
+
+func (cfg Config) withDefaults() Config {
+	if cfg.PingInterval <= 0 {
+		cfg.PingInterval = defaultPingInterval
+	}
+	if cfg.PongTimeout <= 0 {
+		cfg.PongTimeout = defaultPongTimeout
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultQueueSize
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = config.MessageWriteTimeout
+	}
+	return cfg
+}
+
+// uncompressed returns true if compression is enabled but the messages of
+// the protocol must not be compressed.
+func (cfg Config) uncompressed(proto ws.ProtoType) bool {
+	if cfg.CompressionMode == websocket.CompressionDisabled {
+		return false
+	}
+	for _, p := range cfg.UncompressedProtocols {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+var protoTypes = map[string]ws.ProtoType{
+	"shell":        ws.ProtoTypeShell,
+	"filetransfer": ws.ProtoTypeFileTransfer,
+	"portforward":  ws.ProtoTypePortForward,
+	"control":      ws.ProtoTypeControl,
+}
+
+// NewConfig returns the websocket configuration from the API configuration.
+func NewConfig(cfg config.WebsocketConfig) (Config, error) {
+	var ret Config
+	switch strings.ToLower(cfg.Compression) {
+	case "", "disabled":
+		ret.CompressionMode = websocket.CompressionDisabled
+	case "context-takeover":
+		ret.CompressionMode = websocket.CompressionContextTakeover
+	case "no-context-takeover":
+		ret.CompressionMode = websocket.CompressionNoContextTakeover
+	default:
+		return ret, fmt.Errorf("invalid websocket compression mode %q", cfg.Compression)
+	}
+	if cfg.CompressionThreshold < 0 {
+		return ret, fmt.Errorf(
+			"invalid websocket compression threshold: %d",
+			cfg.CompressionThreshold,
+		)
+	}
+	ret.CompressionThreshold = cfg.CompressionThreshold
+	ret.PingInterval = time.Duration(cfg.PingInterval)
+	ret.PongTimeout = time.Duration(cfg.PongTimeout)
+	ret.ReadTimeout = time.Duration(cfg.ReadTimeout)
+	if ret.PingInterval < 0 || ret.PongTimeout < 0 || ret.ReadTimeout < 0 {
+		return ret, errors.New("invalid websocket keepalive: negative duration")
+	}
+	ret.QueueSize = cfg.QueueSize
+	ret.QueueTimeout = time.Duration(cfg.QueueTimeout)
+	ret.WriteTimeout = time.Duration(cfg.WriteTimeout)
+	if ret.WriteTimeout < 0 {
+		return ret, fmt.Errorf("invalid websocket write timeout: %s", ret.WriteTimeout)
+	}
+	for _, name := range cfg.UncompressedProtocols {
+		proto, ok := protoTypes[strings.ToLower(name)]
+		if !ok {
+			return ret, fmt.Errorf("invalid protocol name %q", name)
+		}
+		ret.UncompressedProtocols = append(ret.UncompressedProtocols, proto)
+		if proto == ws.ProtoTypePortForward {
+			ret.UncompressedProtocols = append(
+				ret.UncompressedProtocols, ws.ProtoTypePortForwardV2,
+			)
+		}
+	}
+	return ret, nil
+}
+
 // Client implements only parts of the api.Client interface
 type Client struct {
 	httpClient *http.Client
+	config     Config
 }
 
-func NewClient(httpClient *http.Client) api.SocketClient {
+func NewClient(httpClient *http.Client, config Config) api.SocketClient {
 	return &Client{
 		httpClient: httpClient,
+		config:     config.withDefaults(),
 	}
 }
 
@@ -187,6 +406,8 @@ func (c *Client) OpenSocket(ctx context.Context, authz *api.Authz) (api.Socket,
 	if strings.HasPrefix(url, "http") {
 		url = strings.Replace(url, "http", "ws", 1)
 	}
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
 	//nolint: bodyclose
 	conn, rsp, err := websocket.Dial(ctx,
 		url,
@@ -195,14 +416,15 @@ func (c *Client) OpenSocket(ctx context.Context, authz *api.Authz) (api.Socket,
 				"Authorization": []string{"Bearer " + authz.Token},
 				"User-Agent":    []string{api.UserAgent()},
 			},
-			HTTPClient: c.httpClient,
+			HTTPClient:           c.httpClient,
+			CompressionMode:      c.config.CompressionMode,
+			CompressionThreshold: c.config.CompressionThreshold,
 		},
 	)
-	if err != nil {
+	if rsp != nil && rsp.StatusCode >= 300 {
+		return nil, api.NewError(rsp)
+	} else if err != nil {
 		return nil, err
 	}
-	if rsp.StatusCode >= 300 {
-		return nil, &api.Error{Code: rsp.StatusCode}
-	}
-	return newSocket(conn)
+	return newSocket(conn, c.config)
 }
@@ -0,0 +1,430 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+package ws
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/northerntechhq/nt-connect/api"
+	"github.com/northerntechhq/nt-connect/config"
+)
+
+func TestNewConfig(t *testing.T) {
+	t.Parallel()
+	testCases := map[string]struct {
+		Config config.WebsocketConfig
+
+		Expected Config
+		Error    string
+	}{
+		"ok/default": {},
+		"ok/compression": {
+			Config: config.WebsocketConfig{
+				Compression:           "context-takeover",
+				CompressionThreshold:  256,
+				UncompressedProtocols: []string{"filetransfer", "PortForward"},
+			},
+			Expected: Config{
+				CompressionMode:      websocket.CompressionContextTakeover,
+				CompressionThreshold: 256,
+				UncompressedProtocols: []ws.ProtoType{
+					ws.ProtoTypeFileTransfer,
+					ws.ProtoTypePortForward,
+					ws.ProtoTypePortForwardV2,
+				},
+			},
+		},
+		"error/mode": {
+			Config: config.WebsocketConfig{Compression: "gzip"},
+			Error:  `invalid websocket compression mode "gzip"`,
+		},
+		"error/threshold": {
+			Config: config.WebsocketConfig{CompressionThreshold: -1},
+			Error:  "invalid websocket compression threshold",
+		},
+		"error/write timeout": {
+			Config: config.WebsocketConfig{WriteTimeout: -1},
+			Error:  "invalid websocket write timeout",
+		},
+		"error/protocol": {
+			Config: config.WebsocketConfig{UncompressedProtocols: []string{"vnc"}},
+			Error:  `invalid protocol name "vnc"`,
+		},
+	}
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			actual, err := NewConfig(tc.Config)
+			if tc.Error != "" {
+				assert.ErrorContains(t, err, tc.Error)
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tc.Expected, actual)
+			}
+		})
+	}
+}
+
+// recordingConn records the bytes read by the server to inspect the
+// frames written by the client.
+type recordingConn struct {
+	net.Conn
+	l *recordingListener
+}
+
+func (c recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.l.mu.Lock()
+	c.l.buf = append(c.l.buf, b[:n]...)
+	c.l.mu.Unlock()
+	return n, err
+}
+
+type recordingListener struct {
+	net.Listener
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (l *recordingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return recordingConn{Conn: conn, l: l}, nil
+}
+
+func (l *recordingListener) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buf)
+}
+
+type frameHeader struct {
+	Fin    bool
+	RSV1   bool
+	Opcode byte
+}
+
+// Frames parses the headers of the client frames recorded from offset,
+// which must be the start of a frame.
+func (l *recordingListener) Frames(t *testing.T, offset int) []frameHeader {
+	l.mu.Lock()
+	b := l.buf[offset:]
+	l.mu.Unlock()
+	var frames []frameHeader
+	for len(b) > 0 {
+		if !assert.GreaterOrEqual(t, len(b), 2, "truncated frame") {
+			return frames
+		}
+		frames = append(frames, frameHeader{
+			Fin:    b[0]&0x80 != 0,
+			RSV1:   b[0]&0x40 != 0,
+			Opcode: b[0] & 0x0f,
+		})
+		n, size := uint64(b[1]&0x7f), 2
+		switch n {
+		case 126:
+			n, size = uint64(binary.BigEndian.Uint16(b[2:])), 4
+		case 127:
+			n, size = binary.BigEndian.Uint64(b[2:]), 10
+		}
+		if b[1]&0x80 != 0 {
+			// Masking key
+			size += 4
+		}
+		if !assert.LessOrEqual(t, uint64(size)+n, uint64(len(b)), "truncated frame") {
+			return frames
+		}
+		b = b[uint64(size)+n:]
+	}
+	return frames
+}
+
+func TestSocketCompression(t *testing.T) {
+	t.Parallel()
+	received := make(chan ws.ProtoMsg, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+				CompressionMode: websocket.CompressionContextTakeover,
+			})
+			if err != nil {
+				return
+			}
+			defer conn.CloseNow()
+			conn.SetReadLimit(1024 * 1024)
+			for {
+				_, b, err := conn.Read(r.Context())
+				if err != nil {
+					return
+				}
+				var msg ws.ProtoMsg
+				if err = msgpack.Unmarshal(b, &msg); err != nil {
+					t.Error(err)
+					return
+				}
+				received <- msg
+			}
+		},
+	))
+	listener := &recordingListener{Listener: srv.Listener}
+	srv.Listener = listener
+	srv.Start()
+	defer srv.Close()
+
+	client := NewClient(srv.Client(), Config{
+		CompressionMode:       websocket.CompressionContextTakeover,
+		UncompressedProtocols: []ws.ProtoType{ws.ProtoTypeFileTransfer},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	sock, err := client.OpenSocket(ctx, &api.Authz{
+		ServerURL: srv.URL,
+		Token:     "token",
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer sock.Close()
+
+	body := make([]byte, 64*1024)
+	send := func(proto ws.ProtoType) (int, []frameHeader) {
+		start := listener.Len()
+		err := sock.Send(ws.ProtoMsg{
+			Header: ws.ProtoHdr{Proto: proto, MsgType: "test"},
+			Body:   body,
+		})
+		assert.NoError(t, err)
+		select {
+		case msg := <-received:
+			assert.Equal(t, proto, msg.Header.Proto)
+			assert.Equal(t, body, msg.Body)
+		case <-ctx.Done():
+			t.Fatal("timeout waiting for message")
+		}
+		return listener.Len() - start, listener.Frames(t, start)
+	}
+	// The uncompressed messages rely on the websocket library only
+	// compressing a message if its first frame reaches the threshold:
+	// the RSV1 bit of the first frame marks compressed messages.
+	n, frames := send(ws.ProtoTypeShell)
+	assert.Less(t, n, len(body)/10, "shell messages should be compressed")
+	if assert.NotEmpty(t, frames) {
+		assert.Equal(t, byte(websocket.MessageBinary), frames[0].Opcode)
+		assert.True(t, frames[0].RSV1, "shell messages should be compressed")
+		assert.True(t, frames[len(frames)-1].Fin)
+	}
+	n, frames = send(ws.ProtoTypeFileTransfer)
+	assert.Greater(t, n, len(body), "file transfer messages should not be compressed")
+	if assert.NotEmpty(t, frames) {
+		assert.Equal(t, byte(websocket.MessageBinary), frames[0].Opcode)
+		assert.True(t, frames[len(frames)-1].Fin)
+	}
+	for _, frame := range frames {
+		assert.False(t, frame.RSV1, "file transfer messages should not be compressed")
+	}
+}
+
+func TestSocketKeepalive(t *testing.T) {
+	t.Parallel()
+	testCases := map[string]struct {
+		Config Config
+		// Respond replies to pings from the client
+		Respond bool
+
+		Error error
+	}{
+		"pong timeout": {
+			Config: Config{
+				PingInterval: time.Millisecond * 50,
+				PongTimeout:  time.Millisecond * 50,
+			},
+			Error: ErrPongDeadline,
+		},
+		"read timeout": {
+			Config: Config{
+				PingInterval: time.Hour,
+				ReadTimeout:  time.Millisecond * 100,
+			},
+			Respond: true,
+			Error:   ErrReadDeadline,
+		},
+		"pongs reset read timeout": {
+			Config: Config{
+				PingInterval: time.Millisecond * 20,
+				ReadTimeout:  time.Millisecond * 150,
+			},
+			Respond: true,
+		},
+	}
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			srv := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					conn, err := websocket.Accept(w, r, nil)
+					if err != nil {
+						return
+					}
+					defer conn.CloseNow()
+					if tc.Respond {
+						// Reading handles the control frames
+						_, _, _ = conn.Read(r.Context())
+					} else {
+						<-r.Context().Done()
+					}
+				},
+			))
+			defer srv.Close()
+
+			client := NewClient(srv.Client(), tc.Config)
+			sock, err := client.OpenSocket(context.Background(), &api.Authz{
+				ServerURL: srv.URL,
+				Token:     "token",
+			})
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer sock.Close()
+			select {
+			case _, open := <-sock.ReceiveChan():
+				assert.False(t, open)
+				if assert.NotNil(t, tc.Error, "unexpected error: %v", sock.Err()) {
+					assert.ErrorIs(t, sock.Err(), tc.Error)
+				}
+			case <-time.After(time.Millisecond * 500):
+				assert.Nil(t, tc.Error, "timeout waiting for socket to close")
+			}
+		})
+	}
+}
+
+func TestSocketSendContext(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			conn, err := websocket.Accept(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.CloseNow()
+			// Never read: the client eventually stalls on a full
+			// connection.
+			<-r.Context().Done()
+		},
+	))
+	defer srv.Close()
+
+	client := NewClient(srv.Client(), Config{
+		WriteTimeout: time.Millisecond * 100,
+	})
+	sock, err := client.OpenSocket(context.Background(), &api.Authz{
+		ServerURL: srv.URL,
+		Token:     "token",
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer sock.Close()
+
+	msg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{Proto: ws.ProtoTypeShell, MsgType: "test"},
+		Body:   make([]byte, 1024*1024),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = sock.SendContext(ctx, msg)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	for i := 0; i < 256; i++ {
+		if err = sock.Send(msg); err != nil {
+			break
+		}
+	}
+	assert.ErrorIs(t, err, ErrWriteDeadline)
+	select {
+	case _, open := <-sock.ReceiveChan():
+		assert.False(t, open)
+		assert.ErrorIs(t, sock.Err(), ErrWriteDeadline)
+	case <-time.After(time.Second):
+		t.Error("timeout waiting for socket to close")
+	}
+	assert.ErrorIs(t, sock.Send(msg), ErrClosed)
+}
+
+func TestSocketSendDeadline(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			conn, err := websocket.Accept(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.CloseNow()
+			<-r.Context().Done()
+		},
+	))
+	defer srv.Close()
+
+	client := NewClient(srv.Client(), Config{
+		WriteTimeout: time.Millisecond * 500,
+	})
+	sock, err := client.OpenSocket(context.Background(), &api.Authz{
+		ServerURL: srv.URL,
+		Token:     "token",
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer sock.Close()
+
+	msg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{Proto: ws.ProtoTypeShell, MsgType: "test"},
+		Body:   make([]byte, 1024*1024),
+	}
+	for i := 0; i < 256; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+		err = sock.SendContext(ctx, msg)
+		cancel()
+		if err != nil {
+			break
+		}
+	}
+	// The caller's deadline only fails its own message
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NoError(t, sock.Err())
+
+	select {
+	case _, open := <-sock.ReceiveChan():
+		assert.False(t, open)
+		assert.ErrorIs(t, sock.Err(), ErrWriteDeadline)
+	case <-time.After(time.Second * 5):
+		t.Error("timeout waiting for socket to close")
+	}
+}
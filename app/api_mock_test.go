@@ -49,6 +49,17 @@ func (s *SocketMock) Send(msg ws.ProtoMsg) error {
 	return nil
 }
 
+func (s *SocketMock) SendContext(ctx context.Context, msg ws.ProtoMsg) error {
+	select {
+	case s.SendChan <- msg:
+	case <-s.closed:
+		return io.ErrClosedPipe
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
 func (s *SocketMock) ReceiveChan() <-chan ws.ProtoMsg {
 	return s.RecvChan
 }
@@ -122,6 +133,20 @@ func (_m *Client) OpenSocket(ctx context.Context, authz *api.Authz) (api.Socket,
 	return r0, r1
 }
 
+// PatchInventory provides a mock function with given fields: ctx, authz, inv
+func (_m *Client) PatchInventory(ctx context.Context, authz *api.Authz, inv api.Inventory) error {
+	ret := _m.Called(ctx, authz, inv)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *api.Authz, api.Inventory) error); ok {
+		r0 = rf(ctx, authz, inv)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // SendInventory provides a mock function with given fields: ctx, authz, inv
 func (_m *Client) SendInventory(ctx context.Context, authz *api.Authz, inv api.Inventory) error {
 	ret := _m.Called(ctx, authz, inv)
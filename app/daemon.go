@@ -14,17 +14,17 @@
 package app
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"fmt"
 	"os"
-	"os/exec"
 	"os/signal"
 	"os/user"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -37,22 +37,38 @@ import (
 
 	"github.com/northerntechhq/nt-connect/api"
 	apihttp "github.com/northerntechhq/nt-connect/api/http"
+	apiws "github.com/northerntechhq/nt-connect/api/ws"
 	"github.com/northerntechhq/nt-connect/config"
+	"github.com/northerntechhq/nt-connect/inventory"
 	"github.com/northerntechhq/nt-connect/limits/filetransfer"
 	"github.com/northerntechhq/nt-connect/session"
+	cryptoutils "github.com/northerntechhq/nt-connect/utils/crypto"
+	"github.com/northerntechhq/nt-connect/utils/systemd"
 )
 
 type Daemon struct {
 	spawnedShellsMutex      sync.Mutex
 	done                    chan struct{}
 	signal                  chan os.Signal
+	drained                 <-chan struct{}
 	username                string
+	shellUsers              config.ShellUsersConfig
+	policy                  session.Policy
 	shellCommand            string
 	shellArguments          []string
 	sessionSweepTicker      <-chan time.Time
 	inventoryTicker         <-chan time.Time
-	inventoryDigest         []byte
 	inventoryExecutable     string
+	inventoryCollectors     []inventory.Collector
+	inventoryScriptOptions  inventory.ScriptOptions
+	inventoryRefresh        chan struct{}
+	inventoryDebounce       time.Duration
+	inventoryMutex          sync.Mutex
+	inventoryState          *inventoryState
+	inventoryCachePath      string
+	inventoryFullInterval   time.Duration
+	inventorySpool          *inventory.Spool
+	inventoryTimeSeries     bool
 	expireSessionsAfter     time.Duration
 	expireSessionsAfterIdle time.Duration
 	terminalString          string
@@ -64,6 +80,25 @@ type Daemon struct {
 	trace                   bool
 	router                  session.Router
 	apiClient               api.Client
+	failover                *api.FailoverClient
+	primaryRetryTicker      <-chan time.Time
+	sessionGate             sessionGate
+	sessionWatchTicker      <-chan time.Time
+	sessions                map[string]struct{}
+	observer                sessionObserver
+	controlChan             chan func(sock api.Sender)
+	connected               atomic.Bool
+	shutdownGracePeriod     time.Duration
+	notifier                *systemd.Notifier
+	readyOnce               sync.Once
+	startupTimeout          time.Duration
+	startupTimer            <-chan time.Time
+	watchdogTicker          <-chan time.Time
+	watchdogTimeout         time.Duration
+	// The server URL and the status notified to systemd are owned by
+	// the message loop.
+	serverURL string
+	status    string
 	config.TerminalConfig
 	config.FileTransferConfig
 	config.PortForwardConfig
@@ -85,29 +120,61 @@ func newDaemon(conf *config.NTConnectConfig) *Daemon {
 		routes[ws.ProtoTypePortForward] = session.PortForward()
 		routes[ws.ProtoTypePortForwardV2] = session.PortForwardV2()
 	}
+	policy := session.NewPolicy(conf.Authorization)
 	router := session.NewRouter(
 		routes, session.Config{
 			IdleTimeout: time.Second * 10,
+			Policy:      policy,
 		},
 	)
 
 	daemon := &Daemon{
 		done:                    make(chan struct{}),
 		username:                conf.User,
+		shellUsers:              conf.ShellUsers,
+		policy:                  policy,
 		shellCommand:            conf.ShellCommand,
 		shellArguments:          conf.ShellArguments,
 		expireSessionsAfter:     time.Second * time.Duration(conf.Sessions.ExpireAfter),
 		expireSessionsAfterIdle: time.Second * time.Duration(conf.Sessions.ExpireAfterIdle),
 		inventoryExecutable:     conf.APIConfig.InventoryExecutable,
-		terminalString:          config.DefaultTerminalString,
-		TerminalConfig:          conf.Terminal,
-		FileTransferConfig:      conf.FileTransfer,
-		PortForwardConfig:       conf.PortForward,
-		Chroot:                  conf.Chroot,
-		shellsSpawned:           0,
-		debug:                   conf.Debug,
-		trace:                   conf.Trace,
-		router:                  router,
+		inventoryScriptOptions: inventory.ScriptOptions{
+			Timeout:    time.Duration(conf.APIConfig.InventoryScriptTimeout),
+			MaxOutput:  conf.APIConfig.InventoryScriptMaxOutput,
+			PrefixKeys: conf.APIConfig.InventoryScriptPrefixKeys,
+		},
+		inventoryRefresh:      make(chan struct{}, 1),
+		inventoryDebounce:     config.DefaultInventoryDebounce,
+		inventoryCachePath:    conf.APIConfig.InventoryCachePath,
+		inventoryFullInterval: time.Duration(conf.APIConfig.InventoryFullInterval),
+		terminalString:        config.DefaultTerminalString,
+		TerminalConfig:        conf.Terminal,
+		FileTransferConfig:    conf.FileTransfer,
+		PortForwardConfig:     conf.PortForward,
+		Chroot:                conf.Chroot,
+		shellsSpawned:         0,
+		debug:                 conf.Debug,
+		trace:                 conf.Trace,
+		router:                router,
+		controlChan:           make(chan func(sock api.Sender)),
+		shutdownGracePeriod:   time.Duration(conf.ShutdownGracePeriod),
+		startupTimeout:        time.Duration(conf.StartupTimeout),
+	}
+	if daemon.shutdownGracePeriod == 0 {
+		daemon.shutdownGracePeriod = config.DefaultShutdownGracePeriod
+	}
+	if daemon.startupTimeout <= 0 {
+		daemon.startupTimeout = config.DefaultStartupTimeout
+	}
+	if daemon.inventoryFullInterval <= 0 {
+		daemon.inventoryFullInterval = config.DefaultInventoryFullInterval
+	}
+	if spool := conf.APIConfig.InventorySpool; spool.Path != "" {
+		daemon.inventorySpool = inventory.NewSpool(spool.Path, inventory.SpoolOptions{
+			MaxSnapshots: spool.MaxSnapshots,
+			MaxSize:      spool.MaxSize,
+		})
+		daemon.inventoryTimeSeries = spool.TimeSeries
 	}
 	sweepPeriod := daemon.expireSessionsAfter
 	if 0 > daemon.expireSessionsAfterIdle && sweepPeriod > daemon.expireSessionsAfterIdle {
@@ -153,32 +220,149 @@ func NewDaemon(conf *config.NTConnectConfig) (*Daemon, error) {
 			shellCommand, conf.Chroot)
 	}
 
-	var err error
+	tlsConfig, err := conf.TLS.ToStdConfig(conf.APIConfig.GetPrivateKey())
+	if err != nil {
+		return nil, err
+	}
+	daemon.inventoryCollectors, err = inventory.New(
+		conf.APIConfig.InventoryCollectors,
+		inventory.Options{Features: enabledFeatures(conf)},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if conf.APIConfig.InventoryDirectory != "" {
+		daemon.inventoryCollectors = append(daemon.inventoryCollectors,
+			inventory.NewScriptDir(
+				conf.APIConfig.InventoryDirectory, daemon.inventoryScriptOptions,
+			),
+		)
+	}
 	switch conf.APIConfig.APIType {
 	case config.APITypeHTTP:
-		var tlsConfig *tls.Config
-		tlsConfig, err = conf.TLS.ToStdConfig()
-		if err != nil {
-			return nil, err
-		}
-		daemon.apiClient, err = apihttp.NewClient(conf.APIConfig, tlsConfig)
-		daemon.inventoryTicker = time.NewTicker(
-			time.Duration(conf.APIConfig.InventoryInterval),
-		).C
+		err = daemon.initHTTPClient(conf, tlsConfig)
 	case config.APITypeDBus:
-		daemon.apiClient, err = getDBUSClient(daemon.done)
+		var wsConfig apiws.Config
+		wsConfig, err = apiws.NewConfig(conf.APIConfig.Websocket)
+		if err == nil {
+			daemon.apiClient, err = getDBUSClient(
+				daemon.done, tlsConfig, wsConfig, conf.APIConfig.DBusInventory,
+			)
+		}
+		if !conf.APIConfig.DBusInventory.Enabled() {
+			// Inventory is managed by the client owning the
+			// Authentication Manager
+			daemon.inventoryExecutable = ""
+			daemon.inventoryCollectors = nil
+		}
 	default:
 		return nil, fmt.Errorf("invalid API config: unknown type %q", conf.APIConfig.APIType)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize API client: %w", err)
 	}
+	if daemon.inventoryEnabled() {
+		daemon.inventoryTicker = time.NewTicker(
+			time.Duration(conf.APIConfig.InventoryInterval),
+		).C
+		daemon.startInventoryTriggers(conf.APIConfig.InventoryTriggers)
+	}
+
+	daemon.initSystemd()
+	if !conf.DBusService.Disable {
+		if err = startDBusService(daemon); err != nil {
+			log.Warnf("local D-Bus service not available: %s", err.Error())
+		}
+	}
+	if conf.ControlSocket != "" {
+		if err = daemon.listenControl(conf.ControlSocket); err != nil {
+			log.Warnf("control socket not available: %s", err.Error())
+		}
+	}
 
-	daemon.apiClient = api.ExpBackoff(daemon.apiClient)
+	backoff := conf.APIConfig.Backoff
+	daemon.apiClient = api.NewExpBackoff(daemon.apiClient, api.BackoffConfig{
+		MinInterval: time.Duration(backoff.MinInterval),
+		MaxInterval: time.Duration(backoff.MaxInterval),
+		Jitter:      time.Duration(backoff.Jitter),
+
+		CircuitThreshold: backoff.CircuitThreshold,
+		CircuitCooldown:  time.Duration(backoff.CircuitCooldown),
+	})
 
 	return daemon, nil
 }
 
+func newHTTPEndpoint(
+	conf *config.NTConnectConfig,
+	server config.ServerConfig,
+	tlsConfig *tls.Config,
+	cachePath string,
+) (api.Endpoint, error) {
+	apiConfig := conf.APIConfig
+	apiConfig.ServerURL = server.ServerURL
+	if server.CACertificate != "" {
+		certs, err := cryptoutils.LoadCertificates(server.CACertificate)
+		if err != nil {
+			return api.Endpoint{}, fmt.Errorf(
+				"failed to load CACertificate for %q: %w", server.ServerURL, err,
+			)
+		}
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.RootCAs = certs
+	}
+	client, err := apihttp.NewClient(apiConfig, tlsConfig)
+	if err != nil {
+		return api.Endpoint{}, err
+	}
+	identity := *client.Identity
+	identity.TenantToken = server.TenantToken
+	client.Identity = &identity
+
+	serverURL := strings.TrimRight(server.ServerURL, "/")
+	endpoint := api.Endpoint{
+		Client:    client,
+		ServerURL: serverURL,
+	}
+	if cachePath != "" {
+		endpoint.Client = api.CachedAuthz(client, cachePath, serverURL, &identity)
+	}
+	return endpoint, nil
+}
+
+func (d *Daemon) initHTTPClient(conf *config.NTConnectConfig, tlsConfig *tls.Config) error {
+	servers := conf.APIConfig.GetServers()
+	cachePaths := conf.APIConfig.AuthzCachePaths()
+	endpoints := make([]api.Endpoint, len(servers))
+	for i, server := range servers {
+		var cachePath string
+		if cachePaths != nil {
+			cachePath = cachePaths[i]
+		}
+		endpoint, err := newHTTPEndpoint(conf, server, tlsConfig, cachePath)
+		if err != nil {
+			return err
+		}
+		endpoints[i] = endpoint
+	}
+	if len(endpoints) == 1 {
+		d.apiClient = endpoints[0].Client
+		return nil
+	}
+	failover, err := api.NewFailoverClient(endpoints, conf.APIConfig.FailoverAttempts)
+	if err != nil {
+		return err
+	}
+	retryInterval := time.Duration(conf.APIConfig.PrimaryRetryInterval)
+	if retryInterval <= 0 {
+		retryInterval = config.DefaultPrimaryRetryInterval
+	}
+	d.failover = failover
+	d.primaryRetryTicker = time.NewTicker(retryInterval).C
+	d.apiClient = failover
+	return nil
+}
+
 func (d *Daemon) StopDaemon() {
 	select {
 	case <-d.done:
@@ -190,6 +374,17 @@ func (d *Daemon) StopDaemon() {
 func (d *Daemon) outputStatus() {
 	log.Infof("nt-connect daemon v%s", api.VersionString())
 	log.Info(" status: ")
+	if d.failover != nil {
+		i, serverURL := d.failover.Active()
+		log.Infof("  server: %s (endpoint %d)", serverURL, i)
+	}
+	if bc, ok := d.apiClient.(api.BackoffClient); ok {
+		log.Info("  api:")
+		for _, op := range api.Operations {
+			state := bc.State(op)
+			log.Infof("   %s: circuit:%s failures:%d", op, state.Circuit, state.Failures)
+		}
+	}
 	d.spawnedShellsMutex.Lock()
 	log.Infof("  shells: %d/%d", d.shellsSpawned, config.MaxShellsSpawned)
 	d.spawnedShellsMutex.Unlock()
@@ -201,23 +396,62 @@ func (d *Daemon) outputStatus() {
 		log.Infof("   expires:%s active:%s", s.GetExpiresAtFmt(), s.GetActiveAtFmt())
 		log.Infof("   shell:%s", s.GetShellCommandPath())
 	}
+	log.Info("  outbound queue:")
+	for _, stats := range apiws.GetQueueStats() {
+		log.Infof("   %s: depth %d (max %d) sent %d rejected %d",
+			stats.Priority, stats.Depth, stats.MaxDepth, stats.Sent, stats.Rejected)
+	}
 	log.Info("  file-transfer:")
 	tx, rx, tx1m, rx1m := filetransfer.GetCounters()
 	log.Infof("   total: tx/rx %d/%d", tx, rx)
 	log.Infof("   1m: tx rx %.2f %.2f (w)", tx1m, rx1m)
 }
 
-func (d *Daemon) handleSignal(sig os.Signal) error {
+// handleSignal handles the signal. On termination, the sessions are drained
+// in the background for the main loop to keep serving the watchdog, and the
+// returned channel is closed once they are. Further termination signals
+// return the same channel instead of starting another drain.
+func (d *Daemon) handleSignal(sig os.Signal) <-chan struct{} {
 	sig.Signal()
 	switch sig {
 	case unix.SIGINT, unix.SIGTERM:
-		return fmt.Errorf("terminated by signal: %s", sig)
+		if d.drained != nil {
+			log.Infof("received %s while draining the sessions", sig)
+			return d.drained
+		}
+		d.notifySystemd(systemd.Stopping, systemd.Status("Draining sessions"))
+		drained := make(chan struct{})
+		go func() {
+			defer close(drained)
+			d.drain(shutdownReason)
+		}()
+		d.drained = drained
+		return drained
 	case unix.SIGUSR1:
 		d.outputStatus()
 	}
 	return nil
 }
 
+// waitCircuit waits until the circuit breaker of the operation lets the
+// next request through.
+func (d *Daemon) waitCircuit(ctx context.Context, op api.Operation) error {
+	wait := time.Second
+	if bc, ok := d.apiClient.(api.BackoffClient); ok {
+		if until := time.Until(bc.State(op).NextAttempt); until > wait {
+			wait = until
+		}
+	}
+	log.Infof("circuit breaker open for %s: retrying in %s",
+		op, wait.Round(time.Second))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+	}
+	return nil
+}
+
 func (d *Daemon) connect(ctx context.Context, authz *api.Authz) (api.Socket, *api.Authz, error) {
 	var (
 		sock           api.Socket
@@ -229,8 +463,8 @@ func (d *Daemon) connect(ctx context.Context, authz *api.Authz) (api.Socket, *ap
 		logReauthorize = func() {
 			i++
 			const durationResolution = time.Millisecond * 10
-			nextAttempt, attempt := bc.NextAttempt()
-			until := time.Until(nextAttempt).
+			state := bc.State(api.OperationAuthenticate)
+			until := time.Until(state.NextAttempt).
 				Round(durationResolution)
 			var durationStr string
 			if until < 0 {
@@ -238,7 +472,7 @@ func (d *Daemon) connect(ctx context.Context, authz *api.Authz) (api.Socket, *ap
 			} else {
 				durationStr = until.String()
 			}
-			log.Infof("attempting to reauthorize %s: attempt %d", durationStr, attempt)
+			log.Infof("attempting to reauthorize %s: attempt %d", durationStr, state.Attempt)
 		}
 	} else {
 		logReauthorize = func() {
@@ -251,7 +485,12 @@ func (d *Daemon) connect(ctx context.Context, authz *api.Authz) (api.Socket, *ap
 			log.Infof("client not authorized: sending authorization request")
 			for {
 				authz, err = d.apiClient.Authenticate(ctx)
-				if err != nil {
+				if errors.Is(err, api.ErrCircuitOpen) {
+					if err = d.waitCircuit(ctx, api.OperationAuthenticate); err != nil {
+						return nil, nil, err
+					}
+					continue
+				} else if err != nil {
 					log.Infof("authorization request failed: %s", err.Error())
 					if api.IsRetryable(err) {
 						logReauthorize()
@@ -265,11 +504,21 @@ func (d *Daemon) connect(ctx context.Context, authz *api.Authz) (api.Socket, *ap
 		} else {
 			sock, err = d.apiClient.OpenSocket(ctx, authz)
 		}
-		if err != nil && !api.IsRetryable(err) {
+		if err == nil {
+			break
+		} else if errors.Is(err, api.ErrCircuitOpen) {
+			if err = d.waitCircuit(ctx, api.OperationOpenSocket); err != nil {
+				return nil, nil, err
+			}
+			continue
+		} else if ctx.Err() != nil || (!api.IsRetryable(err) && d.failover == nil) {
 			log.Errorf("failed to establish socket connection: %s", err.Error())
 			return nil, nil, err
 		}
-		break
+		log.Infof("failed to establish socket connection: %s", err.Error())
+		if !api.IsUnauthorized(err) {
+			logReauthorize()
+		}
 	}
 	log.Infof("connection established with %q", authz.ServerURL)
 	return sock, authz, err
@@ -288,6 +537,10 @@ func (d *Daemon) mainLoop() (err error) {
 		err = d.messageLoop(ctx)
 		d.StopDaemon()
 	}()
+	var (
+		drained    <-chan struct{}
+		stopSignal os.Signal
+	)
 	for {
 		select {
 		case <-d.done:
@@ -295,83 +548,326 @@ func (d *Daemon) mainLoop() (err error) {
 			return err
 
 		case sig := <-d.signal:
-			if err := d.handleSignal(sig); err != nil {
-				return err
+			if ch := d.handleSignal(sig); ch != nil && drained == nil {
+				drained, stopSignal = ch, sig
 			}
+		case <-drained:
+			return fmt.Errorf("terminated by signal: %s", stopSignal)
+
 		case <-d.sessionSweepTicker:
 			d.handleExpiredSessions()
+
+		case <-d.watchdogTicker:
+			d.notifyWatchdog()
+
+		case <-d.startupTimer:
+			d.notifyStartupTimeout()
 		}
 	}
 }
 
-type logFunc func(s string)
+// enabledFeatures returns the names of the enabled nt-connect features.
+func enabledFeatures(conf *config.NTConnectConfig) []string {
+	var features []string
+	if !conf.Terminal.Disable {
+		features = append(features, "terminal")
+	}
+	if !conf.FileTransfer.Disable {
+		features = append(features, "filetransfer")
+	}
+	if !conf.PortForward.Disable {
+		features = append(features, "portforward")
+	}
+	return features
+}
 
-func (l logFunc) Write(b []byte) (int, error) {
-	l(string(b))
-	return len(b), nil
+func (d *Daemon) inventoryEnabled() bool {
+	return d.inventoryExecutable != "" || len(d.inventoryCollectors) > 0
 }
 
-func (d *Daemon) dispatchInventory(ctx context.Context, authz *api.Authz) (err error) {
-	log.Debug("running inventory script")
-	//nolint:gosec // Ignore G204 since the script is meant to be configurable
-	cmd := exec.CommandContext(ctx, d.inventoryExecutable)
-	var buf bytes.Buffer
-	logger := func(s string) {
-		log.Errorf("stderr: %s", s)
+// collectInventory merges the attributes from the built-in collectors, the
+// inventory directory and the inventory script. The script takes
+// precedence.
+func (d *Daemon) collectInventory(ctx context.Context) (api.Inventory, error) {
+	inv := make(api.Inventory)
+	for _, collector := range d.inventoryCollectors {
+		attrs, err := collector.Collect(ctx)
+		if err != nil {
+			log.Warnf("inventory collector %q failed: %s", collector.Name(), err.Error())
+			continue
+		}
+		inv.Merge(attrs)
+	}
+	if d.inventoryExecutable == "" {
+		return inv, nil
 	}
-	cmd.Stdout = &buf
-	cmd.Stderr = logFunc(logger)
 
-	err = cmd.Run()
+	// Unlike the scripts of the inventory directory, the inventory script
+	// is required: sending the attributes read until it failed would
+	// replace the complete inventory on the server.
+	attrs, err := inventory.RunScript(ctx, d.inventoryExecutable, d.inventoryScriptOptions)
 	if err != nil {
 		log.Errorf("error collecting inventory: %s", err.Error())
-		return
+		return nil, err
 	}
-	inventory, err := api.NewInventoryFromStream(&buf)
-	if err != nil {
-		log.Errorf("failed to parse inventory data: %s", err)
-		return
+	inv.Merge(attrs)
+	return inv, nil
+}
+
+func (d *Daemon) dispatchInventory(ctx context.Context, authz *api.Authz) (err error) {
+	if !d.inventoryEnabled() {
+		return nil
 	}
-	dgst := inventory.Digest()
-	if bytes.Equal(d.inventoryDigest, dgst) {
+	collected, err := d.collectInventory(ctx)
+	snapshots := d.spooledInventory()
+	spooled := err != nil
+	if spooled {
+		if len(snapshots) == 0 {
+			return err
+		}
+		log.Warn("sending the latest spooled inventory")
+		collected = snapshots[len(snapshots)-1].Inventory
+	}
+	d.inventoryMutex.Lock()
+	defer d.inventoryMutex.Unlock()
+	state := d.loadInventoryState()
+	inv := make(api.Inventory, len(collected))
+	inv.Merge(collected)
+	// The time-series attributes describe the last period spent offline
+	// until the next one.
+	timeSeries := state.TimeSeries
+	if len(snapshots) > 0 {
+		timeSeries = inventory.TimeSeries(snapshots)
+	}
+	if d.inventoryTimeSeries {
+		inv.Merge(timeSeries)
+	}
+	// Removed attributes require a complete update, since a patch only
+	// adds or replaces attributes. So does another server or device, which
+	// does not know the inventory.
+	changed, removed := inv.Diff(state.Digests)
+	full := len(removed) > 0 ||
+		state.ServerURL != authz.ServerURL ||
+		state.DeviceID != authz.Subject() ||
+		time.Since(state.UpdatedAt) >= d.inventoryFullInterval
+	if !full && len(changed) == 0 {
 		log.Debug("inventory did not change since last time")
-	} else {
-		err = d.apiClient.SendInventory(ctx, authz, inventory)
-		if err != nil {
-			log.Errorf("failed to submit inventory: %s", err.Error())
-		} else {
-			log.Debugf("inventory submitted: signature \"0x%x\"", dgst)
-			d.inventoryDigest = dgst
+		return nil
+	}
+	if !full {
+		authz, err = d.submitInventory(ctx, authz, d.apiClient.PatchInventory, changed)
+		if errors.Is(err, api.ErrPatchNotSupported) {
+			full = true
+		} else if err != nil && ctx.Err() == nil {
+			log.Warnf("failed to patch inventory: %s: sending the complete inventory",
+				err.Error())
+			full = true
+		} else if err == nil {
+			log.Debugf("inventory patched: %d attributes changed", len(changed))
 		}
 	}
-	return err
+	if full {
+		authz, err = d.submitInventory(ctx, authz, d.apiClient.SendInventory, inv)
+		if err == nil {
+			log.Debugf("inventory submitted: signature \"0x%x\"", inv.Digest())
+			state.ServerURL = authz.ServerURL
+			state.DeviceID = authz.Subject()
+			state.UpdatedAt = time.Now()
+		}
+	}
+	if err != nil {
+		log.Errorf("failed to submit inventory: %s", err.Error())
+		if ctx.Err() == nil && !spooled {
+			d.spoolInventory(collected)
+		}
+		return err
+	}
+	if len(snapshots) > 0 {
+		if clearErr := d.inventorySpool.Clear(); clearErr != nil {
+			log.Warnf("failed to clear the inventory spool: %s", clearErr.Error())
+		}
+	}
+	state.Digests = inv.Digests()
+	state.TimeSeries = timeSeries
+	d.storeInventoryState(state)
+	return nil
+}
+
+// submitInventory submits the inventory with the client method, renewing
+// the token if it is rejected.
+func (d *Daemon) submitInventory(
+	ctx context.Context,
+	authz *api.Authz,
+	submit func(context.Context, *api.Authz, api.Inventory) error,
+	inventory api.Inventory,
+) (*api.Authz, error) {
+	err := submit(ctx, authz, inventory)
+	if api.IsUnauthorized(err) {
+		log.Info("inventory submission unauthorized: renewing token")
+		var renewed *api.Authz
+		renewed, err = d.apiClient.Authenticate(ctx)
+		if err == nil {
+			authz = renewed
+			err = submit(ctx, authz, inventory)
+		}
+	}
+	return authz, err
+}
+
+// authzRefreshRetry is the interval between attempts to renew the token
+// after a failed refresh.
+const authzRefreshRetry = time.Minute
+
+// primaryProbeTimeout is the timeout for checking the availability of the
+// primary server.
+const primaryProbeTimeout = time.Minute
+
+type authzResult struct {
+	authz *api.Authz
+	err   error
+}
+
+func (d *Daemon) refreshAuthz(ctx context.Context, result chan<- authzResult) {
+	log.Debug("renewing authorization token")
+	authz, err := d.apiClient.Authenticate(ctx)
+	result <- authzResult{authz: authz, err: err}
+}
+
+// probePrimary checks if the primary server is available after failing
+// over to another server.
+func (d *Daemon) probePrimary(ctx context.Context, result chan<- authzResult) {
+	ctx, cancel := context.WithTimeout(ctx, primaryProbeTimeout)
+	defer cancel()
+	authz, err := d.failover.ProbePrimary(ctx)
+	result <- authzResult{authz: authz, err: err}
 }
 
 func (d *Daemon) messageLoop(ctx context.Context) (err error) {
 	log.Trace("messageLoop: starting")
 	var (
-		sock  api.Socket
-		authz *api.Authz
-		done  bool
+		sock    api.Socket
+		authz   *api.Authz
+		msgChan <-chan ws.ProtoMsg
+		done    bool
+
+		refreshChan   chan authzResult
+		refreshCancel context.CancelFunc = func() {}
+		probeChan     chan authzResult
 	)
-	sock, authz, err = d.connect(ctx, nil)
+	sock, authz, err = d.connectSpooling(ctx, nil)
 	if err != nil {
 		return err
 	}
+	d.notifyConnection(true, authz.ServerURL)
+	defer d.notifyConnection(false, "")
+	// The token is renewed in the background shortly before it expires
+	// without interrupting the socket connection.
+	refreshTimer := time.NewTimer(0)
+	refreshTimer.Stop()
+	defer refreshTimer.Stop()
+	scheduleRefresh := func() {
+		refreshTimer.Stop()
+		if refreshAt := authz.RefreshAt(); !refreshAt.IsZero() {
+			log.Debugf("authorization token renewal scheduled at %s",
+				refreshAt.Format(time.RFC3339))
+			refreshTimer.Reset(time.Until(refreshAt))
+		}
+	}
+	scheduleRefresh()
+	// The inventory updates requested by the triggers are delayed to
+	// collect the changes happening together.
+	inventoryTimer := time.NewTimer(0)
+	inventoryTimer.Stop()
+	defer inventoryTimer.Stop()
+	var inventoryPending bool
 	invCtx, cancel := context.WithCancel(ctx)
+	// reconnect replaces the socket connection using the given token,
+	// and sends the inventory once connected.
+	reconnect := func(current *api.Authz) bool {
+		_ = sock.Close()
+		refreshTimer.Stop()
+		refreshCancel()
+		refreshChan = nil
+		cancel()
+		d.notifyConnection(false, "")
+		sock, authz, err = d.connectSpooling(ctx, current)
+		if err != nil {
+			return false
+		}
+		d.notifyConnection(true, authz.ServerURL)
+		scheduleRefresh()
+		msgChan = sock.ReceiveChan()
+		invCtx, cancel = context.WithCancel(ctx)
+		go d.dispatchInventory(invCtx, authz) //nolint:errcheck
+		return true
+	}
+
 	go d.dispatchInventory(invCtx, authz) //nolint:errcheck
-	msgChan := sock.ReceiveChan()
+	msgChan = sock.ReceiveChan()
 	defer sock.Close()
 	for !done {
 		select {
 		case <-d.done:
 			done = true
 
+		case <-refreshTimer.C:
+			var refreshCtx context.Context
+			refreshCtx, refreshCancel = context.WithCancel(ctx)
+			refreshChan = make(chan authzResult, 1)
+			go d.refreshAuthz(refreshCtx, refreshChan)
+
+		case res := <-refreshChan:
+			refreshChan = nil
+			refreshCancel()
+			if res.err != nil {
+				log.Warnf("failed to renew authorization token: %s", res.err.Error())
+				refreshTimer.Reset(authzRefreshRetry)
+			} else {
+				log.Debug("authorization token renewed")
+				authz = res.authz
+				scheduleRefresh()
+			}
+
+		case <-d.primaryRetryTicker:
+			if probeChan == nil {
+				probeChan = make(chan authzResult, 1)
+				go d.probePrimary(ctx, probeChan)
+			}
+
+		case res := <-probeChan:
+			probeChan = nil
+			if res.err != nil {
+				log.Debugf("primary server unavailable: %s", res.err.Error())
+			} else if res.authz != nil {
+				log.Infof("reconnecting to primary server %q", res.authz.ServerURL)
+				done = !reconnect(res.authz)
+			}
+
 		case <-d.inventoryTicker:
 			cancel()
 			invCtx, cancel = context.WithCancel(ctx)
 			go d.dispatchInventory(invCtx, authz) //nolint:errcheck
 
+		case <-d.inventoryRefresh:
+			if !inventoryPending {
+				inventoryPending = true
+				inventoryTimer.Reset(d.inventoryDebounce)
+			}
+
+		case <-inventoryTimer.C:
+			inventoryPending = false
+			log.Debug("inventory update triggered")
+			cancel()
+			invCtx, cancel = context.WithCancel(ctx)
+			go d.dispatchInventory(invCtx, authz) //nolint:errcheck
+
+		case fn := <-d.controlChan:
+			fn(sock)
+			d.updateSessions()
+
+		case <-d.sessionWatchTicker:
+			d.updateSessions()
+
 		case msg, open := <-msgChan:
 			if open {
 				log.Tracef("got message: type:%s data length:%d", msg.Header.MsgType, len(msg.Body))
@@ -379,21 +875,18 @@ func (d *Daemon) messageLoop(ctx context.Context) (err error) {
 				if err != nil {
 					log.Warnf("error routing message: %s", err.Error())
 				}
+				d.updateSessions()
 			} else {
 				err = sock.Err()
 				if err == nil {
 					err = errors.New("socket closed")
 				}
-				_ = sock.Close()
-				sock, authz, err = d.connect(ctx, authz)
-				if err != nil {
-					done = true
-					continue
-				}
-				msgChan = sock.ReceiveChan()
+				log.Warnf("connection lost: %s: reconnecting", err.Error())
+				done = !reconnect(authz)
 			}
 		}
 	}
+	refreshCancel()
 	cancel()
 	return err
 }
@@ -469,6 +962,9 @@ func (d *Daemon) Run() error {
 
 func (d *Daemon) routeMessage(msg *ws.ProtoMsg, sock api.Socket) error {
 	var err error
+	if blocked, _, reason := d.sessionGate.State(); blocked && d.isNewSession(msg) {
+		return d.rejectSession(msg, sock, reason)
+	}
 	// NOTE: the switch is required for backward compatibility, otherwise
 	//       routing is performed and managed by the session.Router.
 	//       Use the new API in sessions package (see filetransfer.go for an example)
@@ -0,0 +1,295 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package app
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/northerntechhq/nt-connect/api"
+	"github.com/northerntechhq/nt-connect/session"
+)
+
+const (
+	// sessionWatchInterval is the interval for polling the active
+	// sessions when an observer is registered.
+	sessionWatchInterval = time.Second
+	// controlTimeout is the time a local control request waits for the
+	// message loop to pick it up.
+	controlTimeout = 10 * time.Second
+)
+
+var (
+	ErrSessionsBlocked = errors.New("new sessions are blocked")
+	ErrControlTimeout  = errors.New("timeout waiting for the daemon")
+	ErrDaemonStopped   = errors.New("daemon stopped")
+)
+
+// sessionObserver is notified about changes of the connection state and
+// the active sessions.
+type sessionObserver interface {
+	ConnectionChanged(connected bool, serverURL string)
+	SessionStarted(sessionID string)
+	SessionEnded(sessionID string)
+}
+
+// sessionGate blocks the creation of new sessions, either until it is
+// unblocked or until a deadline.
+type sessionGate struct {
+	mu      sync.Mutex
+	blocked bool
+	until   time.Time
+	reason  string
+}
+
+// Block blocks new sessions for the duration, or until unblocked if the
+// duration is not positive.
+func (g *sessionGate) Block(duration time.Duration, reason string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.blocked = true
+	g.until = time.Time{}
+	if duration > 0 {
+		g.until = time.Now().Add(duration)
+	}
+	g.reason = reason
+}
+
+func (g *sessionGate) Unblock() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.blocked = false
+	g.until = time.Time{}
+	g.reason = ""
+}
+
+// State returns whether new sessions are blocked, and if so, until when
+// (zero if indefinitely) and why.
+func (g *sessionGate) State() (blocked bool, until time.Time, reason string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.blocked && !g.until.IsZero() && !time.Now().Before(g.until) {
+		g.blocked = false
+		g.until = time.Time{}
+		g.reason = ""
+	}
+	return g.blocked, g.until, g.reason
+}
+
+func (d *Daemon) setObserver(observer sessionObserver) {
+	d.observer = observer
+	d.sessionWatchTicker = time.NewTicker(sessionWatchInterval).C
+}
+
+func (d *Daemon) notifyConnection(connected bool, serverURL string) {
+	d.connected.Store(connected)
+	d.serverURL = serverURL
+	if connected {
+		d.notifyReady()
+	}
+	d.updateStatus()
+	if d.observer != nil {
+		d.observer.ConnectionChanged(connected, serverURL)
+	}
+}
+
+// activeSessions returns the sorted IDs of the shell sessions and the
+// sessions managed by the router.
+func (d *Daemon) activeSessions() []string {
+	ids := session.GetSessionIds()
+	if mgr, ok := d.router.(session.SessionManager); ok {
+		ids = append(ids, mgr.SessionIDs()...)
+	}
+	sort.Strings(ids)
+	unique := ids[:0]
+	for i, id := range ids {
+		if i == 0 || id != ids[i-1] {
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// updateSessions notifies the observer about the sessions started and
+// ended since the last update, and systemd about the number of sessions.
+// It must be called from the message loop.
+func (d *Daemon) updateSessions() {
+	d.updateStatus()
+	if d.observer == nil {
+		return
+	}
+	current := make(map[string]struct{})
+	for _, id := range d.activeSessions() {
+		current[id] = struct{}{}
+		if _, ok := d.sessions[id]; !ok {
+			d.observer.SessionStarted(id)
+		}
+	}
+	for id := range d.sessions {
+		if _, ok := current[id]; !ok {
+			d.observer.SessionEnded(id)
+		}
+	}
+	d.sessions = current
+}
+
+// isNewSession returns true if the message would start a new session.
+func (d *Daemon) isNewSession(msg *ws.ProtoMsg) bool {
+	if msg.Header.Proto == ws.ProtoTypeShell {
+		return msg.Header.MsgType == wsshell.MessageTypeSpawnShell &&
+			session.GetSessionById(msg.Header.SessionID) == nil
+	}
+	mgr, ok := d.router.(session.SessionManager)
+	if !ok {
+		return false
+	}
+	for _, id := range mgr.SessionIDs() {
+		if id == msg.Header.SessionID {
+			return false
+		}
+	}
+	return true
+}
+
+// rejectSession responds to a message starting a new session while new
+// sessions are blocked.
+func (d *Daemon) rejectSession(msg *ws.ProtoMsg, sock api.Sender, reason string) error {
+	err := ErrSessionsBlocked
+	if reason != "" {
+		err = fmt.Errorf("%w: %s", ErrSessionsBlocked, reason)
+	}
+	if msg.Header.Proto == ws.ProtoTypeShell {
+		response := &ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:      msg.Header.Proto,
+				MsgType:    msg.Header.MsgType,
+				SessionID:  msg.Header.SessionID,
+				Properties: map[string]interface{}{},
+			},
+		}
+		d.routeMessageResponse(response, err, sock)
+		return err
+	}
+	errSchema := ws.Error{
+		Error:        err.Error(),
+		MessageProto: msg.Header.Proto,
+		MessageType:  msg.Header.MsgType,
+		Close:        true,
+	}
+	if msgID, ok := msg.Header.Properties["msgid"].(string); ok {
+		errSchema.MessageID = msgID
+	}
+	b, _ := msgpack.Marshal(errSchema)
+	if err := sock.Send(ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeControl,
+			MsgType:   ws.MessageTypeError,
+			SessionID: msg.Header.SessionID,
+		},
+		Body: b,
+	}); err != nil {
+		log.Errorf("unable to send the response message: %s", err.Error())
+	}
+	return err
+}
+
+// control runs the function on the message loop, which owns the socket and
+// the shell sessions.
+func (d *Daemon) control(fn func(sock api.Sender)) error {
+	done := make(chan struct{})
+	req := func(sock api.Sender) {
+		defer close(done)
+		fn(sock)
+	}
+	timer := time.NewTimer(controlTimeout)
+	defer timer.Stop()
+	select {
+	case d.controlChan <- req:
+	case <-d.done:
+		return ErrDaemonStopped
+	case <-timer.C:
+		return ErrControlTimeout
+	}
+	<-done
+	return nil
+}
+
+// terminateSession stops the session with the ID and notifies the remote
+// peer. It must be called from the message loop.
+func (d *Daemon) terminateSession(sessionID string, sock api.Sender) bool {
+	var found bool
+	if s := session.GetSessionById(sessionID); s != nil {
+		found = true
+		err := session.StopSessionById(sessionID)
+		if err == nil {
+			d.DecreaseSpawnedShellsCount(1)
+		} else if err == session.ErrSessionNotFound {
+			// The session does not have a running shell
+			_ = session.DeleteSessionById(sessionID)
+		} else {
+			log.Errorf("failed to terminate session %s: %s", sessionID, err.Error())
+		}
+		err = sock.Send(ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:     ws.ProtoTypeShell,
+				MsgType:   wsshell.MessageTypeStopShell,
+				SessionID: sessionID,
+				Properties: map[string]interface{}{
+					"status": wsshell.ErrorMessage,
+				},
+			},
+			Body: []byte("session terminated"),
+		})
+		if err != nil {
+			log.Errorf("unable to send the stop message: %s", err.Error())
+		}
+	}
+	if mgr, ok := d.router.(session.SessionManager); ok && mgr.CloseSession(sessionID) {
+		found = true
+	}
+	if found {
+		log.Infof("session %s terminated by local request", sessionID)
+	}
+	return found
+}
+
+// TerminateSession terminates the active session with the ID, returning
+// false if the session does not exist.
+func (d *Daemon) TerminateSession(sessionID string) (found bool, err error) {
+	err = d.control(func(sock api.Sender) {
+		found = d.terminateSession(sessionID, sock)
+	})
+	return found, err
+}
+
+// TerminateSessions terminates all the active sessions and returns the
+// number of sessions terminated.
+func (d *Daemon) TerminateSessions() (count int, err error) {
+	err = d.control(func(sock api.Sender) {
+		for _, id := range d.activeSessions() {
+			if d.terminateSession(id, sock) {
+				count++
+			}
+		}
+	})
+	return count, err
+}
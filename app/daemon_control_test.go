@@ -0,0 +1,160 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package app
+
+import (
+	"os/user"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/northerntechhq/nt-connect/config"
+)
+
+type observerEvent struct {
+	Name  string
+	Value string
+}
+
+type chanObserver chan observerEvent
+
+func (o chanObserver) ConnectionChanged(connected bool, serverURL string) {
+	if connected {
+		o <- observerEvent{Name: "connected", Value: serverURL}
+	} else {
+		o <- observerEvent{Name: "disconnected"}
+	}
+}
+
+func (o chanObserver) SessionStarted(sessionID string) {
+	o <- observerEvent{Name: "started", Value: sessionID}
+}
+
+func (o chanObserver) SessionEnded(sessionID string) {
+	o <- observerEvent{Name: "ended", Value: sessionID}
+}
+
+func TestSessionGate(t *testing.T) {
+	var gate sessionGate
+	blocked, _, _ := gate.State()
+	assert.False(t, blocked)
+
+	gate.Block(0, "maintenance")
+	blocked, until, reason := gate.State()
+	assert.True(t, blocked)
+	assert.True(t, until.IsZero())
+	assert.Equal(t, "maintenance", reason)
+
+	gate.Unblock()
+	blocked, _, reason = gate.State()
+	assert.False(t, blocked)
+	assert.Empty(t, reason)
+
+	gate.Block(50*time.Millisecond, "")
+	blocked, until, _ = gate.State()
+	assert.True(t, blocked)
+	assert.False(t, until.IsZero())
+	time.Sleep(100 * time.Millisecond)
+	blocked, _, _ = gate.State()
+	assert.False(t, blocked)
+}
+
+func TestDaemonSessionControl(t *testing.T) {
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Fatalf("cant get current user: %s", err.Error())
+	}
+	observer := make(chanObserver, 10)
+	d := newDaemon(&config.NTConnectConfig{
+		NTConnectConfigFromFile: config.NTConnectConfigFromFile{
+			User: currentUser.Username,
+		},
+	})
+	d.setObserver(observer)
+	sockMock := runTestDaemon(t, d)
+
+	waitEvent := func(expected observerEvent) {
+		t.Helper()
+		select {
+		case event := <-observer:
+			assert.Equal(t, expected, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for event %v", expected)
+		}
+	}
+	waitError := func(sessionID string) ws.Error {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case msg := <-sockMock.Output():
+				if msg.Header.MsgType != ws.MessageTypeError {
+					continue
+				}
+				assert.Equal(t, sessionID, msg.Header.SessionID)
+				var rsp ws.Error
+				assert.NoError(t, msgpack.Unmarshal(msg.Body, &rsp))
+				return rsp
+			case <-timeout:
+				t.Fatal("timeout waiting for error message")
+			}
+		}
+	}
+	ping := func(sessionID string) {
+		sockMock.Input() <- ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:     ws.ProtoTypeControl,
+				MsgType:   ws.MessageTypePing,
+				SessionID: sessionID,
+			},
+		}
+	}
+	waitEvent(observerEvent{Name: "connected", Value: "http://localhost:12345"})
+
+	// New sessions are rejected while blocked
+	d.sessionGate.Block(0, "maintenance")
+	ping("blocked")
+	rsp := waitError("blocked")
+	assert.Equal(t, "new sessions are blocked: maintenance", rsp.Error)
+	assert.True(t, rsp.Close)
+
+	d.sessionGate.Unblock()
+	ping("session")
+	waitEvent(observerEvent{Name: "started", Value: "session"})
+
+	// Existing sessions are not affected by blocking
+	d.sessionGate.Block(0, "")
+	ping("session")
+
+	found, err := d.TerminateSession("dummy")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	var count int
+
+	count, err = d.TerminateSessions()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	rsp = waitError("session")
+	assert.Equal(t, "session terminated", rsp.Error)
+	waitEvent(observerEvent{Name: "ended", Value: "session"})
+
+	d.StopDaemon()
+	waitEvent(observerEvent{Name: "disconnected"})
+	_, err = d.TerminateSession("session")
+	assert.ErrorIs(t, err, ErrDaemonStopped)
+}
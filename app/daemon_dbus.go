@@ -18,14 +18,23 @@
 package app
 
 import (
+	"crypto/tls"
+
 	log "github.com/sirupsen/logrus"
 
 	"github.com/northerntechhq/nt-connect/api"
 	apidbus "github.com/northerntechhq/nt-connect/api/dbus"
+	apiws "github.com/northerntechhq/nt-connect/api/ws"
 	"github.com/northerntechhq/nt-connect/client/dbus"
+	"github.com/northerntechhq/nt-connect/config"
 )
 
-func getDBUSClient(done <-chan struct{}) (api.Client, error) {
+func getDBUSClient(
+	done <-chan struct{},
+	tlsConfig *tls.Config,
+	wsConfig apiws.Config,
+	inventory config.DBusInventoryMethod,
+) (api.Client, error) {
 	dbusAPI, err := dbus.GetDBusAPI()
 	if err != nil {
 		return nil, err
@@ -42,6 +51,8 @@ func getDBUSClient(done <-chan struct{}) (api.Client, error) {
 		log.Errorf("nt-connect dbus failed to create client, error: %s", err.Error())
 		return nil, err
 	}
+	apiClient.ConfigureSocket(tlsConfig, wsConfig)
+	apiClient.ConfigureInventory(inventory.Enabled())
 
 	//dbus main loop, requiredaemon.
 	loop := dbusAPI.MainLoopNew()
@@ -52,3 +63,19 @@ func getDBUSClient(done <-chan struct{}) (api.Client, error) {
 	}()
 	return apiClient, nil
 }
+
+// startDBusService exposes the daemon on the system bus for local
+// integrations.
+func startDBusService(d *Daemon) error {
+	dbusAPI, err := dbus.GetDBusAPI()
+	if err != nil {
+		return err
+	}
+	service, err := newDBusService(d, dbusAPI, dbus.GBusTypeSystem)
+	if err != nil {
+		return err
+	}
+	d.setObserver(service)
+	log.Infof("D-Bus service %s available on the system bus", DBusServiceName)
+	return nil
+}
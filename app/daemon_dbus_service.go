@@ -0,0 +1,287 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+//go:build dbus
+// +build dbus
+
+package app
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/northerntechhq/nt-connect/client/dbus"
+)
+
+// The D-Bus service exposed by nt-connect for local integrations.
+const (
+	DBusServiceName          = "tech.northern.NTConnect"
+	DBusServicePath          = "/tech/northern/NTConnect"
+	DBusServiceInterfaceName = "tech.northern.NTConnect1"
+
+	dbusErrorInvalidArgs    = "org.freedesktop.DBus.Error.InvalidArgs"
+	dbusErrorNoSuchSession  = DBusServiceInterfaceName + ".Error.NoSuchSession"
+	dbusErrorDaemonNotReady = DBusServiceInterfaceName + ".Error.NotReady"
+)
+
+const dbusServiceIntrospection = `<interface name="tech.northern.NTConnect1">` +
+	`<property name="Connected" type="b" access="read"/>` +
+	`<property name="ServerURL" type="s" access="read"/>` +
+	`<property name="Sessions" type="as" access="read"/>` +
+	`<property name="SessionsBlocked" type="b" access="read"/>` +
+	`<property name="BlockedUntil" type="t" access="read"/>` +
+	`<property name="BlockReason" type="s" access="read"/>` +
+	`<method name="BlockSessions">` +
+	`<arg name="seconds" type="u" direction="in"/>` +
+	`<arg name="reason" type="s" direction="in"/>` +
+	`</method>` +
+	`<method name="UnblockSessions"/>` +
+	`<method name="TerminateSession">` +
+	`<arg name="session_id" type="s" direction="in"/>` +
+	`</method>` +
+	`<method name="TerminateSessions">` +
+	`<arg name="count" type="u" direction="out"/>` +
+	`</method>` +
+	`<signal name="SessionStarted"><arg name="session_id" type="s"/></signal>` +
+	`<signal name="SessionEnded"><arg name="session_id" type="s"/></signal>` +
+	`</interface>`
+
+// dbusService exposes the connection state and the active sessions of the
+// daemon on the bus, and lets local integrations block new sessions or
+// terminate the active ones.
+type dbusService struct {
+	service dbus.DBusServiceAPI
+	conn    dbus.Handle
+	daemon  *Daemon
+
+	mu           sync.Mutex
+	connected    bool
+	serverURL    string
+	sessions     map[string]struct{}
+	unblockTimer *time.Timer
+}
+
+func newDBusService(d *Daemon, dbusAPI dbus.DBusAPI, busType uint) (*dbusService, error) {
+	service, ok := dbusAPI.(dbus.DBusServiceAPI)
+	if !ok {
+		return nil, errors.New("the D-Bus client does not support services")
+	}
+	conn, err := dbusAPI.BusGet(busType)
+	if err != nil {
+		return nil, err
+	}
+	s := &dbusService{
+		service:  service,
+		conn:     conn,
+		daemon:   d,
+		sessions: make(map[string]struct{}),
+	}
+	err = service.BusExportInterface(conn, DBusServicePath, dbus.ExportedInterface{
+		Name: DBusServiceInterfaceName,
+		Methods: map[string]dbus.MethodHandler{
+			"BlockSessions":     s.blockSessions,
+			"UnblockSessions":   s.unblockSessions,
+			"TerminateSession":  s.terminateSession,
+			"TerminateSessions": s.terminateSessions,
+		},
+		Properties:    s.properties,
+		Introspection: dbusServiceIntrospection,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = service.BusRequestName(conn, DBusServiceName); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *dbusService) properties() map[string]interface{} {
+	properties := s.blockProperties()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	properties["Connected"] = s.connected
+	properties["ServerURL"] = s.serverURL
+	properties["Sessions"] = s.sessionIDs()
+	return properties
+}
+
+func (s *dbusService) blockProperties() map[string]interface{} {
+	blocked, until, reason := s.daemon.sessionGate.State()
+	var blockedUntil uint64
+	if !until.IsZero() {
+		blockedUntil = uint64(until.Unix())
+	}
+	return map[string]interface{}{
+		"SessionsBlocked": blocked,
+		"BlockedUntil":    blockedUntil,
+		"BlockReason":     reason,
+	}
+}
+
+func (s *dbusService) emitPropertiesChanged(changed map[string]interface{}) {
+	err := s.service.BusEmitPropertiesChanged(
+		s.conn, DBusServicePath, DBusServiceInterfaceName, changed,
+	)
+	if err != nil {
+		log.Warnf("dbus service: failed to emit PropertiesChanged: %s", err.Error())
+	}
+}
+
+func (s *dbusService) emitSignal(name string, args ...interface{}) {
+	err := s.service.BusEmitSignal(
+		s.conn, DBusServicePath, DBusServiceInterfaceName, name, args...,
+	)
+	if err != nil {
+		log.Warnf("dbus service: failed to emit %s: %s", name, err.Error())
+	}
+}
+
+func (s *dbusService) blockSessions(args []interface{}) ([]interface{}, error) {
+	var (
+		seconds uint32
+		reason  string
+		ok      bool
+	)
+	if len(args) == 2 {
+		seconds, ok = args[0].(uint32)
+		if ok {
+			reason, ok = args[1].(string)
+		}
+	}
+	if !ok {
+		return nil, &dbus.MethodError{
+			Name:    dbusErrorInvalidArgs,
+			Message: "expected arguments (seconds uint32, reason string)",
+		}
+	}
+	duration := time.Duration(seconds) * time.Second
+	s.daemon.sessionGate.Block(duration, reason)
+	log.Infof("new sessions blocked by local request (duration: %s, reason: %q)",
+		duration, reason)
+	s.mu.Lock()
+	if s.unblockTimer != nil {
+		s.unblockTimer.Stop()
+		s.unblockTimer = nil
+	}
+	if duration > 0 {
+		s.unblockTimer = time.AfterFunc(duration, func() {
+			s.emitPropertiesChanged(s.blockProperties())
+		})
+	}
+	s.mu.Unlock()
+	s.emitPropertiesChanged(s.blockProperties())
+	return nil, nil
+}
+
+func (s *dbusService) unblockSessions(args []interface{}) ([]interface{}, error) {
+	s.daemon.sessionGate.Unblock()
+	log.Info("new sessions unblocked by local request")
+	s.mu.Lock()
+	if s.unblockTimer != nil {
+		s.unblockTimer.Stop()
+		s.unblockTimer = nil
+	}
+	s.mu.Unlock()
+	s.emitPropertiesChanged(s.blockProperties())
+	return nil, nil
+}
+
+func controlError(err error) error {
+	return &dbus.MethodError{
+		Name:    dbusErrorDaemonNotReady,
+		Message: err.Error(),
+	}
+}
+
+func (s *dbusService) terminateSession(args []interface{}) ([]interface{}, error) {
+	var sessionID string
+	if len(args) == 1 {
+		sessionID, _ = args[0].(string)
+	}
+	if sessionID == "" {
+		return nil, &dbus.MethodError{
+			Name:    dbusErrorInvalidArgs,
+			Message: "expected argument (session_id string)",
+		}
+	}
+	found, err := s.daemon.TerminateSession(sessionID)
+	if err != nil {
+		return nil, controlError(err)
+	} else if !found {
+		return nil, &dbus.MethodError{
+			Name:    dbusErrorNoSuchSession,
+			Message: fmt.Sprintf("no such session %q", sessionID),
+		}
+	}
+	return nil, nil
+}
+
+func (s *dbusService) terminateSessions(args []interface{}) ([]interface{}, error) {
+	count, err := s.daemon.TerminateSessions()
+	if err != nil {
+		return nil, controlError(err)
+	}
+	return []interface{}{uint32(count)}, nil
+}
+
+// ConnectionChanged implements sessionObserver
+func (s *dbusService) ConnectionChanged(connected bool, serverURL string) {
+	s.mu.Lock()
+	if s.connected == connected && s.serverURL == serverURL {
+		s.mu.Unlock()
+		return
+	}
+	s.connected = connected
+	s.serverURL = serverURL
+	s.mu.Unlock()
+	s.emitPropertiesChanged(map[string]interface{}{
+		"Connected": connected,
+		"ServerURL": serverURL,
+	})
+}
+
+func (s *dbusService) sessionIDs() []string {
+	ids := make([]string, 0, len(s.sessions))
+	for id := range s.sessions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// SessionStarted implements sessionObserver
+func (s *dbusService) SessionStarted(sessionID string) {
+	s.mu.Lock()
+	s.sessions[sessionID] = struct{}{}
+	sessions := s.sessionIDs()
+	s.mu.Unlock()
+	s.emitSignal("SessionStarted", sessionID)
+	s.emitPropertiesChanged(map[string]interface{}{"Sessions": sessions})
+}
+
+// SessionEnded implements sessionObserver
+func (s *dbusService) SessionEnded(sessionID string) {
+	s.mu.Lock()
+	delete(s.sessions, sessionID)
+	sessions := s.sessionIDs()
+	s.mu.Unlock()
+	s.emitSignal("SessionEnded", sessionID)
+	s.emitPropertiesChanged(map[string]interface{}{"Sessions": sessions})
+}
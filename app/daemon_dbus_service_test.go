@@ -0,0 +1,141 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+//go:build dbus
+// +build dbus
+
+package app
+
+import (
+	"bufio"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/northerntechhq/nt-connect/client/dbus"
+	"github.com/northerntechhq/nt-connect/config"
+)
+
+// startSessionBus starts a private dbus-daemon and points
+// DBUS_SESSION_BUS_ADDRESS to it.
+func startSessionBus(t *testing.T) {
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not available")
+	}
+	address := "unix:path=" + filepath.Join(t.TempDir(), "bus")
+	cmd := exec.Command(daemon, "--session", "--nofork", "--print-address",
+		"--address="+address)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to start dbus-daemon: %s", err)
+	}
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", strings.TrimSpace(line))
+}
+
+func TestDBusService(t *testing.T) {
+	dbusAPI, err := dbus.GetDBusAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dbusAPI.(dbus.DBusServiceAPI); !ok {
+		t.Skip("D-Bus client does not support services")
+	}
+	startSessionBus(t)
+
+	d := newDaemon(&config.NTConnectConfig{})
+	service, err := newDBusService(d, dbusAPI, dbus.GBusTypeSession)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	service.ConnectionChanged(true, "https://localhost")
+
+	conn, err := dbusAPI.BusGet(dbus.GBusTypeSession)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	proxy, err := dbusAPI.BusProxyNew(
+		conn, DBusServiceName, DBusServicePath, DBusServiceInterfaceName,
+	)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	properties, err := dbusAPI.BusProxyNew(
+		conn, DBusServiceName, DBusServicePath, "org.freedesktop.DBus.Properties",
+	)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	getProperty := func(name string) dbus.DBusCallResponse {
+		t.Helper()
+		rsp, err := dbusAPI.BusProxyCall(properties, "Get",
+			[]interface{}{DBusServiceInterfaceName, name}, -1)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return rsp
+	}
+	assert.True(t, getProperty("Connected").GetBoolean())
+	assert.Equal(t, "https://localhost", getProperty("ServerURL").GetString())
+	assert.False(t, getProperty("SessionsBlocked").GetBoolean())
+
+	_, err = dbusAPI.BusProxyCall(proxy, "BlockSessions",
+		[]interface{}{uint32(60), "maintenance"}, -1)
+	assert.NoError(t, err)
+	blocked, until, reason := d.sessionGate.State()
+	assert.True(t, blocked)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), until, 5*time.Second)
+	assert.Equal(t, "maintenance", reason)
+	assert.True(t, getProperty("SessionsBlocked").GetBoolean())
+	assert.Equal(t, "maintenance", getProperty("BlockReason").GetString())
+
+	_, err = dbusAPI.BusProxyCall(proxy, "BlockSessions", "invalid", -1)
+	assert.Error(t, err)
+
+	_, err = dbusAPI.BusProxyCall(proxy, "UnblockSessions", nil, -1)
+	assert.NoError(t, err)
+	blocked, _, _ = d.sessionGate.State()
+	assert.False(t, blocked)
+
+	service.SessionStarted("session")
+	params, err := dbusAPI.WaitForSignal("SessionStarted", 5*time.Second)
+	if assert.NoError(t, err) && assert.Len(t, params, 1) {
+		assert.Equal(t, "session", params[0].ParamData)
+	}
+	service.SessionEnded("session")
+	params, err = dbusAPI.WaitForSignal("SessionEnded", 5*time.Second)
+	if assert.NoError(t, err) && assert.Len(t, params, 1) {
+		assert.Equal(t, "session", params[0].ParamData)
+	}
+
+	// The daemon is not running: the request cannot be served
+	d.StopDaemon()
+	_, err = dbusAPI.BusProxyCall(proxy, "TerminateSession", "session", -1)
+	assert.ErrorContains(t, err, dbusErrorDaemonNotReady)
+}
@@ -0,0 +1,106 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package app
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/northerntechhq/nt-connect/api"
+	"github.com/northerntechhq/nt-connect/session"
+)
+
+const (
+	// shutdownReason is the reason given to the peers when the daemon
+	// is terminated.
+	shutdownReason = "nt-connect is shutting down"
+	// drainPollInterval is the interval for checking if the file
+	// transfers finished while draining.
+	drainPollInterval = 100 * time.Millisecond
+)
+
+// onMessageLoop runs the function on the message loop if connected, and
+// directly otherwise, since the message loop is then only connecting.
+func (d *Daemon) onMessageLoop(fn func(sock api.Sender)) error {
+	if d.connected.Load() {
+		return d.control(fn)
+	}
+	fn(nil)
+	return nil
+}
+
+// drain terminates the sessions gracefully: new sessions are rejected, the
+// peers are notified that the sessions are closing and the port forwards
+// are stopped. The file transfers in progress are given the grace period
+// to finish before the shells are terminated and the partial uploads
+// removed.
+func (d *Daemon) drain(reason string) {
+	log.Infof("draining sessions: %s", reason)
+	d.sessionGate.Block(0, reason)
+	mgr, _ := d.router.(session.SessionManager)
+	err := d.onMessageLoop(func(sock api.Sender) {
+		if sock == nil {
+			return
+		}
+		// The sessions managed by the router notify their peer
+		routed := make(map[string]bool)
+		if mgr != nil {
+			for _, id := range mgr.SessionIDs() {
+				routed[id] = true
+			}
+			mgr.DrainSessions(reason)
+		}
+		for _, id := range session.GetSessionIds() {
+			if routed[id] {
+				continue
+			}
+			if err := session.NotifyClose(sock, id, reason); err != nil {
+				log.Errorf("unable to notify session %s: %s", id, err.Error())
+			}
+		}
+	})
+	if err != nil {
+		log.Warnf("failed to notify the sessions: %s", err.Error())
+	}
+
+	deadline := time.Now().Add(d.shutdownGracePeriod)
+	for session.ActiveFileTransfers() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+	if n := session.ActiveFileTransfers(); n > 0 {
+		log.Warnf("aborting %d file transfers in progress", n)
+	}
+
+	err = d.onMessageLoop(func(api.Sender) {
+		shells, _, err := session.TerminateAllSessions()
+		if err != nil {
+			log.Errorf("failed to terminate sessions: %s", err.Error())
+		}
+		if shells > 0 {
+			d.DecreaseSpawnedShellsCount(uint(shells))
+		}
+		if mgr != nil {
+			for _, id := range mgr.SessionIDs() {
+				mgr.CloseSession(id)
+			}
+		}
+	})
+	if err != nil {
+		log.Warnf("failed to terminate the sessions: %s", err.Error())
+	}
+	if n := session.RemovePartialUploads(); n > 0 {
+		log.Infof("removed %d partial uploads", n)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package app
+
+import (
+	"os/user"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/sys/unix"
+
+	"github.com/northerntechhq/nt-connect/config"
+	"github.com/northerntechhq/nt-connect/utils/types"
+)
+
+func TestDaemonDrain(t *testing.T) {
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Fatalf("cant get current user: %s", err.Error())
+	}
+	observer := make(chanObserver, 10)
+	d := newDaemon(&config.NTConnectConfig{
+		NTConnectConfigFromFile: config.NTConnectConfigFromFile{
+			User:                currentUser.Username,
+			ShutdownGracePeriod: types.Duration(time.Second),
+		},
+	})
+	d.setObserver(observer)
+	sockMock := runTestDaemon(t, d)
+
+	waitEvent := func(expected observerEvent) {
+		t.Helper()
+		select {
+		case event := <-observer:
+			assert.Equal(t, expected, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for event %v", expected)
+		}
+	}
+	waitMessage := func(msgType string) ws.ProtoMsg {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case msg := <-sockMock.Output():
+				if msg.Header.MsgType == msgType {
+					return msg
+				}
+			case <-timeout:
+				t.Fatalf("timeout waiting for %s message", msgType)
+			}
+		}
+	}
+	ping := func(sessionID string) {
+		sockMock.Input() <- ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:     ws.ProtoTypeControl,
+				MsgType:   ws.MessageTypePing,
+				SessionID: sessionID,
+			},
+		}
+	}
+	waitEvent(observerEvent{Name: "connected", Value: "http://localhost:12345"})
+	ping("session")
+	waitEvent(observerEvent{Name: "started", Value: "session"})
+
+	d.drain(shutdownReason)
+
+	msg := waitMessage(ws.MessageTypeClose)
+	assert.Equal(t, "session", msg.Header.SessionID)
+	assert.Equal(t, shutdownReason, string(msg.Body))
+	msg = waitMessage(ws.MessageTypeError)
+	var rsp ws.Error
+	assert.NoError(t, msgpack.Unmarshal(msg.Body, &rsp))
+	assert.Equal(t, "session terminated", rsp.Error)
+	waitEvent(observerEvent{Name: "ended", Value: "session"})
+
+	// New sessions are rejected
+	ping("new")
+	msg = waitMessage(ws.MessageTypeError)
+	assert.NoError(t, msgpack.Unmarshal(msg.Body, &rsp))
+	assert.Equal(t, "new sessions are blocked: "+shutdownReason, rsp.Error)
+}
+
+func TestDaemonHandleSignal(t *testing.T) {
+	d := newDaemon(&config.NTConnectConfig{})
+	assert.Nil(t, d.handleSignal(unix.SIGUSR1))
+
+	// The sessions are drained in the background
+	drained := d.handleSignal(unix.SIGTERM)
+	// Further termination signals do not start another drain
+	assert.Equal(t, drained, d.handleSignal(unix.SIGINT))
+	assert.Equal(t, drained, d.handleSignal(unix.SIGTERM))
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the sessions to be drained")
+	}
+	blocked, _, reason := d.sessionGate.State()
+	assert.True(t, blocked)
+	assert.Equal(t, shutdownReason, reason)
+}
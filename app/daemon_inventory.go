@@ -0,0 +1,195 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/northerntechhq/nt-connect/api"
+	"github.com/northerntechhq/nt-connect/config"
+	"github.com/northerntechhq/nt-connect/inventory"
+	"github.com/northerntechhq/nt-connect/utils"
+)
+
+var ErrInventoryDisabled = errors.New("inventory is disabled")
+
+// inventoryState describes the inventory known to the server.
+type inventoryState struct {
+	// ServerURL is the server the inventory was sent to.
+	ServerURL string `json:"server_url"`
+	// DeviceID is the device the inventory was sent for: the subject
+	// of the token.
+	DeviceID string `json:"device_id,omitempty"`
+	// UpdatedAt is the time of the last complete update.
+	UpdatedAt time.Time `json:"updated_at"`
+	// Digests are the digests of the attributes sent.
+	Digests map[string]string `json:"digests"`
+	// TimeSeries are the attributes summarizing the inventory spooled
+	// during the last period offline.
+	TimeSeries api.Inventory `json:"time_series,omitempty"`
+}
+
+// loadInventoryState returns the inventory state, reading it from the
+// cache on first use. It must be called with the inventory mutex held.
+func (d *Daemon) loadInventoryState() *inventoryState {
+	if d.inventoryState != nil {
+		return d.inventoryState
+	}
+	d.inventoryState = &inventoryState{}
+	if d.inventoryCachePath == "" {
+		return d.inventoryState
+	}
+	b, err := os.ReadFile(d.inventoryCachePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("failed to read cached inventory state: %s", err.Error())
+		}
+		return d.inventoryState
+	}
+	var state inventoryState
+	if err = json.Unmarshal(b, &state); err != nil {
+		log.Warnf("failed to parse cached inventory state: %s", err.Error())
+		return d.inventoryState
+	}
+	d.inventoryState = &state
+	return d.inventoryState
+}
+
+// storeInventoryState persists the inventory state. It must be called with
+// the inventory mutex held.
+func (d *Daemon) storeInventoryState(state *inventoryState) {
+	d.inventoryState = state
+	if d.inventoryCachePath == "" {
+		return
+	}
+	b, _ := json.Marshal(state)
+	if err := utils.WriteFileAtomic(d.inventoryCachePath, b, 0600); err != nil {
+		log.Warnf("failed to cache inventory state: %s", err.Error())
+	}
+}
+
+// spoolInventory adds a snapshot of the inventory to the spool, if
+// enabled.
+func (d *Daemon) spoolInventory(inv api.Inventory) {
+	if d.inventorySpool == nil {
+		return
+	}
+	if err := d.inventorySpool.Add(inventory.NewSnapshot(inv, inventory.Options{})); err != nil {
+		log.Warnf("failed to spool inventory: %s", err.Error())
+		return
+	}
+	log.Debug("inventory spooled")
+}
+
+// spooledInventory returns the spooled inventory snapshots.
+func (d *Daemon) spooledInventory() []inventory.Snapshot {
+	if d.inventorySpool == nil {
+		return nil
+	}
+	snapshots, err := d.inventorySpool.Snapshots()
+	if err != nil {
+		log.Warnf("failed to read the inventory spool: %s", err.Error())
+	}
+	return snapshots
+}
+
+// connectSpooling connects to the server like connect, spooling the
+// inventory collected while the server is unreachable.
+func (d *Daemon) connectSpooling(
+	ctx context.Context,
+	authz *api.Authz,
+) (api.Socket, *api.Authz, error) {
+	if d.inventorySpool == nil || d.inventoryTicker == nil {
+		return d.connect(ctx, authz)
+	}
+	spoolCtx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-spoolCtx.Done():
+				return
+			case <-d.inventoryTicker:
+				inv, err := d.collectInventory(spoolCtx)
+				if err == nil && spoolCtx.Err() == nil {
+					d.spoolInventory(inv)
+				}
+			}
+		}
+	}()
+	sock, authz, err := d.connect(ctx, authz)
+	cancel()
+	<-stopped
+	return sock, authz, err
+}
+
+// RefreshInventory schedules an inventory update. The requests received
+// within the debounce time are coalesced into one update.
+func (d *Daemon) RefreshInventory() error {
+	if !d.inventoryEnabled() {
+		return ErrInventoryDisabled
+	}
+	select {
+	case d.inventoryRefresh <- struct{}{}:
+	default:
+		// An update is already requested
+	}
+	return nil
+}
+
+// startInventoryTriggers watches for the system changes triggering an
+// inventory update until the daemon stops.
+func (d *Daemon) startInventoryTriggers(conf config.InventoryTriggersConfig) {
+	d.inventoryDebounce = time.Duration(conf.Debounce)
+	if d.inventoryDebounce <= 0 {
+		d.inventoryDebounce = config.DefaultInventoryDebounce
+	}
+	notify := func() {
+		_ = d.RefreshInventory()
+	}
+	var watchers []io.Closer
+	if conf.Netlink {
+		watcher, err := inventory.WatchNetlink(notify)
+		if err != nil {
+			log.Warnf("inventory: not watching network changes: %s", err.Error())
+		} else {
+			watchers = append(watchers, watcher)
+		}
+	}
+	if len(conf.WatchFiles) > 0 {
+		watcher, err := inventory.WatchFiles(conf.WatchFiles, notify)
+		if err != nil {
+			log.Warnf("inventory: not watching files: %s", err.Error())
+		} else {
+			watchers = append(watchers, watcher)
+		}
+	}
+	if len(watchers) == 0 {
+		return
+	}
+	go func() {
+		<-d.done
+		for _, watcher := range watchers {
+			_ = watcher.Close()
+		}
+	}()
+}
@@ -18,11 +18,21 @@
 package app
 
 import (
+	"crypto/tls"
 	"fmt"
 
 	"github.com/northerntechhq/nt-connect/api"
+	apiws "github.com/northerntechhq/nt-connect/api/ws"
+	"github.com/northerntechhq/nt-connect/config"
 )
 
-func getDBUSClient(<-chan struct{}) (api.Client, error) {
+func getDBUSClient(
+	<-chan struct{}, *tls.Config, apiws.Config, config.DBusInventoryMethod,
+) (api.Client, error) {
 	return nil, fmt.Errorf("binary not built with dbus support: use 'dbus' build tag to enable")
 }
+
+// startDBusService is a no-op without dbus support
+func startDBusService(*Daemon) error {
+	return nil
+}
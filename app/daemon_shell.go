@@ -15,6 +15,8 @@ package app
 
 import (
 	"fmt"
+	"os/user"
+	"strconv"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
 	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
@@ -39,6 +41,49 @@ func getUserIdFromMessage(message *ws.ProtoMsg) string {
 	return userID
 }
 
+// shellUser is the local account a shell runs as.
+type shellUser struct {
+	name    string
+	uid     uint32
+	gid     uint32
+	homeDir string
+}
+
+// resolveShellUser returns the local account the shell of the remote user
+// runs as: the account mapped from the user ID and roles if configured,
+// or the daemon user otherwise.
+func (d *Daemon) resolveShellUser(message *ws.ProtoMsg) (shellUser, error) {
+	if !d.shellUsers.Enabled() {
+		return shellUser{
+			name:    d.username,
+			uid:     uint32(d.uid),
+			gid:     uint32(d.gid),
+			homeDir: d.homeDir,
+		}, nil
+	}
+	name := d.shellUsers.LocalUser(
+		getUserIdFromMessage(message), session.UserRoles(message),
+	)
+	u, err := user.Lookup(name)
+	if err != nil {
+		return shellUser{}, fmt.Errorf("failed to look up shell user %q: %w", name, err)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return shellUser{}, fmt.Errorf("invalid uid of shell user %q: %w", name, err)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return shellUser{}, fmt.Errorf("invalid gid of shell user %q: %w", name, err)
+	}
+	return shellUser{
+		name:    name,
+		uid:     uint32(uid),
+		gid:     uint32(gid),
+		homeDir: u.HomeDir,
+	}, nil
+}
+
 func (d *Daemon) routeMessageSpawnShell(message *ws.ProtoMsg, sock api.Sender) error {
 	var err error
 	response := &ws.ProtoMsg{
@@ -52,11 +97,22 @@ func (d *Daemon) routeMessageSpawnShell(message *ws.ProtoMsg, sock api.Sender) e
 		},
 		Body: []byte{},
 	}
+	if d.policy != nil {
+		if err = d.policy.Authorize(message); err != nil {
+			d.routeMessageResponse(response, err, sock)
+			return err
+		}
+	}
 	if d.shellsSpawned >= config.MaxShellsSpawned {
 		err = session.ErrSessionTooManyShellsAlreadyRunning
 		d.routeMessageResponse(response, err, sock)
 		return err
 	}
+	shellUser, err := d.resolveShellUser(message)
+	if err != nil {
+		d.routeMessageResponse(response, err, sock)
+		return err
+	}
 	s := session.GetSessionById(message.Header.SessionID)
 	if s == nil {
 		userId := getUserIdFromMessage(message)
@@ -86,12 +142,12 @@ func (d *Daemon) routeMessageSpawnShell(message *ws.ProtoMsg, sock api.Sender) e
 		terminalWidth = requestedWidth
 	}
 
-	log.Debugf("starting shell session_id=%s", s.GetId())
+	log.Debugf("starting shell session_id=%s user=%s", s.GetId(), shellUser.name)
 	if err = s.StartShell(sock, s.GetId(), session.TerminalSettings{
-		Uid:            uint32(d.uid),
-		Gid:            uint32(d.gid),
+		Uid:            shellUser.uid,
+		Gid:            shellUser.gid,
 		Shell:          d.shellCommand,
-		HomeDir:        d.homeDir,
+		HomeDir:        shellUser.homeDir,
 		TerminalString: d.terminalString,
 		Height:         terminalHeight,
 		Width:          terminalWidth,
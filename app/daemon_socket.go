@@ -0,0 +1,144 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// The commands of the control socket. A command is a line of text, and the
+// response is a line with "ok" or "error: " followed by the error message.
+const (
+	ControlInventoryRefresh = "inventory refresh"
+
+	controlResponseOK    = "ok"
+	controlResponseError = "error: "
+)
+
+// listenControl serves the control socket at the path until the daemon
+// stops. The socket is only accessible to the owner of the daemon: it is
+// created in a private directory and moved into place once its permissions
+// are set.
+func (d *Daemon) listenControl(path string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// Only the socket left by a previous instance is replaced
+	if info, err := os.Lstat(path); err == nil && info.Mode().Type() != os.ModeSocket {
+		return fmt.Errorf("%s already exists and is not a socket", path)
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	tmpDir, err := os.MkdirTemp(dir, ".control-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpPath := filepath.Join(tmpDir, "control.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	l.SetUnlinkOnClose(false)
+	if err = os.Chmod(tmpPath, 0600); err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = os.Lstat(path)
+	}
+	if err != nil {
+		l.Close()
+		return err
+	}
+	go func() {
+		<-d.done
+		l.Close()
+		// Leave the socket of another instance in place
+		if current, err := os.Lstat(path); err == nil && os.SameFile(info, current) {
+			_ = os.Remove(path)
+		}
+	}()
+	go d.serveControl(l)
+	return nil
+}
+
+func (d *Daemon) serveControl(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Warnf("control socket: %s", err.Error())
+			continue
+		}
+		go d.handleControl(conn)
+	}
+}
+
+func (d *Daemon) handleControl(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(controlTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		log.Debugf("control socket: failed to read command: %s", err.Error())
+		return
+	}
+	command := strings.Join(strings.Fields(line), " ")
+	switch command {
+	case ControlInventoryRefresh:
+		log.Info("inventory refresh requested by local command")
+		err = d.RefreshInventory()
+	default:
+		err = fmt.Errorf("unknown command %q", command)
+	}
+	response := controlResponseOK
+	if err != nil {
+		response = controlResponseError + err.Error()
+	}
+	_, _ = fmt.Fprintln(conn, response)
+}
+
+// SendControlCommand sends the command to the daemon listening on the
+// control socket at the path.
+func SendControlCommand(path, command string) error {
+	conn, err := net.DialTimeout("unix", path, controlTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the daemon: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(controlTimeout))
+	if _, err = fmt.Fprintln(conn, command); err != nil {
+		return fmt.Errorf("failed to send the command: %w", err)
+	}
+	response, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read the response: %w", err)
+	}
+	response = strings.TrimSpace(response)
+	if response == controlResponseOK {
+		return nil
+	}
+	return errors.New(strings.TrimPrefix(response, controlResponseError))
+}
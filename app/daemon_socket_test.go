@@ -0,0 +1,87 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/northerntechhq/nt-connect/config"
+)
+
+func TestControlSocket(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "run", "control.sock")
+
+	d := newDaemon(&config.NTConnectConfig{
+		NTConnectConfigFromFile: config.NTConnectConfigFromFile{
+			APIConfig: config.APIConfig{
+				InventoryExecutable: "/usr/share/nt-connect/inventory.sh",
+			},
+		},
+	})
+	defer d.StopDaemon()
+	if !assert.NoError(t, d.listenControl(path)) {
+		t.FailNow()
+	}
+	info, err := os.Lstat(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.ModeSocket, info.Mode().Type())
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+	// The private directory is removed
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if assert.NoError(t, err) && assert.Len(t, entries, 1) {
+		assert.Equal(t, "control.sock", entries[0].Name())
+	}
+
+	// Consecutive requests are coalesced
+	assert.NoError(t, SendControlCommand(path, ControlInventoryRefresh))
+	assert.NoError(t, SendControlCommand(path, ControlInventoryRefresh))
+	assert.Len(t, d.inventoryRefresh, 1)
+
+	err = SendControlCommand(path, "dummy")
+	assert.EqualError(t, err, `unknown command "dummy"`)
+
+	// The stale socket is replaced
+	disabled := newDaemon(&config.NTConnectConfig{})
+	defer disabled.StopDaemon()
+	if !assert.NoError(t, disabled.listenControl(path)) {
+		t.FailNow()
+	}
+	err = SendControlCommand(path, ControlInventoryRefresh)
+	assert.EqualError(t, err, ErrInventoryDisabled.Error())
+
+	disabled.StopDaemon()
+	assert.Eventually(t, func() bool {
+		_, err := os.Lstat(path)
+		return os.IsNotExist(err)
+	}, time.Second*5, time.Millisecond*10, "the socket should be removed")
+	err = SendControlCommand(filepath.Join(t.TempDir(), "missing.sock"), "dummy")
+	assert.ErrorContains(t, err, "failed to connect to the daemon")
+
+	// Files other than sockets are not replaced
+	filePath := filepath.Join(t.TempDir(), "control.sock")
+	if !assert.NoError(t, os.WriteFile(filePath, []byte("data"), 0644)) {
+		t.FailNow()
+	}
+	err = disabled.listenControl(filePath)
+	assert.EqualError(t, err, filePath+" already exists and is not a socket")
+	b, _ := os.ReadFile(filePath)
+	assert.Equal(t, "data", string(b))
+}
@@ -0,0 +1,118 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package app
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/northerntechhq/nt-connect/api"
+	"github.com/northerntechhq/nt-connect/utils/systemd"
+)
+
+// initSystemd sets up the notifications to systemd when started as a
+// service with Type=notify, and the watchdog if enabled.
+func (d *Daemon) initSystemd() {
+	notifier, err := systemd.NewNotifier()
+	if err != nil {
+		log.Warnf("systemd notifications not available: %s", err.Error())
+		return
+	} else if notifier == nil {
+		return
+	}
+	d.notifier = notifier
+	d.startupTimer = time.NewTimer(d.startupTimeout).C
+	interval, err := systemd.WatchdogInterval()
+	if err != nil {
+		log.Warnf("systemd watchdog not available: %s", err.Error())
+	} else if interval > 0 {
+		// The watchdog is notified twice per interval, leaving the
+		// message loop a quarter of the interval to respond.
+		d.watchdogTicker = time.NewTicker(interval / 2).C
+		d.watchdogTimeout = interval / 4
+	}
+}
+
+func (d *Daemon) notifySystemd(state ...string) {
+	if err := d.notifier.Notify(state...); err != nil {
+		log.Debug(err.Error())
+	}
+}
+
+// notifyReady notifies systemd that the daemon started, with the optional
+// state, once connected or after the startup timeout.
+func (d *Daemon) notifyReady(state ...string) {
+	d.readyOnce.Do(func() {
+		d.notifySystemd(append([]string{systemd.Ready}, state...)...)
+	})
+}
+
+// notifyStartupTimeout notifies systemd that the daemon started even though
+// it is not connected yet, not to hold the boot while the server is
+// unreachable.
+func (d *Daemon) notifyStartupTimeout() {
+	if !d.connected.Load() {
+		log.Warnf("not connected after %s: notifying systemd anyway", d.startupTimeout)
+		d.notifyReady(systemd.Status("Disconnected: connecting to the server"))
+	}
+}
+
+// updateStatus notifies systemd about the connection state and the number
+// of active sessions if changed. It must be called from the message loop.
+func (d *Daemon) updateStatus() {
+	if d.notifier == nil {
+		return
+	}
+	count := len(d.activeSessions())
+	var status string
+	if d.connected.Load() {
+		status = systemd.Status("Connected to %s: %d active sessions", d.serverURL, count)
+	} else {
+		status = systemd.Status("Disconnected: %d active sessions", count)
+	}
+	if status != d.status {
+		d.status = status
+		d.notifySystemd(status)
+	}
+}
+
+// messageLoopResponding returns false if the message loop does not pick up
+// a request within the watchdog timeout. The message loop is assumed to be
+// responding while it connects, which it retries on its own.
+func (d *Daemon) messageLoopResponding() bool {
+	if !d.connected.Load() {
+		return true
+	}
+	timer := time.NewTimer(d.watchdogTimeout)
+	defer timer.Stop()
+	select {
+	case d.controlChan <- func(api.Sender) {}:
+		return true
+	case <-d.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// notifyWatchdog notifies the systemd watchdog if the message loop is
+// responding, for systemd to restart the daemon otherwise.
+func (d *Daemon) notifyWatchdog() {
+	if !d.messageLoopResponding() {
+		log.Warn("message loop not responding: skipping watchdog notification")
+		return
+	}
+	d.notifySystemd(systemd.Watchdog)
+}
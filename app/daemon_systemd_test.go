@@ -0,0 +1,143 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package app
+
+import (
+	"net"
+	"os/user"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/northerntechhq/nt-connect/config"
+	"github.com/northerntechhq/nt-connect/utils/systemd"
+	"github.com/northerntechhq/nt-connect/utils/types"
+)
+
+func TestDaemonSystemd(t *testing.T) {
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Fatalf("cant get current user: %s", err.Error())
+	}
+	// The service manager is a local datagram socket
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv(systemd.EnvNotifySocket, path)
+	t.Setenv(systemd.EnvWatchdogUsec, "200000")
+	t.Setenv(systemd.EnvWatchdogPID, "")
+
+	d := newDaemon(&config.NTConnectConfig{
+		NTConnectConfigFromFile: config.NTConnectConfigFromFile{
+			User: currentUser.Username,
+		},
+	})
+	d.initSystemd()
+	if !assert.NotNil(t, d.notifier) || !assert.NotNil(t, d.watchdogTicker) {
+		t.FailNow()
+	}
+	sockMock := runTestDaemon(t, d)
+
+	waitNotification := func(expected string) {
+		t.Helper()
+		b := make([]byte, 1024)
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			n, err := conn.Read(b)
+			if err != nil {
+				t.Fatalf("waiting for notification %q: %s", expected, err.Error())
+			} else if string(b[:n]) == expected {
+				return
+			}
+		}
+	}
+	waitNotification(systemd.Ready)
+	waitNotification("STATUS=Connected to http://localhost:12345: 0 active sessions")
+
+	sockMock.Input() <- ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeControl,
+			MsgType:   ws.MessageTypePing,
+			SessionID: "session",
+		},
+	}
+	waitNotification("STATUS=Connected to http://localhost:12345: 1 active sessions")
+	waitNotification(systemd.Watchdog)
+}
+
+func TestDaemonSystemdStartupTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv(systemd.EnvNotifySocket, path)
+	t.Setenv(systemd.EnvWatchdogUsec, "")
+
+	d := newDaemon(&config.NTConnectConfig{
+		NTConnectConfigFromFile: config.NTConnectConfigFromFile{
+			StartupTimeout: types.Duration(10 * time.Millisecond),
+		},
+	})
+	d.initSystemd()
+	select {
+	case <-d.startupTimer:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the startup timeout")
+	}
+	d.notifyStartupTimeout()
+
+	b := make([]byte, 1024)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, systemd.Ready+"\nSTATUS=Disconnected: connecting to the server",
+			string(b[:n]))
+	}
+
+	// Ready is only notified once
+	d.notifyConnection(true, "http://localhost:12345")
+	n, err = conn.Read(b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "STATUS=Connected to http://localhost:12345: 0 active sessions",
+			string(b[:n]))
+	}
+}
+
+func TestMessageLoopResponding(t *testing.T) {
+	t.Parallel()
+	d := newDaemon(&config.NTConnectConfig{})
+	d.watchdogTimeout = 10 * time.Millisecond
+
+	// Connecting
+	assert.True(t, d.messageLoopResponding())
+
+	// Hung message loop
+	d.connected.Store(true)
+	assert.False(t, d.messageLoopResponding())
+
+	go func() {
+		fn := <-d.controlChan
+		fn(nil)
+	}()
+	d.watchdogTimeout = 5 * time.Second
+	assert.True(t, d.messageLoopResponding())
+}
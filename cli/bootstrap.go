@@ -16,9 +16,8 @@ package cli
 
 import (
 	"crypto"
-	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -32,44 +31,98 @@ import (
 	cryptoutil "github.com/northerntechhq/nt-connect/utils/crypto"
 )
 
-func bootstrapHTTP(
-	cfg *config.NTConnectConfig, force bool,
-	keyType string, extraIdentity []string,
-) (err error) {
-	var (
-		pkey     crypto.Signer
-		identity *api.Identity
-	)
-	if _, err = os.Stat(cfg.APIConfig.PrivateKeyPath); err != nil {
+func bootstrapPrivateKey(
+	cfg config.APIConfig, force bool, keyType string,
+) (pkey crypto.Signer, err error) {
+	if cfg.PrivateKeyURI != "" || len(cfg.SignerCommand) > 0 {
+		return bootstrapExternalKey(cfg, force, keyType)
+	}
+	passphrase, err := cfg.ReadPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = os.Stat(cfg.PrivateKeyPath); err != nil {
 		if !os.IsNotExist(err) {
-			return fmt.Errorf(
+			return nil, fmt.Errorf(
 				"unexpected error checking file existance: %w",
 				err,
 			)
 		}
 	} else if err == nil {
-		b, err := os.ReadFile(cfg.APIConfig.PrivateKeyPath)
+		b, err := os.ReadFile(cfg.PrivateKeyPath)
 		if err == nil {
-			pkey, err = cryptoutil.LoadPrivateKey(b)
+			pkey, err = cryptoutil.LoadPrivateKeyWithPassphrase(b, passphrase)
 		}
 		if err != nil {
-			return fmt.Errorf("failed to load private key: %w", err)
+			return nil, fmt.Errorf("failed to load private key: %w", err)
 		}
 	}
 	if os.IsNotExist(err) || force {
 		kt, err := cryptoutil.ParseKeyType(keyType)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		pkey, err = cryptoutil.GeneratePrivateKey(kt)
 		if err != nil {
-			return fmt.Errorf("failed to generate private key: %w", err)
+			return nil, fmt.Errorf("failed to generate private key: %w", err)
 		}
-		err = cryptoutil.SavePrivateKey(pkey, cfg.APIConfig.PrivateKeyPath)
+		err = cryptoutil.SaveEncryptedPrivateKey(pkey, cfg.PrivateKeyPath, passphrase)
 		if err != nil {
-			return fmt.Errorf("failed to save private key: %w", err)
+			return nil, fmt.Errorf("failed to save private key: %w", err)
 		}
 	}
+	return pkey, nil
+}
+
+// bootstrapExternalKey loads the device key from a PKCS #11 token or
+// signer helper, generating the key inside the token if it does not exist.
+// Any other error loading the key is returned, so that a token that is
+// temporarily unavailable does not replace the device identity.
+func bootstrapExternalKey(
+	cfg config.APIConfig, force bool, keyType string,
+) (crypto.Signer, error) {
+	var (
+		pkey crypto.Signer
+		err  error
+	)
+	if !force {
+		if cfg.PrivateKeyURI != "" {
+			pkey, err = cryptoutil.NewPKCS11Signer(cfg.PrivateKeyURI)
+		} else {
+			pkey, err = cryptoutil.NewExternalSigner(cfg.SignerCommand)
+		}
+		if err == nil {
+			return pkey, nil
+		} else if !errors.Is(err, cryptoutil.ErrKeyNotFound) {
+			return nil, fmt.Errorf("failed to load private key: %w", err)
+		}
+		log.Infof("%s: generating a new key", err)
+	}
+	kt, err := cryptoutil.ParseKeyType(keyType)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.PrivateKeyURI != "" {
+		pkey, err = cryptoutil.GeneratePKCS11Key(cfg.PrivateKeyURI, kt)
+	} else {
+		pkey, err = cryptoutil.GenerateExternalKey(cfg.SignerCommand, kt)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate private key: %w", err)
+	}
+	return pkey, nil
+}
+
+func bootstrapHTTP(
+	cfg *config.NTConnectConfig, force bool,
+	keyType string, extraIdentity []string,
+	csr csrOptions,
+) (err error) {
+	var identity *api.Identity
+	pkey, err := bootstrapPrivateKey(cfg.APIConfig, force, keyType)
+	if err != nil {
+		return err
+	}
 	if _, err = os.Stat(cfg.APIConfig.IdentityPath); err != nil &&
 		!os.IsNotExist(err) {
 		return fmt.Errorf("unexpected error checking file existance: %w", err)
@@ -83,6 +136,7 @@ func bootstrapHTTP(
 		if err != nil {
 			return fmt.Errorf("failed to generate private key: %w", err)
 		}
+		removeAuthzCache(&cfg.APIConfig)
 	} else {
 		b, err := os.ReadFile(cfg.APIConfig.IdentityPath)
 		if err == nil {
@@ -92,6 +146,12 @@ func bootstrapHTTP(
 			return fmt.Errorf("failed to load identity file: %w", err)
 		}
 	}
+	if csr.Path != "" {
+		err = writeCertificateRequest(pkey, csr)
+		if err != nil {
+			return err
+		}
+	}
 	enc := json.NewEncoder(os.Stdout)
 	enc.SetIndent("", "  ")
 	err = enc.Encode(identity)
@@ -102,6 +162,32 @@ func bootstrapHTTP(
 	return err
 }
 
+type csrOptions struct {
+	Path       string
+	CommonName string
+}
+
+func writeCertificateRequest(pkey crypto.Signer, opts csrOptions) error {
+	commonName := opts.CommonName
+	if commonName == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to get hostname for CSR: %w", err)
+		}
+		commonName = hostname
+	}
+	csrPEM, err := cryptoutil.CreateCertificateRequest(pkey, commonName)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(opts.Path, csrPEM, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write CSR: %w", err)
+	}
+	log.Infof("certificate signing request written to %s", opts.Path)
+	return nil
+}
+
 func bootstrap(c *cli.Context, cfg *config.NTConnectConfig) error {
 	var err error
 	switch cfg.APIConfig.APIType {
@@ -109,6 +195,10 @@ func bootstrap(c *cli.Context, cfg *config.NTConnectConfig) error {
 		err = bootstrapHTTP(
 			cfg, c.Bool("force"),
 			c.String("key-type"), c.StringSlice("extra-identity"),
+			csrOptions{
+				Path:       c.String("csr"),
+				CommonName: c.String("csr-common-name"),
+			},
 		)
 	case config.APITypeDBus:
 		log.Info("Authentication configured for DBus: skipping bootstrap")
@@ -135,14 +225,10 @@ func generateIdentityData(
 		}
 		identityData = make(map[string]string, len(extraValues)+1)
 	)
-	pubBytes, err := x509.MarshalPKIXPublicKey(pkey.Public())
+	identity.PublicKey, err = encodePublicKey(pkey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to serialize public key: %w", err)
+		return nil, err
 	}
-	identity.PublicKey = string(pem.EncodeToMemory(&pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: pubBytes,
-	}))
 	interfaces, err := net.Interfaces()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get interfaces: %w", err)
@@ -186,19 +272,11 @@ func generateIdentityData(
 		}
 	}
 
-	fd, err := os.OpenFile(cfg.IdentityPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create identity file: %w", err)
-	}
-	defer fd.Close()
-
 	b, _ := json.Marshal(identityData)
 	identity.Data = string(b)
 
-	enc := json.NewEncoder(fd)
-	err = enc.Encode(identity)
-	if err != nil {
-		return nil, fmt.Errorf("error serializing identity data: %w", err)
+	if err = saveIdentity(cfg.IdentityPath, identity); err != nil {
+		return nil, err
 	}
 	return identity, nil
 }
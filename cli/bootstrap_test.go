@@ -0,0 +1,100 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/northerntechhq/nt-connect/config"
+)
+
+func TestBootstrapExternalKey(t *testing.T) {
+	t.Parallel()
+	// The helper fails the public-key verb with the exit status and
+	// records the generate requests.
+	newHelper := func(dir string, status int) []string {
+		return []string{"/bin/sh", "-c",
+			`if [ "$0" = public-key ]; then exit ` + strconv.Itoa(status) + `; fi
+			echo "$0" >> ` + filepath.Join(dir, "generated") + `; exit 1`}
+	}
+	testCases := []struct {
+		Name string
+
+		Status    int
+		Force     bool
+		Generated bool
+		Error     string
+	}{{
+		Name: "ok/key not found",
+
+		Status:    3,
+		Generated: true,
+		Error:     "failed to generate private key",
+	}, {
+		Name: "ok/force",
+
+		Status:    1,
+		Force:     true,
+		Generated: true,
+		Error:     "failed to generate private key",
+	}, {
+		Name: "error/helper failure",
+
+		Status: 1,
+		Error:  "failed to load private key",
+	}}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			_, err := bootstrapExternalKey(config.APIConfig{
+				SignerCommand: newHelper(dir, tc.Status),
+			}, tc.Force, "secp256r1")
+			assert.ErrorContains(t, err, tc.Error)
+			_, err = os.Stat(filepath.Join(dir, "generated"))
+			assert.Equal(t, tc.Generated, err == nil)
+		})
+	}
+}
+
+func TestBootstrapRemovesAuthzCache(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.NewNTConnectConfig()
+	cfg.APIConfig.APIType = config.APITypeHTTP
+	cfg.APIConfig.PrivateKeyPath = filepath.Join(dir, "private.pem")
+	cfg.APIConfig.IdentityPath = filepath.Join(dir, "identity.json")
+	cfg.APIConfig.AuthzCachePath = filepath.Join(dir, "authz.json")
+	cfg.APIConfig.Servers = []config.ServerConfig{
+		{ServerURL: "https://primary"}, {ServerURL: "https://secondary"},
+	}
+	cachePaths := cfg.APIConfig.AuthzCachePaths()
+	for _, path := range cachePaths {
+		if err := os.WriteFile(path, []byte(`{"token":"token"}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := bootstrapHTTP(cfg, true, "secp256r1", nil, csrOptions{})
+	if assert.NoError(t, err) {
+		assert.Len(t, cachePaths, 2)
+		for _, path := range cachePaths {
+			assert.NoFileExists(t, path)
+		}
+	}
+}
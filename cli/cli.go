@@ -15,11 +15,14 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/urfave/cli/v2"
 
 	"github.com/northerntechhq/nt-connect/api"
+	"github.com/northerntechhq/nt-connect/app"
 	"github.com/northerntechhq/nt-connect/config"
 )
 
@@ -58,6 +61,52 @@ func SetupCLI(args []string) error {
 						Usage: "Extra identity values " +
 							"(--extra-identity key=value [--extra-identity key2=value])",
 					},
+					&cli.StringFlag{
+						Name: "csr",
+						Usage: "Write a certificate signing request for the " +
+							"device key to `FILE`",
+					},
+					&cli.StringFlag{
+						Name:  "csr-common-name",
+						Usage: "Subject common name of the CSR (default: hostname)",
+					},
+				},
+			},
+			{
+				Name: "rotate-key",
+				Usage: "Rotate the device's private key, keeping the " +
+					"identity data.",
+				Action: runOptions.handleCLIOptions,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "key-type",
+						Value: "secp384r1",
+						Usage: "Key type (choices: " +
+							"rsa2048|rsa3072|rsa4096|secp256r1|" +
+							"secp384r1|secp521r1|ed25519)",
+					},
+					&cli.DurationFlag{
+						Name:  "wait",
+						Value: 10 * time.Minute,
+						Usage: "Maximum time to wait for the server to accept the new key",
+					},
+					&cli.DurationFlag{
+						Name:  "poll-interval",
+						Value: 10 * time.Second,
+						Usage: "Interval between authentication attempts with the new key",
+					},
+				},
+			},
+			{
+				Name:  "inventory",
+				Usage: "Manage the device inventory.",
+				Subcommands: []*cli.Command{
+					{
+						Name: "refresh",
+						Usage: "Trigger an inventory update by the running " +
+							"daemon.",
+						Action: runOptions.handleCLIOptions,
+					},
 				},
 			},
 			{
@@ -129,6 +178,13 @@ func (runOptions *runOptionsType) handleCLIOptions(ctx *cli.Context) error {
 		return runDaemon(d)
 	case "bootstrap":
 		return bootstrap(ctx, cfg)
+	case "rotate-key":
+		return rotateKey(ctx, cfg)
+	case "refresh":
+		if cfg.ControlSocket == "" {
+			return errors.New("the control socket is disabled")
+		}
+		return app.SendControlCommand(cfg.ControlSocket, app.ControlInventoryRefresh)
 	default:
 		cli.ShowAppHelpAndExit(ctx, 1)
 	}
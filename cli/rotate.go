@@ -0,0 +1,210 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/northerntechhq/nt-connect/api"
+	apihttp "github.com/northerntechhq/nt-connect/api/http"
+	"github.com/northerntechhq/nt-connect/config"
+	"github.com/northerntechhq/nt-connect/utils"
+	cryptoutil "github.com/northerntechhq/nt-connect/utils/crypto"
+)
+
+var errKeyNotAccepted = errors.New("the new key was not accepted by the server")
+
+type keyRotation struct {
+	cfg          *config.NTConnectConfig
+	keyType      cryptoutil.KeyType
+	wait         time.Duration
+	pollInterval time.Duration
+}
+
+func rotateKey(c *cli.Context, cfg *config.NTConnectConfig) error {
+	if cfg.APIConfig.APIType != config.APITypeHTTP {
+		return fmt.Errorf(
+			"key rotation is only supported for API type %q",
+			config.APITypeHTTP,
+		)
+	}
+	keyType, err := cryptoutil.ParseKeyType(c.String("key-type"))
+	if err != nil {
+		return err
+	}
+	rot := &keyRotation{
+		cfg:          cfg,
+		keyType:      keyType,
+		wait:         c.Duration("wait"),
+		pollInterval: c.Duration("poll-interval"),
+	}
+	return rot.Run(c.Context)
+}
+
+func saveIdentity(path string, identity *api.Identity) error {
+	b, err := json.Marshal(identity)
+	if err != nil {
+		return fmt.Errorf("error serializing identity data: %w", err)
+	}
+	err = utils.WriteFileAtomic(path, append(b, '\n'), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write identity file: %w", err)
+	}
+	return nil
+}
+
+// removeAuthzCache removes the tokens cached for the previous identity.
+func removeAuthzCache(cfg *config.APIConfig) {
+	for _, path := range cfg.AuthzCachePaths() {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Warnf("failed to remove cached token: %s", err.Error())
+		}
+	}
+}
+
+func encodePublicKey(pkey crypto.Signer) (string, error) {
+	pubBytes, err := x509.MarshalPKIXPublicKey(pkey.Public())
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize public key: %w", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pubBytes,
+	})), nil
+}
+
+// Run generates a new device key and authenticates with it, keeping the
+// identity data, until the server accepts the new key. The current key is
+// only replaced after a successful authentication; on failure the new key
+// is discarded.
+func (rot *keyRotation) Run(ctx context.Context) (err error) {
+	apiConfig := rot.cfg.APIConfig
+	if apiConfig.PrivateKeyURI != "" || len(apiConfig.SignerCommand) > 0 {
+		return errors.New("key rotation is not supported for external keys")
+	}
+	if err = apiConfig.Validate(); err != nil {
+		return fmt.Errorf("failed to load current identity: %w", err)
+	}
+	passphrase, err := apiConfig.ReadPassphrase()
+	if err != nil {
+		return err
+	}
+	pendingPath := apiConfig.PrivateKeyPath + config.SuffixPending
+	pendingIdentityPath := apiConfig.IdentityPath + config.SuffixPending
+	pkey, err := cryptoutil.GeneratePrivateKey(rot.keyType)
+	if err != nil {
+		return fmt.Errorf("failed to generate private key: %w", err)
+	}
+	err = cryptoutil.SaveEncryptedPrivateKey(pkey, pendingPath, passphrase)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			log.Warnf("key rotation failed: discarding new key")
+			_ = os.Remove(pendingIdentityPath)
+			_ = os.Remove(pendingPath)
+		}
+	}()
+
+	identity := *apiConfig.GetIdentity()
+	identity.PublicKey, err = encodePublicKey(pkey)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := rot.cfg.TLS.ToStdConfig(apiConfig.GetPrivateKey())
+	if err != nil {
+		return err
+	}
+	client, err := apihttp.NewClient(apiConfig, tlsConfig)
+	if err != nil {
+		return err
+	}
+	client.PrivateKey = pkey
+	client.Identity = &identity
+
+	if err = rot.authenticate(ctx, client); err != nil {
+		return err
+	}
+	if err = saveIdentity(pendingIdentityPath, &identity); err != nil {
+		return err
+	}
+	return rot.commit(pendingPath, pendingIdentityPath)
+}
+
+func (rot *keyRotation) authenticate(ctx context.Context, client api.Client) error {
+	ctx, cancel := context.WithTimeout(ctx, rot.wait)
+	defer cancel()
+	for {
+		_, err := client.Authenticate(ctx)
+		if err == nil {
+			log.Info("new key accepted by the server")
+			return nil
+		} else if ctx.Err() != nil {
+			return errKeyNotAccepted
+		} else if !api.IsUnauthorized(err) {
+			return fmt.Errorf("failed to authenticate with new key: %w", err)
+		}
+		log.Infof("new key pending acceptance: retrying in %s", rot.pollInterval)
+		select {
+		case <-ctx.Done():
+			return errKeyNotAccepted
+		case <-time.After(rot.pollInterval):
+		}
+	}
+}
+
+// commit replaces the current key and identity with the pending ones. The
+// pending identity is written before the key is replaced: if interrupted,
+// the rotation is completed or rolled back when the configuration is
+// loaded (see config.APIConfig). The previous key is restored if the
+// identity cannot be updated.
+func (rot *keyRotation) commit(pendingPath, pendingIdentityPath string) error {
+	keyPath := rot.cfg.APIConfig.PrivateKeyPath
+	backupPath := keyPath + config.SuffixBackup
+	oldKey, err := os.ReadFile(keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to read current private key: %w", err)
+	}
+	if err = utils.WriteFileAtomic(backupPath, oldKey, 0600); err != nil {
+		return fmt.Errorf("failed to back up current private key: %w", err)
+	}
+	if err = os.Rename(pendingPath, keyPath); err != nil {
+		_ = os.Remove(backupPath)
+		return fmt.Errorf("failed to replace private key: %w", err)
+	}
+	if err = os.Rename(pendingIdentityPath, rot.cfg.APIConfig.IdentityPath); err != nil {
+		if errRestore := os.Rename(backupPath, keyPath); errRestore != nil {
+			log.Errorf("failed to restore previous private key from %s: %s",
+				backupPath, errRestore.Error())
+		}
+		return fmt.Errorf("failed to write identity file: %w", err)
+	}
+	removeAuthzCache(&rot.cfg.APIConfig)
+	_ = os.Remove(backupPath)
+	log.Infof("device key rotated: restart the nt-connect service to apply")
+	return nil
+}
@@ -0,0 +1,217 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/northerntechhq/nt-connect/api"
+	"github.com/northerntechhq/nt-connect/config"
+	cryptoutil "github.com/northerntechhq/nt-connect/utils/crypto"
+)
+
+// authHandler verifies the request signature and responds with the status
+// codes in order, repeating the last one.
+func authHandler(t *testing.T, codes ...int) (http.Handler, *atomic.Int32) {
+	var calls atomic.Int32
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := int(calls.Add(1)) - 1
+		if i >= len(codes) {
+			i = len(codes) - 1
+		}
+		body, _ := io.ReadAll(r.Body)
+		var identity api.Identity
+		_ = json.Unmarshal(body, &identity)
+		block, _ := pem.Decode([]byte(identity.PublicKey))
+		if !assert.NotNil(t, block) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		sig, _ := base64.StdEncoding.DecodeString(r.Header.Get("X-Men-Signature"))
+		dgst := sha256.Sum256(body)
+		if !assert.NoError(t, err) ||
+			!assert.True(t, ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), dgst[:], sig)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(codes[i])
+		_, _ = w.Write([]byte("token"))
+	}), &calls
+}
+
+func newRotationConfig(t *testing.T, serverURL string) (*config.NTConnectConfig, []byte) {
+	dir := t.TempDir()
+	cfg := config.NewNTConnectConfig()
+	cfg.APIConfig.APIType = config.APITypeHTTP
+	cfg.APIConfig.ServerURL = serverURL
+	cfg.APIConfig.TenantToken = "tenant"
+	cfg.APIConfig.PrivateKeyPath = filepath.Join(dir, "private.pem")
+	cfg.APIConfig.IdentityPath = filepath.Join(dir, "identity.json")
+	cfg.APIConfig.AuthzCachePath = filepath.Join(dir, "authz.json")
+	err := bootstrapHTTP(cfg, false, string(cryptoutil.KeyTypeSECP256R1),
+		[]string{"serial=1234"}, csrOptions{})
+	if err != nil {
+		t.Fatalf("failed to bootstrap test identity: %s", err)
+	}
+	oldKey, _ := os.ReadFile(cfg.APIConfig.PrivateKeyPath)
+	err = os.WriteFile(cfg.APIConfig.AuthzCachePath, []byte(`{"token":"token"}`), 0600)
+	if err != nil {
+		t.Fatalf("failed to write cached token: %s", err)
+	}
+	return cfg, oldKey
+}
+
+func readIdentity(t *testing.T, path string) *api.Identity {
+	var identity api.Identity
+	b, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(b, &identity)
+	}
+	if err != nil {
+		t.Fatalf("failed to read identity: %s", err)
+	}
+	return &identity
+}
+
+func TestKeyRotation(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		handler, calls := authHandler(t,
+			http.StatusUnauthorized, http.StatusUnauthorized, http.StatusOK)
+		srv := httptest.NewServer(handler)
+		defer srv.Close()
+		cfg, oldKey := newRotationConfig(t, srv.URL)
+		oldIdentity := readIdentity(t, cfg.APIConfig.IdentityPath)
+
+		rot := &keyRotation{
+			cfg:          cfg,
+			keyType:      cryptoutil.KeyTypeSECP256R1,
+			wait:         5 * time.Second,
+			pollInterval: time.Millisecond,
+		}
+		err := rot.Run(context.Background())
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, int32(3), calls.Load())
+
+		newKey, _ := os.ReadFile(cfg.APIConfig.PrivateKeyPath)
+		assert.NotEqual(t, oldKey, newKey)
+		newIdentity := readIdentity(t, cfg.APIConfig.IdentityPath)
+		assert.Equal(t, oldIdentity.Data, newIdentity.Data)
+		pkey, err := cryptoutil.LoadPrivateKey(newKey)
+		if assert.NoError(t, err) {
+			pub, _ := encodePublicKey(pkey)
+			assert.Equal(t, pub, newIdentity.PublicKey)
+		}
+		assert.NoFileExists(t, cfg.APIConfig.PrivateKeyPath+config.SuffixPending)
+		assert.NoFileExists(t, cfg.APIConfig.PrivateKeyPath+config.SuffixBackup)
+		assert.NoFileExists(t, cfg.APIConfig.IdentityPath+config.SuffixPending)
+		assert.NoFileExists(t, cfg.APIConfig.AuthzCachePath)
+	})
+	for name, code := range map[string]int{
+		"error/not accepted":   http.StatusUnauthorized,
+		"error/internal error": http.StatusInternalServerError,
+	} {
+		statusCode := code
+		t.Run(name, func(t *testing.T) {
+			handler, _ := authHandler(t, statusCode)
+			srv := httptest.NewServer(handler)
+			defer srv.Close()
+			cfg, oldKey := newRotationConfig(t, srv.URL)
+			oldIdentity := readIdentity(t, cfg.APIConfig.IdentityPath)
+
+			rot := &keyRotation{
+				cfg:          cfg,
+				keyType:      cryptoutil.KeyTypeSECP256R1,
+				wait:         50 * time.Millisecond,
+				pollInterval: time.Millisecond,
+			}
+			err := rot.Run(context.Background())
+			if statusCode == http.StatusUnauthorized {
+				assert.ErrorIs(t, err, errKeyNotAccepted)
+			} else {
+				assert.True(t, api.IsRetryable(err))
+			}
+
+			key, _ := os.ReadFile(cfg.APIConfig.PrivateKeyPath)
+			assert.Equal(t, oldKey, key)
+			assert.Equal(t, oldIdentity, readIdentity(t, cfg.APIConfig.IdentityPath))
+			assert.NoFileExists(t, cfg.APIConfig.PrivateKeyPath+config.SuffixPending)
+			assert.NoFileExists(t, cfg.APIConfig.IdentityPath+config.SuffixPending)
+			assert.FileExists(t, cfg.APIConfig.AuthzCachePath)
+		})
+	}
+}
+
+func TestKeyRotationRecovery(t *testing.T) {
+	// replaceKey simulates a rotation interrupted after replacing the
+	// key, returning the pending identity.
+	replaceKey := func(t *testing.T, cfg *config.NTConnectConfig) *api.Identity {
+		pkey, err := cryptoutil.GeneratePrivateKey(cryptoutil.KeyTypeSECP256R1)
+		if err == nil {
+			err = cryptoutil.SavePrivateKey(pkey, cfg.APIConfig.PrivateKeyPath)
+		}
+		if err != nil {
+			t.Fatalf("failed to replace private key: %s", err)
+		}
+		identity := readIdentity(t, cfg.APIConfig.IdentityPath)
+		identity.PublicKey, _ = encodePublicKey(pkey)
+		return identity
+	}
+	t.Run("ok/complete", func(t *testing.T) {
+		cfg, _ := newRotationConfig(t, "https://localhost")
+		identity := replaceKey(t, cfg)
+		pendingPath := cfg.APIConfig.IdentityPath + config.SuffixPending
+		if err := saveIdentity(pendingPath, identity); err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, cfg.APIConfig.Validate())
+		assert.Equal(t, identity, readIdentity(t, cfg.APIConfig.IdentityPath))
+		assert.Equal(t, identity.PublicKey, cfg.APIConfig.GetIdentity().PublicKey)
+		assert.NoFileExists(t, pendingPath)
+	})
+	t.Run("ok/roll back", func(t *testing.T) {
+		cfg, oldKey := newRotationConfig(t, "https://localhost")
+		oldIdentity := readIdentity(t, cfg.APIConfig.IdentityPath)
+		backupPath := cfg.APIConfig.PrivateKeyPath + config.SuffixBackup
+		if err := os.WriteFile(backupPath, oldKey, 0600); err != nil {
+			t.Fatal(err)
+		}
+		replaceKey(t, cfg)
+		assert.NoError(t, cfg.APIConfig.Validate())
+		key, _ := os.ReadFile(cfg.APIConfig.PrivateKeyPath)
+		assert.Equal(t, oldKey, key)
+		pub, _ := encodePublicKey(cfg.APIConfig.GetPrivateKey())
+		assert.Equal(t, oldIdentity.PublicKey, pub)
+		assert.NoFileExists(t, backupPath)
+	})
+}
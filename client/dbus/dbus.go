@@ -63,6 +63,51 @@ type DBusAPI interface {
 	WaitForSignal(signalName string, timeout time.Duration) ([]SignalParams, error)
 }
 
+// MethodHandler handles a method call on an exported interface. It receives
+// the call arguments and returns the reply arguments.
+type MethodHandler func(args []interface{}) ([]interface{}, error)
+
+// ExportedInterface describes an interface of an object exported on the bus.
+type ExportedInterface struct {
+	// Name is the interface name.
+	Name string
+	// Methods maps the method names to their handlers.
+	Methods map[string]MethodHandler
+	// Properties returns the current values of the (read-only) properties.
+	Properties func() map[string]interface{}
+	// Introspection is the XML <interface> element describing the
+	// interface.
+	Introspection string
+}
+
+// MethodError is returned by a MethodHandler to reply with a D-Bus error.
+type MethodError struct {
+	Name    string
+	Message string
+}
+
+func (err *MethodError) Error() string {
+	return err.Name + ": " + err.Message
+}
+
+// DBusServiceAPI is implemented by DBusAPIs which can provide services on
+// the bus in addition to calling them.
+type DBusServiceAPI interface {
+	// BusRequestName requests ownership of the well-known bus name
+	BusRequestName(conn Handle, name string) error
+	// BusExportInterface exports an interface of the object at the path
+	BusExportInterface(conn Handle, objectPath string, iface ExportedInterface) error
+	// BusEmitSignal emits a signal from the object at the path
+	BusEmitSignal(
+		conn Handle, objectPath, interfaceName, signalName string, args ...interface{},
+	) error
+	// BusEmitPropertiesChanged emits the standard PropertiesChanged
+	// signal with the new values of the properties
+	BusEmitPropertiesChanged(
+		conn Handle, objectPath, interfaceName string, changed map[string]interface{},
+	) error
+}
+
 // GetDBusAPI returns the global DBusAPI object
 func GetDBusAPI() (DBusAPI, error) {
 	if dbusAPI != nil {
@@ -11,8 +11,8 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
-//go:build !nodbus && cgo
-// +build !nodbus,cgo
+//go:build !nodbus && cgo && !purego
+// +build !nodbus,cgo,!purego
 
 package dbus
 
@@ -50,10 +50,6 @@ const (
 	GDBusCallFlagsAllowInteractiveAuthorization = (1 << 1)
 )
 
-const (
-	GDBusTypeString = "s"
-)
-
 // BusGet synchronously connects to the message bus specified by bus_type
 // https://developer.gnome.org/gio/stable/GDBusConnection.html#g-bus-get-sync
 func (d *dbusAPILibGio) BusGet(busType uint) (Handle, error) {
@@ -109,15 +105,29 @@ func (d *dbusAPILibGio) BusProxyCall(
 	params interface{},
 	timeout int,
 ) (DBusCallResponse, error) {
-	var gerror *C.GError
+	var (
+		gerror *C.GError
+		err    error
+	)
 	gproxy := C.to_gdbusproxy(unsafe.Pointer(proxy))
 	cmethodName := C.CString(methodName)
 	defer C.free(unsafe.Pointer(cmethodName))
+	var parameters *C.GVariant
+	switch params := params.(type) {
+	case nil:
+	case []interface{}:
+		parameters, err = tupleToGVariant(params)
+	default:
+		parameters, err = tupleToGVariant([]interface{}{params})
+	}
+	if err != nil {
+		return nil, err
+	}
 	flags := C.GDBusCallFlags(GDBusCallFlagsNone)
 	result := C.g_dbus_proxy_call_sync(
 		gproxy,
 		cmethodName,
-		nil,
+		parameters,
 		flags,
 		C.gint(timeout),
 		nil,
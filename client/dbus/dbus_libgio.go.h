@@ -95,3 +95,102 @@ static void g_signal_connect_on_proxy(GDBusProxy *proxy)
 {
     g_signal_connect(proxy, "g-signal", G_CALLBACK(on_signal), NULL);
 }
+
+// exported by golang, see dbus_libgio_service.go
+void handle_method_call(
+    guint id,
+    gchar *method_name,
+    GVariant *parameters,
+    GDBusMethodInvocation *invocation);
+
+// exported by golang, see dbus_libgio_service.go
+GVariant *handle_get_property(guint id, gchar *property_name, GError **error);
+
+// method call handler of the exported objects
+static void on_method_call(
+    GDBusConnection *connection,
+    const gchar *sender,
+    const gchar *object_path,
+    const gchar *interface_name,
+    const gchar *method_name,
+    GVariant *parameters,
+    GDBusMethodInvocation *invocation,
+    gpointer user_data)
+{
+    handle_method_call(
+        GPOINTER_TO_UINT(user_data), (gchar *)method_name, parameters, invocation);
+}
+
+// property getter of the exported objects; the properties are read-only
+static GVariant *on_get_property(
+    GDBusConnection *connection,
+    const gchar *sender,
+    const gchar *object_path,
+    const gchar *interface_name,
+    const gchar *property_name,
+    GError **error,
+    gpointer user_data)
+{
+    return handle_get_property(
+        GPOINTER_TO_UINT(user_data), (gchar *)property_name, error);
+}
+
+static const GDBusInterfaceVTable interface_vtable = {
+    on_method_call,
+    on_get_property,
+    NULL,
+};
+
+// registers the object with the interface identified by id; the calls are
+// dispatched in the main context
+static guint register_object(
+    GDBusConnection *conn,
+    const gchar *object_path,
+    GDBusInterfaceInfo *info,
+    guint id,
+    GMainContext *context,
+    GError **error)
+{
+    guint registration;
+    g_main_context_push_thread_default(context);
+    registration = g_dbus_connection_register_object(
+        conn, object_path, info, &interface_vtable, GUINT_TO_POINTER(id), NULL, error);
+    g_main_context_pop_thread_default(context);
+    return registration;
+}
+
+// requests the well-known name without queueing and returns the reply code
+static guint32 request_name(GDBusConnection *conn, const gchar *name, GError **error)
+{
+    guint32 reply = 0;
+    GVariant *result = g_dbus_connection_call_sync(
+        conn,
+        "org.freedesktop.DBus",
+        "/org/freedesktop/DBus",
+        "org.freedesktop.DBus",
+        "RequestName",
+        g_variant_new("(su)", name, G_BUS_NAME_OWNER_FLAGS_DO_NOT_QUEUE),
+        G_VARIANT_TYPE("(u)"),
+        G_DBUS_CALL_FLAGS_NONE,
+        -1,
+        NULL,
+        error);
+    if (result != NULL)
+    {
+        g_variant_get(result, "(u)", &reply);
+        g_variant_unref(result);
+    }
+    return reply;
+}
+
+// sets a D-Bus error
+static void set_dbus_error(GError **error, gint code, const gchar *message)
+{
+    g_set_error_literal(error, G_DBUS_ERROR, code, message);
+}
+
+// creates a builder for a dictionary of variants
+static GVariantBuilder *new_dict_builder(void)
+{
+    return g_variant_builder_new(G_VARIANT_TYPE("a{sv}"));
+}
@@ -19,3 +19,8 @@ const (
 	GBusTypeSystem  = 1
 	GBusTypeSession = 2
 )
+
+// Type strings of signal parameters.
+const (
+	GDBusTypeString = "s"
+)
@@ -11,8 +11,8 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
-//go:build !nodbus && cgo
-// +build !nodbus,cgo
+//go:build !nodbus && cgo && !purego
+// +build !nodbus,cgo,!purego
 
 package dbus
 
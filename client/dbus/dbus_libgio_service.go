@@ -0,0 +1,378 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//go:build !nodbus && cgo && !purego
+// +build !nodbus,cgo,!purego
+
+package dbus
+
+// #cgo pkg-config: gio-2.0
+// #include <stdlib.h>
+// #include <gio/gio.h>
+// #include "dbus_libgio.go.h"
+import "C"
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+const (
+	propertiesInterface = "org.freedesktop.DBus.Properties"
+	errorFailed         = "org.freedesktop.DBus.Error.Failed"
+	errorUnknownMethod  = "org.freedesktop.DBus.Error.UnknownMethod"
+	errorInvalidArgs    = "org.freedesktop.DBus.Error.InvalidArgs"
+
+	requestNameReplyPrimaryOwner = uint32(1)
+	requestNameReplyAlreadyOwner = uint32(4)
+)
+
+var (
+	errNameTaken = errors.New("dbus: name already taken")
+
+	_ DBusServiceAPI = (*dbusAPILibGio)(nil)
+)
+
+// exportedInterfaces maps the IDs passed to the C callbacks to the exported
+// interfaces: C code must not keep pointers to Go memory.
+var exportedInterfaces = struct {
+	sync.Mutex
+	next       C.guint
+	interfaces map[C.guint]ExportedInterface
+}{interfaces: make(map[C.guint]ExportedInterface)}
+
+func addExportedInterface(iface ExportedInterface) C.guint {
+	exportedInterfaces.Lock()
+	defer exportedInterfaces.Unlock()
+	exportedInterfaces.next++
+	exportedInterfaces.interfaces[exportedInterfaces.next] = iface
+	return exportedInterfaces.next
+}
+
+func removeExportedInterface(id C.guint) {
+	exportedInterfaces.Lock()
+	defer exportedInterfaces.Unlock()
+	delete(exportedInterfaces.interfaces, id)
+}
+
+func exportedInterface(id C.guint) ExportedInterface {
+	exportedInterfaces.Lock()
+	defer exportedInterfaces.Unlock()
+	return exportedInterfaces.interfaces[id]
+}
+
+var (
+	serviceContextOnce sync.Once
+	serviceContext     *C.GMainContext
+)
+
+// serviceMainContext returns the main context dispatching the calls to the
+// exported objects. It runs its own main loop, so the objects are served
+// whether or not the client main loop runs.
+func serviceMainContext() *C.GMainContext {
+	serviceContextOnce.Do(func() {
+		serviceContext = C.g_main_context_new()
+		loop := C.g_main_loop_new(serviceContext, 0)
+		go C.g_main_loop_run(loop)
+	})
+	return serviceContext
+}
+
+// BusRequestName requests ownership of the well-known bus name
+func (d *dbusAPILibGio) BusRequestName(conn Handle, name string) error {
+	var gerror *C.GError
+	gconn := C.to_gdbusconnection(unsafe.Pointer(conn))
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	reply := uint32(C.request_name(gconn, (*C.gchar)(cname), &gerror))
+	if Handle(gerror) != nil {
+		return ErrorFromNative(Handle(gerror))
+	}
+	switch reply {
+	case requestNameReplyPrimaryOwner, requestNameReplyAlreadyOwner:
+		return nil
+	}
+	return fmt.Errorf("%w: %s", errNameTaken, name)
+}
+
+// BusExportInterface exports an interface of the object at the path
+// https://docs.gtk.org/gio/method.DBusConnection.register_object.html
+func (d *dbusAPILibGio) BusExportInterface(
+	conn Handle,
+	objectPath string,
+	iface ExportedInterface,
+) error {
+	var gerror *C.GError
+	gconn := C.to_gdbusconnection(unsafe.Pointer(conn))
+	cxml := C.CString("<node>" + iface.Introspection + "</node>")
+	defer C.free(unsafe.Pointer(cxml))
+	node := C.g_dbus_node_info_new_for_xml((*C.gchar)(cxml), &gerror)
+	if Handle(gerror) != nil {
+		return ErrorFromNative(Handle(gerror))
+	}
+	defer C.g_dbus_node_info_unref(node)
+	cname := C.CString(iface.Name)
+	defer C.free(unsafe.Pointer(cname))
+	info := C.g_dbus_node_info_lookup_interface(node, (*C.gchar)(cname))
+	if info == nil {
+		return fmt.Errorf("dbus: interface %q not found in the introspection data", iface.Name)
+	}
+	cobjectPath := C.CString(objectPath)
+	defer C.free(unsafe.Pointer(cobjectPath))
+	id := addExportedInterface(iface)
+	C.register_object(
+		gconn, (*C.gchar)(cobjectPath), info, id, serviceMainContext(), &gerror,
+	)
+	if Handle(gerror) != nil {
+		removeExportedInterface(id)
+		return ErrorFromNative(Handle(gerror))
+	}
+	return nil
+}
+
+// BusEmitSignal emits a signal from the object at the path
+// https://docs.gtk.org/gio/method.DBusConnection.emit_signal.html
+func (d *dbusAPILibGio) BusEmitSignal(
+	conn Handle,
+	objectPath, interfaceName, signalName string,
+	args ...interface{},
+) error {
+	parameters, err := tupleToGVariant(args)
+	if err != nil {
+		return err
+	}
+	var gerror *C.GError
+	gconn := C.to_gdbusconnection(unsafe.Pointer(conn))
+	cobjectPath := C.CString(objectPath)
+	defer C.free(unsafe.Pointer(cobjectPath))
+	cinterfaceName := C.CString(interfaceName)
+	defer C.free(unsafe.Pointer(cinterfaceName))
+	csignalName := C.CString(signalName)
+	defer C.free(unsafe.Pointer(csignalName))
+	C.g_dbus_connection_emit_signal(
+		gconn,
+		nil,
+		(*C.gchar)(cobjectPath),
+		(*C.gchar)(cinterfaceName),
+		(*C.gchar)(csignalName),
+		parameters,
+		&gerror,
+	)
+	if Handle(gerror) != nil {
+		return ErrorFromNative(Handle(gerror))
+	}
+	return nil
+}
+
+// BusEmitPropertiesChanged emits the standard PropertiesChanged signal
+// with the new values of the properties
+func (d *dbusAPILibGio) BusEmitPropertiesChanged(
+	conn Handle,
+	objectPath, interfaceName string,
+	changed map[string]interface{},
+) error {
+	return d.BusEmitSignal(conn, objectPath, propertiesInterface, "PropertiesChanged",
+		interfaceName, changed, []string{})
+}
+
+//export handle_method_call
+func handle_method_call(
+	id C.guint,
+	methodName *C.gchar,
+	parameters *C.GVariant,
+	invocation *C.GDBusMethodInvocation,
+) {
+	name := goString(methodName)
+	handler, ok := exportedInterface(id).Methods[name]
+	if !ok {
+		returnMethodError(invocation, &MethodError{
+			Name:    errorUnknownMethod,
+			Message: fmt.Sprintf("no such method %q", name),
+		})
+		return
+	}
+	args, err := argsFromGVariant(parameters)
+	if err != nil {
+		returnMethodError(invocation, &MethodError{
+			Name:    errorInvalidArgs,
+			Message: err.Error(),
+		})
+		return
+	}
+	result, err := handler(args)
+	var reply *C.GVariant
+	if err == nil {
+		reply, err = tupleToGVariant(result)
+	}
+	if err != nil {
+		returnMethodError(invocation, err)
+		return
+	}
+	C.g_dbus_method_invocation_return_value(invocation, reply)
+}
+
+func returnMethodError(invocation *C.GDBusMethodInvocation, err error) {
+	methodErr := &MethodError{Name: errorFailed, Message: err.Error()}
+	errors.As(err, &methodErr)
+	cname := C.CString(methodErr.Name)
+	defer C.free(unsafe.Pointer(cname))
+	cmessage := C.CString(methodErr.Message)
+	defer C.free(unsafe.Pointer(cmessage))
+	C.g_dbus_method_invocation_return_dbus_error(
+		invocation, (*C.gchar)(cname), (*C.gchar)(cmessage),
+	)
+}
+
+//export handle_get_property
+func handle_get_property(
+	id C.guint,
+	propertyName *C.gchar,
+	gerror **C.GError,
+) *C.GVariant {
+	name := goString(propertyName)
+	var properties map[string]interface{}
+	if iface := exportedInterface(id); iface.Properties != nil {
+		properties = iface.Properties()
+	}
+	code := C.gint(C.G_DBUS_ERROR_UNKNOWN_PROPERTY)
+	err := fmt.Errorf("no such property %q", name)
+	if value, ok := properties[name]; ok {
+		var result *C.GVariant
+		if result, err = toGVariant(value); err == nil {
+			return result
+		}
+		code = C.gint(C.G_DBUS_ERROR_FAILED)
+	}
+	cmessage := C.CString(err.Error())
+	defer C.free(unsafe.Pointer(cmessage))
+	C.set_dbus_error(gerror, code, (*C.gchar)(cmessage))
+	return nil
+}
+
+// toGVariant returns a new floating GVariant holding the value
+func toGVariant(value interface{}) (*C.GVariant, error) {
+	switch v := value.(type) {
+	case bool:
+		var b C.gboolean
+		if v {
+			b = 1
+		}
+		return C.g_variant_new_boolean(b), nil
+	case string:
+		cstr := C.CString(v)
+		defer C.free(unsafe.Pointer(cstr))
+		return C.g_variant_new_string((*C.gchar)(cstr)), nil
+	case int32:
+		return C.g_variant_new_int32(C.gint32(v)), nil
+	case uint32:
+		return C.g_variant_new_uint32(C.guint32(v)), nil
+	case int64:
+		return C.g_variant_new_int64(C.gint64(v)), nil
+	case uint64:
+		return C.g_variant_new_uint64(C.guint64(v)), nil
+	case []string:
+		strv := make([]*C.gchar, len(v))
+		for i, str := range v {
+			strv[i] = (*C.gchar)(C.CString(str))
+			defer C.free(unsafe.Pointer(strv[i]))
+		}
+		var ptr **C.gchar
+		if len(strv) > 0 {
+			ptr = &strv[0]
+		}
+		return C.g_variant_new_strv(ptr, C.gssize(len(strv))), nil
+	case map[string]interface{}:
+		builder := C.new_dict_builder()
+		defer C.g_variant_builder_unref(builder)
+		for key, item := range v {
+			gitem, err := toGVariant(item)
+			if err != nil {
+				return nil, err
+			}
+			ckey := C.CString(key)
+			C.g_variant_builder_add_value(builder, C.g_variant_new_dict_entry(
+				C.g_variant_new_string((*C.gchar)(ckey)),
+				C.g_variant_new_variant(gitem),
+			))
+			C.free(unsafe.Pointer(ckey))
+		}
+		return C.g_variant_builder_end(builder), nil
+	}
+	return nil, fmt.Errorf("dbus: unsupported type %T", value)
+}
+
+// tupleToGVariant returns a new floating GVariant tuple holding the values
+func tupleToGVariant(values []interface{}) (*C.GVariant, error) {
+	children := make([]*C.GVariant, len(values))
+	for i, value := range values {
+		child, err := toGVariant(value)
+		if err != nil {
+			for _, child := range children[:i] {
+				C.g_variant_unref(C.g_variant_ref_sink(child))
+			}
+			return nil, err
+		}
+		children[i] = child
+	}
+	var ptr **C.GVariant
+	if len(children) > 0 {
+		ptr = &children[0]
+	}
+	return C.g_variant_new_tuple(ptr, C.gsize(len(children))), nil
+}
+
+// fromGVariant returns the value held by the GVariant
+func fromGVariant(value *C.GVariant) (interface{}, error) {
+	switch typeString := goString(C.g_variant_get_type_string(value)); typeString {
+	case "b":
+		return goBool(C.g_variant_get_boolean(value)), nil
+	case "s", "o":
+		return goString(C.g_variant_get_string(value, nil)), nil
+	case "i":
+		return int32(C.g_variant_get_int32(value)), nil
+	case "u":
+		return uint32(C.g_variant_get_uint32(value)), nil
+	case "x":
+		return int64(C.g_variant_get_int64(value)), nil
+	case "t":
+		return uint64(C.g_variant_get_uint64(value)), nil
+	case "as":
+		n := C.g_variant_n_children(value)
+		strs := make([]string, 0, int(n))
+		for i := C.gsize(0); i < n; i++ {
+			child := C.g_variant_get_child_value(value, i)
+			strs = append(strs, goString(C.g_variant_get_string(child, nil)))
+			C.g_variant_unref(child)
+		}
+		return strs, nil
+	default:
+		return nil, fmt.Errorf("dbus: unsupported type %q", typeString)
+	}
+}
+
+// argsFromGVariant returns the values held by the GVariant tuple
+func argsFromGVariant(parameters *C.GVariant) ([]interface{}, error) {
+	n := C.g_variant_n_children(parameters)
+	args := make([]interface{}, 0, int(n))
+	for i := C.gsize(0); i < n; i++ {
+		child := C.g_variant_get_child_value(parameters, i)
+		arg, err := fromGVariant(child)
+		C.g_variant_unref(child)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
@@ -11,6 +11,8 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
+//go:build !nodbus && cgo && !purego
+// +build !nodbus,cgo,!purego
 
 package dbus
 
@@ -126,6 +128,19 @@ func TestBusProxyCall(t *testing.T) {
 	}
 }
 
+func TestBusProxyCallUnsupportedParams(t *testing.T) {
+	conn, err := libgio.BusGet(GBusTypeSystem)
+	assert.NoError(t, err)
+	proxy, err := libgio.BusProxyNew(
+		conn, "org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus",
+	)
+	assert.NoError(t, err)
+
+	response, err := libgio.BusProxyCall(proxy, "GetNameOwner", 1.5, 10)
+	assert.EqualError(t, err, "dbus: unsupported type float64")
+	assert.Nil(t, response)
+}
+
 func TestMainLoop(t *testing.T) {
 	loop := libgio.MainLoopNew()
 	go libgio.MainLoopRun(loop)
@@ -218,3 +233,27 @@ func TestMenderclient(t *testing.T) {
 		})
 	}
 }
+
+func TestGVariantConversion(t *testing.T) {
+	args := []interface{}{
+		true,
+		"value",
+		int32(-1),
+		uint32(1),
+		int64(-2),
+		uint64(2),
+		[]string{"a", "b"},
+		[]string{},
+	}
+	parameters, err := tupleToGVariant(args)
+	assert.NoError(t, err)
+	values, err := argsFromGVariant(parameters)
+	assert.NoError(t, err)
+	assert.Equal(t, args, values)
+
+	_, err = toGVariant(map[string]interface{}{"Sessions": []string{"session"}})
+	assert.NoError(t, err)
+
+	_, err = tupleToGVariant([]interface{}{"value", 1.5})
+	assert.EqualError(t, err, "dbus: unsupported type float64")
+}
@@ -0,0 +1,277 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//go:build !nodbus && (purego || !cgo)
+// +build !nodbus
+// +build purego !cgo
+
+package dbus
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// dbusAPINative implements DBusAPI in pure Go, speaking the D-Bus wire
+// protocol directly over the bus socket. It is used when building without
+// cgo or with the "purego" build tag.
+type dbusAPINative struct {
+	mu      sync.Mutex
+	signals map[string]chan []SignalParams
+	proxies []*proxy
+}
+
+type proxy struct {
+	conn          *conn
+	name          string
+	objectPath    ObjectPath
+	interfaceName string
+}
+
+// mainLoop is a placeholder: signals are dispatched by the connection's
+// receiver goroutine.
+type mainLoop struct{}
+
+var (
+	reObjectPath    = regexp.MustCompile(`^/$|^(/[A-Za-z0-9_]+)+$`)
+	reInterfaceName = regexp.MustCompile(
+		`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)+$`,
+	)
+	reBusName = regexp.MustCompile(
+		`^(:[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)+|` +
+			`[A-Za-z_-][A-Za-z0-9_-]*(\.[A-Za-z_-][A-Za-z0-9_-]*)+)$`,
+	)
+)
+
+// BusGet synchronously connects to the message bus specified by bus_type
+func (d *dbusAPINative) BusGet(busType uint) (Handle, error) {
+	address, err := busAddress(busType)
+	if err != nil {
+		return Handle(nil), err
+	}
+	c, err := dial(address, d.dispatchSignal)
+	if err != nil {
+		return Handle(nil), err
+	}
+	return Handle(unsafe.Pointer(c)), nil
+}
+
+// BusProxyNew creates a proxy for accessing an interface over DBus
+func (d *dbusAPINative) BusProxyNew(
+	bus Handle,
+	name string,
+	objectPath string,
+	interfaceName string,
+) (Handle, error) {
+	if bus == nil {
+		return Handle(nil), fmt.Errorf("dbus: invalid connection")
+	} else if !reBusName.MatchString(name) {
+		return Handle(nil), fmt.Errorf("dbus: invalid bus name %q", name)
+	} else if !reObjectPath.MatchString(objectPath) {
+		return Handle(nil), fmt.Errorf("dbus: invalid object path %q", objectPath)
+	} else if !reInterfaceName.MatchString(interfaceName) {
+		return Handle(nil), fmt.Errorf("dbus: invalid interface name %q", interfaceName)
+	}
+	p := &proxy{
+		conn:          (*conn)(unsafe.Pointer(bus)),
+		name:          name,
+		objectPath:    ObjectPath(objectPath),
+		interfaceName: interfaceName,
+	}
+	rule := fmt.Sprintf("type='signal',sender='%s',path='%s',interface='%s'",
+		name, objectPath, interfaceName)
+	_, err := p.conn.call(&message{
+		Destination: busName,
+		Path:        busPath,
+		Interface:   busInterface,
+		Member:      "AddMatch",
+		Body:        []interface{}{rule},
+	}, defaultCallTimeout)
+	if err != nil {
+		return Handle(nil), err
+	}
+	d.mu.Lock()
+	d.proxies = append(d.proxies, p)
+	d.mu.Unlock()
+	return Handle(unsafe.Pointer(p)), nil
+}
+
+// BusProxyCall synchronously invokes a method method on a proxy. The
+// params are either nil, a single argument or a []interface{} holding the
+// arguments. The timeout is in milliseconds; a negative value selects the
+// default timeout.
+func (d *dbusAPINative) BusProxyCall(
+	proxyHandle Handle,
+	methodName string,
+	params interface{},
+	timeout int,
+) (DBusCallResponse, error) {
+	if proxyHandle == nil {
+		return nil, fmt.Errorf("dbus: invalid proxy")
+	}
+	p := (*proxy)(unsafe.Pointer(proxyHandle))
+	var args []interface{}
+	switch params := params.(type) {
+	case nil:
+	case []interface{}:
+		args = params
+	default:
+		args = []interface{}{params}
+	}
+	callTimeout := defaultCallTimeout
+	if timeout >= 0 {
+		callTimeout = time.Duration(timeout) * time.Millisecond
+	}
+	reply, err := p.conn.call(&message{
+		Destination: p.name,
+		Path:        p.objectPath,
+		Interface:   p.interfaceName,
+		Member:      methodName,
+		Body:        args,
+	}, callTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &dbusCallResponseNative{body: reply.Body}, nil
+}
+
+// MainLoopNew creates a new main loop; the native implementation does not
+// need one and returns a placeholder.
+func (d *dbusAPINative) MainLoopNew() MainLoop {
+	return MainLoop(unsafe.Pointer(&mainLoop{}))
+}
+
+// MainLoopRun is a no-op: signals are handled as they are received
+func (d *dbusAPINative) MainLoopRun(loop MainLoop) {}
+
+// MainLoopQuit is a no-op: signals are handled as they are received
+func (d *dbusAPINative) MainLoopQuit(loop MainLoop) {}
+
+// dispatchSignal passes the signals received for the proxies to
+// HandleSignal. As with libgio, only string arguments are forwarded.
+func (d *dbusAPINative) dispatchSignal(msg *message) {
+	d.mu.Lock()
+	var match bool
+	for _, p := range d.proxies {
+		if p.objectPath == msg.Path && p.interfaceName == msg.Interface {
+			match = true
+			break
+		}
+	}
+	d.mu.Unlock()
+	if !match {
+		return
+	}
+	var params []SignalParams
+	for _, arg := range msg.Body {
+		if s, ok := arg.(string); ok {
+			params = append(params, SignalParams{
+				ParamType: GDBusTypeString,
+				ParamData: s,
+			})
+		}
+	}
+	d.HandleSignal(msg.Member, params)
+}
+
+// GetChannelForSignal returns a channel that can be used to wait for signals
+func (d *dbusAPINative) GetChannelForSignal(signalName string) chan []SignalParams {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	channel, ok := d.signals[signalName]
+	if !ok {
+		channel = make(chan []SignalParams, 1)
+		d.signals[signalName] = channel
+	}
+	return channel
+}
+
+// DrainSignal drains the channel used to wait for signals
+func (d *dbusAPINative) DrainSignal(signalName string) {
+	channel := d.GetChannelForSignal(signalName)
+	select {
+	case <-channel:
+	default:
+	}
+}
+
+// HandleSignal handles a DBus signal
+func (d *dbusAPINative) HandleSignal(signalName string, params []SignalParams) {
+	channel := d.GetChannelForSignal(signalName)
+	select {
+	case channel <- params:
+	default:
+	}
+}
+
+// WaitForSignal waits for a DBus signal
+func (d *dbusAPINative) WaitForSignal(
+	signalName string,
+	timeout time.Duration,
+) ([]SignalParams, error) {
+	channel := d.GetChannelForSignal(signalName)
+	select {
+	case p := <-channel:
+		return p, nil
+	case <-time.After(timeout):
+		return []SignalParams{}, fmt.Errorf("timeout waiting for signal %s", signalName)
+	}
+}
+
+type dbusCallResponseNative struct {
+	body []interface{}
+}
+
+// arg returns the i-th argument of the response, unwrapping variants such
+// as the values returned by org.freedesktop.DBus.Properties.Get.
+func (r *dbusCallResponseNative) arg(i int) interface{} {
+	if i < len(r.body) {
+		if v, ok := r.body[i].(Variant); ok {
+			return v.Value
+		}
+		return r.body[i]
+	}
+	return nil
+}
+
+// GetString returns a string stored in the response object
+func (r *dbusCallResponseNative) GetString() string {
+	s, _ := r.arg(0).(string)
+	return s
+}
+
+// GetTwoStrings returns two string stored in the response object
+func (r *dbusCallResponseNative) GetTwoStrings() (string, string) {
+	s1, _ := r.arg(0).(string)
+	s2, _ := r.arg(1).(string)
+	return s1, s2
+}
+
+// GetBoolean returns a boolean stored in the response object
+func (r *dbusCallResponseNative) GetBoolean() bool {
+	b, _ := r.arg(0).(bool)
+	return b
+}
+
+func newDBusAPINative() *dbusAPINative {
+	return &dbusAPINative{
+		signals: make(map[string]chan []SignalParams),
+	}
+}
+
+func init() {
+	dbusAPI = newDBusAPINative()
+}
@@ -0,0 +1,313 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//go:build !nodbus && (purego || !cgo)
+// +build !nodbus
+// +build purego !cgo
+
+package dbus
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	busName      = "org.freedesktop.DBus"
+	busPath      = ObjectPath("/org/freedesktop/DBus")
+	busInterface = "org.freedesktop.DBus"
+
+	envSystemBusAddress  = "DBUS_SYSTEM_BUS_ADDRESS"
+	envSessionBusAddress = "DBUS_SESSION_BUS_ADDRESS"
+
+	defaultSystemBusAddress = "unix:path=/var/run/dbus/system_bus_socket"
+	defaultCallTimeout      = 25 * time.Second
+	authTimeout             = 10 * time.Second
+)
+
+var (
+	ErrConnClosed = errors.New("dbus: connection closed")
+	ErrTimeout    = errors.New("dbus: timeout waiting for reply")
+)
+
+// Error is an error reply received from the bus.
+type Error struct {
+	Name    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Name
+	}
+	return e.Name + ": " + e.Message
+}
+
+// busAddress returns the address of the message bus of the type.
+func busAddress(busType uint) (string, error) {
+	switch busType {
+	case GBusTypeSystem:
+		if addr, ok := os.LookupEnv(envSystemBusAddress); ok {
+			return addr, nil
+		}
+		return defaultSystemBusAddress, nil
+	case GBusTypeSession:
+		if addr, ok := os.LookupEnv(envSessionBusAddress); ok {
+			return addr, nil
+		}
+		return "", fmt.Errorf("dbus: $%s not set", envSessionBusAddress)
+	}
+	return "", fmt.Errorf("dbus: unsupported bus type %d", busType)
+}
+
+// dialAddress connects to the first reachable server address. Only the
+// unix transport is supported.
+func dialAddress(address string) (net.Conn, error) {
+	var errs []error
+	for _, addr := range strings.Split(address, ";") {
+		transport, params, ok := strings.Cut(addr, ":")
+		if !ok || transport != "unix" {
+			errs = append(errs, fmt.Errorf("dbus: unsupported address %q", addr))
+			continue
+		}
+		var path string
+		for _, kv := range strings.Split(params, ",") {
+			key, value, _ := strings.Cut(kv, "=")
+			value, err := url.PathUnescape(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("dbus: invalid address %q", addr))
+				break
+			}
+			switch key {
+			case "path":
+				path = value
+			case "abstract":
+				path = "@" + value
+			}
+		}
+		if path == "" {
+			continue
+		}
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("dbus: no usable address in %q", address)
+	}
+	return nil, errors.Join(errs...)
+}
+
+type conn struct {
+	conn net.Conn
+	name string
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	serial  uint32
+	pending map[uint32]chan *message
+	err     error
+	signals func(*message)
+	objects map[ObjectPath]map[string]ExportedInterface
+}
+
+// authenticate runs the SASL EXTERNAL authentication handshake.
+func authenticate(c net.Conn) error {
+	_ = c.SetDeadline(time.Now().Add(authTimeout))
+	defer c.SetDeadline(time.Time{}) //nolint:errcheck
+	uid := strconv.Itoa(os.Getuid())
+	_, err := fmt.Fprintf(c, "\x00AUTH EXTERNAL %s\r\n", hex.EncodeToString([]byte(uid)))
+	if err != nil {
+		return err
+	}
+	// Read byte by byte to avoid consuming the first message
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < 512 {
+		if _, err = c.Read(b); err != nil {
+			return err
+		}
+		line = append(line, b[0])
+		if b[0] == '\n' {
+			break
+		}
+	}
+	reply := strings.TrimSpace(string(line))
+	if !strings.HasPrefix(reply, "OK ") {
+		return fmt.Errorf("dbus: authentication failed: %s", reply)
+	}
+	_, err = c.Write([]byte("BEGIN\r\n"))
+	return err
+}
+
+// dial connects and authenticates to the bus at the address and registers
+// the connection with a Hello call.
+func dial(address string, signals func(*message)) (*conn, error) {
+	netConn, err := dialAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if err = authenticate(netConn); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	c := &conn{
+		conn:    netConn,
+		pending: make(map[uint32]chan *message),
+		signals: signals,
+	}
+	go c.receiver()
+	reply, err := c.call(&message{
+		Destination: busName,
+		Path:        busPath,
+		Interface:   busInterface,
+		Member:      "Hello",
+	}, defaultCallTimeout)
+	if err != nil {
+		c.close(err)
+		return nil, err
+	}
+	if len(reply.Body) > 0 {
+		c.name, _ = reply.Body[0].(string)
+	}
+	return c, nil
+}
+
+func (c *conn) receiver() {
+	r := bufio.NewReader(c.conn)
+	for {
+		msg, err := readMessage(r)
+		if err != nil {
+			c.close(err)
+			return
+		}
+		switch msg.Type {
+		case messageTypeMethodReturn, messageTypeError:
+			c.mu.Lock()
+			reply, ok := c.pending[msg.ReplySerial]
+			delete(c.pending, msg.ReplySerial)
+			c.mu.Unlock()
+			if ok {
+				reply <- msg
+			}
+		case messageTypeSignal:
+			if c.signals != nil {
+				c.signals(msg)
+			}
+		case messageTypeMethodCall:
+			go c.handleCall(msg)
+		}
+	}
+}
+
+func (c *conn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = fmt.Errorf("%w: %w", ErrConnClosed, err)
+	c.conn.Close()
+	for serial, reply := range c.pending {
+		close(reply)
+		delete(c.pending, serial)
+	}
+}
+
+// send writes the message to the bus. If a reply is expected, the returned
+// channel receives it.
+func (c *conn) send(msg *message) (chan *message, error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.serial++
+	msg.Serial = c.serial
+	var reply chan *message
+	if msg.Type == messageTypeMethodCall && msg.Flags&flagNoReplyExpected == 0 {
+		reply = make(chan *message, 1)
+		c.pending[msg.Serial] = reply
+	}
+	c.mu.Unlock()
+
+	b, err := msg.marshal()
+	if err == nil {
+		c.writeMu.Lock()
+		_, err = c.conn.Write(b)
+		c.writeMu.Unlock()
+	}
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, msg.Serial)
+		c.mu.Unlock()
+		return nil, err
+	}
+	return reply, nil
+}
+
+// call invokes a method and waits for the reply.
+func (c *conn) call(msg *message, timeout time.Duration) (*message, error) {
+	msg.Type = messageTypeMethodCall
+	reply, err := c.send(msg)
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case rsp, ok := <-reply:
+		if !ok {
+			c.mu.Lock()
+			err = c.err
+			c.mu.Unlock()
+			return nil, err
+		}
+		if rsp.Type == messageTypeError {
+			e := &Error{Name: rsp.ErrorName}
+			if len(rsp.Body) > 0 {
+				e.Message, _ = rsp.Body[0].(string)
+			}
+			return nil, e
+		}
+		return rsp, nil
+	case <-timer.C:
+		c.mu.Lock()
+		delete(c.pending, msg.Serial)
+		c.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s.%s", ErrTimeout, msg.Interface, msg.Member)
+	}
+}
+
+// emit sends a signal.
+func (c *conn) emit(path ObjectPath, iface, member string, args ...interface{}) error {
+	_, err := c.send(&message{
+		Type:      messageTypeSignal,
+		Path:      path,
+		Interface: iface,
+		Member:    member,
+		Body:      args,
+	})
+	return err
+}
@@ -0,0 +1,702 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//go:build !nodbus && (purego || !cgo)
+// +build !nodbus
+// +build purego !cgo
+
+package dbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// D-Bus wire format, see:
+// https://dbus.freedesktop.org/doc/dbus-specification.html#message-protocol
+
+type messageType byte
+
+const (
+	messageTypeMethodCall   messageType = 1
+	messageTypeMethodReturn messageType = 2
+	messageTypeError        messageType = 3
+	messageTypeSignal       messageType = 4
+)
+
+const (
+	flagNoReplyExpected byte = 0x1
+)
+
+type headerField byte
+
+const (
+	fieldPath        headerField = 1
+	fieldInterface   headerField = 2
+	fieldMember      headerField = 3
+	fieldErrorName   headerField = 4
+	fieldReplySerial headerField = 5
+	fieldDestination headerField = 6
+	fieldSender      headerField = 7
+	fieldSignature   headerField = 8
+)
+
+const (
+	protocolVersion = 1
+	// maxMessageSize is the maximum message size allowed by the
+	// specification (128 MiB).
+	maxMessageSize = 1 << 27
+)
+
+var (
+	errInvalidSignature = errors.New("dbus: invalid signature")
+	errMessageTooLarge  = errors.New("dbus: message too large")
+)
+
+// ObjectPath is a D-Bus object path (type "o").
+type ObjectPath string
+
+// Signature is a D-Bus type signature (type "g").
+type Signature string
+
+// Variant is a D-Bus variant (type "v").
+type Variant struct {
+	Signature Signature
+	Value     interface{}
+}
+
+type message struct {
+	Type        messageType
+	Flags       byte
+	Serial      uint32
+	Path        ObjectPath
+	Interface   string
+	Member      string
+	ErrorName   string
+	ReplySerial uint32
+	Destination string
+	Sender      string
+	Signature   Signature
+	Body        []interface{}
+}
+
+// signatureOf returns the D-Bus signature of a Go value.
+func signatureOf(v interface{}) (Signature, error) {
+	switch v := v.(type) {
+	case byte:
+		return "y", nil
+	case bool:
+		return "b", nil
+	case int16:
+		return "n", nil
+	case uint16:
+		return "q", nil
+	case int32:
+		return "i", nil
+	case uint32:
+		return "u", nil
+	case int64:
+		return "x", nil
+	case uint64:
+		return "t", nil
+	case float64:
+		return "d", nil
+	case string:
+		return "s", nil
+	case ObjectPath:
+		return "o", nil
+	case Signature:
+		return "g", nil
+	case Variant:
+		return "v", nil
+	case []string:
+		return "as", nil
+	case []byte:
+		return "ay", nil
+	case map[string]string:
+		return "a{ss}", nil
+	case map[string]Variant:
+		return "a{sv}", nil
+	case []interface{}:
+		var sig strings.Builder
+		sig.WriteByte('(')
+		for _, elem := range v {
+			s, err := signatureOf(elem)
+			if err != nil {
+				return "", err
+			}
+			sig.WriteString(string(s))
+		}
+		sig.WriteByte(')')
+		return Signature(sig.String()), nil
+	}
+	return "", fmt.Errorf("dbus: unsupported type %T", v)
+}
+
+// bodySignature returns the signature of the message arguments.
+func bodySignature(args []interface{}) (Signature, error) {
+	var sig strings.Builder
+	for _, arg := range args {
+		s, err := signatureOf(arg)
+		if err != nil {
+			return "", err
+		}
+		sig.WriteString(string(s))
+	}
+	return Signature(sig.String()), nil
+}
+
+func alignment(c byte) int {
+	switch c {
+	case 'y', 'g', 'v':
+		return 1
+	case 'n', 'q':
+		return 2
+	case 'b', 'i', 'u', 's', 'o', 'a', 'h':
+		return 4
+	case 'x', 't', 'd', '(', '{':
+		return 8
+	}
+	return 1
+}
+
+// nextType returns the first complete type of the signature.
+func nextType(sig Signature) (Signature, error) {
+	if len(sig) == 0 {
+		return "", errInvalidSignature
+	}
+	switch sig[0] {
+	case 'a':
+		elem, err := nextType(sig[1:])
+		if err != nil {
+			return "", err
+		}
+		return sig[:1+len(elem)], nil
+	case '(', '{':
+		end := byte(')')
+		if sig[0] == '{' {
+			end = '}'
+		}
+		i := 1
+		for i < len(sig) && sig[i] != end {
+			elem, err := nextType(sig[i:])
+			if err != nil {
+				return "", err
+			}
+			i += len(elem)
+		}
+		if i >= len(sig) || i == 1 {
+			return "", errInvalidSignature
+		}
+		return sig[:i+1], nil
+	case 'y', 'b', 'n', 'q', 'i', 'u', 'x', 't', 'd', 's', 'o', 'g', 'v', 'h':
+		return sig[:1], nil
+	}
+	return "", errInvalidSignature
+}
+
+// splitSignature splits the signature into complete types.
+func splitSignature(sig Signature) ([]Signature, error) {
+	var types []Signature
+	for len(sig) > 0 {
+		t, err := nextType(sig)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, t)
+		sig = sig[len(t):]
+	}
+	return types, nil
+}
+
+// encoder encodes values in little endian byte order.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) align(n int) {
+	for len(e.buf)%n != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.align(4)
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) string(s string) {
+	e.uint32(uint32(len(s)))
+	e.buf = append(e.buf, s...)
+	e.buf = append(e.buf, 0)
+}
+
+func (e *encoder) signature(s Signature) {
+	e.buf = append(e.buf, byte(len(s)))
+	e.buf = append(e.buf, s...)
+	e.buf = append(e.buf, 0)
+}
+
+// array encodes an array with elements of the given alignment.
+func (e *encoder) array(elemAlign int, elems func() error) error {
+	e.align(4)
+	lenPos := len(e.buf)
+	e.buf = append(e.buf, 0, 0, 0, 0)
+	e.align(elemAlign)
+	start := len(e.buf)
+	if err := elems(); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(e.buf[lenPos:], uint32(len(e.buf)-start))
+	return nil
+}
+
+func (e *encoder) encode(v interface{}) error {
+	switch v := v.(type) {
+	case byte:
+		e.buf = append(e.buf, v)
+	case bool:
+		var b uint32
+		if v {
+			b = 1
+		}
+		e.uint32(b)
+	case int16:
+		e.align(2)
+		e.buf = binary.LittleEndian.AppendUint16(e.buf, uint16(v))
+	case uint16:
+		e.align(2)
+		e.buf = binary.LittleEndian.AppendUint16(e.buf, v)
+	case int32:
+		e.uint32(uint32(v))
+	case uint32:
+		e.uint32(v)
+	case int64:
+		e.align(8)
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, uint64(v))
+	case uint64:
+		e.align(8)
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, v)
+	case float64:
+		e.align(8)
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(v))
+	case string:
+		e.string(v)
+	case ObjectPath:
+		e.string(string(v))
+	case Signature:
+		e.signature(v)
+	case Variant:
+		sig := v.Signature
+		if sig == "" {
+			var err error
+			if sig, err = signatureOf(v.Value); err != nil {
+				return err
+			}
+		}
+		e.signature(sig)
+		return e.encode(v.Value)
+	case []string:
+		return e.array(4, func() error {
+			for _, s := range v {
+				e.string(s)
+			}
+			return nil
+		})
+	case []byte:
+		return e.array(1, func() error {
+			e.buf = append(e.buf, v...)
+			return nil
+		})
+	case map[string]string:
+		return e.array(8, func() error {
+			for _, k := range sortedKeys(v) {
+				e.align(8)
+				e.string(k)
+				e.string(v[k])
+			}
+			return nil
+		})
+	case map[string]Variant:
+		return e.array(8, func() error {
+			for _, k := range sortedKeys(v) {
+				e.align(8)
+				e.string(k)
+				if err := e.encode(v[k]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	case []interface{}:
+		e.align(8)
+		for _, elem := range v {
+			if err := e.encode(elem); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("dbus: unsupported type %T", v)
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// marshal encodes the message in little endian byte order.
+func (msg *message) marshal() ([]byte, error) {
+	sig, err := bodySignature(msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	body := &encoder{}
+	for _, arg := range msg.Body {
+		if err := body.encode(arg); err != nil {
+			return nil, err
+		}
+	}
+
+	hdr := &encoder{}
+	hdr.buf = append(hdr.buf, 'l', byte(msg.Type), msg.Flags, protocolVersion)
+	hdr.uint32(uint32(len(body.buf)))
+	hdr.uint32(msg.Serial)
+	fields := []struct {
+		code  headerField
+		value interface{}
+		set   bool
+	}{
+		{fieldPath, msg.Path, msg.Path != ""},
+		{fieldInterface, msg.Interface, msg.Interface != ""},
+		{fieldMember, msg.Member, msg.Member != ""},
+		{fieldErrorName, msg.ErrorName, msg.ErrorName != ""},
+		{fieldReplySerial, msg.ReplySerial, msg.ReplySerial != 0},
+		{fieldDestination, msg.Destination, msg.Destination != ""},
+		{fieldSignature, sig, sig != ""},
+	}
+	err = hdr.array(8, func() error {
+		for _, f := range fields {
+			if !f.set {
+				continue
+			}
+			hdr.align(8)
+			hdr.buf = append(hdr.buf, byte(f.code))
+			if err := hdr.encode(Variant{Value: f.value}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	hdr.align(8)
+	b := append(hdr.buf, body.buf...)
+	if len(b) > maxMessageSize {
+		return nil, errMessageTooLarge
+	}
+	return b, nil
+}
+
+type decoder struct {
+	buf   []byte
+	pos   int
+	order binary.ByteOrder
+	// depth limits the nesting of containers
+	depth int
+}
+
+var errShortMessage = errors.New("dbus: unexpected end of message")
+
+func (d *decoder) align(n int) error {
+	for d.pos%n != 0 {
+		if d.pos >= len(d.buf) {
+			return errShortMessage
+		}
+		d.pos++
+	}
+	return nil
+}
+
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.buf) {
+		return nil, errShortMessage
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) uint32() (uint32, error) {
+	if err := d.align(4); err != nil {
+		return 0, err
+	}
+	b, err := d.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint32(b), nil
+}
+
+func (d *decoder) string() (string, error) {
+	n, err := d.uint32()
+	if err != nil {
+		return "", err
+	}
+	b, err := d.next(int(n) + 1)
+	if err != nil {
+		return "", err
+	}
+	return string(b[:n]), nil
+}
+
+func (d *decoder) signature() (Signature, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return "", err
+	}
+	s, err := d.next(int(b[0]) + 1)
+	if err != nil {
+		return "", err
+	}
+	return Signature(s[:b[0]]), nil
+}
+
+// decode decodes a value of a single complete type. Arrays are decoded as
+// []interface{}, dictionaries as map[interface{}]interface{} and structs
+// as []interface{}.
+func (d *decoder) decode(sig Signature) (interface{}, error) {
+	if d.depth > 64 {
+		return nil, errInvalidSignature
+	}
+	switch sig[0] {
+	case 'y':
+		b, err := d.next(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0], nil
+	case 'b':
+		v, err := d.uint32()
+		return v != 0, err
+	case 'n', 'q':
+		if err := d.align(2); err != nil {
+			return nil, err
+		}
+		b, err := d.next(2)
+		if err != nil {
+			return nil, err
+		}
+		if sig[0] == 'n' {
+			return int16(d.order.Uint16(b)), nil
+		}
+		return d.order.Uint16(b), nil
+	case 'i':
+		v, err := d.uint32()
+		return int32(v), err
+	case 'u', 'h':
+		return d.uint32()
+	case 'x', 't', 'd':
+		if err := d.align(8); err != nil {
+			return nil, err
+		}
+		b, err := d.next(8)
+		if err != nil {
+			return nil, err
+		}
+		v := d.order.Uint64(b)
+		switch sig[0] {
+		case 'x':
+			return int64(v), nil
+		case 'd':
+			return math.Float64frombits(v), nil
+		}
+		return v, nil
+	case 's':
+		return d.string()
+	case 'o':
+		s, err := d.string()
+		return ObjectPath(s), err
+	case 'g':
+		return d.signature()
+	case 'v':
+		s, err := d.signature()
+		if err != nil {
+			return nil, err
+		}
+		if t, err := nextType(s); err != nil || len(t) != len(s) {
+			return nil, errInvalidSignature
+		}
+		d.depth++
+		defer func() { d.depth-- }()
+		v, err := d.decode(s)
+		return Variant{Signature: s, Value: v}, err
+	case 'a':
+		return d.decodeArray(sig[1:])
+	case '(':
+		if err := d.align(8); err != nil {
+			return nil, err
+		}
+		types, err := splitSignature(sig[1 : len(sig)-1])
+		if err != nil {
+			return nil, err
+		}
+		d.depth++
+		defer func() { d.depth-- }()
+		fields := make([]interface{}, 0, len(types))
+		for _, t := range types {
+			v, err := d.decode(t)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, v)
+		}
+		return fields, nil
+	}
+	return nil, errInvalidSignature
+}
+
+func (d *decoder) decodeArray(elem Signature) (interface{}, error) {
+	n, err := d.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if err = d.align(alignment(elem[0])); err != nil {
+		return nil, err
+	}
+	end := d.pos + int(n)
+	if end > len(d.buf) {
+		return nil, errShortMessage
+	}
+	d.depth++
+	defer func() { d.depth-- }()
+	if elem[0] == '{' {
+		types, err := splitSignature(elem[1 : len(elem)-1])
+		if err != nil || len(types) != 2 {
+			return nil, errInvalidSignature
+		}
+		dict := make(map[interface{}]interface{})
+		for d.pos < end {
+			if err := d.align(8); err != nil {
+				return nil, err
+			}
+			k, err := d.decode(types[0])
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.decode(types[1])
+			if err != nil {
+				return nil, err
+			}
+			dict[k] = v
+		}
+		return dict, nil
+	}
+	var elems []interface{}
+	for d.pos < end {
+		v, err := d.decode(elem)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, v)
+	}
+	return elems, nil
+}
+
+// readMessage reads and decodes a message from the connection.
+func readMessage(r io.Reader) (*message, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch fixed[0] {
+	case 'l':
+		order = binary.LittleEndian
+	case 'B':
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("dbus: invalid byte order %q", fixed[0])
+	}
+	bodyLen := order.Uint32(fixed[4:])
+	fieldsLen := order.Uint32(fixed[12:])
+	hdrLen := 16 + int(fieldsLen)
+	hdrLen += (8 - hdrLen%8) % 8
+	if uint64(hdrLen)+uint64(bodyLen) > maxMessageSize {
+		return nil, errMessageTooLarge
+	}
+	buf := make([]byte, hdrLen+int(bodyLen))
+	copy(buf, fixed)
+	if _, err := io.ReadFull(r, buf[16:]); err != nil {
+		return nil, err
+	}
+
+	msg := &message{
+		Type:   messageType(fixed[1]),
+		Flags:  fixed[2],
+		Serial: order.Uint32(fixed[8:]),
+	}
+	d := &decoder{buf: buf[:hdrLen], pos: 12, order: order}
+	fields, err := d.decode("a(yv)")
+	if err != nil {
+		return nil, fmt.Errorf("dbus: invalid message header: %w", err)
+	}
+	for _, f := range fields.([]interface{}) {
+		field := f.([]interface{})
+		value := field[1].(Variant).Value
+		switch headerField(field[0].(byte)) {
+		case fieldPath:
+			msg.Path, _ = value.(ObjectPath)
+		case fieldInterface:
+			msg.Interface, _ = value.(string)
+		case fieldMember:
+			msg.Member, _ = value.(string)
+		case fieldErrorName:
+			msg.ErrorName, _ = value.(string)
+		case fieldReplySerial:
+			msg.ReplySerial, _ = value.(uint32)
+		case fieldDestination:
+			msg.Destination, _ = value.(string)
+		case fieldSender:
+			msg.Sender, _ = value.(string)
+		case fieldSignature:
+			msg.Signature, _ = value.(Signature)
+		}
+	}
+
+	types, err := splitSignature(msg.Signature)
+	if err != nil {
+		return nil, err
+	}
+	// The body is aligned relative to its own start
+	d = &decoder{buf: buf[hdrLen:], order: order}
+	for _, t := range types {
+		v, err := d.decode(t)
+		if err != nil {
+			return nil, fmt.Errorf("dbus: invalid message body: %w", err)
+		}
+		msg.Body = append(msg.Body, v)
+	}
+	return msg, nil
+}
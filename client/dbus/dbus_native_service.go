@@ -0,0 +1,296 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//go:build !nodbus && (purego || !cgo)
+// +build !nodbus
+// +build purego !cgo
+
+package dbus
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+const (
+	propertiesInterface   = "org.freedesktop.DBus.Properties"
+	introspectInterface   = "org.freedesktop.DBus.Introspectable"
+	peerInterface         = "org.freedesktop.DBus.Peer"
+	errorFailed           = "org.freedesktop.DBus.Error.Failed"
+	errorUnknownMethod    = "org.freedesktop.DBus.Error.UnknownMethod"
+	errorUnknownObject    = "org.freedesktop.DBus.Error.UnknownObject"
+	errorUnknownInterface = "org.freedesktop.DBus.Error.UnknownInterface"
+	errorUnknownProperty  = "org.freedesktop.DBus.Error.UnknownProperty"
+	errorInvalidArgs      = "org.freedesktop.DBus.Error.InvalidArgs"
+	errorPropertyReadOnly = "org.freedesktop.DBus.Error.PropertyReadOnly"
+
+	// requestNameDoNotQueue fails the RequestName call instead of
+	// queueing for the name.
+	requestNameDoNotQueue        = uint32(0x4)
+	requestNameReplyPrimaryOwner = uint32(1)
+	requestNameReplyAlreadyOwner = uint32(4)
+
+	introspectDocType = `<!DOCTYPE node PUBLIC ` +
+		`"-//freedesktop//DTD D-BUS Object Introspection 1.0//EN" ` +
+		`"http://www.freedesktop.org/standards/dbus/1.0/introspect.dtd">`
+	introspectStandardInterfaces = `<interface name="org.freedesktop.DBus.Peer">` +
+		`<method name="Ping"/>` +
+		`</interface>` +
+		`<interface name="org.freedesktop.DBus.Introspectable">` +
+		`<method name="Introspect">` +
+		`<arg name="xml_data" type="s" direction="out"/>` +
+		`</method>` +
+		`</interface>` +
+		`<interface name="org.freedesktop.DBus.Properties">` +
+		`<method name="Get">` +
+		`<arg name="interface_name" type="s" direction="in"/>` +
+		`<arg name="property_name" type="s" direction="in"/>` +
+		`<arg name="value" type="v" direction="out"/>` +
+		`</method>` +
+		`<method name="GetAll">` +
+		`<arg name="interface_name" type="s" direction="in"/>` +
+		`<arg name="properties" type="a{sv}" direction="out"/>` +
+		`</method>` +
+		`<signal name="PropertiesChanged">` +
+		`<arg name="interface_name" type="s"/>` +
+		`<arg name="changed_properties" type="a{sv}"/>` +
+		`<arg name="invalidated_properties" type="as"/>` +
+		`</signal>` +
+		`</interface>`
+)
+
+var (
+	errNameTaken = errors.New("dbus: name already taken")
+
+	_ DBusServiceAPI = (*dbusAPINative)(nil)
+)
+
+func (c *conn) export(path ObjectPath, iface ExportedInterface) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.objects == nil {
+		c.objects = make(map[ObjectPath]map[string]ExportedInterface)
+	}
+	if c.objects[path] == nil {
+		c.objects[path] = make(map[string]ExportedInterface)
+	}
+	c.objects[path][iface.Name] = iface
+}
+
+func (c *conn) interfaces(path ObjectPath) map[string]ExportedInterface {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.objects[path]
+}
+
+// handleCall dispatches a method call to the exported objects and sends
+// the reply.
+func (c *conn) handleCall(msg *message) {
+	body, err := c.dispatchCall(msg)
+	if msg.Flags&flagNoReplyExpected != 0 {
+		return
+	}
+	reply := &message{
+		Type:        messageTypeMethodReturn,
+		Flags:       flagNoReplyExpected,
+		ReplySerial: msg.Serial,
+		Destination: msg.Sender,
+		Body:        body,
+	}
+	if err != nil {
+		reply.Type = messageTypeError
+		reply.ErrorName = errorFailed
+		reply.Body = []interface{}{err.Error()}
+		var methodErr *MethodError
+		if errors.As(err, &methodErr) {
+			reply.ErrorName = methodErr.Name
+			reply.Body = []interface{}{methodErr.Message}
+		}
+	}
+	_, _ = c.send(reply)
+}
+
+func (c *conn) dispatchCall(msg *message) ([]interface{}, error) {
+	ifaces := c.interfaces(msg.Path)
+	switch msg.Interface {
+	case peerInterface:
+		if msg.Member == "Ping" {
+			return nil, nil
+		}
+	case introspectInterface:
+		if msg.Member == "Introspect" {
+			return []interface{}{introspect(ifaces)}, nil
+		}
+	}
+	if ifaces == nil {
+		return nil, &MethodError{
+			Name:    errorUnknownObject,
+			Message: fmt.Sprintf("no such object %q", msg.Path),
+		}
+	}
+	if msg.Interface == propertiesInterface {
+		return dispatchProperties(ifaces, msg)
+	}
+	for name, iface := range ifaces {
+		if msg.Interface != "" && msg.Interface != name {
+			continue
+		}
+		if handler, ok := iface.Methods[msg.Member]; ok {
+			return handler(msg.Body)
+		}
+	}
+	return nil, &MethodError{
+		Name:    errorUnknownMethod,
+		Message: fmt.Sprintf("no such method %q", msg.Member),
+	}
+}
+
+func dispatchProperties(
+	ifaces map[string]ExportedInterface,
+	msg *message,
+) ([]interface{}, error) {
+	if len(msg.Body) == 0 {
+		return nil, &MethodError{Name: errorInvalidArgs, Message: "missing interface name"}
+	}
+	name, _ := msg.Body[0].(string)
+	iface, ok := ifaces[name]
+	if !ok {
+		return nil, &MethodError{
+			Name:    errorUnknownInterface,
+			Message: fmt.Sprintf("no such interface %q", name),
+		}
+	}
+	properties := map[string]interface{}{}
+	if iface.Properties != nil {
+		properties = iface.Properties()
+	}
+	switch msg.Member {
+	case "Get":
+		var property string
+		if len(msg.Body) > 1 {
+			property, _ = msg.Body[1].(string)
+		}
+		value, ok := properties[property]
+		if !ok {
+			return nil, &MethodError{
+				Name:    errorUnknownProperty,
+				Message: fmt.Sprintf("no such property %q", property),
+			}
+		}
+		return []interface{}{Variant{Value: value}}, nil
+	case "GetAll":
+		return []interface{}{variants(properties)}, nil
+	case "Set":
+		return nil, &MethodError{Name: errorPropertyReadOnly, Message: "properties are read-only"}
+	}
+	return nil, &MethodError{
+		Name:    errorUnknownMethod,
+		Message: fmt.Sprintf("no such method %q", msg.Member),
+	}
+}
+
+func variants(values map[string]interface{}) map[string]Variant {
+	result := make(map[string]Variant, len(values))
+	for name, value := range values {
+		result[name] = Variant{Value: value}
+	}
+	return result
+}
+
+func introspect(ifaces map[string]ExportedInterface) string {
+	names := make([]string, 0, len(ifaces))
+	for name := range ifaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var xml strings.Builder
+	xml.WriteString(introspectDocType)
+	xml.WriteString("<node>")
+	xml.WriteString(introspectStandardInterfaces)
+	for _, name := range names {
+		xml.WriteString(ifaces[name].Introspection)
+	}
+	xml.WriteString("</node>")
+	return xml.String()
+}
+
+// BusRequestName requests ownership of the well-known bus name
+func (d *dbusAPINative) BusRequestName(bus Handle, name string) error {
+	if bus == nil {
+		return fmt.Errorf("dbus: invalid connection")
+	} else if !reBusName.MatchString(name) {
+		return fmt.Errorf("dbus: invalid bus name %q", name)
+	}
+	c := (*conn)(unsafe.Pointer(bus))
+	reply, err := c.call(&message{
+		Destination: busName,
+		Path:        busPath,
+		Interface:   busInterface,
+		Member:      "RequestName",
+		Body:        []interface{}{name, requestNameDoNotQueue},
+	}, defaultCallTimeout)
+	if err != nil {
+		return err
+	}
+	rsp := &dbusCallResponseNative{body: reply.Body}
+	switch code, _ := rsp.arg(0).(uint32); code {
+	case requestNameReplyPrimaryOwner, requestNameReplyAlreadyOwner:
+		return nil
+	}
+	return fmt.Errorf("%w: %s", errNameTaken, name)
+}
+
+// BusExportInterface exports an interface of the object at the path
+func (d *dbusAPINative) BusExportInterface(
+	bus Handle,
+	objectPath string,
+	iface ExportedInterface,
+) error {
+	if bus == nil {
+		return fmt.Errorf("dbus: invalid connection")
+	} else if !reObjectPath.MatchString(objectPath) {
+		return fmt.Errorf("dbus: invalid object path %q", objectPath)
+	} else if !reInterfaceName.MatchString(iface.Name) {
+		return fmt.Errorf("dbus: invalid interface name %q", iface.Name)
+	}
+	(*conn)(unsafe.Pointer(bus)).export(ObjectPath(objectPath), iface)
+	return nil
+}
+
+// BusEmitSignal emits a signal from the object at the path
+func (d *dbusAPINative) BusEmitSignal(
+	bus Handle,
+	objectPath, interfaceName, signalName string,
+	args ...interface{},
+) error {
+	if bus == nil {
+		return fmt.Errorf("dbus: invalid connection")
+	}
+	return (*conn)(unsafe.Pointer(bus)).emit(
+		ObjectPath(objectPath), interfaceName, signalName, args...,
+	)
+}
+
+// BusEmitPropertiesChanged emits the standard PropertiesChanged signal
+// with the new values of the properties
+func (d *dbusAPINative) BusEmitPropertiesChanged(
+	bus Handle,
+	objectPath, interfaceName string,
+	changed map[string]interface{},
+) error {
+	return d.BusEmitSignal(bus, objectPath, propertiesInterface, "PropertiesChanged",
+		interfaceName, variants(changed), []string{})
+}
@@ -0,0 +1,374 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//go:build !nodbus && (purego || !cgo)
+// +build !nodbus
+// +build purego !cgo
+
+package dbus
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startSessionBus starts a private dbus-daemon and points
+// DBUS_SESSION_BUS_ADDRESS to it.
+func startSessionBus(t *testing.T) {
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not available")
+	}
+	address := "unix:path=" + filepath.Join(t.TempDir(), "bus")
+	cmd := exec.Command(daemon, "--session", "--nofork", "--print-address",
+		"--address="+address)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	// The daemon prints the address once it is listening
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to start dbus-daemon: %s", err)
+	}
+	t.Setenv(envSessionBusAddress, strings.TrimSpace(line))
+}
+
+func TestNativeMessageRoundTrip(t *testing.T) {
+	msg := &message{
+		Type:        messageTypeSignal,
+		Serial:      42,
+		Path:        "/io/mender/AuthenticationManager",
+		Interface:   "io.mender.Authentication1",
+		Member:      "JwtTokenStateChange",
+		Destination: ":1.1",
+		Body: []interface{}{
+			"token",
+			true,
+			byte(7),
+			int16(-2),
+			uint16(3),
+			int32(-4),
+			uint32(5),
+			int64(-6),
+			uint64(7),
+			float64(0.5),
+			ObjectPath("/"),
+			Signature("a{sv}"),
+			[]string{"a", "bc"},
+			[]byte("bytes"),
+			map[string]string{"key": "value", "a": "b"},
+			map[string]Variant{"n": {Value: uint32(1)}},
+			[]interface{}{"struct", int64(1)},
+		},
+	}
+	b, err := msg.marshal()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	actual, err := readMessage(bytes.NewReader(b))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, msg.Type, actual.Type)
+	assert.Equal(t, msg.Serial, actual.Serial)
+	assert.Equal(t, msg.Path, actual.Path)
+	assert.Equal(t, msg.Interface, actual.Interface)
+	assert.Equal(t, msg.Member, actual.Member)
+	assert.Equal(t, msg.Destination, actual.Destination)
+	assert.Equal(t, Signature("sbynqiuxtdogasaya{ss}a{sv}(sx)"), actual.Signature)
+	assert.Equal(t, []interface{}{
+		"token",
+		true,
+		byte(7),
+		int16(-2),
+		uint16(3),
+		int32(-4),
+		uint32(5),
+		int64(-6),
+		uint64(7),
+		float64(0.5),
+		ObjectPath("/"),
+		Signature("a{sv}"),
+		[]interface{}{"a", "bc"},
+		[]interface{}{byte('b'), byte('y'), byte('t'), byte('e'), byte('s')},
+		map[interface{}]interface{}{"key": "value", "a": "b"},
+		map[interface{}]interface{}{"n": Variant{Signature: "u", Value: uint32(1)}},
+		[]interface{}{"struct", int64(1)},
+	}, actual.Body)
+
+	_, err = readMessage(bytes.NewReader(b[:len(b)-1]))
+	assert.Error(t, err)
+}
+
+func TestNativeBusProxyNew(t *testing.T) {
+	startSessionBus(t)
+	native := newDBusAPINative()
+	conn, err := native.BusGet(GBusTypeSession)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	testCases := map[string]struct {
+		name          string
+		objectPath    string
+		interfaceName string
+		err           bool
+	}{
+		"ok": {
+			name:          "org.freedesktop.DBus",
+			objectPath:    "/org/freedesktop/DBus",
+			interfaceName: "org.freedesktop.DBus",
+		},
+		"ko, wrong path": {
+			name:          "org.freedesktop.DBus",
+			objectPath:    "dummy",
+			interfaceName: "org.freedesktop.DBus",
+			err:           true,
+		},
+		"ko, wrong interface": {
+			name:          "org.freedesktop.DBus",
+			objectPath:    "/org/freedesktop/DBus",
+			interfaceName: "DBus",
+			err:           true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			proxy, err := native.BusProxyNew(conn, tc.name, tc.objectPath, tc.interfaceName)
+			if tc.err {
+				assert.Error(t, err)
+				assert.Equal(t, Handle(nil), proxy)
+			} else {
+				assert.NoError(t, err)
+				assert.NotEqual(t, Handle(nil), proxy)
+			}
+		})
+	}
+}
+
+func TestNativeBusProxyCall(t *testing.T) {
+	startSessionBus(t)
+	native := newDBusAPINative()
+	conn, err := native.BusGet(GBusTypeSession)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	proxy, err := native.BusProxyNew(conn,
+		"org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	rsp, err := native.BusProxyCall(proxy, "ListNames", nil, -1)
+	if assert.NoError(t, err) {
+		names := rsp.(*dbusCallResponseNative).body[0]
+		assert.Contains(t, names, "org.freedesktop.DBus")
+	}
+
+	rsp, err = native.BusProxyCall(proxy, "NameHasOwner", "org.freedesktop.DBus", -1)
+	if assert.NoError(t, err) {
+		assert.True(t, rsp.GetBoolean())
+	}
+
+	rsp, err = native.BusProxyCall(proxy, "GetNameOwner",
+		[]interface{}{"org.freedesktop.DBus"}, 1000)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "org.freedesktop.DBus", rsp.GetString())
+	}
+
+	rsp, err = native.BusProxyCall(proxy, "Hello", nil, -1)
+	assert.Nil(t, rsp)
+	var dbusErr *Error
+	if assert.ErrorAs(t, err, &dbusErr) {
+		assert.Equal(t, "org.freedesktop.DBus.Error.Failed", dbusErr.Name)
+	}
+}
+
+func TestNativeSignal(t *testing.T) {
+	const (
+		objectName    = "io.mender.AuthenticationManager"
+		objectPath    = "/io/mender/AuthenticationManager"
+		interfaceName = "io.mender.Authentication1"
+		signalName    = "JwtTokenStateChange"
+	)
+	startSessionBus(t)
+
+	// The service owning the name emits the signal
+	address, _ := busAddress(GBusTypeSession)
+	service, err := dial(address, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = service.call(&message{
+		Destination: busName,
+		Path:        busPath,
+		Interface:   busInterface,
+		Member:      "RequestName",
+		Body:        []interface{}{objectName, uint32(0)},
+	}, time.Second)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	native := newDBusAPINative()
+	conn, err := native.BusGet(GBusTypeSession)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	proxy, err := native.BusProxyNew(conn, objectName, objectPath, interfaceName)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NotEqual(t, Handle(nil), proxy)
+	loop := native.MainLoopNew()
+	native.MainLoopRun(loop)
+	defer native.MainLoopQuit(loop)
+
+	// Signals from other interfaces are ignored
+	err = service.emit(objectPath, "io.mender.Update1", signalName, "ignored")
+	assert.NoError(t, err)
+	err = service.emit(objectPath, interfaceName, signalName, "token", "https://server")
+	assert.NoError(t, err)
+
+	params, err := native.WaitForSignal(signalName, 5*time.Second)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []SignalParams{
+			{ParamType: GDBusTypeString, ParamData: "token"},
+			{ParamType: GDBusTypeString, ParamData: "https://server"},
+		}, params)
+	}
+	_, err = native.WaitForSignal(signalName, 100*time.Millisecond)
+	assert.Error(t, err)
+}
+
+func TestNativeService(t *testing.T) {
+	const (
+		objectName    = "io.mender.Test"
+		objectPath    = "/io/mender/Test"
+		interfaceName = "io.mender.Test1"
+	)
+	startSessionBus(t)
+
+	native := newDBusAPINative()
+	bus, err := native.BusGet(GBusTypeSession)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	var echoed []interface{}
+	err = native.BusExportInterface(bus, objectPath, ExportedInterface{
+		Name: interfaceName,
+		Methods: map[string]MethodHandler{
+			"Echo": func(args []interface{}) ([]interface{}, error) {
+				echoed = args
+				return args, nil
+			},
+			"Fail": func(args []interface{}) ([]interface{}, error) {
+				return nil, &MethodError{Name: "io.mender.Test.Error", Message: "failed"}
+			},
+		},
+		Properties: func() map[string]interface{} {
+			return map[string]interface{}{"Answer": uint32(42)}
+		},
+		Introspection: `<interface name="io.mender.Test1"/>`,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NoError(t, native.BusRequestName(bus, objectName))
+	assert.Error(t, native.BusExportInterface(bus, "dummy", ExportedInterface{
+		Name: interfaceName,
+	}))
+
+	client := newDBusAPINative()
+	clientBus, err := client.BusGet(GBusTypeSession)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// The name can only be owned by one connection
+	assert.Error(t, client.BusRequestName(clientBus, objectName))
+
+	proxy, err := client.BusProxyNew(clientBus, objectName, objectPath, interfaceName)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	rsp, err := client.BusProxyCall(proxy, "Echo", []interface{}{"hello", uint32(1)}, -1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "hello", rsp.GetString())
+		assert.Equal(t, []interface{}{"hello", uint32(1)}, echoed)
+	}
+	_, err = client.BusProxyCall(proxy, "Fail", nil, -1)
+	var dbusErr *Error
+	if assert.ErrorAs(t, err, &dbusErr) {
+		assert.Equal(t, "io.mender.Test.Error", dbusErr.Name)
+		assert.Equal(t, "failed", dbusErr.Message)
+	}
+	_, err = client.BusProxyCall(proxy, "Unknown", nil, -1)
+	if assert.ErrorAs(t, err, &dbusErr) {
+		assert.Equal(t, errorUnknownMethod, dbusErr.Name)
+	}
+
+	properties, err := client.BusProxyNew(clientBus, objectName, objectPath, propertiesInterface)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	rsp, err = client.BusProxyCall(properties, "Get",
+		[]interface{}{interfaceName, "Answer"}, -1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, Variant{Signature: "u", Value: uint32(42)},
+			rsp.(*dbusCallResponseNative).body[0])
+	}
+	_, err = client.BusProxyCall(properties, "Get",
+		[]interface{}{interfaceName, "Question"}, -1)
+	if assert.ErrorAs(t, err, &dbusErr) {
+		assert.Equal(t, errorUnknownProperty, dbusErr.Name)
+	}
+
+	introspectable, err := client.BusProxyNew(clientBus, objectName, objectPath,
+		introspectInterface)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	rsp, err = client.BusProxyCall(introspectable, "Introspect", nil, -1)
+	if assert.NoError(t, err) {
+		assert.Contains(t, rsp.GetString(), `<interface name="io.mender.Test1"/>`)
+	}
+
+	// Signals are received by the proxies of the interface
+	assert.NoError(t, native.BusEmitSignal(bus, objectPath, interfaceName, "Event", "value"))
+	params, err := client.WaitForSignal("Event", 5*time.Second)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []SignalParams{{ParamType: GDBusTypeString, ParamData: "value"}},
+			params)
+	}
+	assert.NoError(t, native.BusEmitPropertiesChanged(bus, objectPath, interfaceName,
+		map[string]interface{}{"Answer": uint32(43)}))
+	params, err = client.WaitForSignal("PropertiesChanged", 5*time.Second)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []SignalParams{{ParamType: GDBusTypeString, ParamData: interfaceName}},
+			params)
+	}
+}
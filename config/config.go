@@ -19,7 +19,9 @@ import (
 	"bytes"
 	"crypto"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"net/url"
@@ -27,6 +29,7 @@ import (
 	"os/user"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -55,6 +58,11 @@ type PortForwardConfig struct {
 	Disable bool
 }
 
+type DBusServiceConfig struct {
+	// Disable the local D-Bus service (dbus builds only)
+	Disable bool
+}
+
 type SessionsConfig struct {
 	// Whether to stop expired sessions
 	StopExpired bool
@@ -66,6 +74,177 @@ type SessionsConfig struct {
 	MaxPerUser uint32
 }
 
+// ShellUserRule maps the remote users with the user ID, the role, or both,
+// to a local account.
+type ShellUserRule struct {
+	// UserID is the ID of the remote user.
+	UserID string `json:"UserID,omitempty"`
+	// Role is a role of the remote user.
+	Role string `json:"Role,omitempty"`
+	// User is the name of the local account the shell runs as.
+	User string `json:"User"`
+}
+
+func (r ShellUserRule) matches(userID string, roles []string) bool {
+	return matchesRemoteUser(r.UserID, r.Role, userID, roles)
+}
+
+// matchesRemoteUser returns true if the remote user with the ID and roles
+// has the rule user ID and role, if set.
+func matchesRemoteUser(ruleUserID, ruleRole, userID string, roles []string) bool {
+	if ruleUserID != "" && ruleUserID != userID {
+		return false
+	}
+	if ruleRole == "" {
+		return true
+	}
+	for _, role := range roles {
+		if role == ruleRole {
+			return true
+		}
+	}
+	return false
+}
+
+// ShellUsersConfig maps the remote users opening a shell to local
+// accounts. If not configured, all shells run as User.
+type ShellUsersConfig struct {
+	// Map lists the rules mapping remote users to local accounts. The
+	// first matching rule applies.
+	Map []ShellUserRule `json:"Map,omitempty"`
+	// Default is the local account of the remote users not matching any
+	// rule (default "nobody").
+	Default string `json:"Default,omitempty"`
+}
+
+// Enabled returns true if the shells run as the accounts mapped from the
+// remote users.
+func (c ShellUsersConfig) Enabled() bool {
+	return len(c.Map) > 0 || c.Default != ""
+}
+
+func (c ShellUsersConfig) Validate() error {
+	for i, rule := range c.Map {
+		if rule.UserID == "" && rule.Role == "" {
+			return fmt.Errorf("rule %d: UserID or Role is required", i)
+		} else if rule.User == "" {
+			return fmt.Errorf("rule %d: User is required", i)
+		}
+	}
+	return nil
+}
+
+// LocalUser returns the name of the local account of the remote user with
+// the ID and roles.
+func (c ShellUsersConfig) LocalUser(userID string, roles []string) string {
+	for _, rule := range c.Map {
+		if rule.matches(userID, roles) {
+			return rule.User
+		}
+	}
+	if c.Default == "" {
+		return DefaultShellUser
+	}
+	return c.Default
+}
+
+// The permissions granted to the remote users.
+const (
+	PermissionShell       = "shell"
+	PermissionFileGet     = "file_get"
+	PermissionFilePut     = "file_put"
+	PermissionPortForward = "port_forward"
+	// PermissionAll grants all the permissions.
+	PermissionAll = "*"
+)
+
+func isPermission(permission string) bool {
+	switch permission {
+	case PermissionShell, PermissionFileGet, PermissionFilePut,
+		PermissionPortForward, PermissionAll:
+		return true
+	}
+	return false
+}
+
+// AuthorizationRule grants permissions to the remote users with the user
+// ID, the role, or both.
+type AuthorizationRule struct {
+	// UserID is the ID of the remote user.
+	UserID string `json:"UserID,omitempty"`
+	// Role is a role of the remote user.
+	Role string `json:"Role,omitempty"`
+	// Allow lists the permissions granted: "shell", "file_get",
+	// "file_put", "port_forward" or "*" for all.
+	Allow []string `json:"Allow"`
+}
+
+func (r AuthorizationRule) matches(userID string, roles []string) bool {
+	return matchesRemoteUser(r.UserID, r.Role, userID, roles)
+}
+
+// AuthorizationConfig decides which remote users may use the protocols
+// enabled on the device. If not configured, all the remote users may use
+// all the enabled protocols.
+type AuthorizationConfig struct {
+	// Rules lists the rules granting permissions. The permissions of all
+	// the matching rules are granted.
+	Rules []AuthorizationRule `json:"Rules,omitempty"`
+	// Default lists the permissions granted to the remote users not
+	// matching any rule (default none).
+	Default []string `json:"Default,omitempty"`
+}
+
+// Enabled returns true if the permissions of the remote users are
+// checked.
+func (c AuthorizationConfig) Enabled() bool {
+	return len(c.Rules) > 0 || c.Default != nil
+}
+
+func (c AuthorizationConfig) Validate() error {
+	for i, rule := range c.Rules {
+		if rule.UserID == "" && rule.Role == "" {
+			return fmt.Errorf("rule %d: UserID or Role is required", i)
+		}
+		for _, permission := range rule.Allow {
+			if !isPermission(permission) {
+				return fmt.Errorf("rule %d: invalid permission %q", i, permission)
+			}
+		}
+	}
+	for _, permission := range c.Default {
+		if !isPermission(permission) {
+			return fmt.Errorf("default: invalid permission %q", permission)
+		}
+	}
+	return nil
+}
+
+// Allowed returns true if the remote user with the ID and roles has the
+// permission.
+func (c AuthorizationConfig) Allowed(userID string, roles []string, permission string) bool {
+	if !c.Enabled() {
+		return true
+	}
+	granted := c.Default
+	matched := false
+	for _, rule := range c.Rules {
+		if !rule.matches(userID, roles) {
+			continue
+		}
+		if !matched {
+			granted, matched = nil, true
+		}
+		granted = append(granted, rule.Allow...)
+	}
+	for _, p := range granted {
+		if p == permission || p == PermissionAll {
+			return true
+		}
+	}
+	return false
+}
+
 // Counter for the limits  and restrictions for the File Transfer
 // on and off the device(MEN-4325)
 type RateLimits struct {
@@ -115,6 +294,35 @@ type Limits struct {
 	FileTransfer FileTransferLimits `json:"FileTransfer"`
 }
 
+// InventoryTriggersConfig configures the system changes triggering an
+// inventory update in addition to the periodic updates.
+type InventoryTriggersConfig struct {
+	// Netlink triggers an update on network link and address changes.
+	Netlink bool `json:"Netlink,omitempty"`
+	// WatchFiles lists files triggering an update when modified, such
+	// as "/etc/os-release".
+	WatchFiles []string `json:"WatchFiles,omitempty"`
+	// Debounce is the time the changes are collected before the update
+	// (default 5s).
+	Debounce types.Duration `json:"Debounce,omitempty"`
+}
+
+// InventorySpoolConfig configures the spool of the inventory snapshots
+// collected while the server is unreachable.
+type InventorySpoolConfig struct {
+	// Path is the file the snapshots are persisted to. Spooling is
+	// disabled if empty.
+	Path string `json:"Path,omitempty"`
+	// MaxSnapshots is the number of snapshots kept (default 100).
+	MaxSnapshots int `json:"MaxSnapshots,omitempty"`
+	// MaxSize is the size in bytes of the spool (default 1 MiB).
+	MaxSize int64 `json:"MaxSize,omitempty"`
+	// TimeSeries adds the attributes summarizing the snapshots to the
+	// inventory sent on reconnect: "offline_since", "offline_snapshots",
+	// "last_seen_uptime_s" and "max_memory_pressure".
+	TimeSeries bool `json:"TimeSeries,omitempty"`
+}
+
 // NTConnectConfigFromFile holds the configuration settings read from the config file
 type NTConnectConfigFromFile struct {
 	// The command to run as shell
@@ -124,6 +332,12 @@ type NTConnectConfigFromFile struct {
 	ShellArguments []string `json:",omitempty"`
 	// Name of the user who owns the shell process
 	User string `json:",omitempty"`
+	// ShellUsers maps the remote users to the local accounts the shells
+	// run as, instead of User.
+	ShellUsers ShellUsersConfig `json:"ShellUsers,omitempty"`
+	// Authorization decides which remote users may use the shell, the
+	// file transfer and the port forward.
+	Authorization AuthorizationConfig `json:"Authorization,omitempty"`
 	// Terminal settings
 	Terminal TerminalConfig `json:"Terminal,omitempty"`
 	// User sessions settings
@@ -136,19 +350,110 @@ type NTConnectConfigFromFile struct {
 	FileTransfer FileTransferConfig `json:",omitempty"`
 	// PortForward config
 	PortForward PortForwardConfig `json:",omitempty"`
+	// DBusService config
+	DBusService DBusServiceConfig `json:",omitempty"`
 	// TLS configures how the client manages tls sessions.
 	TLS TLSConfig `json:"TLS,omitempty"`
 	// APIConfig
 	APIConfig APIConfig `json:"API,omitempty"`
 	Chroot    string    `json:"Chroot,omitempty"`
+	// ControlSocket is the path of the local control socket used by the
+	// command line interface. The socket is disabled if empty.
+	ControlSocket string `json:"ControlSocket,omitempty"`
+	// ShutdownGracePeriod is the time the file transfers in progress are
+	// given to finish when the daemon is terminated (default 10s). A
+	// negative value terminates the sessions immediately.
+	ShutdownGracePeriod types.Duration `json:"ShutdownGracePeriod,omitempty"`
+	// StartupTimeout is the time systemd is told to wait for the first
+	// connection to the server before the daemon is considered started
+	// anyway (default 30s).
+	StartupTimeout types.Duration `json:"StartupTimeout,omitempty"`
 }
 
 type TLSConfig struct {
 	CACertificate      string `json:"CACertificate,omitempty"`
 	InsecureSkipVerify bool   `json:"InsecureSkipVerify,omitempty"`
+	// ClientCertificate is the path to a PEM encoded certificate chain
+	// presented to the server for mutual TLS authentication.
+	ClientCertificate string `json:"ClientCertificate,omitempty"`
+	// ClientKey is the path to the private key of ClientCertificate.
+	// If empty, the device key (API.PrivateKeyPath) is used.
+	ClientKey string `json:"ClientKey,omitempty"`
+	// MinVersion is the minimum accepted TLS version (1.0, 1.1, 1.2 or 1.3)
+	MinVersion string `json:"MinVersion,omitempty"`
+	// CipherSuites restricts the cipher suites negotiated for TLS 1.2 and
+	// below using the IANA names (e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256).
+	CipherSuites []string `json:"CipherSuites,omitempty"`
 }
 
-func (cfg TLSConfig) ToStdConfig() (*tls.Config, error) {
+func parseTLSVersion(version string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(version), "tls") {
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("config: invalid TLS version %q", version)
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("config: invalid or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (cfg TLSConfig) loadClientCertificate(deviceKey crypto.Signer) (*tls.Certificate, error) {
+	chain, err := cryptoutils.LoadCertificateChain(cfg.ClientCertificate)
+	if err != nil {
+		return nil, fmt.Errorf("config: failed to load ClientCertificate: %w", err)
+	}
+	pkey := deviceKey
+	if cfg.ClientKey != "" {
+		b, err := os.ReadFile(cfg.ClientKey)
+		if err == nil {
+			pkey, err = cryptoutils.LoadPrivateKey(b)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("config: failed to load ClientKey: %w", err)
+		}
+	} else if pkey == nil {
+		return nil, fmt.Errorf("config: ClientCertificate requires a ClientKey")
+	}
+	type publicKey interface {
+		Equal(crypto.PublicKey) bool
+	}
+	if pub, ok := chain[0].PublicKey.(publicKey); !ok || !pub.Equal(pkey.Public()) {
+		return nil, fmt.Errorf(
+			"config: ClientCertificate does not match the private key",
+		)
+	}
+	cert := &tls.Certificate{
+		PrivateKey: pkey,
+		Leaf:       chain[0],
+	}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert, nil
+}
+
+// ToStdConfig creates a tls.Config from the configuration. The deviceKey is
+// used for the client certificate if ClientKey is not configured.
+func (cfg TLSConfig) ToStdConfig(deviceKey crypto.Signer) (*tls.Config, error) {
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: cfg.InsecureSkipVerify,
 	}
@@ -159,6 +464,27 @@ func (cfg TLSConfig) ToStdConfig() (*tls.Config, error) {
 		}
 		tlsConfig.RootCAs = certs
 	}
+	if cfg.ClientCertificate != "" {
+		cert, err := cfg.loadClientCertificate(deviceKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{*cert}
+	}
+	if cfg.MinVersion != "" {
+		version, err := parseTLSVersion(cfg.MinVersion)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.MinVersion = version
+	}
+	if len(cfg.CipherSuites) > 0 {
+		suites, err := parseCipherSuites(cfg.CipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.CipherSuites = suites
+	}
 	return tlsConfig, nil
 }
 
@@ -178,16 +504,165 @@ func (t APIType) Validate() error {
 	return fmt.Errorf("invalid auth type %q", t)
 }
 
+// DBusInventoryMethod selects how the inventory is submitted with the
+// "dbus" API type.
+type DBusInventoryMethod string
+
+const (
+	DBusInventoryNone DBusInventoryMethod = "none"
+	DBusInventoryHTTP DBusInventoryMethod = "http"
+)
+
+func (m DBusInventoryMethod) Validate() error {
+	switch m {
+	case "", DBusInventoryNone, DBusInventoryHTTP:
+		return nil
+	default:
+	}
+	return fmt.Errorf("invalid D-Bus inventory method %q", m)
+}
+
+// Enabled returns true if the inventory is submitted in D-Bus mode.
+func (m DBusInventoryMethod) Enabled() bool {
+	return m != "" && m != DBusInventoryNone
+}
+
+// BackoffConfig configures the interval between failed API requests.
+type BackoffConfig struct {
+	// MinInterval is the interval after the first failed attempt. The
+	// interval doubles on each consecutive failure.
+	MinInterval types.Duration `json:"MinInterval,omitempty"`
+	// MaxInterval is the upper bound for the interval.
+	MaxInterval types.Duration `json:"MaxInterval,omitempty"`
+	// Jitter is the upper bound of the random duration added to each
+	// interval. A negative value disables jitter.
+	Jitter types.Duration `json:"Jitter,omitempty"`
+	// CircuitThreshold is the number of consecutive failures of an API
+	// operation after which requests are suspended for CircuitCooldown.
+	// The circuit breaker is disabled if not positive (default).
+	CircuitThreshold int `json:"CircuitThreshold,omitempty"`
+	// CircuitCooldown is the time requests are suspended once the
+	// circuit breaker opens.
+	CircuitCooldown types.Duration `json:"CircuitCooldown,omitempty"`
+}
+
+// WebsocketConfig configures the websocket connection to the server.
+type WebsocketConfig struct {
+	// Compression enables the permessage-deflate extension if supported by
+	// the server: "context-takeover" (better compression) or
+	// "no-context-takeover" (lower memory usage). Disabled if empty.
+	Compression string `json:"Compression,omitempty"`
+	// CompressionThreshold is the minimum size in bytes of compressed
+	// messages.
+	CompressionThreshold int `json:"CompressionThreshold,omitempty"`
+	// UncompressedProtocols lists the protocols sent without compression:
+	// "shell", "filetransfer", "portforward" or "control".
+	UncompressedProtocols []string `json:"UncompressedProtocols,omitempty"`
+
+	// PingInterval is the interval between websocket pings (default 30m).
+	PingInterval types.Duration `json:"PingInterval,omitempty"`
+	// PongTimeout is the time to wait for the reply to a ping before the
+	// connection is considered dead (default 10s).
+	PongTimeout types.Duration `json:"PongTimeout,omitempty"`
+	// ReadTimeout is the maximum time without receiving messages or pongs
+	// from the server before reconnecting. Disabled if zero.
+	ReadTimeout types.Duration `json:"ReadTimeout,omitempty"`
+
+	// QueueSize is the number of outbound messages queued for each
+	// priority class (control, shell, port forward and file transfer).
+	QueueSize int `json:"QueueSize,omitempty"`
+	// QueueTimeout is the maximum time to wait for room in a full outbound
+	// queue. Zero waits indefinitely and a negative value fails immediately.
+	QueueTimeout types.Duration `json:"QueueTimeout,omitempty"`
+	// WriteTimeout is the maximum time to write a single message before
+	// the connection is considered stuck and closed (default 2s).
+	WriteTimeout types.Duration `json:"WriteTimeout,omitempty"`
+}
+
+// ServerConfig describes an API endpoint.
+type ServerConfig struct {
+	ServerURL string `json:"ServerURL"`
+	// CACertificate overrides TLS.CACertificate for this server.
+	CACertificate string `json:"CACertificate,omitempty"`
+	// TenantToken overrides API.TenantToken for this server.
+	TenantToken string `json:"TenantToken,omitempty"`
+}
+
 type APIConfig struct {
-	APIType        `json:"Type"`
-	ServerURL      string `json:"ServerURL"`
+	APIType   `json:"Type"`
+	ServerURL string `json:"ServerURL"`
+	// Servers is an ordered list of API endpoints taking precedence over
+	// ServerURL. The first server is the primary, the remaining servers
+	// are used for failover.
+	Servers []ServerConfig `json:"Servers,omitempty"`
+	// FailoverAttempts is the number of consecutive failed attempts to
+	// authenticate or connect before failing over to the next server.
+	FailoverAttempts int `json:"FailoverAttempts,omitempty"`
+	// PrimaryRetryInterval is the interval between attempts to return to
+	// the primary server after failing over.
+	PrimaryRetryInterval types.Duration `json:"PrimaryRetryInterval,omitempty"`
+	// Backoff configures the interval between failed requests. A delay
+	// requested by the server (Retry-After) takes precedence.
+	Backoff BackoffConfig `json:"Backoff,omitempty"`
+	// Websocket configures the websocket connection.
+	Websocket WebsocketConfig `json:"Websocket,omitempty"`
+
 	PrivateKeyPath string `json:"PrivateKeyPath"`
-	IdentityPath   string `json:"IdentityPath"`
-	TenantToken    string `json:"TenantToken"`
-	ExternalID     string `json:"ExternalID"`
+	// PrivateKeyURI is a PKCS #11 URI ("pkcs11:...") identifying the device
+	// key in a hardware token. Takes precedence over PrivateKeyPath.
+	PrivateKeyURI string `json:"PrivateKeyURI,omitempty"`
+	// SignerCommand is a helper command performing the private key
+	// operations of the device key (see cryptoutils.ExternalSigner).
+	SignerCommand []string `json:"SignerCommand,omitempty"`
+	// PrivateKeyPassphrase is the source of the passphrase encrypting the
+	// private key at PrivateKeyPath: "file:PATH", "env:NAME",
+	// "credential:NAME" (systemd credentials) or "exec:COMMAND".
+	PrivateKeyPassphrase string `json:"PrivateKeyPassphrase,omitempty"`
+	IdentityPath         string `json:"IdentityPath"`
+	TenantToken          string `json:"TenantToken"`
+	ExternalID           string `json:"ExternalID"`
+	// AuthzCachePath is where the device token is persisted across
+	// restarts. Caching is disabled if empty.
+	AuthzCachePath string `json:"AuthzCachePath"`
 
 	InventoryExecutable string         `json:"InventoryExecutable"`
 	InventoryInterval   types.Duration `json:"InventoryInterval"`
+	// InventoryCollectors lists the built-in inventory collectors merged
+	// with the output of InventoryExecutable: "os", "kernel", "cpu",
+	// "memory", "rootfs", "network", "hostname", "uptime", "nt-connect"
+	// or "all". "all" leaves out "uptime", which changes on every run.
+	InventoryCollectors []string `json:"InventoryCollectors,omitempty"`
+	// InventoryDirectory is a directory of inventory scripts run
+	// concurrently in addition to InventoryExecutable. Disabled if empty.
+	InventoryDirectory string `json:"InventoryDirectory,omitempty"`
+	// InventoryScriptTimeout is the time an inventory script may run
+	// (default 1m).
+	InventoryScriptTimeout types.Duration `json:"InventoryScriptTimeout,omitempty"`
+	// InventoryScriptMaxOutput is the number of bytes read from the
+	// output of an inventory script (default 1MiB).
+	InventoryScriptMaxOutput int64 `json:"InventoryScriptMaxOutput,omitempty"`
+	// InventoryScriptPrefixKeys prefixes the attributes of the scripts in
+	// InventoryDirectory with the script name.
+	InventoryScriptPrefixKeys bool `json:"InventoryScriptPrefixKeys,omitempty"`
+	// InventoryTriggers configures the system changes triggering an
+	// inventory update.
+	InventoryTriggers InventoryTriggersConfig `json:"InventoryTriggers,omitempty"`
+	// InventoryCachePath is where the digests of the last inventory sent
+	// are persisted, for only the changed attributes to be sent after a
+	// restart. Caching is disabled if empty.
+	InventoryCachePath string `json:"InventoryCachePath,omitempty"`
+	// InventoryFullInterval is the interval for sending the complete
+	// inventory instead of the changed attributes (default 24h).
+	InventoryFullInterval types.Duration `json:"InventoryFullInterval,omitempty"`
+	// InventorySpool configures the spool of the inventory snapshots
+	// collected while the server is unreachable. The latest snapshot is
+	// sent on reconnect.
+	InventorySpool InventorySpoolConfig `json:"InventorySpool,omitempty"`
+	// DBusInventory selects how the inventory is submitted with the
+	// "dbus" API type: "none" (default, left to the client owning the
+	// Authentication Manager) or "http" (sent to the server with the
+	// token from the Authentication Manager).
+	DBusInventory DBusInventoryMethod `json:"DBusInventory,omitempty"`
 
 	privateKey crypto.Signer
 	identity   *api.Identity
@@ -244,6 +719,23 @@ func (cfg *APIConfig) load() error {
 	}
 	buf.Reset()
 
+	switch {
+	case cfg.PrivateKeyURI != "":
+		pkey, err := cryptoutils.NewPKCS11Signer(cfg.PrivateKeyURI)
+		if err != nil {
+			return fmt.Errorf("failed to load private key from token: %w", err)
+		}
+		cfg.privateKey = pkey
+		return nil
+	case len(cfg.SignerCommand) > 0:
+		pkey, err := cryptoutils.NewExternalSigner(cfg.SignerCommand)
+		if err != nil {
+			return fmt.Errorf("failed to load external signer: %w", err)
+		}
+		cfg.privateKey = pkey
+		return nil
+	}
+
 	fd, err := os.Open(cfg.PrivateKeyPath)
 	if err != nil {
 		return fmt.Errorf("failed to open private key file: %w", err)
@@ -254,12 +746,71 @@ func (cfg *APIConfig) load() error {
 	if err != nil {
 		return fmt.Errorf("failed to read private key: %w", err)
 	}
-	pkey, err := cryptoutils.LoadPrivateKey(buf.Bytes())
+	passphrase, err := cfg.ReadPassphrase()
+	if err != nil {
+		return err
+	}
+	pkey, err := cryptoutils.LoadPrivateKeyWithPassphrase(buf.Bytes(), passphrase)
 	if err != nil {
 		return fmt.Errorf("failed to load private key: %w", err)
 	}
 	cfg.privateKey = pkey
 	buf.Reset()
+	return cfg.recoverKeyRotation(buf, passphrase)
+}
+
+// The suffixes of the files written while rotating the device key: the
+// pending key and identity, and the backup of the current key.
+const (
+	SuffixPending = ".new"
+	SuffixBackup  = ".old"
+)
+
+// publicKeyMatches returns true if the identity holds the public key of
+// the private key.
+func publicKeyMatches(identity *api.Identity, pkey crypto.Signer) bool {
+	block, _ := pem.Decode([]byte(identity.PublicKey))
+	if block == nil {
+		return false
+	}
+	der, err := x509.MarshalPKIXPublicKey(pkey.Public())
+	return err == nil && bytes.Equal(block.Bytes, der)
+}
+
+// recoverKeyRotation completes or rolls back a key rotation interrupted
+// after replacing the private key: the pending identity replaces the
+// identity if it matches the private key, otherwise the backup key is
+// restored if it matches the identity.
+func (cfg *APIConfig) recoverKeyRotation(buf *bytes.Buffer, passphrase []byte) error {
+	if publicKeyMatches(cfg.identity, cfg.privateKey) {
+		return nil
+	}
+	pendingPath := cfg.IdentityPath + SuffixPending
+	if b, err := os.ReadFile(pendingPath); err == nil {
+		var identity api.Identity
+		if json.Unmarshal(b, &identity) == nil &&
+			publicKeyMatches(&identity, cfg.privateKey) {
+			if err = os.Rename(pendingPath, cfg.IdentityPath); err != nil {
+				return fmt.Errorf("failed to complete key rotation: %w", err)
+			}
+			log.Warnf("completed interrupted key rotation: identity updated")
+			return cfg.loadIdentity(buf)
+		}
+	}
+	backupPath := cfg.PrivateKeyPath + SuffixBackup
+	if b, err := os.ReadFile(backupPath); err == nil {
+		pkey, err := cryptoutils.LoadPrivateKeyWithPassphrase(b, passphrase)
+		if err == nil && publicKeyMatches(cfg.identity, pkey) {
+			if err = os.Rename(backupPath, cfg.PrivateKeyPath); err != nil {
+				return fmt.Errorf("failed to roll back key rotation: %w", err)
+			}
+			log.Warnf("rolled back interrupted key rotation: previous key restored")
+			cfg.privateKey = pkey
+			return nil
+		}
+	}
+	log.Warnf("the private key %s does not match the identity %s",
+		cfg.PrivateKeyPath, cfg.IdentityPath)
 	return nil
 }
 
@@ -270,35 +821,91 @@ func (cfg *APIConfig) Validate() error {
 	if err != nil {
 		return err
 	}
+	if err = cfg.DBusInventory.Validate(); err != nil {
+		return err
+	}
 	if cfg.APIType == APITypeHTTP {
-		if cfg.ServerURL == "" {
-			err = fmt.Errorf("empty value")
-		} else {
-			_, err = url.Parse(cfg.ServerURL)
-		}
-		if err != nil {
-			return fmt.Errorf("invalid ServerURL: %w", err)
-		}
-		if cfg.TenantToken == magicTenantToken {
-			if strings.HasPrefix(cfg.ExternalID, "iot-hub") {
-				return fmt.Errorf(
-					"Default tenant token found in env var %s: "+
-						"please customize tenant token in "+
-						"Azure IoT Edge module, or where you set "+
-						"environment variables", envTenantToken)
-			} else {
-				return fmt.Errorf("TenantToken (env: %s) invalid: "+
-					"please copy the token from your account settings",
-					envTenantToken)
+		for _, server := range cfg.GetServers() {
+			if err = cfg.validateServer(server); err != nil {
+				return err
 			}
 		}
-		if cfg.TenantToken == "" {
-			return fmt.Errorf("TenantToken (env: %s) cannot be blank", envTenantToken)
+	}
+	return nil
+}
+
+func (cfg *APIConfig) validateServer(server ServerConfig) (err error) {
+	if server.ServerURL == "" {
+		err = fmt.Errorf("empty value")
+	} else {
+		_, err = url.Parse(server.ServerURL)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid ServerURL: %w", err)
+	}
+	if server.TenantToken == magicTenantToken {
+		if strings.HasPrefix(cfg.ExternalID, "iot-hub") {
+			return fmt.Errorf(
+				"Default tenant token found in env var %s: "+
+					"please customize tenant token in "+
+					"Azure IoT Edge module, or where you set "+
+					"environment variables", envTenantToken)
+		} else {
+			return fmt.Errorf("TenantToken (env: %s) invalid: "+
+				"please copy the token from your account settings",
+				envTenantToken)
 		}
 	}
+	if server.TenantToken == "" {
+		return fmt.Errorf("TenantToken (env: %s) cannot be blank", envTenantToken)
+	}
 	return nil
 }
 
+// GetServers returns the API endpoints in order of preference with the
+// defaults from the API and TLS configuration applied.
+func (cfg *APIConfig) GetServers() []ServerConfig {
+	if len(cfg.Servers) == 0 {
+		return []ServerConfig{{
+			ServerURL:   cfg.ServerURL,
+			TenantToken: cfg.TenantToken,
+		}}
+	}
+	servers := make([]ServerConfig, len(cfg.Servers))
+	for i, server := range cfg.Servers {
+		if server.TenantToken == "" {
+			server.TenantToken = cfg.TenantToken
+		}
+		servers[i] = server
+	}
+	return servers
+}
+
+// AuthzCachePaths returns the paths the tokens of the servers are cached
+// at, in the order of GetServers, or nil if caching is disabled.
+func (cfg *APIConfig) AuthzCachePaths() []string {
+	if cfg.AuthzCachePath == "" {
+		return nil
+	}
+	paths := make([]string, len(cfg.GetServers()))
+	for i := range paths {
+		paths[i] = cfg.AuthzCachePath
+		if i > 0 {
+			paths[i] += "." + strconv.Itoa(i)
+		}
+	}
+	return paths
+}
+
+// ReadPassphrase reads the private key passphrase from the configured
+// source. It returns nil if no passphrase is configured.
+func (cfg *APIConfig) ReadPassphrase() ([]byte, error) {
+	if cfg.PrivateKeyPassphrase == "" {
+		return nil, nil
+	}
+	return cryptoutils.ReadPassphrase(cfg.PrivateKeyPassphrase)
+}
+
 func (cfg *APIConfig) GetPrivateKey() crypto.Signer {
 	return cfg.privateKey
 }
@@ -321,10 +928,16 @@ func NewNTConnectConfig() *NTConnectConfig {
 			APIConfig: APIConfig{
 				PrivateKeyPath: path.Join(DefaultDataStore, "private.pem"),
 				IdentityPath:   path.Join(DefaultDataStore, "identity.json"),
+				AuthzCachePath: path.Join(DefaultDataStore, "authz.json"),
 
 				InventoryInterval:   types.Duration(time.Hour),
 				InventoryExecutable: path.Join(DefaultPathDataDir, "inventory.sh"),
+				InventoryCachePath:  path.Join(DefaultDataStore, "inventory.json"),
+				InventorySpool: InventorySpoolConfig{
+					Path: path.Join(DefaultDataStore, "inventory-spool.json"),
+				},
 			},
+			ControlSocket: DefaultControlSocket,
 		},
 	}
 }
@@ -473,6 +1086,14 @@ func (c *NTConnectConfig) Validate() (err error) {
 		return err
 	}
 
+	if err := c.ShellUsers.Validate(); err != nil {
+		return fmt.Errorf("invalid ShellUsers configuration: %w", err)
+	}
+
+	if err := c.Authorization.Validate(); err != nil {
+		return fmt.Errorf("invalid Authorization configuration: %w", err)
+	}
+
 	if !isInShells(c.ShellCommand) {
 		log.Errorf("ShellCommand %s is not present in /etc/shells", c.ShellCommand)
 		return errors.New("ShellCommand " + c.ShellCommand + " is not present in /etc/shells")
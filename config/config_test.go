@@ -15,7 +15,16 @@
 package config
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/fs"
 	"io/ioutil"
+	"math/big"
 	"os"
 	"path"
 	"testing"
@@ -150,9 +159,15 @@ func validateConfiguration(t *testing.T, actual *NTConnectConfig) {
 		APIConfig: APIConfig{
 			PrivateKeyPath:      path.Join(DefaultDataStore, "private.pem"),
 			IdentityPath:        path.Join(DefaultDataStore, "identity.json"),
+			AuthzCachePath:      path.Join(DefaultDataStore, "authz.json"),
 			InventoryInterval:   types.Duration(time.Hour),
 			InventoryExecutable: path.Join(DefaultPathDataDir, "inventory.sh"),
+			InventoryCachePath:  path.Join(DefaultDataStore, "inventory.json"),
+			InventorySpool: InventorySpoolConfig{
+				Path: path.Join(DefaultDataStore, "inventory-spool.json"),
+			},
 		},
+		ControlSocket: DefaultControlSocket,
 	}
 	assert.Equal(t, actual, expectedConfig)
 }
@@ -369,3 +384,240 @@ func TestShellArgumentsEmptyDefaults(t *testing.T) {
 	assert.Equal(t, []string{"--no-profile", "--norc", "--restricted"}, config.ShellArguments)
 
 }
+
+func TestTLSConfigToStdConfig(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	pkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &x509.Certificate{SerialNumber: big.NewInt(1)}, pkey.Public(), pkey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	certPath := path.Join(dir, "client.crt")
+	err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: der,
+	}), 0600)
+	if err != nil {
+		t.Fatalf("failed to write certificate: %s", err)
+	}
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(pkey)
+	keyPath := path.Join(dir, "client.key")
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: keyDER,
+	}), 0600)
+	if err != nil {
+		t.Fatalf("failed to write private key: %s", err)
+	}
+
+	t.Run("ok/device key", func(t *testing.T) {
+		t.Parallel()
+		tlsConfig, err := TLSConfig{
+			ClientCertificate: certPath,
+			MinVersion:        "1.2",
+			CipherSuites:      []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		}.ToStdConfig(pkey)
+		if assert.NoError(t, err) {
+			assert.Len(t, tlsConfig.Certificates, 1)
+			assert.Equal(t, pkey, tlsConfig.Certificates[0].PrivateKey)
+			assert.Equal(t, uint16(tls.VersionTLS12), tlsConfig.MinVersion)
+			assert.Equal(t,
+				[]uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+				tlsConfig.CipherSuites)
+		}
+	})
+	t.Run("ok/client key", func(t *testing.T) {
+		t.Parallel()
+		tlsConfig, err := TLSConfig{
+			ClientCertificate: certPath,
+			ClientKey:         keyPath,
+		}.ToStdConfig(nil)
+		if assert.NoError(t, err) {
+			assert.Len(t, tlsConfig.Certificates, 1)
+		}
+	})
+	t.Run("error/key mismatch", func(t *testing.T) {
+		t.Parallel()
+		_, err := TLSConfig{
+			ClientCertificate: certPath,
+		}.ToStdConfig(otherKey)
+		assert.EqualError(t, err,
+			"config: ClientCertificate does not match the private key")
+	})
+	t.Run("error/no key", func(t *testing.T) {
+		t.Parallel()
+		_, err := TLSConfig{
+			ClientCertificate: certPath,
+		}.ToStdConfig(nil)
+		assert.EqualError(t, err, "config: ClientCertificate requires a ClientKey")
+	})
+	t.Run("error/certificate not found", func(t *testing.T) {
+		t.Parallel()
+		missing := path.Join(dir, "missing.crt")
+		_, err := TLSConfig{
+			ClientCertificate: missing,
+		}.ToStdConfig(pkey)
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+		assert.EqualError(t, err, "config: failed to load ClientCertificate: open "+
+			missing+": no such file or directory")
+	})
+	t.Run("error/min version", func(t *testing.T) {
+		t.Parallel()
+		_, err := TLSConfig{MinVersion: "2.0"}.ToStdConfig(nil)
+		assert.EqualError(t, err, `config: invalid TLS version "2.0"`)
+	})
+	t.Run("error/insecure cipher suite", func(t *testing.T) {
+		t.Parallel()
+		_, err := TLSConfig{
+			CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"},
+		}.ToStdConfig(nil)
+		assert.EqualError(t, err,
+			`config: invalid or insecure cipher suite "TLS_RSA_WITH_RC4_128_SHA"`)
+	})
+}
+
+func TestAPIConfigGetServers(t *testing.T) {
+	cfg := APIConfig{
+		ServerURL:   "https://hosted.example.com",
+		TenantToken: "tenant",
+	}
+	assert.Equal(t, []ServerConfig{{
+		ServerURL:   "https://hosted.example.com",
+		TenantToken: "tenant",
+	}}, cfg.GetServers())
+	assert.NoError(t, cfg.validateServer(cfg.GetServers()[0]))
+
+	cfg.Servers = []ServerConfig{{
+		ServerURL: "https://primary.example.com",
+	}, {
+		ServerURL:     "https://dr.example.com",
+		CACertificate: "/etc/ssl/dr.crt",
+		TenantToken:   "dr-tenant",
+	}}
+	assert.Equal(t, []ServerConfig{{
+		ServerURL:   "https://primary.example.com",
+		TenantToken: "tenant",
+	}, {
+		ServerURL:     "https://dr.example.com",
+		CACertificate: "/etc/ssl/dr.crt",
+		TenantToken:   "dr-tenant",
+	}}, cfg.GetServers())
+
+	err := cfg.validateServer(ServerConfig{TenantToken: "tenant"})
+	assert.ErrorContains(t, err, "invalid ServerURL")
+	err = cfg.validateServer(ServerConfig{ServerURL: "https://dr.example.com"})
+	assert.ErrorContains(t, err, "cannot be blank")
+}
+
+func TestDBusInventoryMethod(t *testing.T) {
+	for _, method := range []DBusInventoryMethod{
+		"", DBusInventoryNone, DBusInventoryHTTP,
+	} {
+		assert.NoError(t, method.Validate())
+	}
+	assert.EqualError(t, DBusInventoryMethod("dbus").Validate(),
+		`invalid D-Bus inventory method "dbus"`)
+
+	assert.False(t, DBusInventoryMethod("").Enabled())
+	assert.False(t, DBusInventoryNone.Enabled())
+	assert.True(t, DBusInventoryHTTP.Enabled())
+}
+
+func TestShellUsersConfig(t *testing.T) {
+	conf := ShellUsersConfig{
+		Map: []ShellUserRule{{
+			UserID: "alice",
+			User:   "root",
+		}, {
+			UserID: "bob",
+			Role:   "admin",
+			User:   "admin",
+		}, {
+			Role: "operator",
+			User: "operator",
+		}},
+	}
+	assert.True(t, conf.Enabled())
+	assert.NoError(t, conf.Validate())
+
+	assert.Equal(t, "root", conf.LocalUser("alice", nil))
+	assert.Equal(t, "admin", conf.LocalUser("bob", []string{"operator", "admin"}))
+	assert.Equal(t, "operator", conf.LocalUser("bob", []string{"operator"}))
+	assert.Equal(t, "operator", conf.LocalUser("carol", []string{"operator"}))
+	assert.Equal(t, DefaultShellUser, conf.LocalUser("carol", []string{"admin"}))
+	conf.Default = "guest"
+	assert.Equal(t, "guest", conf.LocalUser("", nil))
+
+	assert.False(t, ShellUsersConfig{}.Enabled())
+	assert.True(t, ShellUsersConfig{Default: "guest"}.Enabled())
+
+	err := ShellUsersConfig{Map: []ShellUserRule{{User: "root"}}}.Validate()
+	assert.EqualError(t, err, "rule 0: UserID or Role is required")
+	err = ShellUsersConfig{Map: []ShellUserRule{{Role: "admin"}}}.Validate()
+	assert.EqualError(t, err, "rule 0: User is required")
+}
+
+func TestAuthorizationConfig(t *testing.T) {
+	conf := AuthorizationConfig{
+		Rules: []AuthorizationRule{{
+			Role:  "admin",
+			Allow: []string{PermissionAll},
+		}, {
+			Role:  "operator",
+			Allow: []string{PermissionShell, PermissionFileGet},
+		}, {
+			UserID: "bob",
+			Allow:  []string{PermissionFilePut},
+		}},
+		Default: []string{PermissionFileGet},
+	}
+	assert.True(t, conf.Enabled())
+	assert.NoError(t, conf.Validate())
+
+	testCases := []struct {
+		UserID     string
+		Roles      []string
+		Permission string
+		Allowed    bool
+	}{
+		{UserID: "alice", Roles: []string{"admin"}, Permission: PermissionPortForward, Allowed: true},
+		{UserID: "alice", Roles: []string{"operator"}, Permission: PermissionShell, Allowed: true},
+		{UserID: "alice", Roles: []string{"operator"}, Permission: PermissionFilePut},
+		{UserID: "bob", Roles: []string{"operator"}, Permission: PermissionFilePut, Allowed: true},
+		{UserID: "bob", Permission: PermissionFileGet},
+		{UserID: "carol", Permission: PermissionFileGet, Allowed: true},
+		{UserID: "carol", Permission: PermissionShell},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.Allowed, conf.Allowed(tc.UserID, tc.Roles, tc.Permission),
+			"%s %v %s", tc.UserID, tc.Roles, tc.Permission)
+	}
+
+	assert.False(t, AuthorizationConfig{}.Enabled())
+	assert.True(t, AuthorizationConfig{}.Allowed("", nil, PermissionShell))
+	assert.False(t, AuthorizationConfig{Default: []string{}}.Allowed("", nil, PermissionShell))
+
+	err := AuthorizationConfig{Rules: []AuthorizationRule{{Allow: []string{"shell"}}}}.Validate()
+	assert.EqualError(t, err, "rule 0: UserID or Role is required")
+	err = AuthorizationConfig{
+		Rules: []AuthorizationRule{{Role: "admin", Allow: []string{"reboot"}}},
+	}.Validate()
+	assert.EqualError(t, err, `rule 0: invalid permission "reboot"`)
+	err = AuthorizationConfig{Default: []string{"reboot"}}.Validate()
+	assert.EqualError(t, err, `default: invalid permission "reboot"`)
+}
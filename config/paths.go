@@ -25,8 +25,11 @@ var (
 	DefaultPathDataDir = "/usr/share/nt-connect"
 	DefaultDataStore   = "/var/lib/nt-connect"
 
+	DefaultControlSocket = "/run/nt-connect/control.sock"
+
 	DefaultShellCommand      = "/bin/sh"
 	DefaultShellArguments    = []string{"--login"}
+	DefaultShellUser         = "nobody"
 	DefaultDeviceConnectPath = "/api/devices/v1/deviceconnect/connect"
 
 	DefaultTerminalString = "xterm-256color"
@@ -41,6 +44,11 @@ var (
 
 	MaxReconnectAttempts             = uint(10)
 	DefaultReconnectIntervalsSeconds = 5
+	DefaultPrimaryRetryInterval      = 10 * time.Minute
+	DefaultInventoryDebounce         = 5 * time.Second
+	DefaultInventoryFullInterval     = 24 * time.Hour
+	DefaultShutdownGracePeriod       = 10 * time.Second
+	DefaultStartupTimeout            = 30 * time.Second
 	MessageWriteTimeout              = 2 * time.Second
 	MaxShellsSpawned                 = uint(16)
 )
@@ -0,0 +1,258 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package inventory
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/northerntechhq/nt-connect/api"
+)
+
+// The network interfaces are looked up through variables to be replaced
+// in tests.
+var (
+	netInterfaces  = net.Interfaces
+	interfaceAddrs = func(iface net.Interface) ([]net.Addr, error) {
+		return iface.Addrs()
+	}
+)
+
+// scanLines calls fn for each line of the file until it returns false.
+func scanLines(path string, fn func(line string) bool) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		if !fn(s.Text()) {
+			break
+		}
+	}
+	return s.Err()
+}
+
+// field returns the value of a "key: value" line.
+func field(line, key string) (string, bool) {
+	k, v, ok := strings.Cut(line, ":")
+	if !ok || strings.TrimSpace(k) != key {
+		return "", false
+	}
+	return strings.TrimSpace(v), true
+}
+
+func collectCPU(opts Options) collectFunc {
+	return func(context.Context) (api.Inventory, error) {
+		inv := make(api.Inventory)
+		var count int
+		models := make(map[string]bool)
+		err := scanLines(opts.path("/proc/cpuinfo"), func(line string) bool {
+			if _, ok := field(line, "processor"); ok {
+				count++
+			} else if model, ok := field(line, "model name"); ok && !models[model] {
+				models[model] = true
+				inv.Add("cpu_model", model)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			count = runtime.NumCPU()
+		}
+		inv.Add("cpu_count", count)
+		return inv, nil
+	}
+}
+
+func collectHostname(opts Options) collectFunc {
+	return func(context.Context) (api.Inventory, error) {
+		hostname, err := os.Hostname()
+		if err != nil || hostname == "" {
+			b, _ := os.ReadFile(opts.path("/etc/hostname"))
+			hostname = strings.TrimSpace(string(b))
+		}
+		if hostname == "" {
+			hostname = "localhost"
+		}
+		return api.Inventory{"hostname": api.NewInventoryValue(hostname)}, nil
+	}
+}
+
+func collectKernel(opts Options) collectFunc {
+	return func(context.Context) (api.Inventory, error) {
+		b, err := os.ReadFile(opts.path("/proc/version"))
+		if err != nil {
+			return nil, err
+		}
+		return api.Inventory{
+			"kernel": api.NewInventoryValue(strings.TrimSpace(string(b))),
+		}, nil
+	}
+}
+
+func collectMemory(opts Options) collectFunc {
+	return func(context.Context) (api.Inventory, error) {
+		inv := make(api.Inventory)
+		err := scanLines(opts.path("/proc/meminfo"), func(line string) bool {
+			if value, ok := field(line, "MemTotal"); ok {
+				value = strings.TrimSpace(strings.TrimSuffix(value, "kB"))
+				if kB, err := strconv.ParseUint(value, 10, 64); err == nil {
+					inv.Add("mem_total_kB", kB)
+				} else {
+					inv.Add("mem_total_kB", value)
+				}
+				return false
+			}
+			return true
+		})
+		return inv, err
+	}
+}
+
+// isContainerInterface matches the interfaces created by container
+// runtimes, which are excluded from the inventory.
+func isContainerInterface(name string) bool {
+	return strings.HasPrefix(name, "br-") ||
+		strings.HasPrefix(name, "docker") ||
+		strings.HasPrefix(name, "veth")
+}
+
+func collectNetwork(Options) collectFunc {
+	return func(context.Context) (api.Inventory, error) {
+		ifaces, err := netInterfaces()
+		if err != nil {
+			return nil, err
+		}
+		inv := make(api.Inventory)
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagLoopback != 0 || isContainerInterface(iface.Name) {
+				continue
+			}
+			inv.Add("network_interfaces", iface.Name)
+			if len(iface.HardwareAddr) > 0 {
+				inv.Add("mac_"+iface.Name, iface.HardwareAddr.String())
+			}
+			addrs, err := interfaceAddrs(iface)
+			if err != nil {
+				continue
+			}
+			for _, addr := range addrs {
+				ipNet, ok := addr.(*net.IPNet)
+				if !ok {
+					continue
+				}
+				key := "ipv6_" + iface.Name
+				if ipNet.IP.To4() != nil {
+					key = "ipv4_" + iface.Name
+				}
+				inv.Add(key, ipNet.String())
+			}
+		}
+		return inv, nil
+	}
+}
+
+func collectNTConnect(opts Options) collectFunc {
+	return func(context.Context) (api.Inventory, error) {
+		inv := make(api.Inventory)
+		inv.Add("nt_connect_version", api.VersionString())
+		for _, feature := range opts.Features {
+			inv.Add("nt_connect_features", feature)
+		}
+		return inv, nil
+	}
+}
+
+// unquote removes the quotes around an os-release value.
+func unquote(value string) string {
+	if s, err := strconv.Unquote(value); err == nil {
+		return s
+	}
+	return strings.Trim(value, `'`)
+}
+
+func collectOS(opts Options) collectFunc {
+	return func(context.Context) (api.Inventory, error) {
+		for _, path := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+			values := make(map[string]string)
+			err := scanLines(opts.path(path), func(line string) bool {
+				if key, value, ok := strings.Cut(line, "="); ok {
+					values[key] = unquote(value)
+				}
+				return true
+			})
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if values["PRETTY_NAME"] != "" {
+				return api.Inventory{"os": api.NewInventoryValue(values["PRETTY_NAME"])}, nil
+			} else if values["NAME"] != "" && values["VERSION"] != "" {
+				return api.Inventory{
+					"os": api.NewInventoryValue(values["NAME"] + " " + values["VERSION"]),
+				}, nil
+			}
+		}
+		return api.Inventory{"os": api.NewInventoryValue("unknown")}, nil
+	}
+}
+
+func collectRootfs(opts Options) collectFunc {
+	return func(context.Context) (api.Inventory, error) {
+		fsType := "Unknown"
+		err := scanLines(opts.path("/proc/mounts"), func(line string) bool {
+			fields := strings.Fields(line)
+			if len(fields) > 2 && fields[1] == "/" && fields[0] != "rootfs" {
+				// The last mount on / is the visible one
+				fsType = fields[2]
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		return api.Inventory{"rootfs_type": api.NewInventoryValue(fsType)}, nil
+	}
+}
+
+func collectUptime(opts Options) collectFunc {
+	return func(context.Context) (api.Inventory, error) {
+		b, err := os.ReadFile(opts.path("/proc/uptime"))
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(string(b))
+		if len(fields) == 0 {
+			return nil, errors.New("inventory: malformed /proc/uptime")
+		}
+		uptime, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, err
+		}
+		return api.Inventory{
+			"uptime_s": api.NewInventoryValue(int64(uptime)),
+		}, nil
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+// Package inventory provides built-in collectors of device inventory
+// attributes as an alternative to the inventory scripts.
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/northerntechhq/nt-connect/api"
+)
+
+// CollectorsAll enables all the built-in collectors.
+const CollectorsAll = "all"
+
+// Collector collects a set of inventory attributes.
+type Collector interface {
+	Name() string
+	Collect(ctx context.Context) (api.Inventory, error)
+}
+
+// Options configures the built-in collectors.
+type Options struct {
+	// Root is the root directory of the file system the collectors read
+	// from (default "/").
+	Root string
+	// Features lists the enabled nt-connect features.
+	Features []string
+}
+
+func (opts Options) path(name string) string {
+	if opts.Root == "" {
+		return name
+	}
+	return filepath.Join(opts.Root, name)
+}
+
+type collectFunc func(ctx context.Context) (api.Inventory, error)
+
+type collector struct {
+	name    string
+	collect collectFunc
+}
+
+func (c collector) Name() string {
+	return c.name
+}
+
+func (c collector) Collect(ctx context.Context) (api.Inventory, error) {
+	return c.collect(ctx)
+}
+
+var builtins = map[string]func(opts Options) collectFunc{
+	"cpu":        collectCPU,
+	"hostname":   collectHostname,
+	"kernel":     collectKernel,
+	"memory":     collectMemory,
+	"network":    collectNetwork,
+	"nt-connect": collectNTConnect,
+	"os":         collectOS,
+	"rootfs":     collectRootfs,
+	"uptime":     collectUptime,
+}
+
+// optIn lists the collectors selected by name only, not by "all": their
+// attributes change on every run, so the inventory would never be
+// unchanged and skipped.
+var optIn = map[string]bool{
+	"uptime": true,
+}
+
+// Names returns the sorted names of the built-in collectors.
+func Names() []string {
+	names := make([]string, 0, len(builtins))
+	for name := range builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New returns the built-in collectors with the names. The name "all"
+// selects all collectors but "uptime", which must be named explicitly.
+func New(names []string, opts Options) ([]Collector, error) {
+	enabled := make(map[string]bool, len(names))
+	for _, name := range names {
+		if name == CollectorsAll {
+			for _, name := range Names() {
+				enabled[name] = enabled[name] || !optIn[name]
+			}
+			continue
+		} else if _, ok := builtins[name]; !ok {
+			return nil, fmt.Errorf("unknown inventory collector %q", name)
+		}
+		enabled[name] = true
+	}
+	var collectors []Collector
+	for _, name := range Names() {
+		if enabled[name] {
+			collectors = append(collectors, collector{
+				name:    name,
+				collect: builtins[name](opts),
+			})
+		}
+	}
+	return collectors, nil
+}
@@ -0,0 +1,214 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package inventory
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/northerntechhq/nt-connect/api"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestNew(t *testing.T) {
+	collectors, err := New([]string{"os", "kernel"}, Options{})
+	if assert.NoError(t, err) && assert.Len(t, collectors, 2) {
+		assert.Equal(t, "kernel", collectors[0].Name())
+		assert.Equal(t, "os", collectors[1].Name())
+	}
+
+	collectors, err = New([]string{CollectorsAll, "os"}, Options{})
+	if assert.NoError(t, err) {
+		assert.Len(t, collectors, len(Names())-1)
+		for _, c := range collectors {
+			assert.NotEqual(t, "uptime", c.Name())
+		}
+	}
+
+	collectors, err = New([]string{"uptime", CollectorsAll}, Options{})
+	if assert.NoError(t, err) {
+		assert.Len(t, collectors, len(Names()))
+	}
+
+	collectors, err = New(nil, Options{})
+	assert.NoError(t, err)
+	assert.Empty(t, collectors)
+
+	_, err = New([]string{"dummy"}, Options{})
+	assert.EqualError(t, err, `unknown inventory collector "dummy"`)
+}
+
+func TestCollectors(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"proc/cpuinfo": "processor\t: 0\nmodel name\t: ARMv7 Processor rev 4\n\n" +
+			"processor\t: 1\nmodel name\t: ARMv7 Processor rev 4\n",
+		"proc/version": "Linux version 6.1.0 (gcc 12.2.0)\n",
+		"proc/meminfo": "MemTotal:        8000000 kB\nMemFree:         1000 kB\n",
+		"proc/mounts": "rootfs / rootfs rw 0 0\n" +
+			"/dev/mmcblk0p2 / ext4 rw,relatime 0 0\n" +
+			"proc /proc proc rw 0 0\n",
+		"proc/uptime": "12345.67 45678.90\n",
+		"etc/os-release": "NAME=\"Debian GNU/Linux\"\n" +
+			"PRETTY_NAME=\"Debian GNU/Linux 12 (bookworm)\"\n",
+	})
+	yoctoRoot := writeFiles(t, map[string]string{
+		"usr/lib/os-release": "NAME='Yocto'\nVERSION=4.0\n",
+	})
+	opts := Options{Root: root, Features: []string{"terminal", "filetransfer"}}
+
+	testCases := map[string]struct {
+		Root      string
+		Collector string
+
+		Inventory api.Inventory
+		Error     bool
+	}{
+		"cpu": {
+			Collector: "cpu",
+			Inventory: api.Inventory{
+				"cpu_model": api.NewInventoryValue("ARMv7 Processor rev 4"),
+				"cpu_count": api.NewInventoryValue(2),
+			},
+		},
+		"kernel": {
+			Collector: "kernel",
+			Inventory: api.Inventory{
+				"kernel": api.NewInventoryValue("Linux version 6.1.0 (gcc 12.2.0)"),
+			},
+		},
+		"memory": {
+			Collector: "memory",
+			Inventory: api.Inventory{"mem_total_kB": api.NewInventoryValue(8000000)},
+		},
+		"rootfs": {
+			Collector: "rootfs",
+			Inventory: api.Inventory{"rootfs_type": api.NewInventoryValue("ext4")},
+		},
+		"uptime": {
+			Collector: "uptime",
+			Inventory: api.Inventory{"uptime_s": api.NewInventoryValue(12345)},
+		},
+		"os": {
+			Collector: "os",
+			Inventory: api.Inventory{
+				"os": api.NewInventoryValue("Debian GNU/Linux 12 (bookworm)"),
+			},
+		},
+		"os, name and version": {
+			Root:      yoctoRoot,
+			Collector: "os",
+			Inventory: api.Inventory{"os": api.NewInventoryValue("Yocto 4.0")},
+		},
+		"os, unknown": {
+			Root:      t.TempDir(),
+			Collector: "os",
+			Inventory: api.Inventory{"os": api.NewInventoryValue("unknown")},
+		},
+		"nt-connect": {
+			Collector: "nt-connect",
+			Inventory: api.Inventory{
+				"nt_connect_version":  api.NewInventoryValue(api.VersionString()),
+				"nt_connect_features": api.NewInventoryValue("terminal", "filetransfer"),
+			},
+		},
+		"error, missing file": {
+			Root:      t.TempDir(),
+			Collector: "kernel",
+			Error:     true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			opts := opts
+			if tc.Root != "" {
+				opts.Root = tc.Root
+			}
+			collectors, err := New([]string{tc.Collector}, opts)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			inv, err := collectors[0].Collect(context.Background())
+			if tc.Error {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Inventory, inv)
+			}
+		})
+	}
+}
+
+func TestCollectHostname(t *testing.T) {
+	collectors, _ := New([]string{"hostname"}, Options{})
+	inv, err := collectors[0].Collect(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, inv["hostname"].Values, 1)
+	assert.NotEmpty(t, inv["hostname"].Values[0])
+}
+
+func TestCollectNetwork(t *testing.T) {
+	defer func(ifaces func() ([]net.Interface, error)) {
+		netInterfaces = ifaces
+	}(netInterfaces)
+	defer func(addrs func(net.Interface) ([]net.Addr, error)) {
+		interfaceAddrs = addrs
+	}(interfaceAddrs)
+
+	mac, _ := net.ParseMAC("02:42:ac:11:00:02")
+	netInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{
+			{Name: "lo", Flags: net.FlagLoopback},
+			{Name: "eth0", HardwareAddr: mac},
+			{Name: "docker0"},
+			{Name: "wlan0"},
+		}, nil
+	}
+	interfaceAddrs = func(iface net.Interface) ([]net.Addr, error) {
+		if iface.Name != "eth0" {
+			return nil, nil
+		}
+		_, ipv4, _ := net.ParseCIDR("192.168.1.10/24")
+		ipv4.IP = net.ParseIP("192.168.1.10")
+		_, ipv6, _ := net.ParseCIDR("fe80::1/64")
+		ipv6.IP = net.ParseIP("fe80::1")
+		return []net.Addr{ipv4, ipv6}, nil
+	}
+	collectors, _ := New([]string{"network"}, Options{})
+	inv, err := collectors[0].Collect(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, api.Inventory{
+		"network_interfaces": api.NewInventoryValue("eth0", "wlan0"),
+		"mac_eth0":           api.NewInventoryValue("02:42:ac:11:00:02"),
+		"ipv4_eth0":          api.NewInventoryValue("192.168.1.10/24"),
+		"ipv6_eth0":          api.NewInventoryValue("fe80::1/64"),
+	}, inv)
+}
@@ -0,0 +1,211 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package inventory
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/northerntechhq/nt-connect/api"
+)
+
+const (
+	// DefaultScriptTimeout is the time an inventory script may run.
+	DefaultScriptTimeout = time.Minute
+	// DefaultScriptMaxOutput is the number of bytes read from the
+	// standard output of an inventory script.
+	DefaultScriptMaxOutput = 1024 * 1024
+	// FailedScriptsKey is the attribute listing the inventory scripts
+	// that failed.
+	FailedScriptsKey = "inventory_failed_scripts"
+
+	// scriptWaitDelay is the time to wait for the output of a script to
+	// be closed after it was killed.
+	scriptWaitDelay = time.Second
+)
+
+var (
+	ErrScriptTimeout        = errors.New("inventory script timed out")
+	ErrScriptOutputTooLarge = errors.New("inventory script output too large")
+)
+
+// ScriptOptions configures how the inventory scripts run.
+type ScriptOptions struct {
+	// Timeout is the time a script may run (default DefaultScriptTimeout).
+	Timeout time.Duration
+	// MaxOutput is the number of bytes read from the output of a script
+	// (default DefaultScriptMaxOutput).
+	MaxOutput int64
+	// PrefixKeys prefixes the attributes of the scripts in the inventory
+	// directory with the script name, without extension, and "_".
+	PrefixKeys bool
+}
+
+func (opts ScriptOptions) timeout() time.Duration {
+	if opts.Timeout <= 0 {
+		return DefaultScriptTimeout
+	}
+	return opts.Timeout
+}
+
+func (opts ScriptOptions) maxOutput() int64 {
+	if opts.MaxOutput <= 0 {
+		return DefaultScriptMaxOutput
+	}
+	return opts.MaxOutput
+}
+
+// limitedBuffer discards the bytes written after the limit. The buffer is
+// not embedded, for io.Copy not to bypass Write with ReadFrom.
+type limitedBuffer struct {
+	buf      bytes.Buffer
+	limit    int64
+	exceeded bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if left := b.limit - int64(b.buf.Len()); int64(len(p)) > left {
+		b.exceeded = true
+		p = p[:left]
+	}
+	_, _ = b.buf.Write(p)
+	return n, nil
+}
+
+type stderrLogger string
+
+func (l stderrLogger) Write(b []byte) (int, error) {
+	log.Errorf("%s: stderr: %s", string(l), b)
+	return len(b), nil
+}
+
+// RunScript runs the inventory script and parses its output. On error, the
+// attributes read until the script failed are returned with the error.
+func RunScript(ctx context.Context, path string, opts ScriptOptions) (api.Inventory, error) {
+	ctx, cancel := context.WithTimeout(ctx, opts.timeout())
+	defer cancel()
+
+	log.Debugf("running inventory script %s", path)
+	//nolint:gosec // Ignore G204 since the script is meant to be configurable
+	cmd := exec.CommandContext(ctx, path)
+	stdout := &limitedBuffer{limit: opts.maxOutput()}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderrLogger(filepath.Base(path))
+	cmd.WaitDelay = scriptWaitDelay
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("%w after %s", ErrScriptTimeout, opts.timeout())
+	} else if err == nil && stdout.exceeded {
+		err = fmt.Errorf("%w: more than %d bytes", ErrScriptOutputTooLarge, stdout.limit)
+	}
+	output := stdout.buf.Bytes()
+	if stdout.exceeded {
+		// Drop the truncated line
+		output = output[:bytes.LastIndexByte(output, '\n')+1]
+	}
+	inv, parseErr := api.NewInventoryFromStream(bytes.NewReader(output))
+	if err == nil {
+		err = parseErr
+	}
+	return inv, err
+}
+
+// scriptDir runs the executables in a directory as inventory scripts.
+type scriptDir struct {
+	dir  string
+	opts ScriptOptions
+}
+
+// NewScriptDir returns a collector running the executables in dir
+// concurrently. The attributes of the failing scripts are kept, and their
+// names are listed by the FailedScriptsKey attribute.
+func NewScriptDir(dir string, opts ScriptOptions) Collector {
+	return &scriptDir{dir: dir, opts: opts}
+}
+
+func (s *scriptDir) Name() string {
+	return filepath.Base(s.dir)
+}
+
+// scripts returns the sorted names of the executables in the directory,
+// skipping hidden and backup files.
+func (s *scriptDir) scripts() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(s.dir, name))
+		if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func scriptPrefix(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + "_"
+}
+
+func (s *scriptDir) Collect(ctx context.Context) (api.Inventory, error) {
+	names, err := s.scripts()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]api.Inventory, len(names))
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			results[i], errs[i] = RunScript(ctx, filepath.Join(s.dir, name), s.opts)
+		}(i, name)
+	}
+	wg.Wait()
+
+	inv := make(api.Inventory)
+	for i, name := range names {
+		if errs[i] != nil {
+			log.Warnf("inventory script %s failed: %s", name, errs[i].Error())
+			inv.Add(FailedScriptsKey, name)
+		}
+		for key, value := range results[i] {
+			if s.opts.PrefixKeys {
+				key = scriptPrefix(name) + key
+			}
+			inv.Append(key, value)
+		}
+	}
+	return inv, nil
+}
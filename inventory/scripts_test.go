@@ -0,0 +1,145 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package inventory
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/northerntechhq/nt-connect/api"
+)
+
+// writeScripts writes the files to a temporary directory and makes the
+// ones ending in ".sh" executable.
+func writeScripts(t *testing.T, files map[string]string) string {
+	dir := writeFiles(t, files)
+	for name := range files {
+		if filepath.Ext(name) == ".sh" {
+			if err := os.Chmod(filepath.Join(dir, name), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return dir
+}
+
+func TestRunScript(t *testing.T) {
+	t.Parallel()
+	dir := writeScripts(t, map[string]string{
+		"ok.sh":      "#!/bin/sh\necho foo=bar\necho foo=baz\necho ignored\n",
+		"fail.sh":    "#!/bin/sh\necho foo=bar\nexit 1\n",
+		"timeout.sh": "#!/bin/sh\necho foo=bar\nexec sleep 10\n",
+		"large.sh":   "#!/bin/sh\necho foo=bar\necho foo=0123456789\n",
+	})
+
+	testCases := []struct {
+		Name    string
+		Script  string
+		Options ScriptOptions
+
+		Inventory api.Inventory
+		Error     func(t *testing.T, err error)
+	}{{
+		Name:      "ok",
+		Script:    "ok.sh",
+		Inventory: api.Inventory{"foo": api.NewInventoryValue("bar", "baz")},
+	}, {
+		Name:      "error/exit code",
+		Script:    "fail.sh",
+		Inventory: api.Inventory{"foo": api.NewInventoryValue("bar")},
+		Error: func(t *testing.T, err error) {
+			var exitErr *exec.ExitError
+			assert.ErrorAs(t, err, &exitErr)
+		},
+	}, {
+		Name:      "error/timeout",
+		Script:    "timeout.sh",
+		Options:   ScriptOptions{Timeout: 100 * time.Millisecond},
+		Inventory: api.Inventory{"foo": api.NewInventoryValue("bar")},
+		Error: func(t *testing.T, err error) {
+			assert.ErrorIs(t, err, ErrScriptTimeout)
+		},
+	}, {
+		Name:      "error/output too large",
+		Script:    "large.sh",
+		Options:   ScriptOptions{MaxOutput: 12},
+		Inventory: api.Inventory{"foo": api.NewInventoryValue("bar")},
+		Error: func(t *testing.T, err error) {
+			assert.ErrorIs(t, err, ErrScriptOutputTooLarge)
+		},
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			inv, err := RunScript(
+				context.Background(), filepath.Join(dir, tc.Script), tc.Options,
+			)
+			if tc.Error != nil {
+				tc.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.Inventory, inv)
+		})
+	}
+}
+
+func TestScriptDir(t *testing.T) {
+	t.Parallel()
+	dir := writeScripts(t, map[string]string{
+		"inventory.d/a.sh":       "#!/bin/sh\necho foo=a\necho a=1\n",
+		"inventory.d/b.sh":       "#!/bin/sh\necho foo=b\necho b=2\nexit 3\n",
+		"inventory.d/c.sh":       "#!/bin/sh\nsleep 10\n",
+		"inventory.d/.hidden.sh": "#!/bin/sh\necho hidden=1\n",
+		"inventory.d/README":     "not executable",
+	})
+	opts := ScriptOptions{Timeout: 500 * time.Millisecond}
+
+	collector := NewScriptDir(filepath.Join(dir, "inventory.d"), opts)
+	assert.Equal(t, "inventory.d", collector.Name())
+	start := time.Now()
+	inv, err := collector.Collect(context.Background())
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, api.Inventory{
+		"foo":            api.NewInventoryValue("a", "b"),
+		"a":              api.NewInventoryValue("1"),
+		"b":              api.NewInventoryValue("2"),
+		FailedScriptsKey: api.NewInventoryValue("b.sh", "c.sh"),
+	}, inv)
+
+	opts.PrefixKeys = true
+	inv, err = NewScriptDir(filepath.Join(dir, "inventory.d"), opts).
+		Collect(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, api.Inventory{
+		"a_foo":          api.NewInventoryValue("a"),
+		"a_a":            api.NewInventoryValue("1"),
+		"b_foo":          api.NewInventoryValue("b"),
+		"b_b":            api.NewInventoryValue("2"),
+		FailedScriptsKey: api.NewInventoryValue("b.sh", "c.sh"),
+	}, inv)
+
+	inv, err = NewScriptDir(filepath.Join(dir, "missing"), opts).
+		Collect(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, inv)
+}
@@ -0,0 +1,231 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package inventory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/northerntechhq/nt-connect/api"
+	"github.com/northerntechhq/nt-connect/utils"
+)
+
+const (
+	// DefaultSpoolMaxSnapshots is the number of snapshots kept in the
+	// spool.
+	DefaultSpoolMaxSnapshots = 100
+	// DefaultSpoolMaxSize is the size in bytes of the spool file.
+	DefaultSpoolMaxSize = 1024 * 1024
+
+	// The time-series attributes summarizing the spooled snapshots.
+	OfflineSinceKey      = "offline_since"
+	OfflineSnapshotsKey  = "offline_snapshots"
+	LastSeenUptimeKey    = "last_seen_uptime_s"
+	MaxMemoryPressureKey = "max_memory_pressure"
+)
+
+var ErrSnapshotTooLarge = errors.New("inventory snapshot larger than the spool")
+
+// Snapshot is an inventory collected while the server was unreachable.
+type Snapshot struct {
+	Time      time.Time     `json:"time"`
+	Inventory api.Inventory `json:"inventory"`
+	// Uptime is the system uptime in seconds.
+	Uptime float64 `json:"uptime_s,omitempty"`
+	// MemoryPressure is the percentage of time some tasks were stalled
+	// on memory over the last 10 seconds, if the kernel reports it.
+	MemoryPressure *float64 `json:"memory_pressure,omitempty"`
+}
+
+// NewSnapshot returns a snapshot of the inventory with the current time
+// and system metrics.
+func NewSnapshot(inv api.Inventory, opts Options) Snapshot {
+	snapshot := Snapshot{
+		Time:      time.Now(),
+		Inventory: inv,
+	}
+	if b, err := os.ReadFile(opts.path("/proc/uptime")); err == nil {
+		if fields := strings.Fields(string(b)); len(fields) > 0 {
+			snapshot.Uptime, _ = strconv.ParseFloat(fields[0], 64)
+		}
+	}
+	_ = scanLines(opts.path("/proc/pressure/memory"), func(line string) bool {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "some" {
+			return true
+		}
+		value, ok := strings.CutPrefix(fields[1], "avg10=")
+		if !ok {
+			return false
+		}
+		if pressure, err := strconv.ParseFloat(value, 64); err == nil {
+			snapshot.MemoryPressure = &pressure
+		}
+		return false
+	})
+	return snapshot
+}
+
+// SpoolOptions bounds the size of a spool.
+type SpoolOptions struct {
+	// MaxSnapshots is the number of snapshots kept
+	// (default DefaultSpoolMaxSnapshots).
+	MaxSnapshots int
+	// MaxSize is the size in bytes of the spool file
+	// (default DefaultSpoolMaxSize).
+	MaxSize int64
+}
+
+func (opts SpoolOptions) maxSnapshots() int {
+	if opts.MaxSnapshots <= 0 {
+		return DefaultSpoolMaxSnapshots
+	}
+	return opts.MaxSnapshots
+}
+
+func (opts SpoolOptions) maxSize() int64 {
+	if opts.MaxSize <= 0 {
+		return DefaultSpoolMaxSize
+	}
+	return opts.MaxSize
+}
+
+// Spool persists the inventory snapshots in a file, one JSON snapshot per
+// line. The oldest snapshots are dropped when the spool is full.
+type Spool struct {
+	path  string
+	opts  SpoolOptions
+	mutex sync.Mutex
+}
+
+// NewSpool returns the spool persisted at the path.
+func NewSpool(path string, opts SpoolOptions) *Spool {
+	return &Spool{path: path, opts: opts}
+}
+
+// Add appends the snapshot to the spool.
+func (s *Spool) Add(snapshot Snapshot) error {
+	line, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if int64(len(line)) > s.opts.maxSize() {
+		return ErrSnapshotTooLarge
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lines, err := s.readLines()
+	if err != nil {
+		return err
+	}
+	lines = append(lines, line)
+	size := int64(0)
+	first := len(lines)
+	for first > 0 && len(lines)-first < s.opts.maxSnapshots() {
+		if size+int64(len(lines[first-1])) > s.opts.maxSize() {
+			break
+		}
+		first--
+		size += int64(len(lines[first]))
+	}
+	return utils.WriteFileAtomic(s.path, bytes.Join(lines[first:], nil), 0600)
+}
+
+func (s *Spool) readLines() ([][]byte, error) {
+	b, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var lines [][]byte
+	for _, line := range bytes.SplitAfter(b, []byte{'\n'}) {
+		if len(bytes.TrimSpace(line)) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// Snapshots returns the spooled snapshots from the oldest to the latest.
+func (s *Spool) Snapshots() ([]Snapshot, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var snapshots []Snapshot
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, int(s.opts.maxSize())+1)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var snapshot Snapshot
+		if err = json.Unmarshal(scanner.Bytes(), &snapshot); err != nil {
+			return snapshots, fmt.Errorf("invalid inventory snapshot: %w", err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, scanner.Err()
+}
+
+// Clear removes the spooled snapshots.
+func (s *Spool) Clear() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// TimeSeries returns the attributes summarizing the snapshots: the time of
+// the oldest snapshot, the number of snapshots, the uptime at the latest
+// snapshot and the maximum memory pressure.
+func TimeSeries(snapshots []Snapshot) api.Inventory {
+	if len(snapshots) == 0 {
+		return nil
+	}
+	latest := snapshots[len(snapshots)-1]
+	inv := api.Inventory{
+		OfflineSinceKey:     api.NewInventoryValue(snapshots[0].Time.UTC().Format(time.RFC3339)),
+		OfflineSnapshotsKey: api.NewInventoryValue(len(snapshots)),
+		LastSeenUptimeKey:   api.NewInventoryValue(int64(latest.Uptime)),
+	}
+	var maxPressure *float64
+	for _, snapshot := range snapshots {
+		if snapshot.MemoryPressure != nil &&
+			(maxPressure == nil || *snapshot.MemoryPressure > *maxPressure) {
+			maxPressure = snapshot.MemoryPressure
+		}
+	}
+	if maxPressure != nil {
+		inv[MaxMemoryPressureKey] = api.NewInventoryValue(*maxPressure)
+	}
+	return inv
+}
@@ -0,0 +1,162 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package inventory
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/northerntechhq/nt-connect/api"
+)
+
+func TestNewSnapshot(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"proc/uptime": "3600.50 7000.00\n",
+		"proc/pressure/memory": "some avg10=1.50 avg60=0.80 avg300=0.20 total=1234\n" +
+			"full avg10=0.50 avg60=0.10 avg300=0.00 total=345\n",
+	})
+	inv := api.Inventory{"os": api.NewInventoryValue("Debian")}
+	snapshot := NewSnapshot(inv, Options{Root: root})
+	assert.Equal(t, inv, snapshot.Inventory)
+	assert.WithinDuration(t, time.Now(), snapshot.Time, time.Minute)
+	assert.Equal(t, 3600.5, snapshot.Uptime)
+	if assert.NotNil(t, snapshot.MemoryPressure) {
+		assert.Equal(t, 1.5, *snapshot.MemoryPressure)
+	}
+
+	snapshot = NewSnapshot(inv, Options{Root: t.TempDir()})
+	assert.Zero(t, snapshot.Uptime)
+	assert.Nil(t, snapshot.MemoryPressure)
+}
+
+func TestSpool(t *testing.T) {
+	newSnapshot := func(i int) Snapshot {
+		return Snapshot{
+			Time:      time.Date(2023, 1, 1, i, 0, 0, 0, time.UTC),
+			Inventory: api.Inventory{"index": api.NewInventoryValue(i)},
+			Uptime:    float64(1000 + i),
+		}
+	}
+	lineSize := func(snapshot Snapshot) int64 {
+		b, _ := json.Marshal(snapshot)
+		return int64(len(b) + 1)
+	}
+
+	testCases := []struct {
+		Name    string
+		Options SpoolOptions
+		Added   int
+		Kept    []int
+	}{{
+		Name:  "ok",
+		Added: 3,
+		Kept:  []int{0, 1, 2},
+	}, {
+		Name:    "ok/max snapshots",
+		Options: SpoolOptions{MaxSnapshots: 2},
+		Added:   5,
+		Kept:    []int{3, 4},
+	}, {
+		Name:    "ok/max size",
+		Options: SpoolOptions{MaxSize: lineSize(newSnapshot(0)) * 3},
+		Added:   5,
+		Kept:    []int{2, 3, 4},
+	}}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "spool.json")
+			spool := NewSpool(path, tc.Options)
+			snapshots, err := spool.Snapshots()
+			assert.NoError(t, err)
+			assert.Empty(t, snapshots)
+
+			for i := 0; i < tc.Added; i++ {
+				if !assert.NoError(t, spool.Add(newSnapshot(i))) {
+					t.FailNow()
+				}
+			}
+			var expected []Snapshot
+			for _, i := range tc.Kept {
+				expected = append(expected, newSnapshot(i))
+			}
+			snapshots, err = spool.Snapshots()
+			assert.NoError(t, err)
+			assert.Equal(t, expected, snapshots)
+
+			info, err := os.Stat(path)
+			if assert.NoError(t, err) {
+				assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+			}
+			assert.NoError(t, spool.Clear())
+			snapshots, err = spool.Snapshots()
+			assert.NoError(t, err)
+			assert.Empty(t, snapshots)
+			assert.NoError(t, spool.Clear())
+		})
+	}
+
+	t.Run("error/snapshot too large", func(t *testing.T) {
+		spool := NewSpool(filepath.Join(t.TempDir(), "spool.json"), SpoolOptions{MaxSize: 16})
+		assert.ErrorIs(t, spool.Add(newSnapshot(0)), ErrSnapshotTooLarge)
+	})
+	t.Run("error/invalid snapshot", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "spool.json")
+		spool := NewSpool(path, SpoolOptions{})
+		assert.NoError(t, spool.Add(newSnapshot(0)))
+		f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+		_, _ = f.WriteString("{\n")
+		f.Close()
+		snapshots, err := spool.Snapshots()
+		assert.ErrorContains(t, err, "invalid inventory snapshot")
+		assert.Equal(t, []Snapshot{newSnapshot(0)}, snapshots)
+	})
+}
+
+func TestTimeSeries(t *testing.T) {
+	low, high := 0.5, 12.25
+	since := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	snapshots := []Snapshot{{
+		Time:           since,
+		Uptime:         100,
+		MemoryPressure: &low,
+	}, {
+		Time:           since.Add(time.Hour),
+		Uptime:         3700.9,
+		MemoryPressure: &high,
+	}, {
+		Time:   since.Add(2 * time.Hour),
+		Uptime: 60,
+	}}
+	assert.Equal(t, api.Inventory{
+		OfflineSinceKey:      api.NewInventoryValue("2023-01-01T00:00:00Z"),
+		OfflineSnapshotsKey:  api.NewInventoryValue(3),
+		LastSeenUptimeKey:    api.NewInventoryValue(60),
+		MaxMemoryPressureKey: api.NewInventoryValue(12.25),
+	}, TimeSeries(snapshots))
+
+	assert.Equal(t, api.Inventory{
+		OfflineSinceKey:     api.NewInventoryValue("2023-01-01T02:00:00Z"),
+		OfflineSnapshotsKey: api.NewInventoryValue(1),
+		LastSeenUptimeKey:   api.NewInventoryValue(60),
+	}, TimeSeries(snapshots[2:]))
+
+	assert.Nil(t, TimeSeries(nil))
+}
@@ -0,0 +1,148 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package inventory
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	netlinkGroups = unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR
+	inotifyMask   = unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE |
+		unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+
+	watchBufferSize = 64 * 1024
+)
+
+// watch reads the events from the file until it is closed, and calls
+// notify if changed returns true for the events read.
+func watch(file *os.File, changed func(b []byte) bool, notify func()) {
+	buf := make([]byte, watchBufferSize)
+	for {
+		n, err := file.Read(buf)
+		if errors.Is(err, os.ErrClosed) {
+			return
+		} else if errors.Is(err, unix.ENOBUFS) {
+			// Events were dropped
+			notify()
+			continue
+		} else if err != nil {
+			log.Warnf("%s: stopped watching for changes: %s", file.Name(), err.Error())
+			return
+		}
+		if changed(buf[:n]) {
+			notify()
+		}
+	}
+}
+
+// WatchNetlink calls notify on network link and address changes until the
+// watcher is closed.
+func WatchNetlink(notify func()) (io.Closer, error) {
+	fd, err := unix.Socket(
+		unix.AF_NETLINK,
+		unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK,
+		unix.NETLINK_ROUTE,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("netlink: %w", err)
+	}
+	err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: netlinkGroups})
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("netlink: %w", err)
+	}
+	// The non-blocking file is closed by the runtime poller, which
+	// interrupts pending reads.
+	file := os.NewFile(uintptr(fd), "netlink")
+	go watch(file, netlinkChanged, notify)
+	return file, nil
+}
+
+func netlinkChanged(b []byte) bool {
+	msgs, err := syscall.ParseNetlinkMessage(b)
+	if err != nil {
+		return false
+	}
+	for _, msg := range msgs {
+		switch msg.Header.Type {
+		case unix.RTM_NEWLINK, unix.RTM_DELLINK, unix.RTM_NEWADDR, unix.RTM_DELADDR:
+			return true
+		}
+	}
+	return false
+}
+
+// WatchFiles calls notify when one of the files is written, replaced or
+// removed, until the watcher is closed. The parent directories are watched
+// for the files to be replaced, and symbolic links are watched together
+// with their targets. Files in missing directories are skipped.
+func WatchFiles(paths []string, notify func()) (io.Closer, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %w", err)
+	}
+	names := make(map[int32]map[string]bool)
+	for _, path := range paths {
+		targets := []string{filepath.Clean(path)}
+		if target, err := filepath.EvalSymlinks(path); err == nil && target != targets[0] {
+			targets = append(targets, target)
+		}
+		for _, target := range targets {
+			dir, name := filepath.Split(target)
+			wd, err := unix.InotifyAddWatch(fd, dir, inotifyMask)
+			if err != nil {
+				log.Warnf("inotify: not watching %s: %s", target, err.Error())
+				continue
+			}
+			if names[int32(wd)] == nil {
+				names[int32(wd)] = make(map[string]bool)
+			}
+			names[int32(wd)][name] = true
+		}
+	}
+	file := os.NewFile(uintptr(fd), "inotify")
+	go watch(file, func(b []byte) bool {
+		return inotifyChanged(b, names)
+	}, notify)
+	return file, nil
+}
+
+// inotifyChanged returns true if one of the events concerns the watched
+// names.
+func inotifyChanged(b []byte, names map[int32]map[string]bool) bool {
+	for len(b) >= unix.SizeofInotifyEvent {
+		event := (*unix.InotifyEvent)(unsafe.Pointer(&b[0]))
+		end := unix.SizeofInotifyEvent + int(event.Len)
+		if end > len(b) {
+			return false
+		}
+		name := string(bytes.TrimRight(b[unix.SizeofInotifyEvent:end], "\x00"))
+		if names[event.Wd][name] {
+			return true
+		}
+		b = b[end:]
+	}
+	return false
+}
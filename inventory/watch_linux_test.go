@@ -0,0 +1,89 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+package inventory
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchFiles(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"etc/version":        "1.0",
+		"etc/unrelated":      "",
+		"usr/lib/os-release": "NAME=Linux\n",
+	})
+	link := filepath.Join(root, "etc", "os-release")
+	if err := os.Symlink(filepath.Join(root, "usr/lib/os-release"), link); err != nil {
+		t.Fatal(err)
+	}
+
+	notified := make(chan struct{}, 16)
+	watcher, err := WatchFiles([]string{
+		filepath.Join(root, "etc/version"),
+		link,
+		filepath.Join(root, "missing/file"),
+	}, func() {
+		notified <- struct{}{}
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer watcher.Close()
+
+	expectNotified := func(t *testing.T, expected bool) {
+		select {
+		case <-notified:
+			assert.True(t, expected, "unexpected notification")
+		case <-time.After(200 * time.Millisecond):
+			assert.False(t, expected, "timeout waiting for notification")
+		}
+		// Drain the events of the same change
+		for len(notified) > 0 {
+			<-notified
+		}
+	}
+
+	err = os.WriteFile(filepath.Join(root, "etc/unrelated"), []byte("x"), 0644)
+	assert.NoError(t, err)
+	expectNotified(t, false)
+
+	err = os.WriteFile(filepath.Join(root, "etc/version"), []byte("2.0"), 0644)
+	assert.NoError(t, err)
+	expectNotified(t, true)
+
+	// Atomic replacement of the symbolic link target
+	tmp := filepath.Join(root, "usr/lib/os-release.tmp")
+	assert.NoError(t, os.WriteFile(tmp, []byte("NAME=Other\n"), 0644))
+	expectNotified(t, false)
+	assert.NoError(t, os.Rename(tmp, filepath.Join(root, "usr/lib/os-release")))
+	expectNotified(t, true)
+
+	assert.NoError(t, watcher.Close())
+	err = os.WriteFile(filepath.Join(root, "etc/version"), []byte("3.0"), 0644)
+	assert.NoError(t, err)
+	expectNotified(t, false)
+}
+
+func TestWatchNetlink(t *testing.T) {
+	watcher, err := WatchNetlink(func() {})
+	if err != nil {
+		t.Skipf("netlink not available: %s", err.Error())
+	}
+	assert.NoError(t, watcher.Close())
+}
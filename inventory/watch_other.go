@@ -0,0 +1,37 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package inventory
+
+import (
+	"errors"
+	"io"
+)
+
+var errWatchNotSupported = errors.New("watching for changes is only supported on Linux")
+
+// WatchNetlink calls notify on network link and address changes until the
+// watcher is closed.
+func WatchNetlink(notify func()) (io.Closer, error) {
+	return nil, errWatchNotSupported
+}
+
+// WatchFiles calls notify when one of the files is written, replaced or
+// removed, until the watcher is closed.
+func WatchFiles(paths []string, notify func()) (io.Closer, error) {
+	return nil, errWatchNotSupported
+}
@@ -15,6 +15,7 @@
 package session
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/fs"
@@ -22,6 +23,7 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"syscall"
 
@@ -46,6 +48,35 @@ const (
 
 var errFileTransferAbort = errors.New("handler aborted")
 
+var (
+	// activeTransfers is the number of file transfers in progress.
+	activeTransfers int32
+	// partialUploads holds the names of the temporary files of the
+	// uploads in progress.
+	partialUploads sync.Map
+)
+
+// ActiveFileTransfers returns the number of file transfers in progress.
+func ActiveFileTransfers() int {
+	return int(atomic.LoadInt32(&activeTransfers))
+}
+
+// RemovePartialUploads removes the temporary files of the uploads in
+// progress and returns the number of files removed.
+func RemovePartialUploads() (count int) {
+	partialUploads.Range(func(key, _ interface{}) bool {
+		name := key.(string)
+		partialUploads.Delete(name)
+		if err := os.Remove(name); err == nil {
+			count++
+		} else if !os.IsNotExist(err) {
+			log.Errorf("error removing partial upload: %s", err.Error())
+		}
+		return true
+	})
+	return count
+}
+
 type FileTransferHandler struct {
 	// mutex is used for protecting the async handler. A channel with cap(1)
 	// is used instead of sync.Mutex to be able to test acquiring the
@@ -55,16 +86,22 @@ type FileTransferHandler struct {
 	msgChan chan *ws.ProtoMsg
 	permit  *filetransfer.Permit
 	chroot  string
+	// ctx is cancelled when the handler is closed to abort pending writes.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // FileTransfer creates a new filetransfer constructor
 func FileTransfer(root string, limits config.Limits) Constructor {
 	return func() SessionHandler {
+		ctx, cancel := context.WithCancel(context.Background())
 		return &FileTransferHandler{
 			mutex:   make(chan struct{}, 1),
 			msgChan: make(chan *ws.ProtoMsg),
 			permit:  filetransfer.NewPermit(limits),
 			chroot:  root,
+			ctx:     ctx,
+			cancel:  cancel,
 		}
 	}
 }
@@ -83,6 +120,7 @@ func (h *FileTransferHandler) Error(code int, msg *ws.ProtoMsg, w api.Sender, er
 }
 
 func (h *FileTransferHandler) Close() error {
+	h.cancel()
 	close(h.msgChan)
 	return nil
 }
@@ -199,6 +237,7 @@ func (h *FileTransferHandler) StatFile(msg *ws.ProtoMsg, w api.Sender) {
 // chunkWriter is used for packaging writes into ProtoMsg chunks before
 // sending it on the connection.
 type chunkWriter struct {
+	Ctx       context.Context
 	SessionID string
 	Offset    int64
 	W         api.Sender
@@ -216,7 +255,7 @@ func (c *chunkWriter) Write(b []byte) (int, error) {
 		},
 		Body: b,
 	}
-	err := c.W.Send(msg)
+	err := c.W.SendContext(c.Ctx, msg)
 	if err != nil {
 		return 0, err
 	}
@@ -283,6 +322,7 @@ func (h *FileTransferHandler) DownloadHandler(
 		ackOffset int64
 		N         int64
 	)
+	atomic.AddInt32(&activeTransfers, 1)
 	defer func() {
 		errClose := fd.Close()
 		if errClose != nil {
@@ -292,10 +332,12 @@ func (h *FileTransferHandler) DownloadHandler(
 			h.Error(http.StatusInternalServerError, msg, w, err)
 			log.Error(err.Error())
 		}
+		atomic.AddInt32(&activeTransfers, -1)
 		<-h.mutex
 	}()
 
 	chunker := &chunkWriter{
+		Ctx:       h.ctx,
 		SessionID: msg.Header.SessionID,
 		W:         w,
 	}
@@ -460,8 +502,10 @@ func (h *FileTransferHandler) FileUploadHandler(
 		fd      *os.File
 		closeFd bool
 	)
+	atomic.AddInt32(&activeTransfers, 1)
 	defer func() {
 		if fd != nil {
+			partialUploads.Delete(fd.Name())
 			if closeFd {
 				errClose := fd.Close()
 				if errClose != nil {
@@ -482,6 +526,7 @@ func (h *FileTransferHandler) FileUploadHandler(
 				h.Error(http.StatusInternalServerError, msg, w, err)
 			}
 		}
+		atomic.AddInt32(&activeTransfers, -1)
 		<-h.mutex
 	}()
 
@@ -494,6 +539,7 @@ func (h *FileTransferHandler) FileUploadHandler(
 		h.Error(code, msg, w, errors.Wrap(err, "failed to create target file"))
 		return err
 	}
+	partialUploads.Store(fd.Name(), struct{}{})
 	closeFd = true
 
 	err = w.Send(ws.ProtoMsg{
@@ -533,6 +579,7 @@ func (h *FileTransferHandler) FileUploadHandler(
 	if err != nil {
 		return errors.Wrap(err, "failed to commit uploaded file")
 	}
+	partialUploads.Delete(filename)
 
 	err = h.permit.PreserveOwnerGroup(dstPath, int(*params.UID), int(*params.GID))
 	if err != nil {
@@ -16,6 +16,7 @@ package session
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"os"
 	"path"
@@ -415,6 +416,10 @@ func (w ChanWriter) Send(msg ws.ProtoMsg) error {
 	return nil
 }
 
+func (w ChanWriter) SendContext(_ context.Context, msg ws.ProtoMsg) error {
+	return w.Send(msg)
+}
+
 func TestFileTransferDownload(t *testing.T) {
 	t.Parallel()
 	testdir := t.TempDir()
@@ -1060,3 +1065,19 @@ func TestFileTransferServeErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestRemovePartialUploads(t *testing.T) {
+	dst := path.Join(t.TempDir(), "upload")
+	fd, err := createWrOnlyTempFile(dst)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	fd.Close()
+	partialUploads.Store(fd.Name(), struct{}{})
+	partialUploads.Store(dst+".missing", struct{}{})
+
+	assert.Equal(t, 1, RemovePartialUploads())
+	_, err = os.Stat(fd.Name())
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, 0, RemovePartialUploads())
+}
@@ -0,0 +1,131 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package session
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsft "github.com/mendersoftware/go-lib-micro/ws/filetransfer"
+	wspf "github.com/mendersoftware/go-lib-micro/ws/portforward"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/northerntechhq/nt-connect/config"
+)
+
+const (
+	// The properties set by the server identifying the remote user.
+	propertyUserID    = "user_id"
+	propertyUserRoles = "roles"
+)
+
+var ErrForbidden = errors.New("session: permission denied")
+
+// Policy decides which remote users may use the protocols.
+type Policy interface {
+	// Authorize returns an error wrapping ErrForbidden if the remote
+	// user sending the message is not allowed to use the protocol.
+	Authorize(msg *ws.ProtoMsg) error
+}
+
+// NewPolicy returns the policy granting the permissions of the
+// configuration, or nil if the permissions are not checked.
+func NewPolicy(conf config.AuthorizationConfig) Policy {
+	if !conf.Enabled() {
+		return nil
+	}
+	return &authorizationPolicy{conf: conf}
+}
+
+type authorizationPolicy struct {
+	conf config.AuthorizationConfig
+}
+
+// Authorize checks the messages starting a shell, a file transfer or a
+// port forward; the messages following them are part of an authorized
+// operation. The denials are logged to the audit trail.
+func (p *authorizationPolicy) Authorize(msg *ws.ProtoMsg) error {
+	permission := requiredPermission(msg)
+	if permission == "" {
+		return nil
+	}
+	userID, roles := UserID(msg), UserRoles(msg)
+	if p.conf.Allowed(userID, roles, permission) {
+		return nil
+	}
+	log.WithFields(log.Fields{
+		"audit":      true,
+		"session_id": msg.Header.SessionID,
+		"user_id":    userID,
+		"roles":      roles,
+		"permission": permission,
+	}).Warn("remote user denied access")
+	return fmt.Errorf("%w: %s not allowed", ErrForbidden, permission)
+}
+
+// requiredPermission returns the permission required for the message, or
+// an empty string if the message does not start an operation.
+func requiredPermission(msg *ws.ProtoMsg) string {
+	switch msg.Header.Proto {
+	case ws.ProtoTypeShell:
+		if msg.Header.MsgType == wsshell.MessageTypeSpawnShell {
+			return config.PermissionShell
+		}
+	case ws.ProtoTypeFileTransfer:
+		switch msg.Header.MsgType {
+		case wsft.MessageTypeGet, wsft.MessageTypeStat:
+			return config.PermissionFileGet
+		case wsft.MessageTypePut:
+			return config.PermissionFilePut
+		}
+	case ws.ProtoTypePortForward, ws.ProtoTypePortForwardV2:
+		if msg.Header.MsgType == wspf.MessageTypePortForwardNew {
+			return config.PermissionPortForward
+		}
+	}
+	return ""
+}
+
+// UserID returns the ID of the remote user sending the message.
+func UserID(msg *ws.ProtoMsg) string {
+	userID, _ := msg.Header.Properties[propertyUserID].(string)
+	return userID
+}
+
+// UserRoles returns the roles of the remote user sending the message,
+// given as an array or a comma-separated list.
+func UserRoles(msg *ws.ProtoMsg) []string {
+	var roles []string
+	switch value := msg.Header.Properties[propertyUserRoles].(type) {
+	case string:
+		for _, role := range strings.Split(value, ",") {
+			if role = strings.TrimSpace(role); role != "" {
+				roles = append(roles, role)
+			}
+		}
+	case []string:
+		roles = value
+	case []interface{}:
+		for _, role := range value {
+			if role, ok := role.(string); ok {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
+}
@@ -0,0 +1,212 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsft "github.com/mendersoftware/go-lib-micro/ws/filetransfer"
+	wspf "github.com/mendersoftware/go-lib-micro/ws/portforward"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/northerntechhq/nt-connect/config"
+)
+
+func newPolicyMessage(
+	proto ws.ProtoType,
+	msgType string,
+	userID string,
+	roles interface{},
+) *ws.ProtoMsg {
+	msg := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:      proto,
+			MsgType:    msgType,
+			SessionID:  "session",
+			Properties: map[string]interface{}{},
+		},
+	}
+	if userID != "" {
+		msg.Header.Properties[propertyUserID] = userID
+	}
+	if roles != nil {
+		msg.Header.Properties[propertyUserRoles] = roles
+	}
+	return msg
+}
+
+func TestPolicy(t *testing.T) {
+	t.Parallel()
+	assert.Nil(t, NewPolicy(config.AuthorizationConfig{}))
+
+	policy := NewPolicy(config.AuthorizationConfig{
+		Rules: []config.AuthorizationRule{{
+			Role:  "admin",
+			Allow: []string{config.PermissionAll},
+		}, {
+			Role:  "operator",
+			Allow: []string{config.PermissionShell, config.PermissionFileGet},
+		}},
+	})
+	testCases := []struct {
+		Name string
+
+		Message *ws.ProtoMsg
+		Allowed bool
+	}{{
+		Name: "ok/admin port forward",
+
+		Message: newPolicyMessage(
+			ws.ProtoTypePortForwardV2, wspf.MessageTypePortForwardNew,
+			"alice", []interface{}{"admin"},
+		),
+		Allowed: true,
+	}, {
+		Name: "ok/operator shell",
+
+		Message: newPolicyMessage(
+			ws.ProtoTypeShell, wsshell.MessageTypeSpawnShell, "bob", "viewer, operator",
+		),
+		Allowed: true,
+	}, {
+		Name: "ok/operator stat",
+
+		Message: newPolicyMessage(
+			ws.ProtoTypeFileTransfer, wsft.MessageTypeStat, "bob", []string{"operator"},
+		),
+		Allowed: true,
+	}, {
+		Name: "ok/following message",
+
+		Message: newPolicyMessage(ws.ProtoTypeFileTransfer, wsft.MessageTypeChunk, "", nil),
+		Allowed: true,
+	}, {
+		Name: "error/operator put",
+
+		Message: newPolicyMessage(
+			ws.ProtoTypeFileTransfer, wsft.MessageTypePut, "bob", []string{"operator"},
+		),
+	}, {
+		Name: "error/operator port forward",
+
+		Message: newPolicyMessage(
+			ws.ProtoTypePortForward, wspf.MessageTypePortForwardNew, "bob", "operator",
+		),
+	}, {
+		Name: "error/anonymous shell",
+
+		Message: newPolicyMessage(ws.ProtoTypeShell, wsshell.MessageTypeSpawnShell, "", nil),
+	}}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			err := policy.Authorize(tc.Message)
+			if tc.Allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrForbidden)
+			}
+		})
+	}
+}
+
+func TestUserRoles(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		Name  string
+		Roles interface{}
+		Want  []string
+	}{{
+		Name: "none",
+	}, {
+		Name:  "list",
+		Roles: "admin, operator,",
+		Want:  []string{"admin", "operator"},
+	}, {
+		Name:  "strings",
+		Roles: []string{"admin"},
+		Want:  []string{"admin"},
+	}, {
+		Name:  "array",
+		Roles: []interface{}{"admin", 1, "operator"},
+		Want:  []string{"admin", "operator"},
+	}}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			msg := newPolicyMessage(ws.ProtoTypeShell, "", "alice", tc.Roles)
+			assert.Equal(t, "alice", UserID(msg))
+			assert.Equal(t, tc.Want, UserRoles(msg))
+		})
+	}
+}
+
+func TestRouterPolicy(t *testing.T) {
+	t.Parallel()
+	routes := ProtoRoutes{
+		ws.ProtoTypeFileTransfer: func() SessionHandler {
+			return new(echoHandler)
+		},
+	}
+	w := &senderMock{
+		SendChan: make(chan ws.ProtoMsg, 10),
+		closed:   make(chan struct{}),
+	}
+	router := NewRouter(routes, Config{
+		IdleTimeout: time.Second * 30,
+		Policy: NewPolicy(config.AuthorizationConfig{
+			Rules: []config.AuthorizationRule{{
+				Role:  "admin",
+				Allow: []string{config.PermissionFilePut},
+			}},
+		}),
+	})
+	receive := func() ws.ProtoMsg {
+		t.Helper()
+		select {
+		case msg := <-w.SendChan:
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the response")
+		}
+		return ws.ProtoMsg{}
+	}
+
+	err := router.RouteMessage(
+		newPolicyMessage(ws.ProtoTypeFileTransfer, wsft.MessageTypePut, "alice", "admin"), w,
+	)
+	assert.NoError(t, err)
+	msg := receive()
+	assert.Equal(t, ws.ProtoTypeFileTransfer, msg.Header.Proto)
+
+	err = router.RouteMessage(
+		newPolicyMessage(ws.ProtoTypeFileTransfer, wsft.MessageTypePut, "bob", nil), w,
+	)
+	assert.NoError(t, err)
+	msg = receive()
+	assert.Equal(t, ws.ProtoTypeControl, msg.Header.Proto)
+	assert.Equal(t, ws.MessageTypeError, msg.Header.MsgType)
+	var rsp ws.Error
+	assert.NoError(t, msgpack.Unmarshal(msg.Body, &rsp))
+	assert.Equal(t, "session: permission denied: file_put not allowed", rsp.Error)
+	assert.Equal(t, wsft.MessageTypePut, rsp.MessageType)
+	assert.False(t, rsp.Close)
+}
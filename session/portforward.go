@@ -165,7 +165,7 @@ func (f *PortForwarder) Read() {
 				},
 				Body: data,
 			}
-			if err := f.Sender.Send(m); err != nil {
+			if err := f.Sender.SendContext(f.ctx, m); err != nil {
 				log.Errorf("portForwardHandler: webSock.WriteMessage(%+v)", err)
 			}
 		case <-time.After(portForwardConnectionTimeout):
@@ -222,6 +222,16 @@ func (h *PortForwardHandler) Close() error {
 	return nil
 }
 
+// Drain stops the port forwards, notifying the peer.
+func (h *PortForwardHandler) Drain(api.Sender) {
+	for _, f := range h.portForwarders {
+		if err := f.Close(true); err != nil {
+			log.Debugf("port-forward[%s/%s] close: %s",
+				f.SessionID, f.ConnectionID, err.Error())
+		}
+	}
+}
+
 func (h *PortForwardHandler) ServeProtoMsg(msg *ws.ProtoMsg, w api.Sender) {
 	var err error
 	if msg.Header.Proto == h.proto {
@@ -15,6 +15,7 @@
 package session
 
 import (
+	"sort"
 	"sync"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
@@ -37,6 +38,20 @@ type Router interface {
 	RouteMessage(msg *ws.ProtoMsg, w api.Sender) error
 }
 
+// SessionManager is implemented by the Router returned by NewRouter to list
+// and terminate the active sessions.
+type SessionManager interface {
+	Router
+	// SessionIDs returns the IDs of the active sessions.
+	SessionIDs() []string
+	// CloseSession terminates the session with the ID, returning false if
+	// the session does not exist.
+	CloseSession(sessionID string) bool
+	// DrainSessions notifies the peers of the active sessions that the
+	// sessions are closing, with the reason, and stops the port forwards.
+	DrainSessions(reason string)
+}
+
 // router manages creation/deletion and routing of concurrent sessions.
 type router struct {
 	Config
@@ -78,3 +93,28 @@ func (mgr *router) RouteMessage(msg *ws.ProtoMsg, w api.Sender) (err error) {
 	}
 	return nil
 }
+
+func (mgr *router) SessionIDs() []string {
+	var ids []string
+	mgr.sessions.Range(func(key, _ interface{}) bool {
+		ids = append(ids, key.(string))
+		return true
+	})
+	sort.Strings(ids)
+	return ids
+}
+
+func (mgr *router) CloseSession(sessionID string) bool {
+	sessFace, ok := mgr.sessions.Load(sessionID)
+	if ok {
+		sessFace.(*Session).Close()
+	}
+	return ok
+}
+
+func (mgr *router) DrainSessions(reason string) {
+	mgr.sessions.Range(func(_, sessFace interface{}) bool {
+		sessFace.(*Session).Drain(reason)
+		return true
+	})
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/mendersoftware/go-lib-micro/ws"
 	"github.com/northerntechhq/nt-connect/api"
 	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
 )
 
 type panicHandler struct {
@@ -107,3 +108,104 @@ func TestRouterRace(t *testing.T) {
 	}, w)
 	assert.EqualError(t, err, "session completed before message handoff")
 }
+
+func TestRouterCloseSession(t *testing.T) {
+	t.Parallel()
+	routes := ProtoRoutes{
+		ws.ProtoType(0x1234): func() SessionHandler {
+			return new(echoHandler)
+		},
+	}
+	w := &senderMock{
+		SendChan: make(chan ws.ProtoMsg, 10),
+		closed:   make(chan struct{}),
+	}
+	router := NewRouter(routes, Config{IdleTimeout: time.Second * 30}).(SessionManager)
+	assert.Empty(t, router.SessionIDs())
+	err := router.RouteMessage(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoType(0x1234),
+			SessionID: "session",
+		},
+	}, w)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"session"}, router.SessionIDs())
+
+	assert.False(t, router.CloseSession("dummy"))
+	assert.True(t, router.CloseSession("session"))
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-w.SendChan:
+			if msg.Header.MsgType != ws.MessageTypeError {
+				continue
+			}
+			var rsp ws.Error
+			assert.NoError(t, msgpack.Unmarshal(msg.Body, &rsp))
+			assert.Equal(t, "session", msg.Header.SessionID)
+			assert.Equal(t, "session terminated", rsp.Error)
+			assert.True(t, rsp.Close)
+		case <-timeout:
+			t.Fatal("timeout waiting for the session to terminate")
+		}
+		break
+	}
+	assert.Eventually(t, func() bool {
+		return len(router.SessionIDs()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+type drainHandler struct {
+	echoHandler
+	drained chan struct{}
+}
+
+func (h drainHandler) Drain(api.Sender) {
+	close(h.drained)
+}
+
+func TestRouterDrainSessions(t *testing.T) {
+	t.Parallel()
+	drained := make(chan struct{})
+	routes := ProtoRoutes{
+		ws.ProtoType(0x1234): func() SessionHandler {
+			return drainHandler{drained: drained}
+		},
+	}
+	w := &senderMock{
+		SendChan: make(chan ws.ProtoMsg, 10),
+		closed:   make(chan struct{}),
+	}
+	router := NewRouter(routes, Config{IdleTimeout: time.Second * 30}).(SessionManager)
+	err := router.RouteMessage(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoType(0x1234),
+			SessionID: "session",
+		},
+	}, w)
+	assert.NoError(t, err)
+	select {
+	case <-w.SendChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the echo")
+	}
+
+	router.DrainSessions("shutting down")
+	select {
+	case msg := <-w.SendChan:
+		assert.Equal(t, ws.ProtoTypeControl, msg.Header.Proto)
+		assert.Equal(t, ws.MessageTypeClose, msg.Header.MsgType)
+		assert.Equal(t, "session", msg.Header.SessionID)
+		assert.Equal(t, "shutting down", string(msg.Body))
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the close message")
+	}
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the handler to drain")
+	}
+	// The session stays open until closed
+	assert.Equal(t, []string{"session"}, router.SessionIDs())
+	assert.True(t, router.CloseSession("session"))
+}
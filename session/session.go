@@ -40,6 +40,7 @@ import (
 	"fmt"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
@@ -59,6 +60,12 @@ type SessionHandler interface {
 	Close() error
 }
 
+// drainer is implemented by the session handlers that stop before the
+// session closes when the session is drained, such as the port forwards.
+type drainer interface {
+	Drain(w api.Sender)
+}
+
 type HandlerFunc func(msg *ws.ProtoMsg, w api.Sender)
 
 func (h HandlerFunc) ServeProtoMsg(msg *ws.ProtoMsg, w api.Sender) { h(msg, w) }
@@ -75,6 +82,9 @@ type Config struct {
 	// IdleTimeout is the duration a session can remain inactive before
 	// it shuts down.
 	IdleTimeout time.Duration
+	// Policy decides which remote users may use the protocols; all the
+	// remote users may use them if nil.
+	Policy Policy
 }
 
 type Session struct {
@@ -84,6 +94,9 @@ type Session struct {
 	handlers map[ws.ProtoType]SessionHandler
 	msgChan  chan *ws.ProtoMsg
 	done     chan struct{}
+	quit     chan struct{}
+	quitOnce sync.Once
+	drain    chan string
 	w        api.Sender
 }
 
@@ -101,6 +114,8 @@ func New(
 		handlers: make(map[ws.ProtoType]SessionHandler),
 		msgChan:  msgChan,
 		done:     make(chan struct{}),
+		quit:     make(chan struct{}),
+		drain:    make(chan string, 1),
 		w:        w,
 	}
 }
@@ -109,6 +124,37 @@ func (sess *Session) Done() <-chan struct{} {
 	return sess.done
 }
 
+// Close terminates the session: the peer is notified with an error message
+// and the session handlers are closed.
+func (sess *Session) Close() {
+	sess.quitOnce.Do(func() {
+		close(sess.quit)
+	})
+}
+
+// Drain notifies the peer that the session is closing, with the reason,
+// and stops the handlers that do not need to finish, such as the port
+// forwards. The session stays open until closed.
+func (sess *Session) Drain(reason string) {
+	select {
+	case sess.drain <- reason:
+	default:
+		// The session is already draining
+	}
+}
+
+// NotifyClose sends a control close message with the reason to the peer.
+func NotifyClose(w api.Sender, sessionID, reason string) error {
+	return w.Send(ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeControl,
+			MsgType:   ws.MessageTypeClose,
+			SessionID: sessionID,
+		},
+		Body: []byte(reason),
+	})
+}
+
 func (sess *Session) MsgChan() chan<- *ws.ProtoMsg {
 	return sess.msgChan
 }
@@ -303,6 +349,21 @@ func (sess *Session) ListenAndServe() {
 	}
 	for {
 		select {
+		case <-sess.quit:
+			sess.Error(&ws.ProtoMsg{}, true, "session terminated")
+			return
+
+		case reason := <-sess.drain:
+			if err := NotifyClose(sess.w, sess.ID, reason); err != nil {
+				log.Errorf("failed to notify client: %s", err.Error())
+			}
+			for _, handler := range sess.handlers {
+				if d, ok := handler.(drainer); ok {
+					d.Drain(sess.w)
+				}
+			}
+			continue
+
 		case <-timerPing.C:
 			if sessIdle {
 				// If the timer triggers twice without receiving
@@ -342,6 +403,13 @@ func (sess *Session) ListenAndServe() {
 			continue
 		}
 
+		if sess.Policy != nil {
+			if err := sess.Policy.Authorize(msg); err != nil {
+				sess.Error(msg, false, err.Error())
+				continue
+			}
+		}
+
 		// Lookup existing handlers for this session.
 		handler, ok := sess.handlers[msg.Header.Proto]
 		if !ok {
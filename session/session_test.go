@@ -14,6 +14,7 @@
 package session
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -89,6 +90,17 @@ func (s *senderMock) Send(msg ws.ProtoMsg) error {
 	return nil
 }
 
+func (s *senderMock) SendContext(ctx context.Context, msg ws.ProtoMsg) error {
+	select {
+	case s.SendChan <- msg:
+	case <-s.closed:
+		return io.ErrClosedPipe
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
 func (s *senderMock) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -117,6 +129,10 @@ func (w *testWriter) Send(msg ws.ProtoMsg) error {
 	return w.err
 }
 
+func (w *testWriter) SendContext(_ context.Context, msg ws.ProtoMsg) error {
+	return w.Send(msg)
+}
+
 func TestSessionListen(t *testing.T) {
 	t.Parallel()
 	testCases := []struct {
@@ -15,6 +15,7 @@ package shell
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"io"
 
@@ -36,6 +37,8 @@ type Shell struct {
 	sessionId string
 	r         io.Reader
 	running   bool
+	// cancel is called by Stop to abort a pending write of the output.
+	cancel context.CancelFunc
 }
 
 // Create a new shell, note that we assume that r Reader and w Writer
@@ -53,12 +56,17 @@ func NewShell(sock api.Sender, sessionId string, r io.Reader, w io.Writer) *Shel
 }
 
 func (s *Shell) Start() {
-	go s.pipeStdout()
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+	go s.pipeStdout(ctx)
 	s.running = true
 }
 
 func (s *Shell) Stop() {
 	s.running = false
+	if s.cancel != nil {
+		s.cancel()
+	}
 }
 
 func (s *Shell) IsRunning() bool {
@@ -89,7 +97,7 @@ func (s *Shell) sendStopMessage(err error) {
 	}
 }
 
-func (s *Shell) pipeStdout() {
+func (s *Shell) pipeStdout(ctx context.Context) {
 	raw := make([]byte, pipStdoutBufferSize)
 	sr := bufio.NewReader(s.r)
 	for {
@@ -117,7 +125,7 @@ func (s *Shell) pipeStdout() {
 			Body: raw[:n],
 		}
 
-		err = s.sock.Send(msg)
+		err = s.sock.SendContext(ctx, msg)
 		if err != nil {
 			log.Debugf("error on write: %s", err.Error())
 		}
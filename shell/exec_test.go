@@ -14,6 +14,7 @@
 package shell
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -50,6 +51,17 @@ func (sock chanSock) Send(msg ws.ProtoMsg) error {
 	return nil
 }
 
+func (sock chanSock) SendContext(ctx context.Context, msg ws.ProtoMsg) error {
+	select {
+	case sock.send <- msg:
+	case <-sock.close:
+		return errors.New("closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
 func TestNewMenderShellReadStdIn(t *testing.T) {
 	messages = []string{}
 	cmd := exec.Command("/bin/sh")
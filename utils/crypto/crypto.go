@@ -24,11 +24,14 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+
+	"github.com/northerntechhq/nt-connect/utils"
 )
 
 type ED25519Signer ed25519.PrivateKey
@@ -42,10 +45,28 @@ func (p ED25519Signer) Public() crypto.PublicKey {
 }
 
 func LoadPrivateKey(pkeyPEM []byte) (crypto.Signer, error) {
+	return LoadPrivateKeyWithPassphrase(pkeyPEM, nil)
+}
+
+// LoadPrivateKeyWithPassphrase loads a PEM encoded private key, using the
+// passphrase to decrypt encrypted PKCS #8 keys.
+func LoadPrivateKeyWithPassphrase(pkeyPEM, passphrase []byte) (crypto.Signer, error) {
 	var err error
 	block, _ := pem.Decode(pkeyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM encoded private key found")
+	}
 	var pkey crypto.PrivateKey
 	switch block.Type {
+	case pemEncryptedPrivateKey:
+		if passphrase == nil {
+			return nil, ErrEncryptedKey
+		}
+		var der []byte
+		der, err = DecryptPKCS8PrivateKey(block.Bytes, passphrase)
+		if err == nil {
+			pkey, err = x509.ParsePKCS8PrivateKey(der)
+		}
 	case "PRIVATE KEY":
 		pkey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
 	case "EC PRIVATE KEY":
@@ -127,18 +148,32 @@ func GeneratePrivateKey(keyType KeyType) (crypto.Signer, error) {
 }
 
 func SavePrivateKey(pkey crypto.Signer, path string) error {
-	der, err := x509.MarshalPKCS8PrivateKey(pkey)
+	return SaveEncryptedPrivateKey(pkey, path, nil)
+}
+
+// SaveEncryptedPrivateKey writes the private key in PKCS #8 format. If the
+// passphrase is not empty, the key is encrypted using the passphrase.
+func SaveEncryptedPrivateKey(pkey crypto.Signer, path string, passphrase []byte) error {
+	var key crypto.PrivateKey = pkey
+	if eddie, ok := pkey.(ED25519Signer); ok {
+		key = ed25519.PrivateKey(eddie)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
 	if err != nil {
 		return fmt.Errorf("failed to serialize private key: %w", err)
 	}
-	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err == nil {
-		defer fd.Close()
-		err = pem.Encode(fd, &pem.Block{
-			Type:  "PRIVATE KEY",
-			Bytes: der,
-		})
+	block := &pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: der,
+	}
+	if len(passphrase) > 0 {
+		block.Type = pemEncryptedPrivateKey
+		block.Bytes, err = EncryptPKCS8PrivateKey(der, passphrase)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt private key: %w", err)
+		}
 	}
+	err = utils.WriteFileAtomic(path, pem.EncodeToMemory(block), 0600)
 	if err != nil {
 		return fmt.Errorf("failed to write private key file: %w", err)
 	}
@@ -168,6 +203,20 @@ func splitCerts(data []byte, atEOF bool) (advance int, token []byte, err error)
 }
 
 func LoadCertificates(filepath string) (certs *x509.CertPool, err error) {
+	chain, err := LoadCertificateChain(filepath)
+	if err != nil {
+		return nil, err
+	}
+	certs = x509.NewCertPool()
+	for _, cert := range chain {
+		certs.AddCert(cert)
+	}
+	return certs, nil
+}
+
+// LoadCertificateChain loads all PEM encoded certificates from filepath in
+// the order they appear in the file.
+func LoadCertificateChain(filepath string) (chain []*x509.Certificate, err error) {
 	const (
 		InitialBufSize = 32 * 1024        // 32 KiB
 		MaxPEMSize     = 512 * 1024       // 512 KiB
@@ -176,14 +225,10 @@ func LoadCertificates(filepath string) (certs *x509.CertPool, err error) {
 	)
 	fd, err := os.Open(filepath)
 	if err != nil {
-		return nil, fmt.Errorf("config: CACertificate not found: %w", err)
+		return nil, err
 	}
 	defer fd.Close()
-	var (
-		scanBuf [InitialBufSize]byte
-		n       int
-	)
-	certs = x509.NewCertPool()
+	var scanBuf [InitialBufSize]byte
 	lr := io.LimitReader(fd, MaxFileSize)
 	s := bufio.NewScanner(lr)
 	s.Buffer(scanBuf[:], MaxPEMSize)
@@ -198,19 +243,36 @@ func LoadCertificates(filepath string) (certs *x509.CertPool, err error) {
 		if err != nil {
 			break
 		}
-		n++
-		certs.AddCert(cert)
+		chain = append(chain, cert)
 	}
 	if err != nil && !errors.Is(err, io.EOF) {
 		return nil, err
 	} else if err = s.Err(); err != nil {
 		return nil, err
-	} else if n <= 0 {
+	} else if len(chain) <= 0 {
 		return nil, &os.PathError{
 			Op:   "LoadCertificates",
 			Path: filepath,
 			Err:  ErrNoCerts,
 		}
 	}
-	return certs, nil
+	return chain, nil
+}
+
+// CreateCertificateRequest creates a PEM encoded certificate signing request
+// for the public key of pkey with the given subject common name.
+func CreateCertificateRequest(pkey crypto.Signer, commonName string) ([]byte, error) {
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName: commonName,
+		},
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, pkey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate request: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: der,
+	}), nil
 }
@@ -15,6 +15,8 @@
 package crypto
 
 import (
+	"crypto/x509"
+	"encoding/pem"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -84,8 +86,37 @@ func TestLoadCertificates(t *testing.T) {
 		t.Parallel()
 		path := filepath.Join(dir, "not_found")
 		_, err := LoadCertificates(path)
-		if assert.Error(t, err) {
-			assert.ErrorIs(t, err, fs.ErrNotExist)
-		}
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+		_, err = LoadCertificateChain(path)
+		assert.ErrorIs(t, err, fs.ErrNotExist)
 	})
 }
+
+func TestCreateCertificateRequest(t *testing.T) {
+	t.Parallel()
+	for _, keyType := range []KeyType{
+		KeyTypeRSA2048, KeyTypeSECP256R1, KeyTypeED25519,
+	} {
+		kt := keyType
+		t.Run(string(kt), func(t *testing.T) {
+			t.Parallel()
+			pkey, err := GeneratePrivateKey(kt)
+			if err != nil {
+				t.Fatalf("failed to generate private key: %s", err)
+			}
+			csrPEM, err := CreateCertificateRequest(pkey, "device")
+			if !assert.NoError(t, err) {
+				return
+			}
+			block, _ := pem.Decode(csrPEM)
+			if assert.NotNil(t, block) &&
+				assert.Equal(t, "CERTIFICATE REQUEST", block.Type) {
+				csr, err := x509.ParseCertificateRequest(block.Bytes)
+				if assert.NoError(t, err) {
+					assert.NoError(t, csr.CheckSignature())
+					assert.Equal(t, "device", csr.Subject.CommonName)
+				}
+			}
+		})
+	}
+}
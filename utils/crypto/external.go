@@ -0,0 +1,167 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package crypto
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ExternalSigner implements crypto.Signer by delegating the private key
+// operations to a helper command. The helper is invoked with the command
+// arguments followed by one of the verbs:
+//
+//	public-key             print the PEM encoded public key to stdout
+//	sign HASH [pss]        sign the digest (or message if HASH is "none")
+//	                       read from stdin and print the raw signature
+//	generate KEYTYPE       generate a new key and print the public key
+//
+// The helper exits with status HelperExitKeyNotFound if it does not hold a
+// key, which is the only failure bootstrap generates a new key for.
+//
+// The signature format is the same as returned by the standard library
+// signers: ASN.1 DER for ECDSA, PKCS #1 v1.5 (or PSS) for RSA and raw for
+// Ed25519.
+type ExternalSigner struct {
+	command []string
+	public  crypto.PublicKey
+}
+
+// HelperExitKeyNotFound is the exit status of the signer helper if it does
+// not hold a key.
+const HelperExitKeyNotFound = 3
+
+var (
+	ErrNoCommand = errors.New("empty signer command")
+	// ErrKeyNotFound is returned if the token or the signer helper
+	// confirms that it does not hold the device key.
+	ErrKeyNotFound = errors.New("private key not found")
+)
+
+func runHelper(command []string, stdin []byte, args ...string) ([]byte, error) {
+	return runHelperEnv(command, nil, stdin, args...)
+}
+
+// runHelperEnv runs the helper command with the variables added to the
+// environment. Secrets are passed in the environment rather than in the
+// arguments, which are readable by all the local users.
+func runHelperEnv(command, env []string, stdin []byte, args ...string) ([]byte, error) {
+	if len(command) == 0 {
+		return nil, ErrNoCommand
+	}
+	var stdout, stderr bytes.Buffer
+	argv := append(append([]string{}, command[1:]...), args...)
+	//nolint:gosec // Ignore G204 since the command is meant to be configurable
+	cmd := exec.Command(command[0], argv...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg != "" {
+			return nil, fmt.Errorf("%s: %w: %s", command[0], err, msg)
+		}
+		return nil, fmt.Errorf("%s: %w", command[0], err)
+	}
+	return stdout.Bytes(), nil
+}
+
+func parsePublicKey(b []byte) (crypto.PublicKey, error) {
+	if block, _ := pem.Decode(b); block != nil {
+		b = block.Bytes
+	}
+	pub, err := x509.ParsePKIXPublicKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	return pub, nil
+}
+
+// NewExternalSigner returns a signer using the helper command to access
+// the private key.
+func NewExternalSigner(command []string) (*ExternalSigner, error) {
+	b, err := runHelper(command, nil, "public-key")
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == HelperExitKeyNotFound {
+		return nil, fmt.Errorf("%w: %w", ErrKeyNotFound, err)
+	} else if err != nil {
+		return nil, err
+	}
+	pub, err := parsePublicKey(b)
+	if err != nil {
+		return nil, err
+	}
+	return &ExternalSigner{
+		command: command,
+		public:  pub,
+	}, nil
+}
+
+// GenerateExternalKey requests the helper command to generate a new
+// private key of the given type.
+func GenerateExternalKey(command []string, keyType KeyType) (*ExternalSigner, error) {
+	b, err := runHelper(command, nil, "generate", string(keyType))
+	if err != nil {
+		return nil, err
+	}
+	pub, err := parsePublicKey(b)
+	if err != nil {
+		return nil, err
+	}
+	return &ExternalSigner{
+		command: command,
+		public:  pub,
+	}, nil
+}
+
+func hashName(h crypto.Hash) string {
+	if h == 0 {
+		return "none"
+	}
+	return strings.ToLower(strings.ReplaceAll(h.String(), "-", ""))
+}
+
+func (s *ExternalSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *ExternalSigner) Sign(
+	_ io.Reader, digest []byte, opts crypto.SignerOpts,
+) ([]byte, error) {
+	args := []string{"sign", hashName(opts.HashFunc())}
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		args = append(args, "pss")
+	}
+	sig, err := runHelper(s.command, digest, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(sig) == 0 {
+		return nil, fmt.Errorf("%s: empty signature", s.command[0])
+	}
+	return sig, nil
+}
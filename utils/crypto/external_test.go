@@ -0,0 +1,151 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const envHelperKey = "TEST_EXTERNAL_SIGNER_KEY"
+
+// TestExternalSignerHelper is not a real test: it implements the signer
+// helper protocol when the test binary is executed by ExternalSigner.
+func TestExternalSignerHelper(t *testing.T) {
+	keyPath, ok := os.LookupEnv(envHelperKey)
+	if !ok {
+		return
+	}
+	var args []string
+	for i, arg := range os.Args {
+		if arg == "--" {
+			args = os.Args[i+1:]
+			break
+		}
+	}
+	b, err := os.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		os.Exit(HelperExitKeyNotFound)
+	} else if err != nil {
+		os.Exit(2)
+	}
+	pkey, err := LoadPrivateKey(b)
+	if err != nil {
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "public-key":
+		der, _ := x509.MarshalPKIXPublicKey(pkey.Public())
+		_ = pem.Encode(os.Stdout, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	case "sign":
+		var opts crypto.SignerOpts = crypto.Hash(0)
+		if args[1] == "sha256" {
+			opts = crypto.SHA256
+		}
+		if len(args) > 2 && args[2] == "pss" {
+			opts = &rsa.PSSOptions{Hash: crypto.SHA256}
+		}
+		digest, _ := io.ReadAll(os.Stdin)
+		sig, err := pkey.Sign(rand.Reader, digest, opts)
+		if err != nil {
+			os.Exit(1)
+		}
+		_, _ = os.Stdout.Write(sig)
+	default:
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func TestExternalSigner(t *testing.T) {
+	dir := t.TempDir()
+	command := []string{os.Args[0], "-test.run=^TestExternalSignerHelper$", "--"}
+	message := []byte("message")
+	digest := sha256.Sum256(message)
+	for _, keyType := range []KeyType{
+		KeyTypeRSA2048, KeyTypeSECP256R1, KeyTypeED25519,
+	} {
+		t.Run(string(keyType), func(t *testing.T) {
+			pkey, err := GeneratePrivateKey(keyType)
+			if err != nil {
+				t.Fatalf("failed to generate private key: %s", err)
+			}
+			keyPath := filepath.Join(dir, string(keyType)+".pem")
+			if err = SavePrivateKey(pkey, keyPath); err != nil {
+				t.Fatalf("failed to save private key: %s", err)
+			}
+			t.Setenv(envHelperKey, keyPath)
+
+			signer, err := NewExternalSigner(command)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, pkey.Public(), signer.Public())
+			switch pub := signer.Public().(type) {
+			case *rsa.PublicKey:
+				sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+				if assert.NoError(t, err) {
+					assert.NoError(t, rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig))
+				}
+				sig, err = signer.Sign(rand.Reader, digest[:],
+					&rsa.PSSOptions{Hash: crypto.SHA256})
+				if assert.NoError(t, err) {
+					assert.NoError(t, rsa.VerifyPSS(pub, crypto.SHA256, digest[:], sig, nil))
+				}
+			case *ecdsa.PublicKey:
+				sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+				if assert.NoError(t, err) {
+					assert.True(t, ecdsa.VerifyASN1(pub, digest[:], sig))
+				}
+			case ed25519.PublicKey:
+				sig, err := signer.Sign(rand.Reader, message, crypto.Hash(0))
+				if assert.NoError(t, err) {
+					assert.True(t, ed25519.Verify(pub, message, sig))
+				}
+			}
+		})
+	}
+	t.Run("error/key not found", func(t *testing.T) {
+		t.Setenv(envHelperKey, filepath.Join(dir, "not-found.pem"))
+		_, err := NewExternalSigner(command)
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+	})
+	t.Run("error/helper failure", func(t *testing.T) {
+		keyPath := filepath.Join(dir, "invalid.pem")
+		if err := os.WriteFile(keyPath, []byte("invalid"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv(envHelperKey, keyPath)
+		_, err := NewExternalSigner(command)
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrKeyNotFound)
+	})
+	t.Run("error/empty command", func(t *testing.T) {
+		_, err := NewExternalSigner(nil)
+		assert.ErrorIs(t, err, ErrNoCommand)
+	})
+}
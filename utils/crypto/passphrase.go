@@ -0,0 +1,95 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package crypto
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// envCredentialsDirectory is set by systemd for units using
+	// LoadCredential= or SetCredential=
+	envCredentialsDirectory = "CREDENTIALS_DIRECTORY"
+
+	maxPassphraseSize = 4096
+)
+
+// ReadPassphrase reads the passphrase from the given source:
+//
+//	file:PATH          first line of the file at PATH
+//	env:NAME           environment variable NAME
+//	credential:NAME    systemd credential NAME ($CREDENTIALS_DIRECTORY/NAME)
+//	exec:COMMAND ARGS  first line of the standard output of COMMAND
+func ReadPassphrase(source string) ([]byte, error) {
+	kind, arg, ok := strings.Cut(source, ":")
+	if !ok || arg == "" {
+		return nil, fmt.Errorf("invalid passphrase source %q", source)
+	}
+	var (
+		b   []byte
+		err error
+	)
+	switch kind {
+	case "file":
+		b, err = readFileLimit(arg)
+
+	case "env":
+		value, ok := os.LookupEnv(arg)
+		if !ok {
+			return nil, fmt.Errorf("passphrase environment variable %s not set", arg)
+		}
+		b = []byte(value)
+
+	case "credential":
+		dir, ok := os.LookupEnv(envCredentialsDirectory)
+		if !ok {
+			return nil, fmt.Errorf(
+				"passphrase credential %s: $%s not set",
+				arg, envCredentialsDirectory,
+			)
+		}
+		b, err = readFileLimit(filepath.Join(dir, filepath.Base(arg)))
+
+	case "exec":
+		b, err = runHelper(strings.Fields(arg), nil)
+
+	default:
+		return nil, fmt.Errorf("invalid passphrase source %q", source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	if i := bytes.IndexAny(b, "\r\n"); i >= 0 {
+		b = b[:i]
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty passphrase from source %q", kind)
+	}
+	return b, nil
+}
+
+func readFileLimit(path string) ([]byte, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return io.ReadAll(io.LimitReader(fd, maxPassphraseSize))
+}
@@ -0,0 +1,65 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package crypto
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadPassphrase(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "passphrase"), []byte("secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_PASSPHRASE", "secret")
+	t.Setenv(envCredentialsDirectory, dir)
+
+	testCases := map[string]struct {
+		Source string
+		Error  string
+	}{
+		"file":       {Source: "file:" + filepath.Join(dir, "passphrase")},
+		"env":        {Source: "env:TEST_PASSPHRASE"},
+		"credential": {Source: "credential:passphrase"},
+		"exec":       {Source: "exec:echo secret"},
+		"error/env not set": {
+			Source: "env:TEST_PASSPHRASE_NOT_SET",
+			Error:  "passphrase environment variable TEST_PASSPHRASE_NOT_SET not set",
+		},
+		"error/unknown source": {
+			Source: "pass:secret",
+			Error:  `invalid passphrase source "pass:secret"`,
+		},
+		"error/empty": {
+			Source: "exec:true",
+			Error:  `empty passphrase from source "exec"`,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			passphrase, err := ReadPassphrase(tc.Source)
+			if tc.Error != "" {
+				assert.EqualError(t, err, tc.Error)
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, []byte("secret"), passphrase)
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package crypto
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PKCS11Tool is the OpenSC command used for accessing PKCS #11 tokens.
+var PKCS11Tool = "pkcs11-tool"
+
+const (
+	// pkcs11PinEnv is the environment variable passing the PIN to
+	// PKCS11Tool, keeping it off the command line.
+	pkcs11PinEnv = "NT_CONNECT_PKCS11_PIN"
+	// pkcs11ObjectNotFound is the error reported by PKCS11Tool if no
+	// object matches the URI.
+	pkcs11ObjectNotFound = "object not found"
+)
+
+// PKCS11URI holds the attributes of a PKCS #11 URI (RFC 7512) relevant for
+// locating the device key.
+type PKCS11URI struct {
+	Token      string
+	Serial     string
+	Object     string
+	ID         []byte
+	ModulePath string
+	PinValue   string
+	PinSource  string
+}
+
+// ParsePKCS11URI parses a "pkcs11:" URI.
+func ParsePKCS11URI(uri string) (*PKCS11URI, error) {
+	const scheme = "pkcs11:"
+	if !strings.HasPrefix(uri, scheme) {
+		return nil, fmt.Errorf("invalid PKCS#11 URI: missing %q scheme", scheme)
+	}
+	pathPart, queryPart, _ := strings.Cut(uri[len(scheme):], "?")
+	ret := &PKCS11URI{}
+	for _, attr := range strings.Split(pathPart, ";") {
+		if attr == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(attr, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid PKCS#11 URI attribute %q", attr)
+		}
+		value, err := url.PathUnescape(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PKCS#11 URI attribute %q: %w", key, err)
+		}
+		switch key {
+		case "token":
+			ret.Token = value
+		case "serial":
+			ret.Serial = value
+		case "object":
+			ret.Object = value
+		case "id":
+			ret.ID = []byte(value)
+		}
+	}
+	for _, attr := range strings.Split(queryPart, "&") {
+		if attr == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(attr, "=")
+		value, err := url.PathUnescape(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PKCS#11 URI attribute %q: %w", key, err)
+		}
+		switch key {
+		case "module-path":
+			ret.ModulePath = value
+		case "pin-value":
+			ret.PinValue = value
+		case "pin-source":
+			ret.PinSource = strings.TrimPrefix(value, "file:")
+		}
+	}
+	if ret.ModulePath == "" {
+		return nil, fmt.Errorf("invalid PKCS#11 URI: module-path is required")
+	}
+	if ret.Object == "" && len(ret.ID) == 0 {
+		return nil, fmt.Errorf("invalid PKCS#11 URI: object or id is required")
+	}
+	return ret, nil
+}
+
+func (uri *PKCS11URI) pin() (string, error) {
+	if uri.PinValue != "" || uri.PinSource == "" {
+		return uri.PinValue, nil
+	}
+	b, err := os.ReadFile(uri.PinSource)
+	if err != nil {
+		return "", fmt.Errorf("failed to read PKCS#11 pin-source: %w", err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// args returns the PKCS11Tool arguments locating the key and the
+// environment holding the PIN if logging in.
+func (uri *PKCS11URI) args(login bool) (args, env []string, err error) {
+	args = []string{"--module", uri.ModulePath}
+	if uri.Token != "" {
+		args = append(args, "--token-label", uri.Token)
+	}
+	if uri.Serial != "" {
+		args = append(args, "--serial", uri.Serial)
+	}
+	if len(uri.ID) > 0 {
+		args = append(args, "--id", hex.EncodeToString(uri.ID))
+	}
+	if uri.Object != "" {
+		args = append(args, "--label", uri.Object)
+	}
+	if login {
+		pin, err := uri.pin()
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, "--login")
+		if pin != "" {
+			args = append(args, "--pin", "env:"+pkcs11PinEnv)
+			env = append(env, pkcs11PinEnv+"="+pin)
+		}
+	}
+	return args, env, nil
+}
+
+// exec executes PKCS11Tool on the key with input on stdin.
+func (uri *PKCS11URI) exec(login bool, input []byte, extraArgs ...string) error {
+	args, env, err := uri.args(login)
+	if err != nil {
+		return err
+	}
+	args = append(args, extraArgs...)
+	_, err = runHelperEnv([]string{PKCS11Tool}, env, input, args...)
+	return err
+}
+
+// run executes PKCS11Tool with input on stdin and returns the contents
+// written to the output file.
+func (uri *PKCS11URI) run(login bool, input []byte, extraArgs ...string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "nt-connect-pkcs11-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "output")
+	args := append(extraArgs[:len(extraArgs):len(extraArgs)], "--output-file", output)
+	if input != nil {
+		args = append(args, "--input-file", "/dev/stdin")
+	}
+	err = uri.exec(login, input, args...)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(output)
+}
+
+// PKCS11Signer implements crypto.Signer for a private key stored in a
+// PKCS #11 token. The private key never leaves the token.
+type PKCS11Signer struct {
+	uri    *PKCS11URI
+	public crypto.PublicKey
+}
+
+func (uri *PKCS11URI) readPublicKey() (crypto.PublicKey, error) {
+	b, err := uri.run(false, nil, "--read-object", "--type", "pubkey")
+	if err != nil && strings.Contains(strings.ToLower(err.Error()), pkcs11ObjectNotFound) {
+		return nil, fmt.Errorf("%w: %w", ErrKeyNotFound, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read public key from token: %w", err)
+	}
+	return parsePublicKey(b)
+}
+
+// NewPKCS11Signer returns a signer for the key identified by the PKCS #11 URI.
+func NewPKCS11Signer(uri string) (*PKCS11Signer, error) {
+	p11, err := ParsePKCS11URI(uri)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := p11.readPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	return &PKCS11Signer{
+		uri:    p11,
+		public: pub,
+	}, nil
+}
+
+func pkcs11KeyType(keyType KeyType) (string, error) {
+	switch keyType {
+	case KeyTypeRSA2048:
+		return "rsa:2048", nil
+	case KeyTypeRSA3072:
+		return "rsa:3072", nil
+	case KeyTypeRSA4096:
+		return "rsa:4096", nil
+	case KeyTypeSECP256R1, KeyTypeSECP384R1, KeyTypeSECP521R1:
+		return "EC:" + string(keyType), nil
+	case KeyTypeED25519:
+		return "EC:edwards25519", nil
+	}
+	return "", fmt.Errorf("invalid key type: %s", keyType)
+}
+
+// deleteKey deletes all private and public key objects matching the URI.
+func (uri *PKCS11URI) deleteKey() error {
+	for _, objType := range []string{"privkey", "pubkey"} {
+		for {
+			err := uri.exec(true, nil, "--delete-object", "--type", objType)
+			if err != nil &&
+				strings.Contains(strings.ToLower(err.Error()), pkcs11ObjectNotFound) {
+				break
+			} else if err != nil {
+				return fmt.Errorf("failed to delete existing key from token: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// GeneratePKCS11Key generates a new key pair inside the token identified by
+// the PKCS #11 URI, replacing any existing key pair matching the URI.
+func GeneratePKCS11Key(uri string, keyType KeyType) (*PKCS11Signer, error) {
+	p11, err := ParsePKCS11URI(uri)
+	if err != nil {
+		return nil, err
+	}
+	kt, err := pkcs11KeyType(keyType)
+	if err != nil {
+		return nil, err
+	}
+	// Generating a key next to an existing one leaves several objects
+	// matching the URI, so that the key used for signing is ambiguous.
+	err = p11.deleteKey()
+	if err != nil {
+		return nil, err
+	}
+	err = p11.exec(true, nil, "--keypairgen", "--key-type", kt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key in token: %w", err)
+	}
+	return NewPKCS11Signer(uri)
+}
+
+// digestInfoPrefix contains the DER encoded DigestInfo prefixes used for
+// PKCS #1 v1.5 signatures (see crypto/rsa).
+var digestInfoPrefix = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48,
+		0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48,
+		0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48,
+		0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+func (s *PKCS11Signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *PKCS11Signer) Sign(
+	_ io.Reader, digest []byte, opts crypto.SignerOpts,
+) ([]byte, error) {
+	var args []string
+	input := digest
+	switch s.public.(type) {
+	case *ecdsa.PublicKey:
+		args = []string{"--mechanism", "ECDSA", "--signature-format", "openssl"}
+	case ed25519.PublicKey:
+		args = []string{"--mechanism", "EDDSA"}
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			hash := strings.ReplaceAll(opts.HashFunc().String(), "-", "")
+			args = []string{
+				"--mechanism", "RSA-PKCS-PSS",
+				"--hash-algorithm", hash,
+				"--mgf", "MGF1-" + hash,
+			}
+			break
+		}
+		prefix, ok := digestInfoPrefix[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash function: %s", opts.HashFunc())
+		}
+		input = append(bytes.Clone(prefix), digest...)
+		args = []string{"--mechanism", "RSA-PKCS"}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", s.public)
+	}
+	args = append([]string{"--sign"}, args...)
+	sig, err := s.uri.run(true, input, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign using token: %w", err)
+	}
+	return sig, nil
+}
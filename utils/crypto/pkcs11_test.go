@@ -0,0 +1,229 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePKCS11URI(t *testing.T) {
+	t.Parallel()
+	testCases := map[string]struct {
+		URI    string
+		Result *PKCS11URI
+		Error  string
+	}{
+		"ok": {
+			URI: "pkcs11:token=nt-connect;object=device%20key;id=%01%02" +
+				"?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-value=1234",
+			Result: &PKCS11URI{
+				Token:      "nt-connect",
+				Object:     "device key",
+				ID:         []byte{0x01, 0x02},
+				ModulePath: "/usr/lib/softhsm/libsofthsm2.so",
+				PinValue:   "1234",
+			},
+		},
+		"ok/pin-source": {
+			URI: "pkcs11:object=key?module-path=/lib/p11.so" +
+				"&pin-source=file:/run/pin",
+			Result: &PKCS11URI{
+				Object:     "key",
+				ModulePath: "/lib/p11.so",
+				PinSource:  "/run/pin",
+			},
+		},
+		"error/scheme": {
+			URI:   "file:/var/lib/nt-connect/private.pem",
+			Error: `invalid PKCS#11 URI: missing "pkcs11:" scheme`,
+		},
+		"error/no module": {
+			URI:   "pkcs11:object=key",
+			Error: "invalid PKCS#11 URI: module-path is required",
+		},
+		"error/no object": {
+			URI:   "pkcs11:token=foo?module-path=/lib/p11.so",
+			Error: "invalid PKCS#11 URI: object or id is required",
+		},
+	}
+	for name, testCase := range testCases {
+		tc := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			uri, err := ParsePKCS11URI(tc.URI)
+			if tc.Error != "" {
+				assert.EqualError(t, err, tc.Error)
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tc.Result, uri)
+			}
+		})
+	}
+}
+
+// TestPKCS11SignerSoftHSM runs against SoftHSM if the tools are available.
+func TestPKCS11URIArgs(t *testing.T) {
+	t.Parallel()
+	uri, err := ParsePKCS11URI("pkcs11:token=nt-connect;object=device;id=%01" +
+		"?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-value=1234")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	args, env, err := uri.args(true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"--module", "/usr/lib/softhsm/libsofthsm2.so",
+		"--token-label", "nt-connect",
+		"--id", "01",
+		"--label", "device",
+		"--login", "--pin", "env:" + pkcs11PinEnv,
+	}, args)
+	assert.Equal(t, []string{pkcs11PinEnv + "=1234"}, env)
+
+	args, env, err = uri.args(false)
+	assert.NoError(t, err)
+	assert.NotContains(t, args, "--login")
+	assert.Empty(t, env)
+}
+
+func TestGeneratePKCS11KeyReplacesKey(t *testing.T) {
+	// The fake tool keeps each token object in a file of the directory,
+	// starting with a duplicated private key left by an earlier bootstrap.
+	dir := t.TempDir()
+	for _, obj := range []string{"privkey.1", "privkey.2", "pubkey.1"} {
+		if err := os.WriteFile(filepath.Join(dir, obj), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pkey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pubDER, _ := x509.MarshalPKIXPublicKey(pkey.Public())
+	pubPath := filepath.Join(dir, "public.pem")
+	err := os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pubDER,
+	}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tool := filepath.Join(dir, "pkcs11-tool")
+	err = os.WriteFile(tool, []byte(`#!/bin/sh
+cd "$(dirname "$0")"
+while [ $# -gt 0 ]; do
+	case "$1" in
+	--delete-object|--keypairgen|--read-object) op=$1 ;;
+	--type) type=$2; shift ;;
+	--output-file) output=$2; shift ;;
+	esac
+	shift
+done
+echo "$op${type:+ $type}" >> log
+case "$op" in
+--delete-object)
+	obj=$(ls $type.* 2>/dev/null | head -n 1)
+	[ -n "$obj" ] || { echo "error: object not found" >&2; exit 1; }
+	rm "$obj" ;;
+--keypairgen)
+	touch privkey.new pubkey.new ;;
+--read-object)
+	cp public.pem "$output" ;;
+esac
+`), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := PKCS11Tool
+	PKCS11Tool = tool
+	t.Cleanup(func() { PKCS11Tool = orig })
+
+	signer, err := GeneratePKCS11Key("pkcs11:object=device?module-path=/lib/p11.so",
+		KeyTypeSECP256R1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, pkey.Public(), signer.Public())
+	}
+	objects, _ := filepath.Glob(filepath.Join(dir, "*key.*"))
+	assert.Equal(t, []string{
+		filepath.Join(dir, "privkey.new"),
+		filepath.Join(dir, "pubkey.new"),
+	}, objects)
+	log, _ := os.ReadFile(filepath.Join(dir, "log"))
+	assert.Equal(t, `--delete-object privkey
+--delete-object privkey
+--delete-object privkey
+--delete-object pubkey
+--delete-object pubkey
+--keypairgen
+--read-object pubkey
+`, string(log))
+}
+
+func TestPKCS11SignerSoftHSM(t *testing.T) {
+	const pin = "1234"
+	modulePath := os.Getenv("SOFTHSM2_MODULE")
+	if modulePath == "" {
+		modulePath = "/usr/lib/softhsm/libsofthsm2.so"
+	}
+	if _, err := exec.LookPath("softhsm2-util"); err != nil {
+		t.Skip("softhsm2-util not available")
+	} else if _, err := exec.LookPath(PKCS11Tool); err != nil {
+		t.Skipf("%s not available", PKCS11Tool)
+	} else if _, err := os.Stat(modulePath); err != nil {
+		t.Skipf("SoftHSM module not available: %s", err)
+	}
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "softhsm2.conf")
+	err := os.WriteFile(conf, []byte(fmt.Sprintf(
+		"directories.tokendir = %s\nobjectstore.backend = file\n", dir,
+	)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", conf)
+	out, err := exec.Command("softhsm2-util",
+		"--init-token", "--free", "--label", "nt-connect",
+		"--pin", pin, "--so-pin", pin).CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to initialize token: %s: %s", err, out)
+	}
+
+	uri := "pkcs11:token=nt-connect;object=device;id=%01" +
+		"?module-path=" + modulePath + "&pin-value=" + pin
+	_, err = NewPKCS11Signer(uri)
+	assert.ErrorIs(t, err, ErrKeyNotFound, "expected error loading non-existing key")
+
+	signer, err := GeneratePKCS11Key(uri, KeyTypeSECP256R1)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	digest := sha256.Sum256([]byte("message"))
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if assert.NoError(t, err) {
+		pub, ok := signer.Public().(*ecdsa.PublicKey)
+		if assert.True(t, ok) {
+			assert.True(t, ecdsa.VerifyASN1(pub, digest[:], sig))
+		}
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"errors"
 	"os"
 	"os/user"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -120,3 +121,50 @@ func FileModes(path string) os.FileMode {
 		return 0
 	}
 }
+
+// WriteFileAtomic writes data to a temporary file in the same directory as
+// path and renames it to path, so that readers either see the old or the new
+// contents of the file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	fd, err := os.CreateTemp(dir, "."+base+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = fd.Close()
+			_ = os.Remove(fd.Name())
+		}
+	}()
+	if err = fd.Chmod(perm); err != nil {
+		return err
+	}
+	if _, err = fd.Write(data); err != nil {
+		return err
+	}
+	if err = fd.Sync(); err != nil {
+		return err
+	}
+	if err = fd.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(fd.Name(), path); err != nil {
+		return err
+	}
+	return SyncDir(dir)
+}
+
+// SyncDir flushes the directory entries of dir to persistent storage.
+func SyncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = fd.Sync()
+	_ = fd.Close()
+	return err
+}
@@ -205,3 +205,25 @@ func TestIsInChroot(t *testing.T) {
 	inChrootExpected := IsInChroot(fileNameChroot, chroot)
 	assert.True(t, inChrootExpected)
 }
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	fileName := path.Join(dir, "file")
+
+	err := WriteFileAtomic(fileName, []byte("first"), 0600)
+	assert.NoError(t, err)
+	err = WriteFileAtomic(fileName, []byte("second"), 0640)
+	assert.NoError(t, err)
+
+	b, err := os.ReadFile(fileName)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(b))
+	assert.Equal(t, os.FileMode(0640), FileModes(fileName).Perm())
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1, "temporary files are left behind")
+
+	err = WriteFileAtomic(path.Join(dir, "not", "found"), []byte("data"), 0600)
+	assert.Error(t, err)
+}
@@ -0,0 +1,115 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+// Package systemd implements the service notification protocol of systemd
+// (sd_notify).
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The notifications understood by the service manager.
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// The environment variables set by the service manager.
+const (
+	EnvNotifySocket = "NOTIFY_SOCKET"
+	EnvWatchdogUsec = "WATCHDOG_USEC"
+	EnvWatchdogPID  = "WATCHDOG_PID"
+)
+
+// Status returns the notification describing the service state.
+func Status(format string, args ...interface{}) string {
+	// The notifications are separated by newlines
+	status := strings.ReplaceAll(fmt.Sprintf(format, args...), "\n", " ")
+	return "STATUS=" + status
+}
+
+// Notifier sends notifications to the service manager. The methods of a
+// nil Notifier do nothing.
+type Notifier struct {
+	conn *net.UnixConn
+}
+
+// NewNotifier returns a Notifier sending to the socket in $NOTIFY_SOCKET,
+// or nil if the variable is not set.
+func NewNotifier() (*Notifier, error) {
+	path := os.Getenv(EnvNotifySocket)
+	if path == "" {
+		return nil, nil
+	}
+	// A leading "@" is an abstract socket
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("systemd: failed to connect to the notification socket: %w",
+			err)
+	}
+	return &Notifier{conn: conn}, nil
+}
+
+// Notify sends the notifications in one message.
+func (n *Notifier) Notify(state ...string) error {
+	if n == nil {
+		return nil
+	}
+	_, err := n.conn.Write([]byte(strings.Join(state, "\n")))
+	if err != nil {
+		return fmt.Errorf("systemd: failed to notify: %w", err)
+	}
+	return nil
+}
+
+// Close closes the connection to the service manager.
+func (n *Notifier) Close() error {
+	if n == nil {
+		return nil
+	}
+	return n.conn.Close()
+}
+
+// WatchdogInterval returns the interval the service manager expects the
+// watchdog notifications within, or zero if the watchdog is disabled for
+// this process.
+func WatchdogInterval() (time.Duration, error) {
+	value := os.Getenv(EnvWatchdogUsec)
+	if value == "" {
+		return 0, nil
+	}
+	usec, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || usec == 0 {
+		return 0, fmt.Errorf("systemd: invalid %s: %q", EnvWatchdogUsec, value)
+	}
+	if value := os.Getenv(EnvWatchdogPID); value != "" {
+		pid, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("systemd: invalid %s: %q", EnvWatchdogPID, value)
+		} else if pid != os.Getpid() {
+			return 0, nil
+		}
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
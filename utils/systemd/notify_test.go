@@ -0,0 +1,114 @@
+// Copyright 2023 Northern.tech AS
+//
+//	Licensed under the Apache License, Version 2.0 (the "License");
+//	you may not use this file except in compliance with the License.
+//	You may obtain a copy of the License at
+//
+//	    http://www.apache.org/licenses/LICENSE-2.0
+//
+//	Unless required by applicable law or agreed to in writing, software
+//	distributed under the License is distributed on an "AS IS" BASIS,
+//	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//	See the License for the specific language governing permissions and
+//	limitations under the License.
+
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// listenNotify returns a datagram socket standing in for the service
+// manager, and sets $NOTIFY_SOCKET to it.
+func listenNotify(t *testing.T) *net.UnixConn {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv(EnvNotifySocket, path)
+	return conn
+}
+
+func TestNotifier(t *testing.T) {
+	conn := listenNotify(t)
+	n, err := NewNotifier()
+	if !assert.NoError(t, err) || !assert.NotNil(t, n) {
+		t.FailNow()
+	}
+	defer n.Close()
+
+	assert.NoError(t, n.Notify(Ready, Status("connected\nto %s", "localhost")))
+	b := make([]byte, 1024)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	size, err := conn.Read(b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "READY=1\nSTATUS=connected to localhost", string(b[:size]))
+	}
+
+	t.Setenv(EnvNotifySocket, "")
+	n, err = NewNotifier()
+	assert.NoError(t, err)
+	assert.Nil(t, n)
+	assert.NoError(t, n.Notify(Watchdog))
+	assert.NoError(t, n.Close())
+
+	t.Setenv(EnvNotifySocket, filepath.Join(t.TempDir(), "missing.sock"))
+	_, err = NewNotifier()
+	assert.ErrorContains(t, err, "failed to connect to the notification socket")
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Usec     string
+		PID      string
+		Interval time.Duration
+		Error    string
+	}{{
+		Name: "ok/disabled",
+	}, {
+		Name:     "ok",
+		Usec:     "30000000",
+		Interval: 30 * time.Second,
+	}, {
+		Name:     "ok/this process",
+		Usec:     "1000",
+		PID:      strconv.Itoa(os.Getpid()),
+		Interval: time.Millisecond,
+	}, {
+		Name: "ok/other process",
+		Usec: "1000",
+		PID:  "1",
+	}, {
+		Name:  "error/invalid interval",
+		Usec:  "1s",
+		Error: `systemd: invalid WATCHDOG_USEC: "1s"`,
+	}, {
+		Name:  "error/invalid PID",
+		Usec:  "1000",
+		PID:   "self",
+		Error: `systemd: invalid WATCHDOG_PID: "self"`,
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Setenv(EnvWatchdogUsec, tc.Usec)
+			t.Setenv(EnvWatchdogPID, tc.PID)
+			interval, err := WatchdogInterval()
+			if tc.Error != "" {
+				assert.EqualError(t, err, tc.Error)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Interval, interval)
+			}
+		})
+	}
+}